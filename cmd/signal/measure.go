@@ -129,7 +129,10 @@ func doMeasureTarget(
 		dslx.TCPConnect(connpool),
 		dslx.TLSHandshake(
 			connpool,
-			dslx.TLSHandshakeOptionRootCAs(certPool),
+			dslx.TLSHandshakeOptionCertVerifier(
+				netxlite.NewCertVerifier(certPool),
+				tk.appendCertVerificationReport,
+			),
 		),
 		dslx.HTTPTransportTLS(),
 		dslx.HTTPJustUseOneConn(), // TODO(bassosimone): do we want this?
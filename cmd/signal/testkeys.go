@@ -9,6 +9,7 @@ import (
 
 	"github.com/bassosimone/oonidsl/internal/dslx"
 	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
 )
 
 // testKeys contains the experiment test keys.
@@ -28,6 +29,9 @@ type testKeys struct {
 	// TLSHandshakes contains the TLS handshakes results.
 	TLSHandshakes []*model.ArchivalTLSOrQUICHandshakeResult `json:"tls_handshakes"`
 
+	// CertVerification explains the result of each certificate verification.
+	CertVerification []*netxlite.CertVerificationReport `json:"x_cert_verification"`
+
 	SignalBackendStatus string `json:"signal_backend_status"`
 
 	SignalBackendFailure *string `json:"signal_backend_failure"`
@@ -48,3 +52,10 @@ func (tk *testKeys) mergeObservations(obs ...*dslx.Observations) {
 		tk.TLSHandshakes = append(tk.TLSHandshakes, o.TLSHandshakes...)
 	}
 }
+
+// appendCertVerificationReport appends a certificate verification report to the test keys.
+func (tk *testKeys) appendCertVerificationReport(report *netxlite.CertVerificationReport) {
+	defer tk.mu.Unlock()
+	tk.mu.Lock()
+	tk.CertVerification = append(tk.CertVerification, report)
+}
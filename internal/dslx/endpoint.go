@@ -9,6 +9,7 @@ import (
 
 	"github.com/bassosimone/oonidsl/internal/atomicx"
 	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
 )
 
 type (
@@ -26,6 +27,10 @@ type Endpoint struct {
 	// Address is the MANDATORY endpoint address.
 	Address string
 
+	// ByteCounter is the OPTIONAL byte counter to use. When set, we count
+	// the bytes sent and received by the connections to this endpoint.
+	ByteCounter *netxlite.ByteCounter
+
 	// Domain is the OPTIONAL domain used to resolve the endpoints' IP address.
 	Domain string
 
@@ -45,6 +50,15 @@ type Endpoint struct {
 // EndpointOption is an option you can use to construct EndpointState.
 type EndpointOption func(*Endpoint)
 
+// EndpointOptionByteCounter allows to set the byte counter. By sharing the
+// same byte counter among all the endpoints of an experiment, you can
+// account the data the experiment has sent and received.
+func EndpointOptionByteCounter(value *netxlite.ByteCounter) EndpointOption {
+	return func(es *Endpoint) {
+		es.ByteCounter = value
+	}
+}
+
 // EndpointOptionDomain allows to set the domain.
 func EndpointOptionDomain(value string) EndpointOption {
 	return func(es *Endpoint) {
@@ -88,6 +102,7 @@ func NewEndpoint(
 	network EndpointNetwork, address EndpointAddress, options ...EndpointOption) *Endpoint {
 	epnt := &Endpoint{
 		Address:     string(address),
+		ByteCounter: nil,
 		Domain:      "",
 		IDGenerator: &atomicx.Int64{},
 		Logger:      model.DiscardLogger,
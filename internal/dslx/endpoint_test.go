@@ -0,0 +1,45 @@
+package dslx_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/dslx"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+)
+
+func TestEndpointOptionByteCounter(t *testing.T) {
+	t.Run("we count the bytes of all the endpoints", func(t *testing.T) {
+		_, certPool, _, _ := newTestNetwork(t)
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		counter := netxlite.NewByteCounter()
+		fxTCP := dslx.Compose2(dslx.TCPConnect(pool), dslx.HTTPRequestOverTCP())
+		fxTLS := dslx.Compose3(
+			dslx.TCPConnect(pool),
+			dslx.TLSHandshake(pool, dslx.TLSHandshakeOptionRootCAs(certPool)),
+			dslx.HTTPRequestOverTLS(),
+		)
+		first := fxTCP.Apply(context.Background(), dslx.NewEndpoint("tcp", "10.0.0.2:80",
+			dslx.EndpointOptionDomain("www.example.com"), dslx.EndpointOptionByteCounter(counter)))
+		if first.Error != nil {
+			t.Fatal(first.Error)
+		}
+		received, sent := counter.BytesReceived(), counter.BytesSent()
+		if received <= 0 || sent <= 0 {
+			t.Fatal("expected to count the plaintext bytes", received, sent)
+		}
+		second := fxTLS.Apply(context.Background(), dslx.NewEndpoint("tcp", "10.0.0.2:443",
+			dslx.EndpointOptionDomain("www.example.com"), dslx.EndpointOptionByteCounter(counter)))
+		if second.Error != nil {
+			t.Fatal(second.Error)
+		}
+		// the TLS handshake alone includes the certificate chain
+		if counter.BytesReceived() <= received+500 || counter.BytesSent() <= sent {
+			t.Fatal("expected to count the TLS bytes", counter.BytesReceived(), counter.BytesSent())
+		}
+		if counter.KibiBytesReceived() != float64(counter.BytesReceived())/1024 {
+			t.Fatal("unexpected kibibytes received")
+		}
+	})
+}
@@ -179,6 +179,7 @@ func (f *httpRequestFunc) Apply(
 	state := &HTTPResponse{
 		Address:                  input.Address,
 		Domain:                   input.Domain,
+		HTTPProtocol:             netxlite.HTTPResponseProtocol(resp),
 		HTTPRequest:              req,  // possibly nil
 		HTTPResponse:             resp, // possibly nil
 		HTTPResponseBodySnapshot: body, // possibly nil
@@ -283,6 +284,10 @@ func (f *httpRequestFunc) do(
 	started := input.Trace.TimeSince(input.Trace.ZeroTime)
 	observations := []*Observations{{}} // one entry!
 
+	// Implementation note: we don't use the trace-aware transport returned by
+	// Trace.WrapHTTPTransport because it saves the observations into the trace's
+	// bounded buffers, where the events emitted while reading a large body could
+	// cause us to drop the http_transaction_done event or the request.
 	observations[0].NetworkEvents = append(observations[0].NetworkEvents,
 		measurexlite.NewAnnotationArchivalNetworkEvent(
 			input.Trace.Index,
@@ -334,6 +339,10 @@ type HTTPResponse struct {
 	// Domain is the OPTIONAL domain from which we determined Address.
 	Domain string
 
+	// HTTPProtocol is the protocol we actually used (e.g., "h2c"), as
+	// returned by netxlite.HTTPResponseProtocol, or empty if Err != nil.
+	HTTPProtocol string
+
 	// HTTPRequest is the possibly-nil HTTP request.
 	HTTPRequest *http.Request
 
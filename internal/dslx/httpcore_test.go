@@ -0,0 +1,69 @@
+package dslx_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/dslx"
+	"github.com/bassosimone/oonidsl/internal/measurexlite"
+)
+
+func TestHTTPRequest(t *testing.T) {
+	t.Run("with a body requiring more reads than the trace can buffer", func(t *testing.T) {
+		network, _, _, _ := newTestNetwork(t)
+		listener, err := network.ListenTCP("10.0.0.2:8080")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		chunk := bytes.Repeat([]byte("A"), 1024)
+		const numChunks = 4 * measurexlite.NetworkEventBufferSize
+		go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for idx := 0; idx < numChunks; idx++ {
+				w.Write(chunk)
+				w.(http.Flusher).Flush() // make sure the client needs several reads
+			}
+		}))
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("tcp", dslx.EndpointAddress("10.0.0.2:8080"),
+			dslx.EndpointOptionDomain("www.example.com"))
+		fx := dslx.Compose3(
+			dslx.TCPConnect(pool),
+			dslx.HTTPTransportTCP(),
+			dslx.HTTPRequest(),
+		)
+		result := fx.Apply(context.Background(), endpoint)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if len(result.State.HTTPResponseBodySnapshot) != numChunks*len(chunk) {
+			t.Fatal("unexpected body length", len(result.State.HTTPResponseBodySnapshot))
+		}
+		var (
+			dropped  int64
+			done     int
+			requests int
+		)
+		for _, obs := range result.Observations {
+			dropped += obs.DroppedEvents
+			requests += len(obs.Requests)
+			for _, ev := range obs.NetworkEvents {
+				if ev.Operation == "http_transaction_done" {
+					done++
+				}
+			}
+		}
+		if dropped <= 0 {
+			t.Fatal("expected the trace to drop some read events")
+		}
+		if done != 1 {
+			t.Fatal("expected to see http_transaction_done once", done)
+		}
+		if requests != 1 {
+			t.Fatal("expected to see a single request", requests)
+		}
+	})
+}
@@ -7,6 +7,7 @@ package dslx
 import (
 	"context"
 
+	"github.com/bassosimone/oonidsl/internal/model"
 	"github.com/bassosimone/oonidsl/internal/netxlite"
 )
 
@@ -15,22 +16,48 @@ func HTTPRequestOverTCP(options ...HTTPRequestOption) Func[*TCPConnection, *Mayb
 	return Compose2(HTTPTransportTCP(), HTTPRequest(options...))
 }
 
+// HTTPTransportTCPOption is an option you can pass to HTTPTransportTCP.
+type HTTPTransportTCPOption func(*httpTransportTCPFunc)
+
+// HTTPTransportTCPOptionH2C configures the transport to speak HTTP/2 with
+// prior knowledge (i.e., h2c) rather than HTTP/1.1.
+func HTTPTransportTCPOptionH2C() HTTPTransportTCPOption {
+	return func(f *httpTransportTCPFunc) {
+		f.H2C = true
+	}
+}
+
 // HTTPTransportTCP converts a TCP connection into an HTTP transport.
-func HTTPTransportTCP() Func[*TCPConnection, *Maybe[*HTTPTransport]] {
-	return &httpTransportTCPFunc{}
+func HTTPTransportTCP(options ...HTTPTransportTCPOption) Func[*TCPConnection, *Maybe[*HTTPTransport]] {
+	f := &httpTransportTCPFunc{}
+	for _, option := range options {
+		option(f)
+	}
+	return f
 }
 
 // httpTransportTCPFunc is the function returned by HTTPTransportTCP
-type httpTransportTCPFunc struct{}
+type httpTransportTCPFunc struct {
+	// H2C OPTIONALLY indicates we should use h2c.
+	H2C bool
+}
 
 // Apply implements Func
 func (f *httpTransportTCPFunc) Apply(
 	ctx context.Context, input *TCPConnection) *Maybe[*HTTPTransport] {
-	httpTransport := netxlite.NewHTTPTransport(
-		input.Logger,
-		netxlite.NewSingleUseDialer(input.Conn),
-		netxlite.NewNullTLSDialer(),
-	)
+	var httpTransport model.HTTPTransport
+	if f.H2C {
+		httpTransport = netxlite.NewHTTPTransportH2C(
+			input.Logger,
+			netxlite.NewSingleUseDialer(input.Conn),
+		)
+	} else {
+		httpTransport = netxlite.NewHTTPTransport(
+			input.Logger,
+			netxlite.NewSingleUseDialer(input.Conn),
+			netxlite.NewNullTLSDialer(),
+		)
+	}
 	state := &HTTPTransport{
 		Address:               input.Address,
 		Domain:                input.Domain,
@@ -0,0 +1,42 @@
+package dslx_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/dslx"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestHTTPTransportTCP(t *testing.T) {
+	t.Run("h2c over TCP", func(t *testing.T) {
+		network, _, _, handler := newTestNetwork(t)
+		listener, err := network.ListenTCP("10.0.0.2:8080")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go http.Serve(listener, h2c.NewHandler(handler, &http2.Server{}))
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("tcp", dslx.EndpointAddress("10.0.0.2:8080"),
+			dslx.EndpointOptionDomain("www.example.com"))
+		fx := dslx.Compose3(
+			dslx.TCPConnect(pool),
+			dslx.HTTPTransportTCP(dslx.HTTPTransportTCPOptionH2C()),
+			dslx.HTTPRequest(),
+		)
+		result := fx.Apply(context.Background(), endpoint)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if result.State.HTTPProtocol != "h2c" {
+			t.Fatal("unexpected protocol", result.State.HTTPProtocol)
+		}
+		if string(result.State.HTTPResponseBodySnapshot) != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected body")
+		}
+	})
+}
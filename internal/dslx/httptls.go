@@ -15,18 +15,44 @@ func HTTPRequestOverTLS(options ...HTTPRequestOption) Func[*TLSConnection, *Mayb
 	return Compose2(HTTPTransportTLS(), HTTPRequest(options...))
 }
 
+// HTTPTransportTLSOption is an option you can pass to HTTPTransportTLS.
+type HTTPTransportTLSOption func(*httpTransportTLSFunc)
+
+// HTTPTransportTLSOptionHTTP1Only configures the transport to only speak
+// HTTP/1.1 even if the TLS handshake negotiated "h2". You SHOULD pair this
+// option with TLSHandshakeOptionNextProto([]string{"http/1.1"}), otherwise
+// the server may expect us to speak HTTP/2. Comparing the results obtained
+// with and without this option allows to determine whether a middlebox
+// breaks HTTP/2 but not HTTP/1.1.
+func HTTPTransportTLSOptionHTTP1Only() HTTPTransportTLSOption {
+	return func(f *httpTransportTLSFunc) {
+		f.HTTP1Only = true
+	}
+}
+
 // HTTPTransportTLS converts a TLS connection into an HTTP transport.
-func HTTPTransportTLS() Func[*TLSConnection, *Maybe[*HTTPTransport]] {
-	return &httpTransportTLSFunc{}
+func HTTPTransportTLS(options ...HTTPTransportTLSOption) Func[*TLSConnection, *Maybe[*HTTPTransport]] {
+	f := &httpTransportTLSFunc{}
+	for _, option := range options {
+		option(f)
+	}
+	return f
 }
 
 // httpTransportTLSFunc is the function returned by HTTPTransportTLS.
-type httpTransportTLSFunc struct{}
+type httpTransportTLSFunc struct {
+	// HTTP1Only OPTIONALLY indicates we should only speak HTTP/1.1.
+	HTTP1Only bool
+}
 
 // Apply implements Func.
 func (f *httpTransportTLSFunc) Apply(
 	ctx context.Context, input *TLSConnection) *Maybe[*HTTPTransport] {
-	httpTransport := netxlite.NewHTTPTransport(
+	newTransport := netxlite.NewHTTPTransport
+	if f.HTTP1Only {
+		newTransport = netxlite.NewHTTPTransportHTTP1Only
+	}
+	httpTransport := newTransport(
 		input.Logger,
 		netxlite.NewNullDialer(),
 		netxlite.NewSingleUseTLSDialer(input.Conn),
@@ -0,0 +1,32 @@
+package dslx_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/dslx"
+)
+
+func TestHTTPTransportTLS(t *testing.T) {
+	t.Run("HTTP/1.1 only over TLS", func(t *testing.T) {
+		_, certPool, _, _ := newTestNetwork(t)
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("tcp", dslx.EndpointAddress("10.0.0.2:443"),
+			dslx.EndpointOptionDomain("www.example.com"))
+		fx := dslx.Compose4(
+			dslx.TCPConnect(pool),
+			dslx.TLSHandshake(pool, dslx.TLSHandshakeOptionRootCAs(certPool),
+				dslx.TLSHandshakeOptionNextProto([]string{"http/1.1"})),
+			dslx.HTTPTransportTLS(dslx.HTTPTransportTLSOptionHTTP1Only()),
+			dslx.HTTPRequest(),
+		)
+		result := fx.Apply(context.Background(), endpoint)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if result.State.HTTPProtocol != "http/1.1" {
+			t.Fatal("unexpected protocol", result.State.HTTPProtocol)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package dslx_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+	"github.com/bassosimone/oonidsl/internal/netxlite/memnet"
+	"github.com/google/martian/v3/mitm"
+)
+
+// newTestNetwork creates a memnet network where www.example.com serves HTTP
+// and HTTPS at 10.0.0.2 and installs it for the duration of the test. We don't
+// start an HTTP/3 server here, because quic-go multiplexes UDP conns having
+// the same local address in a process, so we should only start it in the test
+// that needs it. We return the network, the pool containing the CA, the TLS
+// config used by the server, and the HTTP handler.
+func newTestNetwork(t *testing.T) (*memnet.Network, *x509.CertPool, *tls.Config, http.Handler) {
+	network := memnet.New("10.0.0.1")
+	network.AddDNSRecord("www.example.com", "", "10.0.0.2")
+	saved := netxlite.TProxy
+	netxlite.TProxy = network
+	t.Cleanup(func() {
+		netxlite.TProxy = saved
+	})
+
+	cert, privkey, err := mitm.NewAuthority("jafar", "OONI", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mitmConfig, err := mitm.NewConfig(cert, privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	config := mitmConfig.TLS()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Bonsoir, Elliot!"))
+	})
+
+	listener, err := network.ListenTCP("10.0.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go http.Serve(listener, handler)
+
+	tlsListener, err := network.ListenTCP("10.0.0.2:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tlsListener.Close() })
+	go http.Serve(tls.NewListener(tlsListener, config), handler)
+
+	return network, pool, config, handler
+}
@@ -29,6 +29,10 @@ type Observations struct {
 
 	// QUICHandshakes contains the QUIC handshakes results.
 	QUICHandshakes []*model.ArchivalTLSOrQUICHandshakeResult `json:"quic_handshakes"`
+
+	// DroppedEvents is the number of events the trace dropped because
+	// its buffers were full, which means the other fields are incomplete.
+	DroppedEvents int64 `json:"dropped_events,omitempty"`
 }
 
 // ExtractObservations extracts observations from a list of [Maybe].
@@ -46,10 +50,11 @@ func maybeTraceToObservations(trace *measurexlite.Trace) (out []*Observations) {
 		out = append(out, &Observations{
 			NetworkEvents:  trace.NetworkEvents(),
 			Queries:        trace.DNSLookupsFromRoundTrip(),
-			Requests:       []*model.ArchivalHTTPRequestResult{}, // no extractor inside trace!
+			Requests:       trace.HTTPRequests(),
 			TCPConnect:     trace.TCPConnects(),
 			TLSHandshakes:  trace.TLSHandshakes(),
 			QUICHandshakes: trace.QUICHandshakes(),
+			DroppedEvents:  trace.DroppedEvents(),
 		})
 	}
 	return
@@ -21,6 +21,23 @@ import (
 // QUICHandshakeOption is an option you can pass to QUICHandshake.
 type QUICHandshakeOption func(*quicHandshakeFunc)
 
+// QUICHandshakeOptionConnectionIDLength sets the length of the connection IDs
+// we choose, which must be zero (i.e., the default) or between 4 and 18.
+func QUICHandshakeOptionConnectionIDLength(value int) QUICHandshakeOption {
+	return func(thf *quicHandshakeFunc) {
+		thf.ConnectionIDLength = value
+	}
+}
+
+// QUICHandshakeOptionInitialPacketSize sets the size of the UDP datagrams
+// containing QUIC Initial packets. See netxlite.NewQUICListenerWithInitialPacketSize
+// for more information on how this setting works.
+func QUICHandshakeOptionInitialPacketSize(value int) QUICHandshakeOption {
+	return func(thf *quicHandshakeFunc) {
+		thf.InitialPacketSize = value
+	}
+}
+
 // QUICHandshakeOptionInsecureSkipVerify controls whether QUIC verification is enabled.
 func QUICHandshakeOptionInsecureSkipVerify(value bool) QUICHandshakeOption {
 	return func(thf *quicHandshakeFunc) {
@@ -42,14 +59,25 @@ func QUICHandshakeOptionServerName(value string) QUICHandshakeOption {
 	}
 }
 
+// QUICHandshakeOptionVersions sets the QUIC versions to offer. We use the first
+// version for the Initial packet and we may negotiate the others.
+func QUICHandshakeOptionVersions(value ...quic.VersionNumber) QUICHandshakeOption {
+	return func(thf *quicHandshakeFunc) {
+		thf.Versions = value
+	}
+}
+
 // QUICHandshake returns a function performing QUIC handshakes.
 func QUICHandshake(pool *ConnPool, options ...QUICHandshakeOption) Func[
 	*Endpoint, *Maybe[*QUICConnection]] {
 	f := &quicHandshakeFunc{
+		ConnectionIDLength: 0,
+		InitialPacketSize:  0,
 		InsecureSkipVerify: false,
 		Pool:               pool,
 		RootCAs:            netxlite.NewDefaultCertPool(),
 		ServerName:         "",
+		Versions:           nil,
 	}
 	for _, option := range options {
 		option(f)
@@ -59,6 +87,12 @@ func QUICHandshake(pool *ConnPool, options ...QUICHandshakeOption) Func[
 
 // quicHandshakeFunc performs QUIC handshakes.
 type quicHandshakeFunc struct {
+	// ConnectionIDLength is the length of the connection IDs.
+	ConnectionIDLength int
+
+	// InitialPacketSize is the size of the datagrams containing Initial packets.
+	InitialPacketSize int
+
 	// InsecureSkipVerify allows to skip TLS verification.
 	InsecureSkipVerify bool
 
@@ -70,6 +104,9 @@ type quicHandshakeFunc struct {
 
 	// ServerName is the ServerName to handshake for.
 	ServerName string
+
+	// Versions contains the QUIC versions to offer.
+	Versions []quic.VersionNumber
 }
 
 // Apply implements Func.
@@ -92,6 +129,12 @@ func (f *quicHandshakeFunc) Apply(
 
 	// setup
 	quicListener := netxlite.NewQUICListener()
+	if input.ByteCounter != nil {
+		quicListener = input.ByteCounter.WrapQUICListener(quicListener)
+	}
+	if f.InitialPacketSize > 0 {
+		quicListener = netxlite.NewQUICListenerWithInitialPacketSize(quicListener, f.InitialPacketSize)
+	}
 	quicDialer := trace.NewQUICDialerWithoutResolver(quicListener, input.Logger)
 	config := &tls.Config{
 		NextProtos:         []string{"h3"},
@@ -104,7 +147,11 @@ func (f *quicHandshakeFunc) Apply(
 	defer cancel()
 
 	// handshake
-	quicConn, err := quicDialer.DialContext(ctx, input.Address, config, &quic.Config{})
+	quicConfig := &quic.Config{
+		ConnectionIDLength: f.ConnectionIDLength,
+		Versions:           f.Versions,
+	}
+	quicConn, err := quicDialer.DialContext(ctx, input.Address, config, quicConfig)
 
 	var closerConn io.Closer
 	var tlsState tls.ConnectionState
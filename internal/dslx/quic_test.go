@@ -0,0 +1,83 @@
+package dslx_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/dslx"
+	"github.com/bassosimone/oonidsl/internal/netxlite/memnet"
+	"github.com/google/go-cmp/cmp"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+func TestQUICHandshake(t *testing.T) {
+	t.Run("QUIC handshake with custom Initial packets", func(t *testing.T) {
+		network, certPool, config, handler := newTestNetwork(t)
+		var (
+			mu        sync.Mutex
+			datagrams []*memnet.Packet
+		)
+		network.SetFilter(func(packet *memnet.Packet) *memnet.Verdict {
+			if packet.Network == "udp" && packet.Destination == "10.0.0.2:443" {
+				mu.Lock()
+				datagrams = append(datagrams, packet)
+				mu.Unlock()
+			}
+			return nil
+		})
+		pconn, err := network.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h3srv := &http3.Server{Handler: handler, TLSConfig: config}
+		done := make(chan any)
+		go func() {
+			defer close(done)
+			h3srv.Serve(pconn)
+		}()
+		defer func() {
+			h3srv.Close()
+			pconn.Close()
+			<-done
+		}()
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("udp", "10.0.0.2:443", dslx.EndpointOptionDomain("www.example.com"))
+		result := dslx.QUICHandshake(
+			pool,
+			dslx.QUICHandshakeOptionRootCAs(certPool),
+			dslx.QUICHandshakeOptionVersions(quic.Version2, quic.Version1),
+			dslx.QUICHandshakeOptionConnectionIDLength(8),
+			dslx.QUICHandshakeOptionInitialPacketSize(1350),
+		).Apply(context.Background(), endpoint)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if v := result.State.QUICConn.ConnectionState().Version; v != quic.Version2 {
+			t.Fatal("unexpected version", v)
+		}
+		mu.Lock()
+		first := datagrams[0]
+		mu.Unlock()
+		if len(first.Payload) != 1350 {
+			t.Fatal("unexpected Initial datagram size", len(first.Payload))
+		}
+		// we choose the source connection ID, which follows the destination one
+		if scidLen := first.Payload[6+int(first.Payload[5])]; scidLen != 8 {
+			t.Fatal("unexpected connection ID length", scidLen)
+		}
+		if len(result.Observations) != 1 || len(result.Observations[0].QUICHandshakes) != 1 {
+			t.Fatal("expected a single QUIC handshake")
+		}
+		ev := result.Observations[0].QUICHandshakes[0]
+		if ev.QUICVersion != "v2" || ev.QUICConnectionIDLength != 8 || ev.QUICInitialPacketSize != 1350 {
+			t.Fatal("unexpected archival data", ev.QUICVersion, ev.QUICConnectionIDLength, ev.QUICInitialPacketSize)
+		}
+		if diff := cmp.Diff([]string{"v2", "v1"}, ev.QUICVersions); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+}
@@ -49,6 +49,11 @@ func (f *tcpConnectFunc) Apply(
 	// connect
 	conn, err := dialer.DialContext(ctx, "tcp", input.Address)
 
+	// possibly count the bytes sent and received
+	if conn != nil && input.ByteCounter != nil {
+		conn = input.ByteCounter.WrapNetConn(conn)
+	}
+
 	// possibly register established conn for late close
 	f.p.MaybeTrack(conn)
 
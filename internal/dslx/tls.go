@@ -15,11 +15,32 @@ import (
 	"github.com/bassosimone/oonidsl/internal/measurexlite"
 	"github.com/bassosimone/oonidsl/internal/model"
 	"github.com/bassosimone/oonidsl/internal/netxlite"
+	utls "gitlab.com/yawning/utls.git"
 )
 
 // TLSHandshakeOption is an option you can pass to TLSHandshake.
 type TLSHandshakeOption func(*tlsHandshakeFunc)
 
+// TLSHandshakeOptionCertVerifier allows to verify the server certificates using
+// the given CertVerifier, which overrides the RootCAs, and to receive the report
+// of each verification using the OPTIONAL onReport callback.
+func TLSHandshakeOptionCertVerifier(
+	value *netxlite.CertVerifier, onReport func(*netxlite.CertVerificationReport)) TLSHandshakeOption {
+	return func(thf *tlsHandshakeFunc) {
+		thf.CertVerifier = value
+		thf.OnCertVerificationReport = onReport
+	}
+}
+
+// TLSHandshakeOptionECH allows to perform an ECH handshake using the given
+// ECHConfigList, e.g., the one returned by an HTTPS lookup. The TLS handshake
+// observations will also contain whether the server accepted ECH.
+func TLSHandshakeOptionECH(echConfigList []byte) TLSHandshakeOption {
+	return func(thf *tlsHandshakeFunc) {
+		thf.ECHConfigList = echConfigList
+	}
+}
+
 // TLSHandshakeOptionInsecureSkipVerify controls whether TLS verification is enabled.
 func TLSHandshakeOptionInsecureSkipVerify(value bool) TLSHandshakeOption {
 	return func(thf *tlsHandshakeFunc) {
@@ -52,11 +73,14 @@ func TLSHandshakeOptionServerName(value string) TLSHandshakeOption {
 func TLSHandshake(pool *ConnPool, options ...TLSHandshakeOption) Func[
 	*TCPConnection, *Maybe[*TLSConnection]] {
 	f := &tlsHandshakeFunc{
-		InsecureSkipVerify: false,
-		NextProto:          []string{},
-		Pool:               pool,
-		RootCAs:            netxlite.NewDefaultCertPool(),
-		ServerName:         "",
+		CertVerifier:             nil,
+		ECHConfigList:            nil,
+		InsecureSkipVerify:       false,
+		NextProto:                []string{},
+		OnCertVerificationReport: nil,
+		Pool:                     pool,
+		RootCAs:                  netxlite.NewDefaultCertPool(),
+		ServerName:               "",
 	}
 	for _, option := range options {
 		option(f)
@@ -66,12 +90,22 @@ func TLSHandshake(pool *ConnPool, options ...TLSHandshakeOption) Func[
 
 // tlsHandshakeFunc performs TLS handshakes.
 type tlsHandshakeFunc struct {
+	// CertVerifier is the OPTIONAL CertVerifier to use.
+	CertVerifier *netxlite.CertVerifier
+
+	// ECHConfigList is the OPTIONAL ECHConfigList to use.
+	ECHConfigList []byte
+
 	// InsecureSkipVerify allows to skip TLS verification.
 	InsecureSkipVerify bool
 
 	// NextProto contains the ALPNs to negotiate.
 	NextProto []string
 
+	// OnCertVerificationReport is the OPTIONAL callback receiving
+	// the reports generated by CertVerifier.
+	OnCertVerificationReport func(*netxlite.CertVerificationReport)
+
 	// Pool is the Pool that owns us.
 	Pool *ConnPool
 
@@ -103,13 +137,16 @@ func (f *tlsHandshakeFunc) Apply(
 	)
 
 	// setup
-	handshaker := trace.NewTLSHandshakerStdlib(input.Logger)
+	handshaker := f.newTLSHandshaker(trace, input.Logger)
 	config := &tls.Config{
 		NextProtos:         nextProto,
 		InsecureSkipVerify: f.InsecureSkipVerify,
 		RootCAs:            f.RootCAs,
 		ServerName:         serverName,
 	}
+	if f.CertVerifier != nil && !f.InsecureSkipVerify {
+		config = f.CertVerifier.WrapTLSConfig(config, f.OnCertVerificationReport)
+	}
 	const timeout = 10 * time.Second
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
@@ -148,6 +185,13 @@ func (f *tlsHandshakeFunc) Apply(
 	}
 }
 
+func (f *tlsHandshakeFunc) newTLSHandshaker(trace *measurexlite.Trace, logger model.Logger) model.TLSHandshaker {
+	if len(f.ECHConfigList) > 0 {
+		return trace.NewTLSHandshakerECH(logger, &utls.HelloChrome_Auto, f.ECHConfigList)
+	}
+	return trace.NewTLSHandshakerStdlib(logger)
+}
+
 func (f *tlsHandshakeFunc) serverName(input *TCPConnection) string {
 	if f.ServerName != "" {
 		return f.ServerName
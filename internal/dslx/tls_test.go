@@ -0,0 +1,47 @@
+package dslx_test
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/dslx"
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+)
+
+func TestTLSHandshake(t *testing.T) {
+	t.Run("with ECH and a server not supporting ECH", func(t *testing.T) {
+		// echConfigList contains a single X25519 config whose public name is public.example.net.
+		echConfigList, _ := hex.DecodeString("0045fe0d0041070020002011111111111111111111111111111111" +
+			"1111111111111111111111111111111100040001000140127075626c69632e6578616d706c652e6e65740000")
+		_, certPool, _, _ := newTestNetwork(t)
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("tcp", dslx.EndpointAddress("10.0.0.2:443"),
+			dslx.EndpointOptionDomain("www.example.com"))
+		fx := dslx.Compose2(
+			dslx.TCPConnect(pool),
+			dslx.TLSHandshake(pool, dslx.TLSHandshakeOptionRootCAs(certPool),
+				dslx.TLSHandshakeOptionECH(echConfigList)),
+		)
+		result := fx.Apply(context.Background(), endpoint)
+		if result.Error == nil {
+			t.Fatal("expected an error")
+		}
+		var handshakes []*model.ArchivalTLSOrQUICHandshakeResult
+		for _, observations := range dslx.ExtractObservations(result) {
+			handshakes = append(handshakes, observations.TLSHandshakes...)
+		}
+		if len(handshakes) != 1 {
+			t.Fatal("expected a single TLS handshake")
+		}
+		ev := handshakes[0]
+		if ev.Failure == nil || *ev.Failure != netxlite.FailureSSLFailedHandshake {
+			t.Fatal("unexpected failure", ev.Failure)
+		}
+		if ev.ECHStatus != netxlite.ECHStatusStripped {
+			t.Fatal("unexpected ECH status", ev.ECHStatus)
+		}
+	})
+}
@@ -0,0 +1,401 @@
+package dslx
+
+//
+// WebSocket measurements core
+//
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/atomicx"
+	"github.com/bassosimone/oonidsl/internal/measurexlite"
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+)
+
+// WebSocketTransport is a WebSocket dialer bound to a TCP or TLS connection
+// that would use such a connection only and for any input URL. You generally
+// use WebSocketTransportTCP or WebSocketTransportTLS to create a new instance; if
+// you want to initialize manually, make sure you init the MANDATORY fields.
+type WebSocketTransport struct {
+	// Address is the MANDATORY address we're connected to.
+	Address string
+
+	// Dialer is the MANDATORY WebSocket dialer we're using.
+	Dialer model.WebSocketDialer
+
+	// Domain is the OPTIONAL domain from which the address was resolved.
+	Domain string
+
+	// IDGenerator is the MANDATORY ID generator.
+	IDGenerator *atomicx.Int64
+
+	// Logger is the MANDATORY logger to use.
+	Logger model.Logger
+
+	// Network is the MANDATORY network used by the underlying conn.
+	Network string
+
+	// Scheme is the MANDATORY URL scheme to use (i.e., "ws" or "wss").
+	Scheme string
+
+	// TLSNegotiatedProtocol is the OPTIONAL negotiated protocol.
+	TLSNegotiatedProtocol string
+
+	// Trace is the MANDATORY trace we're using.
+	Trace *measurexlite.Trace
+
+	// ZeroTime is the MANDATORY zero time of the measurement.
+	ZeroTime time.Time
+}
+
+// WebSocketHandshakeOption is an option you can pass to WebSocketHandshake.
+type WebSocketHandshakeOption func(*webSocketHandshakeFunc)
+
+// WebSocketHandshakeOptionOrigin sets the Origin header, which many
+// servers check before accepting the upgrade.
+func WebSocketHandshakeOptionOrigin(value string) WebSocketHandshakeOption {
+	return func(f *webSocketHandshakeFunc) {
+		f.Origin = value
+	}
+}
+
+// WebSocketHandshakeOptionURLPath sets the URL path.
+func WebSocketHandshakeOptionURLPath(value string) WebSocketHandshakeOption {
+	return func(f *webSocketHandshakeFunc) {
+		f.URLPath = value
+	}
+}
+
+// WebSocketHandshakeOptionUserAgent sets the User-Agent header.
+func WebSocketHandshakeOptionUserAgent(value string) WebSocketHandshakeOption {
+	return func(f *webSocketHandshakeFunc) {
+		f.UserAgent = value
+	}
+}
+
+// WebSocketHandshake performs the WebSocket handshake using a transport and
+// returns a WebSocket connection. We record the upgrade request and the
+// corresponding response as an HTTP request in the observations.
+func WebSocketHandshake(
+	options ...WebSocketHandshakeOption) Func[*WebSocketTransport, *Maybe[*WebSocketConnection]] {
+	f := &webSocketHandshakeFunc{}
+	for _, option := range options {
+		option(f)
+	}
+	return f
+}
+
+// webSocketHandshakeFunc is the Func returned by WebSocketHandshake.
+type webSocketHandshakeFunc struct {
+	// Origin is the OPTIONAL origin header.
+	Origin string
+
+	// URLPath is the OPTIONAL URL path.
+	URLPath string
+
+	// UserAgent is the OPTIONAL user-agent header.
+	UserAgent string
+}
+
+// Apply implements Func.
+func (f *webSocketHandshakeFunc) Apply(
+	ctx context.Context, input *WebSocketTransport) *Maybe[*WebSocketConnection] {
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	URL := f.newURL(input)
+	header := f.newHeader()
+
+	// start the operation logger
+	ol := measurexlite.NewOperationLogger(
+		input.Logger,
+		"[#%d] WebSocketHandshake %s with %s/%s",
+		input.Trace.Index,
+		URL.String(),
+		input.Address,
+		input.Network,
+	)
+
+	// perform the handshake and collect the related observations
+	conn, observations, err := f.do(ctx, input, URL, header)
+
+	// stop the operation logger
+	ol.Stop(err)
+
+	observations = append(observations, maybeTraceToObservations(input.Trace)...)
+
+	state := &WebSocketConnection{
+		Address:     input.Address,
+		Conn:        conn, // possibly nil
+		Domain:      input.Domain,
+		IDGenerator: input.IDGenerator,
+		Logger:      input.Logger,
+		Network:     input.Network,
+		Trace:       input.Trace,
+		ZeroTime:    input.ZeroTime,
+	}
+
+	return &Maybe[*WebSocketConnection]{
+		Error:        err,
+		Observations: observations,
+		Skipped:      false,
+		State:        state,
+	}
+}
+
+func (f *webSocketHandshakeFunc) newURL(input *WebSocketTransport) *url.URL {
+	return &url.URL{
+		Scheme: input.Scheme,
+		Host:   f.urlHost(input),
+		Path:   f.urlPath(),
+	}
+}
+
+func (f *webSocketHandshakeFunc) newHeader() http.Header {
+	header := http.Header{}
+	if v := f.Origin; v != "" {
+		header.Set("Origin", v)
+	}
+	if v := f.UserAgent; v != "" {
+		header.Set("User-Agent", v)
+	}
+	return header
+}
+
+func (f *webSocketHandshakeFunc) urlHost(input *WebSocketTransport) string {
+	if input.Domain != "" {
+		return input.Domain
+	}
+	addr, port, err := net.SplitHostPort(input.Address)
+	if err != nil {
+		input.Logger.Warnf("webSocketHandshakeFunc: cannot SplitHostPort for input.Address")
+		return input.Address
+	}
+	switch {
+	case port == "80" && input.Scheme == "ws":
+		return addr
+	case port == "443" && input.Scheme == "wss":
+		return addr
+	default:
+		return input.Address // with port only if port is nonstandard
+	}
+}
+
+func (f *webSocketHandshakeFunc) urlPath() string {
+	if f.URLPath != "" {
+		return f.URLPath
+	}
+	return "/"
+}
+
+func (f *webSocketHandshakeFunc) do(
+	ctx context.Context,
+	input *WebSocketTransport,
+	URL *url.URL,
+	header http.Header,
+) (model.WebSocketConn, []*Observations, error) {
+	const maxbody = 1 << 10 // the WebSocket dialer only keeps the first KiB of the body
+	started := input.Trace.TimeSince(input.Trace.ZeroTime)
+	observations := []*Observations{{}} // one entry!
+
+	observations[0].NetworkEvents = append(observations[0].NetworkEvents,
+		measurexlite.NewAnnotationArchivalNetworkEvent(
+			input.Trace.Index,
+			started,
+			"websocket_handshake_start",
+		))
+
+	conn, resp, err := input.Dialer.DialContext(ctx, URL.String(), header)
+	var body []byte
+	if resp != nil {
+		// when the server refuses the upgrade the body contains
+		// a snapshot of the response body (e.g., a blockpage)
+		body, _ = netxlite.ReadAllContext(ctx, resp.Body)
+	}
+	finished := input.Trace.TimeSince(input.Trace.ZeroTime)
+
+	observations[0].NetworkEvents = append(observations[0].NetworkEvents,
+		measurexlite.NewAnnotationArchivalNetworkEvent(
+			input.Trace.Index,
+			finished,
+			"websocket_handshake_done",
+		))
+
+	observations[0].Requests = append(observations[0].Requests,
+		measurexlite.NewArchivalHTTPRequestResult(
+			input.Trace.Index,
+			started,
+			input.Network,
+			input.Address,
+			input.TLSNegotiatedProtocol,
+			input.Network,
+			f.upgradeRequest(ctx, URL, header, resp),
+			resp,
+			maxbody,
+			body,
+			err,
+			finished,
+		))
+
+	return conn, observations, err
+}
+
+// upgradeRequest returns the upgrade request to archive. When we have a response, we
+// use its request because it contains all the headers we sent. In both cases, we
+// use the original ws:// or wss:// URL rather than the equivalent http(s):// URL.
+func (f *webSocketHandshakeFunc) upgradeRequest(
+	ctx context.Context, URL *url.URL, header http.Header, resp *http.Response) *http.Request {
+	if resp != nil && resp.Request != nil {
+		req := resp.Request.Clone(ctx)
+		req.URL = URL
+		return req
+	}
+	return &http.Request{
+		Method: "GET",
+		URL:    URL,
+		Header: header,
+		Host:   URL.Host,
+	}
+}
+
+// WebSocketConnection is an established WebSocket connection. If you initialize
+// manually, init at least the ones marked as MANDATORY.
+type WebSocketConnection struct {
+	// Address is the MANDATORY address we're connected to.
+	Address string
+
+	// Conn is the established WebSocket conn.
+	Conn model.WebSocketConn
+
+	// Domain is the OPTIONAL domain from which we determined Address.
+	Domain string
+
+	// IDGenerator is the MANDATORY ID generator.
+	IDGenerator *atomicx.Int64
+
+	// Logger is the MANDATORY logger to use.
+	Logger model.Logger
+
+	// Network is the MANDATORY network we're connected to.
+	Network string
+
+	// Trace is the MANDATORY trace we're using.
+	Trace *measurexlite.Trace
+
+	// ZeroTime is the MANDATORY zero time of the measurement.
+	ZeroTime time.Time
+}
+
+// WebSocketExchange sends the given text message and waits for
+// the first message sent by the peer (e.g., an echo of the message).
+func WebSocketExchange(message string) Func[*WebSocketConnection, *Maybe[*WebSocketMessage]] {
+	return &webSocketExchangeFunc{message}
+}
+
+// webSocketExchangeFunc is the Func returned by WebSocketExchange.
+type webSocketExchangeFunc struct {
+	// Message is the MANDATORY message to send.
+	Message string
+}
+
+// Apply implements Func.
+func (f *webSocketExchangeFunc) Apply(
+	ctx context.Context, input *WebSocketConnection) *Maybe[*WebSocketMessage] {
+	// start the operation logger
+	ol := measurexlite.NewOperationLogger(
+		input.Logger,
+		"[#%d] WebSocketExchange with %s/%s",
+		input.Trace.Index,
+		input.Address,
+		input.Network,
+	)
+
+	const timeout = 10 * time.Second
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	input.Conn.SetWriteDeadline(deadline)
+	input.Conn.SetReadDeadline(deadline)
+
+	var (
+		messageType int
+		data        []byte
+	)
+	err := input.Conn.WriteMessage(netxlite.WebSocketTextMessage, []byte(f.Message))
+	if err == nil {
+		messageType, data, err = input.Conn.ReadMessage()
+	}
+
+	// reset the deadlines so we can continue using the conn
+	input.Conn.SetWriteDeadline(time.Time{})
+	input.Conn.SetReadDeadline(time.Time{})
+
+	// stop the operation logger
+	ol.Stop(err)
+
+	state := &WebSocketMessage{
+		Address:             input.Address,
+		Conn:                input.Conn,
+		Domain:              input.Domain,
+		IDGenerator:         input.IDGenerator,
+		Logger:              input.Logger,
+		Network:             input.Network,
+		ReceivedMessage:     data, // possibly nil
+		ReceivedMessageType: messageType,
+		SentMessage:         f.Message,
+		Trace:               input.Trace,
+		ZeroTime:            input.ZeroTime,
+	}
+
+	return &Maybe[*WebSocketMessage]{
+		Error:        err,
+		Observations: maybeTraceToObservations(input.Trace),
+		Skipped:      false,
+		State:        state,
+	}
+}
+
+// WebSocketMessage is the result of exchanging messages using WebSocketExchange.
+// To init manually, init at least the fields marked as MANDATORY.
+type WebSocketMessage struct {
+	// Address is the MANDATORY address we're connected to.
+	Address string
+
+	// Conn is the MANDATORY WebSocket conn we're using.
+	Conn model.WebSocketConn
+
+	// Domain is the OPTIONAL domain from which we determined Address.
+	Domain string
+
+	// IDGenerator is the MANDATORY ID generator.
+	IDGenerator *atomicx.Int64
+
+	// Logger is the MANDATORY logger to use.
+	Logger model.Logger
+
+	// Network is the MANDATORY network we're connected to.
+	Network string
+
+	// ReceivedMessage is the message we received or nil on failure.
+	ReceivedMessage []byte
+
+	// ReceivedMessageType is the type of the message we received
+	// (e.g., netxlite.WebSocketTextMessage) or zero on failure.
+	ReceivedMessageType int
+
+	// SentMessage is the message we sent.
+	SentMessage string
+
+	// Trace is the MANDATORY trace we're using.
+	Trace *measurexlite.Trace
+
+	// ZeroTime is the MANDATORY zero time of the measurement.
+	ZeroTime time.Time
+}
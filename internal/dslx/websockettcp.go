@@ -0,0 +1,54 @@
+package dslx
+
+//
+// TCP adapters for WebSocket
+//
+
+import (
+	"context"
+
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+)
+
+// WebSocketHandshakeOverTCP returns a Func that performs the WebSocket
+// handshake over TCP (i.e., using the ws:// URL scheme).
+func WebSocketHandshakeOverTCP(
+	options ...WebSocketHandshakeOption) Func[*TCPConnection, *Maybe[*WebSocketConnection]] {
+	return Compose2(WebSocketTransportTCP(), WebSocketHandshake(options...))
+}
+
+// WebSocketTransportTCP converts a TCP connection into a WebSocket transport.
+func WebSocketTransportTCP() Func[*TCPConnection, *Maybe[*WebSocketTransport]] {
+	return &webSocketTransportTCPFunc{}
+}
+
+// webSocketTransportTCPFunc is the function returned by WebSocketTransportTCP.
+type webSocketTransportTCPFunc struct{}
+
+// Apply implements Func
+func (f *webSocketTransportTCPFunc) Apply(
+	ctx context.Context, input *TCPConnection) *Maybe[*WebSocketTransport] {
+	dialer := netxlite.NewWebSocketDialer(
+		input.Logger,
+		netxlite.NewSingleUseDialer(input.Conn),
+		netxlite.NewNullTLSDialer(),
+	)
+	state := &WebSocketTransport{
+		Address:               input.Address,
+		Dialer:                dialer,
+		Domain:                input.Domain,
+		IDGenerator:           input.IDGenerator,
+		Logger:                input.Logger,
+		Network:               input.Network,
+		Scheme:                "ws",
+		TLSNegotiatedProtocol: "",
+		Trace:                 input.Trace,
+		ZeroTime:              input.ZeroTime,
+	}
+	return &Maybe[*WebSocketTransport]{
+		Error:        nil,
+		Observations: nil,
+		Skipped:      false,
+		State:        state,
+	}
+}
@@ -0,0 +1,34 @@
+package dslx_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/dslx"
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+)
+
+func TestWebSocketHandshakeOverTCP(t *testing.T) {
+	t.Run("WebSocket upgrade refused by the server", func(t *testing.T) {
+		newTestNetwork(t)
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("tcp", "10.0.0.2:80", dslx.EndpointOptionDomain("www.example.com"))
+		fx := dslx.Compose2(dslx.TCPConnect(pool), dslx.WebSocketHandshakeOverTCP())
+		result := fx.Apply(context.Background(), endpoint)
+		if result.Error == nil || result.Error.Error() != netxlite.FailureWebSocketBadHandshake {
+			t.Fatal("unexpected error", result.Error)
+		}
+		var requests []*model.ArchivalHTTPRequestResult
+		for _, obs := range result.Observations {
+			requests = append(requests, obs.Requests...)
+		}
+		if len(requests) != 1 {
+			t.Fatal("expected to see the upgrade request")
+		}
+		if requests[0].Response.Code != 200 || requests[0].Response.Body.Value != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected response", requests[0].Response.Code, requests[0].Response.Body.Value)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package dslx
+
+//
+// TLS adapters for WebSocket
+//
+
+import (
+	"context"
+
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+)
+
+// WebSocketHandshakeOverTLS returns a Func that performs the WebSocket
+// handshake over TLS (i.e., using the wss:// URL scheme). Because WebSocket
+// requires HTTP/1.1, you SHOULD perform the TLS handshake passing the
+// TLSHandshakeOptionNextProto([]string{"http/1.1"}) option.
+func WebSocketHandshakeOverTLS(
+	options ...WebSocketHandshakeOption) Func[*TLSConnection, *Maybe[*WebSocketConnection]] {
+	return Compose2(WebSocketTransportTLS(), WebSocketHandshake(options...))
+}
+
+// WebSocketTransportTLS converts a TLS connection into a WebSocket transport.
+func WebSocketTransportTLS() Func[*TLSConnection, *Maybe[*WebSocketTransport]] {
+	return &webSocketTransportTLSFunc{}
+}
+
+// webSocketTransportTLSFunc is the function returned by WebSocketTransportTLS.
+type webSocketTransportTLSFunc struct{}
+
+// Apply implements Func.
+func (f *webSocketTransportTLSFunc) Apply(
+	ctx context.Context, input *TLSConnection) *Maybe[*WebSocketTransport] {
+	dialer := netxlite.NewWebSocketDialer(
+		input.Logger,
+		netxlite.NewNullDialer(),
+		netxlite.NewSingleUseTLSDialer(input.Conn),
+	)
+	state := &WebSocketTransport{
+		Address:               input.Address,
+		Dialer:                dialer,
+		Domain:                input.Domain,
+		IDGenerator:           input.IDGenerator,
+		Logger:                input.Logger,
+		Network:               input.Network,
+		Scheme:                "wss",
+		TLSNegotiatedProtocol: input.TLSState.NegotiatedProtocol,
+		Trace:                 input.Trace,
+		ZeroTime:              input.ZeroTime,
+	}
+	return &Maybe[*WebSocketTransport]{
+		Error:        nil,
+		Observations: nil,
+		Skipped:      false,
+		State:        state,
+	}
+}
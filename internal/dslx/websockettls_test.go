@@ -0,0 +1,64 @@
+package dslx_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/dslx"
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketHandshakeOverTLS(t *testing.T) {
+	t.Run("WebSocket over TLS", func(t *testing.T) {
+		network, certPool, config, _ := newTestNetwork(t)
+		listener, err := network.ListenTCP("10.0.0.2:8443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		upgrader := &websocket.Upgrader{}
+		go http.Serve(tls.NewListener(listener, config), http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				messageType, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				conn.WriteMessage(messageType, data)
+			}))
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("tcp", "10.0.0.2:8443", dslx.EndpointOptionDomain("www.example.com"))
+		fx := dslx.Compose4(
+			dslx.TCPConnect(pool),
+			dslx.TLSHandshake(pool, dslx.TLSHandshakeOptionRootCAs(certPool),
+				dslx.TLSHandshakeOptionNextProto([]string{"http/1.1"})),
+			dslx.WebSocketHandshakeOverTLS(dslx.WebSocketHandshakeOptionURLPath("/apiws")),
+			dslx.WebSocketExchange("Bonsoir, Elliot!"),
+		)
+		result := fx.Apply(context.Background(), endpoint)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if string(result.State.ReceivedMessage) != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected message", string(result.State.ReceivedMessage))
+		}
+		var requests []*model.ArchivalHTTPRequestResult
+		for _, obs := range result.Observations {
+			requests = append(requests, obs.Requests...)
+		}
+		if len(requests) != 1 {
+			t.Fatal("expected to see the upgrade request")
+		}
+		if requests[0].Request.URL != "wss://www.example.com/apiws" || requests[0].Response.Code != 101 {
+			t.Fatal("unexpected upgrade request", requests[0].Request.URL, requests[0].Response.Code)
+		}
+	})
+}
@@ -6,6 +6,7 @@ package measurexlite
 
 import (
 	"net"
+	"sort"
 	"time"
 
 	"github.com/bassosimone/oonidsl/internal/model"
@@ -46,11 +47,8 @@ func (c *connTrace) Read(b []byte) (int, error) {
 	started := c.tx.TimeSince(c.tx.ZeroTime)
 	count, err := c.Conn.Read(b)
 	finished := c.tx.TimeSince(c.tx.ZeroTime)
-	select {
-	case c.tx.networkEvent <- NewArchivalNetworkEvent(
-		c.tx.Index, started, netxlite.ReadOperation, network, addr, count, err, finished):
-	default: // buffer is full
-	}
+	c.tx.emitReadWriteEvent(c, c.tx.newArchivalNetworkEvent(
+		started, netxlite.ReadOperation, network, addr, count, err, finished))
 	return count, err
 }
 
@@ -61,14 +59,17 @@ func (c *connTrace) Write(b []byte) (int, error) {
 	started := c.tx.TimeSince(c.tx.ZeroTime)
 	count, err := c.Conn.Write(b)
 	finished := c.tx.TimeSince(c.tx.ZeroTime)
-	select {
-	case c.tx.networkEvent <- NewArchivalNetworkEvent(
-		c.tx.Index, started, netxlite.WriteOperation, network, addr, count, err, finished):
-	default: // buffer is full
-	}
+	c.tx.emitReadWriteEvent(c, c.tx.newArchivalNetworkEvent(
+		started, netxlite.WriteOperation, network, addr, count, err, finished))
 	return count, err
 }
 
+// Close implements net.Conn.Close and flushes the pending read or write event.
+func (c *connTrace) Close() error {
+	c.tx.flushReadWriteEvent(c)
+	return c.Conn.Close()
+}
+
 // MaybeUDPLikeClose is a convenience function for closing a conn only when such a conn isn't nil.
 func MaybeCloseUDPLikeConn(conn model.UDPLikeConn) (err error) {
 	if conn != nil {
@@ -99,11 +100,8 @@ func (c *udpLikeConnTrace) ReadFrom(b []byte) (int, net.Addr, error) {
 	count, addr, err := c.UDPLikeConn.ReadFrom(b)
 	finished := c.tx.TimeSince(c.tx.ZeroTime)
 	address := addrStringIfNotNil(addr)
-	select {
-	case c.tx.networkEvent <- NewArchivalNetworkEvent(
-		c.tx.Index, started, netxlite.ReadFromOperation, "udp", address, count, err, finished):
-	default: // buffer is full
-	}
+	c.tx.emitReadWriteEvent(c, c.tx.newArchivalNetworkEvent(
+		started, netxlite.ReadFromOperation, "udp", address, count, err, finished))
 	return count, addr, err
 }
 
@@ -113,12 +111,83 @@ func (c *udpLikeConnTrace) WriteTo(b []byte, addr net.Addr) (int, error) {
 	address := addr.String()
 	count, err := c.UDPLikeConn.WriteTo(b, addr)
 	finished := c.tx.TimeSince(c.tx.ZeroTime)
+	c.tx.emitReadWriteEvent(c, c.tx.newArchivalNetworkEvent(
+		started, netxlite.WriteToOperation, "udp", address, count, err, finished))
+	return count, err
+}
+
+// Close implements model.UDPLikeConn.Close and flushes the pending read or write event.
+func (c *udpLikeConnTrace) Close() error {
+	c.tx.flushReadWriteEvent(c)
+	return c.UDPLikeConn.Close()
+}
+
+// emitNetworkEvent saves the given network event unless the buffer is full.
+func (tx *Trace) emitNetworkEvent(ev *model.ArchivalNetworkEvent) {
 	select {
-	case c.tx.networkEvent <- NewArchivalNetworkEvent(
-		c.tx.Index, started, netxlite.WriteToOperation, "udp", address, count, err, finished):
+	case tx.networkEvent <- ev:
 	default: // buffer is full
+		tx.onDroppedEvent()
 	}
-	return count, err
+}
+
+// emitReadWriteEvent saves a read or write event emitted by the given conn. When
+// aggregation is enabled, we merge the event with the pending one when both are
+// successful and have the same operation and address. Otherwise, we save the
+// pending event and the new event becomes pending, unless it failed.
+func (tx *Trace) emitReadWriteEvent(conn any, ev *model.ArchivalNetworkEvent) {
+	if !tx.aggregateReadWrite {
+		tx.emitNetworkEvent(ev)
+		return
+	}
+	tx.mu.Lock()
+	pending := tx.pendingReadWrite[conn]
+	if pending != nil && ev.Failure == nil && pending.Operation == ev.Operation &&
+		pending.Address == ev.Address {
+		pending.NumBytes += ev.NumBytes
+		pending.T = ev.T
+		tx.mu.Unlock()
+		return
+	}
+	delete(tx.pendingReadWrite, conn) // works with a nil map
+	if ev.Failure == nil {
+		if tx.pendingReadWrite == nil {
+			tx.pendingReadWrite = map[any]*model.ArchivalNetworkEvent{}
+		}
+		tx.pendingReadWrite[conn] = ev
+	}
+	tx.mu.Unlock()
+	if pending != nil {
+		tx.emitNetworkEvent(pending)
+	}
+	if ev.Failure != nil {
+		tx.emitNetworkEvent(ev)
+	}
+}
+
+// flushReadWriteEvent saves the pending read or write event of the given conn, if any.
+func (tx *Trace) flushReadWriteEvent(conn any) {
+	tx.mu.Lock()
+	pending := tx.pendingReadWrite[conn]
+	delete(tx.pendingReadWrite, conn) // works with a nil map
+	tx.mu.Unlock()
+	if pending != nil {
+		tx.emitNetworkEvent(pending)
+	}
+}
+
+// drainReadWriteEvents returns and clears all the pending read or write events.
+func (tx *Trace) drainReadWriteEvents() (out []*model.ArchivalNetworkEvent) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	for _, ev := range tx.pendingReadWrite {
+		out = append(out, ev)
+	}
+	tx.pendingReadWrite = nil
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].T0 < out[j].T0
+	})
+	return
 }
 
 // addrStringIfNotNil returns the string of the given addr
@@ -146,6 +215,15 @@ func NewArchivalNetworkEvent(index int64, started time.Duration, operation strin
 	}
 }
 
+// newArchivalNetworkEvent is like NewArchivalNetworkEvent but uses the trace's
+// index and also saves the failure details when they are enabled.
+func (tx *Trace) newArchivalNetworkEvent(started time.Duration, operation string, network string,
+	address string, count int, err error, finished time.Duration) *model.ArchivalNetworkEvent {
+	ev := NewArchivalNetworkEvent(tx.Index, started, operation, network, address, count, err, finished)
+	ev.FailureDetails = tx.newFailureDetails(err)
+	return ev
+}
+
 // NewAnnotationArchivalNetworkEvent is a simplified NewArchivalNetworkEvent
 // where we create a simple annotation without attached I/O info.
 func NewAnnotationArchivalNetworkEvent(
@@ -154,15 +232,35 @@ func NewAnnotationArchivalNetworkEvent(
 }
 
 // NetworkEvents drains the network events buffered inside the NetworkEvent channel.
+// When aggregating read and write events, we also include the pending aggregated
+// events, such that we do not lose them, merging them with the buffered ones by T0.
 func (tx *Trace) NetworkEvents() (out []*model.ArchivalNetworkEvent) {
 	for {
 		select {
 		case ev := <-tx.networkEvent:
 			out = append(out, ev)
 		default:
-			return // done
+			return mergeNetworkEventsByT0(out, tx.drainReadWriteEvents()) // done
+		}
+	}
+}
+
+// mergeNetworkEventsByT0 merges two lists of events sorted by T0 without
+// changing the relative order of the events within each list.
+func mergeNetworkEventsByT0(a, b []*model.ArchivalNetworkEvent) []*model.ArchivalNetworkEvent {
+	if len(b) <= 0 {
+		return a
+	}
+	out := make([]*model.ArchivalNetworkEvent, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].T0 < a[0].T0 {
+			out, b = append(out, b[0]), b[1:]
+			continue
 		}
+		out, a = append(out, a[0]), a[1:]
 	}
+	out = append(out, a...)
+	return append(out, b...)
 }
 
 // FirstNetworkEventOrNil drains the network events buffered inside the NetworkEvents channel
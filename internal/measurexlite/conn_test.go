@@ -132,6 +132,9 @@ func TestWrapNetConn(t *testing.T) {
 		if len(events) != 0 {
 			t.Fatal("expected no network events")
 		}
+		if dropped := trace.DroppedEvents(); dropped != 1 {
+			t.Fatal("unexpected number of dropped events", dropped)
+		}
 	})
 
 	t.Run("Write saves a trace", func(t *testing.T) {
@@ -387,6 +390,141 @@ func TestWrapUDPLikeConn(t *testing.T) {
 	})
 }
 
+func TestAggregateReadWrite(t *testing.T) {
+	newConn := func(err error) *mocks.Conn {
+		return &mocks.Conn{
+			MockRead: func(b []byte) (int, error) {
+				return len(b), err
+			},
+			MockWrite: func(b []byte) (int, error) {
+				return len(b), nil
+			},
+			MockRemoteAddr: func() net.Addr {
+				return &mocks.Addr{
+					MockNetwork: func() string {
+						return "tcp"
+					},
+					MockString: func() string {
+						return "1.1.1.1:443"
+					},
+				}
+			},
+			MockClose: func() error {
+				return nil
+			},
+		}
+	}
+
+	t.Run("merges consecutive reads and writes", func(t *testing.T) {
+		zeroTime := time.Now()
+		td := testingx.NewTimeDeterministic(zeroTime)
+		trace := NewTrace(0, zeroTime, TraceOptionAggregateReadWrite())
+		trace.TimeNowFn = td.Now // deterministic time counting
+		conn := trace.MaybeWrapNetConn(newConn(nil))
+		buffer := make([]byte, 128)
+		conn.Write(buffer[:16])
+		conn.Write(buffer[:16])
+		for idx := 0; idx < 100; idx++ {
+			conn.Read(buffer)
+		}
+		conn.Close()
+		events := trace.NetworkEvents()
+		if len(events) != 2 {
+			t.Fatal("expected two network events", len(events))
+		}
+		if events[0].Operation != netxlite.WriteOperation || events[0].NumBytes != 32 {
+			t.Fatal("unexpected first event", events[0])
+		}
+		if events[1].Operation != netxlite.ReadOperation || events[1].NumBytes != 12800 {
+			t.Fatal("unexpected second event", events[1])
+		}
+		if events[1].T0 >= events[1].T {
+			t.Fatal("the aggregated event should span all the reads")
+		}
+	})
+
+	t.Run("does not merge failed operations", func(t *testing.T) {
+		zeroTime := time.Now()
+		trace := NewTrace(0, zeroTime, TraceOptionAggregateReadWrite())
+		conn := trace.MaybeWrapNetConn(newConn(netxlite.ECONNRESET))
+		buffer := make([]byte, 128)
+		conn.Write(buffer)
+		conn.Read(buffer)
+		events := trace.NetworkEvents()
+		if len(events) != 2 {
+			t.Fatal("expected two network events", len(events))
+		}
+		if events[1].Failure == nil || *events[1].Failure != netxlite.FailureConnectionReset {
+			t.Fatal("unexpected second event", events[1])
+		}
+	})
+
+	t.Run("NetworkEvents includes the pending events", func(t *testing.T) {
+		zeroTime := time.Now()
+		trace := NewTrace(0, zeroTime, TraceOptionAggregateReadWrite())
+		conn := trace.MaybeWrapNetConn(newConn(nil))
+		buffer := make([]byte, 128)
+		conn.Read(buffer)
+		conn.Read(buffer)
+		if events := trace.NetworkEvents(); len(events) != 1 || events[0].NumBytes != 256 {
+			t.Fatal("unexpected events", events)
+		}
+		conn.Read(buffer)
+		if events := trace.NetworkEvents(); len(events) != 1 || events[0].NumBytes != 128 {
+			t.Fatal("unexpected events", events)
+		}
+	})
+
+	t.Run("NetworkEvents merges the pending events by T0", func(t *testing.T) {
+		zeroTime := time.Now()
+		td := testingx.NewTimeDeterministic(zeroTime)
+		trace := NewTrace(0, zeroTime, TraceOptionAggregateReadWrite())
+		trace.TimeNowFn = td.Now // deterministic time counting
+		first := trace.MaybeWrapNetConn(newConn(nil))
+		second := trace.MaybeWrapNetConn(newConn(nil))
+		buffer := make([]byte, 128)
+		first.Read(buffer) // pending until we drain the events
+		second.Write(buffer)
+		second.Close() // buffered with a later T0
+		events := trace.NetworkEvents()
+		if len(events) != 2 {
+			t.Fatal("expected two network events", len(events))
+		}
+		if events[0].Operation != netxlite.ReadOperation || events[1].Operation != netxlite.WriteOperation {
+			t.Fatal("unexpected order", events[0].Operation, events[1].Operation)
+		}
+		if events[0].T0 >= events[1].T0 {
+			t.Fatal("events are not sorted by T0")
+		}
+	})
+
+	t.Run("works with UDP-like conns", func(t *testing.T) {
+		zeroTime := time.Now()
+		trace := NewTrace(0, zeroTime, TraceOptionAggregateReadWrite())
+		underlying := &mocks.UDPLikeConn{
+			MockReadFrom: func(p []byte) (int, net.Addr, error) {
+				return len(p), &mocks.Addr{
+					MockString: func() string {
+						return "1.1.1.1:443"
+					},
+				}, nil
+			},
+			MockClose: func() error {
+				return nil
+			},
+		}
+		conn := trace.MaybeWrapUDPLikeConn(underlying)
+		buffer := make([]byte, 128)
+		conn.ReadFrom(buffer)
+		conn.ReadFrom(buffer)
+		conn.Close()
+		events := trace.NetworkEvents()
+		if len(events) != 1 || events[0].NumBytes != 256 {
+			t.Fatal("unexpected events", events)
+		}
+	})
+}
+
 func TestFirstNetworkEvent(t *testing.T) {
 	t.Run("returns nil when buffer is empty", func(t *testing.T) {
 		zeroTime := time.Now()
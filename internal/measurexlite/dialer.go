@@ -55,22 +55,23 @@ func (tx *Trace) OnConnectDone(
 	case "tcp", "tcp4", "tcp6":
 
 		// insert into the tcpConnect buffer
-		select {
-		case tx.tcpConnect <- NewArchivalTCPConnectResult(
+		ev := NewArchivalTCPConnectResult(
 			tx.Index,
 			started.Sub(tx.ZeroTime),
 			remoteAddr,
 			err,
 			finished.Sub(tx.ZeroTime),
-		):
+		)
+		ev.FailureDetails = tx.newFailureDetails(err)
+		select {
+		case tx.tcpConnect <- ev:
 		default: // buffer is full
+			tx.onDroppedEvent()
 		}
 
 		// insert into the networkEvent buffer
 		// see https://github.com/ooni/probe/issues/2254
-		select {
-		case tx.networkEvent <- NewArchivalNetworkEvent(
-			tx.Index,
+		tx.emitNetworkEvent(tx.newArchivalNetworkEvent(
 			started.Sub(tx.ZeroTime),
 			netxlite.ConnectOperation,
 			"tcp",
@@ -78,9 +79,7 @@ func (tx *Trace) OnConnectDone(
 			0,
 			err,
 			finished.Sub(tx.ZeroTime),
-		):
-		default: // buffer is full
-		}
+		))
 
 	default:
 		// ignore UDP connect attempts because they cannot fail
@@ -51,22 +51,16 @@ func (r *resolverTrace) CloseIdleConnections() {
 
 // emits the resolve_start event
 func (r *resolverTrace) emitResolveStart() {
-	select {
-	case r.tx.networkEvent <- NewAnnotationArchivalNetworkEvent(
+	r.tx.emitNetworkEvent(NewAnnotationArchivalNetworkEvent(
 		r.tx.Index, r.tx.TimeSince(r.tx.ZeroTime), "resolve_start",
-	):
-	default: // buffer is full
-	}
+	))
 }
 
 // emits the resolve_done event
 func (r *resolverTrace) emiteResolveDone() {
-	select {
-	case r.tx.networkEvent <- NewAnnotationArchivalNetworkEvent(
+	r.tx.emitNetworkEvent(NewAnnotationArchivalNetworkEvent(
 		r.tx.Index, r.tx.TimeSince(r.tx.ZeroTime), "resolve_done",
-	):
-	default: // buffer is full
-	}
+	))
 }
 
 // LookupHost implements model.Resolver.LookupHost
@@ -120,7 +114,8 @@ func (tx *Trace) OnDNSRoundTripForLookupHost(started time.Time, reso model.Resol
 		err,
 		t,
 	):
-	default:
+	default: // buffer is full
+		tx.onDroppedEvent()
 	}
 }
 
@@ -277,7 +272,8 @@ func (tx *Trace) OnDelayedDNSResponse(started time.Time, txp model.DNSTransport,
 		t,
 	):
 		return nil
-	default:
+	default: // buffer is full
+		tx.onDroppedEvent()
 		return ErrDelayedDNSResponseBufferFull
 	}
 }
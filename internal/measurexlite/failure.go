@@ -3,6 +3,7 @@ package measurexlite
 import (
 	"errors"
 
+	"github.com/bassosimone/oonidsl/internal/model"
 	"github.com/bassosimone/oonidsl/internal/netxlite"
 	"github.com/bassosimone/oonidsl/internal/runtimex"
 )
@@ -35,3 +36,50 @@ func NewFailure(err error) *string {
 	}
 	return &s
 }
+
+// NewFailureDetails creates the details of an OONI failure from an error. We
+// return nil if the error is nil or is not an ErrWrapper, or if the ErrWrapper
+// does not contain any detail besides the failure and the operation.
+func NewFailureDetails(err error) *model.ArchivalFailureDetails {
+	var errWrapper *netxlite.ErrWrapper
+	if err == nil || !errors.As(err, &errWrapper) {
+		return nil
+	}
+	if errWrapper.Elapsed <= 0 && errWrapper.Errno == 0 && errWrapper.LocalAddr == "" &&
+		errWrapper.RemoteAddr == "" && len(errWrapper.Previous) <= 0 {
+		return nil
+	}
+	out := &model.ArchivalFailureDetails{
+		Failure:    errWrapper.Failure,
+		Operation:  errWrapper.Operation,
+		Elapsed:    errWrapper.Elapsed.Seconds(),
+		Errno:      errWrapper.Errno,
+		LocalAddr:  errWrapper.LocalAddr,
+		RemoteAddr: errWrapper.RemoteAddr,
+	}
+	for _, previous := range errWrapper.Previous {
+		out.Previous = append(out.Previous, newArchivalPreviousFailure(previous))
+	}
+	return out
+}
+
+// newFailureDetails is like NewFailureDetails but returns nil
+// unless we have enabled TraceOptionFailureDetails.
+func (tx *Trace) newFailureDetails(err error) *model.ArchivalFailureDetails {
+	if !tx.failureDetails {
+		return nil
+	}
+	return NewFailureDetails(err)
+}
+
+// newArchivalPreviousFailure converts an ErrWrapper to model.ArchivalPreviousFailure.
+func newArchivalPreviousFailure(errWrapper *netxlite.ErrWrapper) model.ArchivalPreviousFailure {
+	return model.ArchivalPreviousFailure{
+		Failure:    errWrapper.Failure,
+		Operation:  errWrapper.Operation,
+		Elapsed:    errWrapper.Elapsed.Seconds(),
+		Errno:      errWrapper.Errno,
+		LocalAddr:  errWrapper.LocalAddr,
+		RemoteAddr: errWrapper.RemoteAddr,
+	}
+}
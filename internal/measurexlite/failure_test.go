@@ -1,9 +1,11 @@
 package measurexlite
 
 import (
+	"encoding/json"
 	"errors"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/bassosimone/oonidsl/internal/netxlite"
 )
@@ -80,3 +82,89 @@ func TestNewFailure(t *testing.T) {
 		})
 	}
 }
+
+func TestNewFailureDetails(t *testing.T) {
+	t.Run("when error is nil", func(t *testing.T) {
+		if NewFailureDetails(nil) != nil {
+			t.Fatal("expected nil details")
+		}
+	})
+
+	t.Run("when error is not wrapped", func(t *testing.T) {
+		if NewFailureDetails(io.EOF) != nil {
+			t.Fatal("expected nil details")
+		}
+	})
+
+	t.Run("when error is wrapped without details", func(t *testing.T) {
+		err := netxlite.NewErrWrapper(netxlite.ClassifyGenericError, netxlite.ReadOperation, io.EOF)
+		if NewFailureDetails(err) != nil {
+			t.Fatal("expected nil details")
+		}
+	})
+
+	t.Run("when error is wrapped with details", func(t *testing.T) {
+		err := &netxlite.ErrWrapper{
+			Failure:    netxlite.FailureConnectionReset,
+			Operation:  netxlite.ReadOperation,
+			WrappedErr: netxlite.ECONNRESET,
+			Elapsed:    9 * time.Second,
+			Errno:      104,
+			LocalAddr:  "10.0.0.1:54321",
+			RemoteAddr: "8.8.8.8:443",
+			Previous: []*netxlite.ErrWrapper{{
+				Failure:   netxlite.FailureGenericTimeoutError,
+				Operation: netxlite.ConnectOperation,
+			}},
+		}
+		data, jsonErr := json.Marshal(NewFailureDetails(err))
+		if jsonErr != nil {
+			t.Fatal(jsonErr)
+		}
+		expected := `{"failure":"connection_reset","operation":"read","t_elapsed":9,"errno":104,` +
+			`"local_addr":"10.0.0.1:54321","remote_addr":"8.8.8.8:443",` +
+			`"previous":[{"failure":"generic_timeout_error","operation":"connect"}]}`
+		if s := string(data); s != expected {
+			t.Fatal("invalid serialization", s)
+		}
+	})
+}
+
+func TestTraceOptionFailureDetails(t *testing.T) {
+	err := &netxlite.ErrWrapper{
+		Failure:    netxlite.FailureConnectionRefused,
+		Operation:  netxlite.ConnectOperation,
+		WrappedErr: netxlite.ECONNREFUSED,
+		Elapsed:    time.Second,
+		RemoteAddr: "8.8.8.8:443",
+	}
+
+	connect := func(trace *Trace) {
+		started := trace.ZeroTime
+		trace.OnConnectDone(started, "tcp", "dns.google", "8.8.8.8:443", err, started.Add(time.Second))
+	}
+
+	t.Run("by default we do not save the failure details", func(t *testing.T) {
+		trace := NewTrace(0, time.Now())
+		connect(trace)
+		if ev := trace.FirstTCPConnectOrNil(); ev == nil || ev.FailureDetails != nil {
+			t.Fatal("unexpected TCP connect", ev)
+		}
+		if ev := trace.FirstNetworkEventOrNil(); ev == nil || ev.FailureDetails != nil {
+			t.Fatal("unexpected network event", ev)
+		}
+	})
+
+	t.Run("with TraceOptionFailureDetails we save the failure details", func(t *testing.T) {
+		trace := NewTrace(0, time.Now(), TraceOptionFailureDetails())
+		connect(trace)
+		if ev := trace.FirstTCPConnectOrNil(); ev == nil || ev.FailureDetails == nil ||
+			ev.FailureDetails.Elapsed != 1 {
+			t.Fatal("unexpected TCP connect", ev)
+		}
+		if ev := trace.FirstNetworkEventOrNil(); ev == nil || ev.FailureDetails == nil ||
+			ev.FailureDetails.RemoteAddr != "8.8.8.8:443" {
+			t.Fatal("unexpected network event", ev)
+		}
+	})
+}
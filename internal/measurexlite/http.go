@@ -5,11 +5,14 @@ package measurexlite
 //
 
 import (
+	"bytes"
+	"io"
 	"net/http"
 	"sort"
 	"time"
 
 	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
 	"github.com/bassosimone/oonidsl/internal/tracex"
 )
 
@@ -42,14 +45,17 @@ import (
 // - err is the possibly-nil error that occurred during the transaction;
 //
 // - finished is when we finished reading the response's body.
+//
+// We fill the Protocol field using netxlite.HTTPResponseProtocol.
 func NewArchivalHTTPRequestResult(index int64, started time.Duration, network, address, alpn string,
 	transport string, req *http.Request, resp *http.Response, maxRespBodySize int64, body []byte, err error,
 	finished time.Duration) *model.ArchivalHTTPRequestResult {
 	return &model.ArchivalHTTPRequestResult{
-		Network: network,
-		Address: address,
-		ALPN:    alpn,
-		Failure: tracex.NewFailure(err),
+		Network:  network,
+		Address:  address,
+		ALPN:     alpn,
+		Protocol: netxlite.HTTPResponseProtocol(resp),
+		Failure:  tracex.NewFailure(err),
 		Request: model.ArchivalHTTPRequest{
 			Body:            model.ArchivalMaybeBinaryData{},
 			BodyIsTruncated: false,
@@ -203,3 +209,139 @@ func newHTTPHeaderMap(header http.Header) (out map[string]model.ArchivalMaybeBin
 	}
 	return
 }
+
+// DefaultHTTPMaxBodySnapshotSize is the default maximum body snapshot size
+// used by the HTTP transports returned by Trace.WrapHTTPTransport.
+const DefaultHTTPMaxBodySnapshotSize = 1 << 17
+
+// WrapHTTPTransport returns a trace-aware HTTP transport wrapping the given
+// transport. Each round trip emits the http_transaction_start and http_transaction_done
+// network events and an HTTP request observation, which you can read using
+// the HTTPRequests method. A zero or negative maxBodySnapshotSize means that
+// we use DefaultHTTPMaxBodySnapshotSize.
+//
+// Because the transport may use several conns, the observations do not contain
+// the network, the address, and the ALPN. Use WrapHTTPTransportWithEndpoint
+// when the transport is bound to a single conn and you know these values.
+//
+// Like the other events, we drop these events and observations when the buffers
+// are full. Because reading a large body emits many read events, consider using
+// TraceOptionAggregateReadWrite or larger buffers in such a case.
+func (tx *Trace) WrapHTTPTransport(txp model.HTTPTransport, maxBodySnapshotSize int64) model.HTTPTransport {
+	return tx.WrapHTTPTransportWithEndpoint(txp, "", "", "", maxBodySnapshotSize)
+}
+
+// WrapHTTPTransportWithEndpoint is like WrapHTTPTransport but the observations
+// contain the given network, address, and ALPN (which may be empty).
+func (tx *Trace) WrapHTTPTransportWithEndpoint(txp model.HTTPTransport,
+	network, address, alpn string, maxBodySnapshotSize int64) model.HTTPTransport {
+	if maxBodySnapshotSize <= 0 {
+		maxBodySnapshotSize = DefaultHTTPMaxBodySnapshotSize
+	}
+	return &httpTransportTrace{
+		address:         address,
+		alpn:            alpn,
+		maxBodySnapshot: maxBodySnapshotSize,
+		network:         network,
+		tx:              tx,
+		txp:             txp,
+	}
+}
+
+// httpTransportTrace is a trace-aware HTTP transport.
+type httpTransportTrace struct {
+	address         string
+	alpn            string
+	maxBodySnapshot int64
+	network         string
+	tx              *Trace
+	txp             model.HTTPTransport
+}
+
+var _ model.HTTPTransport = &httpTransportTrace{}
+
+// RoundTrip implements model.HTTPTransport.RoundTrip. We read the body snapshot
+// before returning and the caller can read the whole body again.
+func (txp *httpTransportTrace) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := txp.tx.TimeSince(txp.tx.ZeroTime)
+	txp.tx.emitNetworkEvent(NewAnnotationArchivalNetworkEvent(txp.tx.Index, started, "http_transaction_start"))
+
+	resp, err := txp.txp.RoundTrip(req)
+	var body []byte
+	if err == nil {
+		reader := io.LimitReader(resp.Body, txp.maxBodySnapshot)
+		body, err = netxlite.ReadAllContext(req.Context(), reader)
+		if err != nil {
+			resp.Body.Close()
+		}
+	}
+
+	finished := txp.tx.TimeSince(txp.tx.ZeroTime)
+	txp.tx.emitNetworkEvent(NewAnnotationArchivalNetworkEvent(txp.tx.Index, finished, "http_transaction_done"))
+
+	select {
+	case txp.tx.httpRequest <- NewArchivalHTTPRequestResult(
+		txp.tx.Index,
+		started,
+		txp.network,
+		txp.address,
+		txp.alpn,
+		txp.txp.Network(),
+		req,
+		resp,
+		txp.maxBodySnapshot,
+		body,
+		err,
+		finished,
+	):
+	default: // buffer is full
+		txp.tx.onDroppedEvent()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &httpReadableAgainBody{ // allow for reading again the whole body
+		Reader: io.MultiReader(bytes.NewReader(body), resp.Body),
+		Closer: resp.Body,
+	}
+	return resp, nil
+}
+
+// CloseIdleConnections implements model.HTTPTransport.CloseIdleConnections.
+func (txp *httpTransportTrace) CloseIdleConnections() {
+	txp.txp.CloseIdleConnections()
+}
+
+// Network implements model.HTTPTransport.Network.
+func (txp *httpTransportTrace) Network() string {
+	return txp.txp.Network()
+}
+
+// httpReadableAgainBody is the body returned by httpTransportTrace.
+type httpReadableAgainBody struct {
+	io.Reader
+	io.Closer
+}
+
+// HTTPRequests drains the HTTP request observations buffered inside the httpRequest channel.
+func (tx *Trace) HTTPRequests() (out []*model.ArchivalHTTPRequestResult) {
+	for {
+		select {
+		case ev := <-tx.httpRequest:
+			out = append(out, ev)
+		default:
+			return // done
+		}
+	}
+}
+
+// FirstHTTPRequestOrNil drains the HTTP request observations buffered inside the
+// httpRequest channel and returns the first one, if any. Otherwise, it returns nil.
+func (tx *Trace) FirstHTTPRequestOrNil() *model.ArchivalHTTPRequestResult {
+	ev := tx.HTTPRequests()
+	if len(ev) < 1 {
+		return nil
+	}
+	return ev[0]
+}
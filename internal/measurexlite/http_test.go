@@ -1,13 +1,19 @@
 package measurexlite
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/model/mocks"
 	"github.com/bassosimone/oonidsl/internal/netxlite"
 	"github.com/bassosimone/oonidsl/internal/netxlite/filtering"
 )
@@ -363,3 +369,192 @@ func TestNewArchivalHTTPRequestResult(t *testing.T) {
 		})
 	}
 }
+
+func TestWrapHTTPTransport(t *testing.T) {
+	newRequest := func(t *testing.T) *http.Request {
+		req, err := http.NewRequest("GET", "https://dns.google/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	newTransport := func(resp *http.Response, err error) *mocks.HTTPTransport {
+		return &mocks.HTTPTransport{
+			MockNetwork: func() string {
+				return "tcp"
+			},
+			MockRoundTrip: func(req *http.Request) (*http.Response, error) {
+				return resp, err
+			},
+		}
+	}
+
+	t.Run("on success", func(t *testing.T) {
+		zeroTime := time.Now()
+		trace := NewTrace(0, zeroTime)
+		body := strings.Repeat("abc", 10)
+		resp := &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}
+		txp := trace.WrapHTTPTransportWithEndpoint(
+			newTransport(resp, nil), "tcp", "8.8.8.8:443", "h2", 4)
+		got, err := txp.RoundTrip(newRequest(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := netxlite.ReadAllContext(context.Background(), got.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Fatal("cannot read again the whole body")
+		}
+
+		t.Run("for HTTPRequests", func(t *testing.T) {
+			requests := trace.HTTPRequests()
+			if len(requests) != 1 {
+				t.Fatal("expected to see a single request")
+			}
+			request := requests[0]
+			if request.Network != "tcp" || request.Address != "8.8.8.8:443" || request.ALPN != "h2" {
+				t.Fatal("unexpected endpoint", request.Network, request.Address, request.ALPN)
+			}
+			if request.Failure != nil {
+				t.Fatal("unexpected failure", *request.Failure)
+			}
+			if request.Request.URL != "https://dns.google/" || request.Request.Transport != "tcp" {
+				t.Fatal("unexpected request", request.Request)
+			}
+			if request.Response.Code != 200 {
+				t.Fatal("unexpected status code", request.Response.Code)
+			}
+			if request.Response.Body.Value != "abca" || !request.Response.BodyIsTruncated {
+				t.Fatal("unexpected body snapshot", request.Response.Body.Value)
+			}
+		})
+
+		t.Run("for NetworkEvents", func(t *testing.T) {
+			events := trace.NetworkEvents()
+			if len(events) != 2 {
+				t.Fatal("expected to see two events")
+			}
+			if events[0].Operation != "http_transaction_start" {
+				t.Fatal("unexpected first operation", events[0].Operation)
+			}
+			if events[1].Operation != "http_transaction_done" {
+				t.Fatal("unexpected second operation", events[1].Operation)
+			}
+		})
+	})
+
+	t.Run("on round trip failure", func(t *testing.T) {
+		zeroTime := time.Now()
+		trace := NewTrace(0, zeroTime)
+		expected := netxlite.NewTopLevelGenericErrWrapper(netxlite.ECONNRESET)
+		txp := trace.WrapHTTPTransport(newTransport(nil, expected), 0)
+		resp, err := txp.RoundTrip(newRequest(t))
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if resp != nil {
+			t.Fatal("expected nil response")
+		}
+		request := trace.FirstHTTPRequestOrNil()
+		if request == nil {
+			t.Fatal("expected to see a request")
+		}
+		if request.Failure == nil || *request.Failure != netxlite.FailureConnectionReset {
+			t.Fatal("unexpected failure", request.Failure)
+		}
+	})
+
+	t.Run("on body read failure", func(t *testing.T) {
+		zeroTime := time.Now()
+		trace := NewTrace(0, zeroTime)
+		expected := errors.New("mocked error")
+		var closed bool
+		resp := &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body: &httpReadableAgainBody{
+				Reader: iotest.ErrReader(expected),
+				Closer: &mocks.Conn{
+					MockClose: func() error {
+						closed = true
+						return nil
+					},
+				},
+			},
+		}
+		txp := trace.WrapHTTPTransport(newTransport(resp, nil), 0)
+		got, err := txp.RoundTrip(newRequest(t))
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if got != nil {
+			t.Fatal("expected nil response")
+		}
+		if !closed {
+			t.Fatal("did not close the body")
+		}
+		request := trace.FirstHTTPRequestOrNil()
+		if request == nil || request.Failure == nil {
+			t.Fatal("expected to see a failed request")
+		}
+	})
+
+	t.Run("discards events when buffer is full", func(t *testing.T) {
+		zeroTime := time.Now()
+		trace := NewTrace(0, zeroTime)
+		trace.httpRequest = make(chan *model.ArchivalHTTPRequestResult) // no buffer
+		trace.networkEvent = make(chan *model.ArchivalNetworkEvent)     // ditto
+		expected := netxlite.NewTopLevelGenericErrWrapper(netxlite.ECONNRESET)
+		txp := trace.WrapHTTPTransport(newTransport(nil, expected), 0)
+		if _, err := txp.RoundTrip(newRequest(t)); !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if requests := trace.HTTPRequests(); len(requests) != 0 {
+			t.Fatal("expected to see no HTTPRequests")
+		}
+		if events := trace.NetworkEvents(); len(events) != 0 {
+			t.Fatal("expected to see no NetworkEvents")
+		}
+	})
+
+	t.Run("DNS-over-HTTPS resolvers save into the trace", func(t *testing.T) {
+		srvr := filtering.NewHTTPServerCleartext(filtering.HTTPActionDoH)
+		defer srvr.Close()
+		zeroTime := time.Now()
+		trace := NewTrace(0, zeroTime)
+		resolver := trace.NewParallelDNSOverHTTPSResolver(model.DiscardLogger, srvr.URL().String())
+		// note: this DoH server does not set the content-type, so the lookup fails
+		// but we nonetheless expect to see the HTTP requests inside the trace
+		_, err := resolver.LookupHost(context.Background(), "dns.google")
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		requests := trace.HTTPRequests()
+		if len(requests) != 2 { // A and AAAA
+			t.Fatal("expected to see two requests", len(requests))
+		}
+		for _, request := range requests {
+			if request.Request.Method != "POST" || request.Response.Code != 200 {
+				t.Fatal("unexpected request", request.Request.Method, request.Response.Code)
+			}
+		}
+	})
+}
+
+func TestFirstHTTPRequest(t *testing.T) {
+	t.Run("returns nil when buffer is empty", func(t *testing.T) {
+		zeroTime := time.Now()
+		trace := NewTrace(0, zeroTime)
+		got := trace.FirstHTTPRequestOrNil()
+		if got != nil {
+			t.Fatal("expected nil event")
+		}
+	})
+}
@@ -7,26 +7,32 @@ package measurexlite
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bassosimone/oonidsl/internal/model"
 	"github.com/bassosimone/oonidsl/internal/netxlite"
 	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
 )
 
 // NewQUICDialerWithoutResolver is equivalent to netxlite.NewQUICDialerWithoutResolver
 // except that it returns a model.QUICDialer that uses this trace.
 func (tx *Trace) NewQUICDialerWithoutResolver(listener model.QUICListener, dl model.DebugLogger) model.QUICDialer {
 	return &quicDialerTrace{
-		qd: tx.newQUICDialerWithoutResolver(listener, dl),
-		tx: tx,
+		initialPacketSize: netxlite.QUICListenerInitialPacketSize(listener),
+		qd:                tx.newQUICDialerWithoutResolver(listener, dl),
+		tx:                tx,
 	}
 }
 
 // quicDialerTrace is a trace-aware QUIC dialer.
 type quicDialerTrace struct {
-	qd model.QUICDialer
-	tx *Trace
+	initialPacketSize int
+	qd                model.QUICDialer
+	tx                *Trace
 }
 
 var _ model.QUICDialer = &quicDialerTrace{}
@@ -35,7 +41,31 @@ var _ model.QUICDialer = &quicDialerTrace{}
 func (qdx *quicDialerTrace) DialContext(ctx context.Context,
 	address string, tlsConfig *tls.Config, quicConfig *quic.Config) (
 	quic.EarlyConnection, error) {
-	return qdx.qd.DialContext(netxlite.ContextWithTrace(ctx, qdx.tx), address, tlsConfig, quicConfig)
+	if qdx.tx.quicEvents {
+		quicConfig = qdx.tx.wrapQUICConfig(address, quicConfig)
+	}
+	if qdx.initialPacketSize <= 0 {
+		return qdx.qd.DialContext(netxlite.ContextWithTrace(ctx, qdx.tx), address, tlsConfig, quicConfig)
+	}
+	trace := &quicInitialPacketSizeTrace{
+		Trace: qdx.tx,
+		size:  qdx.initialPacketSize,
+	}
+	return qdx.qd.DialContext(netxlite.ContextWithTrace(ctx, trace), address, tlsConfig, quicConfig)
+}
+
+// quicInitialPacketSizeTrace is the model.Trace we use when the QUIC listener pads the
+// datagrams containing Initial packets. It behaves like the embedded trace except that
+// the handshake observation also contains the size of such datagrams.
+type quicInitialPacketSizeTrace struct {
+	*Trace
+	size int
+}
+
+// OnQUICHandshakeDone implements model.Trace.OnQUICHandshakeDone.
+func (t *quicInitialPacketSizeTrace) OnQUICHandshakeDone(started time.Time, remoteAddr string,
+	qconn quic.EarlyConnection, config *tls.Config, quicConfig *quic.Config, err error, finished time.Time) {
+	t.Trace.onQUICHandshakeDone(started, remoteAddr, qconn, config, quicConfig, err, finished, t.size)
 }
 
 // CloseIdleConnections implements model.QUICDialer.CloseIdleConnections.
@@ -46,22 +76,27 @@ func (qdx *quicDialerTrace) CloseIdleConnections() {
 // OnQUICHandshakeStart implements model.Trace.OnQUICHandshakeStart
 func (tx *Trace) OnQUICHandshakeStart(now time.Time, remoteAddr string, config *quic.Config) {
 	t := now.Sub(tx.ZeroTime)
-	select {
-	case tx.networkEvent <- NewAnnotationArchivalNetworkEvent(tx.Index, t, "quic_handshake_start"):
-	default:
-	}
+	tx.emitNetworkEvent(NewAnnotationArchivalNetworkEvent(tx.Index, t, "quic_handshake_start"))
 }
 
 // OnQUICHandshakeDone implements model.Trace.OnQUICHandshakeDone
 func (tx *Trace) OnQUICHandshakeDone(started time.Time, remoteAddr string, qconn quic.EarlyConnection,
-	config *tls.Config, err error, finished time.Time) {
+	config *tls.Config, quicConfig *quic.Config, err error, finished time.Time) {
+	tx.onQUICHandshakeDone(started, remoteAddr, qconn, config, quicConfig, err, finished, 0)
+}
+
+// onQUICHandshakeDone is like OnQUICHandshakeDone but also includes into the handshake
+// observation the size of the datagrams containing Initial packets, unless it's zero.
+func (tx *Trace) onQUICHandshakeDone(started time.Time, remoteAddr string, qconn quic.EarlyConnection,
+	config *tls.Config, quicConfig *quic.Config, err error, finished time.Time, initialPacketSize int) {
 	t := finished.Sub(tx.ZeroTime)
 	state := tls.ConnectionState{}
+	var version quic.VersionNumber
 	if qconn != nil {
 		state = qconn.ConnectionState().TLS.ConnectionState
+		version = qconn.ConnectionState().Version
 	}
-	select {
-	case tx.quicHandshake <- NewArchivalTLSOrQUICHandshakeResult(
+	ev := NewArchivalTLSOrQUICHandshakeResult(
 		tx.Index,
 		started.Sub(tx.ZeroTime),
 		"udp",
@@ -70,13 +105,22 @@ func (tx *Trace) OnQUICHandshakeDone(started time.Time, remoteAddr string, qconn
 		state,
 		err,
 		t,
-	):
-	default: // buffer is full
+	)
+	ev.FailureDetails = tx.newFailureDetails(err)
+	if version != 0 {
+		ev.QUICVersion = netxlite.QUICVersionString(version)
 	}
+	if quicConfig != nil {
+		ev.QUICConnectionIDLength = quicConfig.ConnectionIDLength
+		ev.QUICVersions = netxlite.QUICVersionStrings(quicConfig.Versions)
+	}
+	ev.QUICInitialPacketSize = initialPacketSize
 	select {
-	case tx.networkEvent <- NewAnnotationArchivalNetworkEvent(tx.Index, t, "quic_handshake_done"):
+	case tx.quicHandshake <- ev:
 	default: // buffer is full
+		tx.onDroppedEvent()
 	}
+	tx.emitNetworkEvent(NewAnnotationArchivalNetworkEvent(tx.Index, t, "quic_handshake_done"))
 }
 
 // QUICHandshakes drains the network events buffered inside the QUICHandshake channel.
@@ -101,6 +145,28 @@ func (tx *Trace) FirstQUICHandshakeOrNil() *model.ArchivalTLSOrQUICHandshakeResu
 	return ev[0]
 }
 
+// QUICEvents drains the network events buffered inside the QUICEvent channel.
+func (tx *Trace) QUICEvents() (out []*model.ArchivalNetworkEvent) {
+	for {
+		select {
+		case ev := <-tx.quicEvent:
+			out = append(out, ev)
+		default:
+			return // done
+		}
+	}
+}
+
+// FirstQUICEventOrNil drains the network events buffered inside the QUICEvent channel
+// and returns the first QUICEvent, if any. Otherwise, it returns nil.
+func (tx *Trace) FirstQUICEventOrNil() *model.ArchivalNetworkEvent {
+	ev := tx.QUICEvents()
+	if len(ev) < 1 {
+		return nil
+	}
+	return ev[0]
+}
+
 // MaybeCloseQUICConn is a convenience function for closing a quic.EarlyConnection only when such a conn
 // isn't nil.
 func MaybeCloseQUICConn(conn quic.EarlyConnection) (err error) {
@@ -109,3 +175,204 @@ func MaybeCloseQUICConn(conn quic.EarlyConnection) (err error) {
 	}
 	return
 }
+
+// wrapQUICConfig returns a copy of the given config that also
+// uses a quicTracer emitting events for the given address.
+func (tx *Trace) wrapQUICConfig(address string, config *quic.Config) *quic.Config {
+	if config == nil {
+		config = &quic.Config{}
+	}
+	config = config.Clone()
+	tracer := logging.Tracer(&quicTracer{address: address, tx: tx})
+	if config.Tracer != nil {
+		tracer = logging.NewMultiplexedTracer(config.Tracer, tracer)
+	}
+	config.Tracer = tracer
+	return config
+}
+
+// quicTracer is a logging.Tracer translating the events of the
+// conns using it into network events, in the spirit of qlog.
+type quicTracer struct {
+	logging.NullTracer
+	address string
+	tx      *Trace
+}
+
+var _ logging.Tracer = &quicTracer{}
+
+// TracerForConnection implements logging.Tracer.TracerForConnection.
+func (qt *quicTracer) TracerForConnection(
+	ctx context.Context, p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	return &quicConnectionTracer{address: qt.address, tx: qt.tx}
+}
+
+// quicConnectionTracer is the logging.ConnectionTracer used by quicTracer.
+type quicConnectionTracer struct {
+	logging.NullConnectionTracer
+	address string
+	tx      *Trace
+
+	// mu protects handshakeComplete.
+	mu sync.Mutex
+
+	// handshakeComplete indicates that we have the 1-RTT keys.
+	handshakeComplete bool
+}
+
+var _ logging.ConnectionTracer = &quicConnectionTracer{}
+
+// emit emits a network event with the given operation, size, error, and tags.
+func (qct *quicConnectionTracer) emit(operation string, size logging.ByteCount, err error, tags ...string) {
+	t := qct.tx.TimeSince(qct.tx.ZeroTime)
+	ev := qct.tx.newArchivalNetworkEvent(t, operation, "quic", qct.address, int(size), err, t)
+	ev.Tags = append(ev.Tags, tags...)
+	select {
+	case qct.tx.quicEvent <- ev:
+	default: // buffer is full
+		qct.tx.onDroppedEvent()
+	}
+}
+
+// SentPacket implements logging.ConnectionTracer.SentPacket.
+func (qct *quicConnectionTracer) SentPacket(
+	hdr *logging.ExtendedHeader, size logging.ByteCount, ack *logging.AckFrame, frames []logging.Frame) {
+	qct.emit("quic_packet_sent", size, nil,
+		quicTagPacketType(logging.PacketTypeFromHeader(&hdr.Header)),
+		quicTagPacketNumber(hdr.PacketNumber),
+	)
+}
+
+// ReceivedVersionNegotiationPacket implements logging.ConnectionTracer.ReceivedVersionNegotiationPacket.
+func (qct *quicConnectionTracer) ReceivedVersionNegotiationPacket(
+	dest, src logging.ArbitraryLenConnectionID, versions []logging.VersionNumber) {
+	qct.emit("quic_packet_received", 0, nil,
+		quicTagPacketType(logging.PacketTypeVersionNegotiation),
+		"versions="+strings.Join(netxlite.QUICVersionStrings(versions), ","),
+	)
+}
+
+// ReceivedRetry implements logging.ConnectionTracer.ReceivedRetry.
+func (qct *quicConnectionTracer) ReceivedRetry(hdr *logging.Header) {
+	qct.emit("quic_packet_received", 0, nil, quicTagPacketType(logging.PacketTypeRetry))
+}
+
+// ReceivedLongHeaderPacket implements logging.ConnectionTracer.ReceivedLongHeaderPacket.
+func (qct *quicConnectionTracer) ReceivedLongHeaderPacket(
+	hdr *logging.ExtendedHeader, size logging.ByteCount, frames []logging.Frame) {
+	qct.emit("quic_packet_received", size, nil,
+		quicTagPacketType(logging.PacketTypeFromHeader(&hdr.Header)),
+		quicTagPacketNumber(hdr.PacketNumber),
+	)
+}
+
+// ReceivedShortHeaderPacket implements logging.ConnectionTracer.ReceivedShortHeaderPacket.
+func (qct *quicConnectionTracer) ReceivedShortHeaderPacket(
+	hdr *logging.ShortHeader, size logging.ByteCount, frames []logging.Frame) {
+	qct.emit("quic_packet_received", size, nil,
+		quicTagPacketType(logging.PacketType1RTT),
+		quicTagPacketNumber(hdr.PacketNumber),
+	)
+}
+
+// DroppedPacket implements logging.ConnectionTracer.DroppedPacket.
+func (qct *quicConnectionTracer) DroppedPacket(
+	ptype logging.PacketType, size logging.ByteCount, reason logging.PacketDropReason) {
+	qct.emit("quic_packet_dropped", size, nil,
+		quicTagPacketType(ptype),
+		fmt.Sprintf("reason=%d", reason),
+	)
+}
+
+// LostPacket implements logging.ConnectionTracer.LostPacket.
+func (qct *quicConnectionTracer) LostPacket(
+	level logging.EncryptionLevel, pn logging.PacketNumber, reason logging.PacketLossReason) {
+	qct.emit("quic_packet_lost", 0, nil,
+		quicTagEncryptionLevel(level),
+		quicTagPacketNumber(pn),
+		fmt.Sprintf("reason=%d", reason),
+	)
+}
+
+// UpdatedPTOCount implements logging.ConnectionTracer.UpdatedPTOCount.
+func (qct *quicConnectionTracer) UpdatedPTOCount(value uint32) {
+	qct.emit("quic_pto_count_updated", 0, nil, fmt.Sprintf("pto_count=%d", value))
+}
+
+// UpdatedKeyFromTLS implements logging.ConnectionTracer.UpdatedKeyFromTLS.
+func (qct *quicConnectionTracer) UpdatedKeyFromTLS(level logging.EncryptionLevel, p logging.Perspective) {
+	if level == logging.Encryption1RTT {
+		qct.mu.Lock()
+		qct.handshakeComplete = true
+		qct.mu.Unlock()
+	}
+	qct.emit("quic_key_updated", 0, nil, quicTagEncryptionLevel(level), "perspective="+p.String())
+}
+
+// DroppedEncryptionLevel implements logging.ConnectionTracer.DroppedEncryptionLevel.
+func (qct *quicConnectionTracer) DroppedEncryptionLevel(level logging.EncryptionLevel) {
+	qct.emit("quic_encryption_level_dropped", 0, nil, quicTagEncryptionLevel(level))
+}
+
+// ClosedConnection implements logging.ConnectionTracer.ClosedConnection. We classify
+// the error as a QUIC handshake error unless the handshake was already complete.
+func (qct *quicConnectionTracer) ClosedConnection(err error) {
+	if err != nil {
+		qct.mu.Lock()
+		handshakeComplete := qct.handshakeComplete
+		qct.mu.Unlock()
+		if handshakeComplete {
+			err = netxlite.NewErrWrapper(netxlite.ClassifyGenericError, netxlite.CloseOperation, err)
+		} else {
+			err = netxlite.NewErrWrapper(netxlite.ClassifyQUICHandshakeError, netxlite.QUICHandshakeOperation, err)
+		}
+	}
+	qct.emit("quic_connection_closed", 0, err)
+}
+
+// quicTagPacketType returns the tag describing the packet type using qlog names.
+func quicTagPacketType(ptype logging.PacketType) string {
+	var name string
+	switch ptype {
+	case logging.PacketTypeInitial:
+		name = "initial"
+	case logging.PacketTypeHandshake:
+		name = "handshake"
+	case logging.PacketTypeRetry:
+		name = "retry"
+	case logging.PacketType0RTT:
+		name = "0RTT"
+	case logging.PacketTypeVersionNegotiation:
+		name = "version_negotiation"
+	case logging.PacketType1RTT:
+		name = "1RTT"
+	case logging.PacketTypeStatelessReset:
+		name = "stateless_reset"
+	default:
+		name = "unknown"
+	}
+	return "packet_type=" + name
+}
+
+// quicTagPacketNumber returns the tag describing the packet number.
+func quicTagPacketNumber(pn logging.PacketNumber) string {
+	return fmt.Sprintf("packet_number=%d", pn)
+}
+
+// quicTagEncryptionLevel returns the tag describing the encryption level using qlog names.
+func quicTagEncryptionLevel(level logging.EncryptionLevel) string {
+	var name string
+	switch level {
+	case logging.EncryptionInitial:
+		name = "initial"
+	case logging.EncryptionHandshake:
+		name = "handshake"
+	case logging.Encryption0RTT:
+		name = "0RTT"
+	case logging.Encryption1RTT:
+		name = "1RTT"
+	default:
+		name = "unknown"
+	}
+	return "encryption_level=" + name
+}
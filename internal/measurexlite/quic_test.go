@@ -5,15 +5,18 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
 	"github.com/bassosimone/oonidsl/internal/model"
 	"github.com/bassosimone/oonidsl/internal/model/mocks"
 	"github.com/bassosimone/oonidsl/internal/netxlite"
+	"github.com/bassosimone/oonidsl/internal/netxlite/filtering"
 	"github.com/bassosimone/oonidsl/internal/testingx"
 )
 
@@ -121,8 +124,12 @@ func TestNewQUICDialerWithoutResolver(t *testing.T) {
 			InsecureSkipVerify: true,
 			ServerName:         "dns.cloudflare.com",
 		}
+		quicConfig := &quic.Config{
+			Versions:           []quic.VersionNumber{quic.Version2, quic.Version1},
+			ConnectionIDLength: 8,
+		}
 		ctx := context.Background()
-		qconn, err := dialer.DialContext(ctx, "1.1.1.1:443", tlsConfig, &quic.Config{})
+		qconn, err := dialer.DialContext(ctx, "1.1.1.1:443", tlsConfig, quicConfig)
 		if !errors.Is(err, mockedErr) {
 			t.Fatal("unexpected err", err)
 		}
@@ -137,17 +144,19 @@ func TestNewQUICDialerWithoutResolver(t *testing.T) {
 			}
 			expectedFailure := "unknown_failure: mocked"
 			expect := &model.ArchivalTLSOrQUICHandshakeResult{
-				Network:            "udp",
-				Address:            "1.1.1.1:443",
-				CipherSuite:        "",
-				Failure:            &expectedFailure,
-				NegotiatedProtocol: "",
-				NoTLSVerify:        true,
-				PeerCertificates:   []model.ArchivalMaybeBinaryData{},
-				ServerName:         "dns.cloudflare.com",
-				T:                  time.Second.Seconds(),
-				Tags:               []string{},
-				TLSVersion:         "",
+				Network:                "udp",
+				Address:                "1.1.1.1:443",
+				CipherSuite:            "",
+				Failure:                &expectedFailure,
+				NegotiatedProtocol:     "",
+				NoTLSVerify:            true,
+				PeerCertificates:       []model.ArchivalMaybeBinaryData{},
+				ServerName:             "dns.cloudflare.com",
+				QUICConnectionIDLength: 8,
+				QUICVersions:           []string{"v2", "v1"},
+				T:                      time.Second.Seconds(),
+				Tags:                   []string{},
+				TLSVersion:             "",
 			}
 			got := events[0]
 			if diff := cmp.Diff(expect, got); diff != "" {
@@ -197,6 +206,42 @@ func TestNewQUICDialerWithoutResolver(t *testing.T) {
 
 	})
 
+	t.Run("DialContext saves the initial packet size configured by the listener", func(t *testing.T) {
+		mockedErr := errors.New("mocked")
+		trace := NewTrace(0, time.Now())
+		pconn := &mocks.UDPLikeConn{
+			MockLocalAddr: func() net.Addr {
+				return &net.UDPAddr{}
+			},
+			MockSyscallConn: func() (syscall.RawConn, error) {
+				return nil, mockedErr
+			},
+			MockClose: func() error {
+				return nil
+			},
+		}
+		listener := netxlite.NewQUICListenerWithInitialPacketSize(&mocks.QUICListener{
+			MockListen: func(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+				return pconn, nil
+			},
+		}, 1350)
+		dialer := trace.NewQUICDialerWithoutResolver(listener, model.DiscardLogger)
+		tlsConfig := &tls.Config{
+			ServerName: "dns.cloudflare.com",
+		}
+		qconn, err := dialer.DialContext(context.Background(), "1.1.1.1:443", tlsConfig, &quic.Config{})
+		if !errors.Is(err, mockedErr) {
+			t.Fatal("unexpected err", err)
+		}
+		if qconn != nil {
+			t.Fatal("expected nil qconn")
+		}
+		ev := trace.FirstQUICHandshakeOrNil()
+		if ev == nil || ev.QUICInitialPacketSize != 1350 {
+			t.Fatal("unexpected QUIC handshake", ev)
+		}
+	})
+
 	t.Run("DialContext discards events when buffer is full", func(t *testing.T) {
 		mockedErr := errors.New("mocked")
 		zeroTime := time.Now()
@@ -256,6 +301,164 @@ func TestNewQUICDialerWithoutResolver(t *testing.T) {
 	})
 }
 
+func TestQUICEvents(t *testing.T) {
+	// countEvents counts the network events with the given operation and tag.
+	countEvents := func(events []*model.ArchivalNetworkEvent, operation, tag string) (count int) {
+		for _, ev := range events {
+			if ev.Operation != operation {
+				continue
+			}
+			for _, value := range ev.Tags {
+				if value == tag {
+					count++
+					break
+				}
+			}
+		}
+		return
+	}
+
+	dial := func(trace *Trace, server *filtering.QUICServer) (quic.EarlyConnection, error) {
+		listener := netxlite.NewQUICListener()
+		dialer := trace.NewQUICDialerWithoutResolver(listener, model.DiscardLogger)
+		tlsConfig := server.TLSConfig()
+		tlsConfig.ServerName = "dns.google"
+		quicConfig := &quic.Config{
+			HandshakeIdleTimeout: time.Second,
+		}
+		return dialer.DialContext(context.Background(), server.Endpoint(), tlsConfig, quicConfig)
+	}
+
+	t.Run("wrapQUICConfig does not modify the original config", func(t *testing.T) {
+		trace := NewTrace(0, time.Now())
+		if config := trace.wrapQUICConfig("1.1.1.1:443", nil); config.Tracer == nil {
+			t.Fatal("expected a tracer")
+		}
+		original := &quic.Config{
+			Tracer: &logging.NullTracer{},
+		}
+		config := trace.wrapQUICConfig("1.1.1.1:443", original)
+		if config == original {
+			t.Fatal("expected a copy of the config")
+		}
+		if _, good := original.Tracer.(*logging.NullTracer); !good {
+			t.Fatal("modified the original tracer")
+		}
+		if _, good := config.Tracer.(*quicTracer); good {
+			t.Fatal("expected a multiplexed tracer")
+		}
+	})
+
+	t.Run("without TraceOptionQUICEvents", func(t *testing.T) {
+		server := filtering.NewQUICServer(filtering.QUICActionPass)
+		defer server.Close()
+		trace := NewTrace(0, time.Now())
+		qconn, err := dial(trace, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		MaybeCloseQUICConn(qconn)
+		if count := countEvents(trace.NetworkEvents(), "quic_packet_sent", "packet_type=initial"); count != 0 {
+			t.Fatal("expected to see no QUIC events", count)
+		}
+		if events := trace.QUICEvents(); len(events) != 0 {
+			t.Fatal("expected to see no QUIC events", len(events))
+		}
+	})
+
+	t.Run("ClosedConnection classifies errors depending on the handshake state", func(t *testing.T) {
+		closedConnection := func(handshakeComplete bool) *model.ArchivalNetworkEvent {
+			trace := NewTrace(0, time.Now(), TraceOptionQUICEvents())
+			tracer := &quicConnectionTracer{address: "1.1.1.1:443", tx: trace}
+			if handshakeComplete {
+				tracer.UpdatedKeyFromTLS(logging.Encryption1RTT, logging.PerspectiveClient)
+			}
+			tracer.ClosedConnection(&quic.VersionNegotiationError{})
+			events := trace.QUICEvents()
+			return events[len(events)-1]
+		}
+
+		t.Run("before the handshake is complete", func(t *testing.T) {
+			ev := closedConnection(false)
+			if ev.Operation != "quic_connection_closed" {
+				t.Fatal("unexpected operation", ev.Operation)
+			}
+			if ev.Failure == nil || *ev.Failure != netxlite.FailureQUICIncompatibleVersion {
+				t.Fatal("unexpected failure", ev.Failure)
+			}
+		})
+
+		t.Run("after the handshake is complete", func(t *testing.T) {
+			ev := closedConnection(true)
+			if ev.Failure == nil || !strings.HasPrefix(*ev.Failure, "unknown_failure: ") {
+				t.Fatal("unexpected failure", ev.Failure)
+			}
+		})
+	})
+
+	t.Run("TraceOptionQUICEventBufferSize bounds the QUIC events", func(t *testing.T) {
+		trace := NewTrace(0, time.Now(), TraceOptionQUICEvents(), TraceOptionQUICEventBufferSize(1))
+		tracer := &quicConnectionTracer{address: "1.1.1.1:443", tx: trace}
+		tracer.ClosedConnection(nil)
+		tracer.ClosedConnection(nil)
+		if events := trace.QUICEvents(); len(events) != 1 {
+			t.Fatal("unexpected number of events", len(events))
+		}
+		if ev := trace.FirstQUICEventOrNil(); ev != nil {
+			t.Fatal("expected nil event")
+		}
+	})
+
+	t.Run("with a successful handshake", func(t *testing.T) {
+		server := filtering.NewQUICServer(filtering.QUICActionPass)
+		defer server.Close()
+		trace := NewTrace(0, time.Now(), TraceOptionQUICEvents())
+		qconn, err := dial(trace, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		MaybeCloseQUICConn(qconn)
+		if count := countEvents(trace.NetworkEvents(), "quic_packet_sent", "packet_type=initial"); count != 0 {
+			t.Fatal("expected to see no QUIC events among the network events", count)
+		}
+		events := trace.QUICEvents()
+		if countEvents(events, "quic_packet_sent", "packet_type=initial") < 1 {
+			t.Fatal("expected to see sent initial packets")
+		}
+		if countEvents(events, "quic_packet_received", "packet_type=initial") < 1 {
+			t.Fatal("expected to see received initial packets")
+		}
+		if countEvents(events, "quic_packet_received", "packet_type=handshake") < 1 {
+			t.Fatal("expected to see received handshake packets")
+		}
+		if countEvents(events, "quic_key_updated", "encryption_level=1RTT") < 1 {
+			t.Fatal("expected to see the 1-RTT keys")
+		}
+	})
+
+	t.Run("when the initial is never answered", func(t *testing.T) {
+		server := filtering.NewQUICServer(filtering.QUICActionDrop)
+		defer server.Close()
+		trace := NewTrace(0, time.Now(), TraceOptionQUICEvents())
+		qconn, err := dial(trace, server)
+		if err == nil || err.Error() != netxlite.FailureGenericTimeoutError {
+			t.Fatal("unexpected err", err)
+		}
+		if qconn != nil {
+			t.Fatal("expected nil qconn")
+		}
+		events := trace.QUICEvents()
+		if countEvents(events, "quic_packet_sent", "packet_type=initial") < 1 {
+			t.Fatal("expected to see sent initial packets")
+		}
+		for _, ev := range events {
+			if ev.Operation == "quic_packet_received" {
+				t.Fatal("expected to see no received packets")
+			}
+		}
+	})
+}
+
 func TestFirstQUICHandshake(t *testing.T) {
 	t.Run("returns nil when buffer is empty", func(t *testing.T) {
 		zeroTime := time.Now()
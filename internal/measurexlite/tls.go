@@ -10,6 +10,7 @@ import (
 	"crypto/x509"
 	"errors"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/bassosimone/oonidsl/internal/model"
@@ -19,17 +20,45 @@ import (
 
 // NewTLSHandshakerStdlib is equivalent to netxlite.NewTLSHandshakerStdlib
 // except that it returns a model.TLSHandshaker that uses this trace.
-func (tx *Trace) NewTLSHandshakerStdlib(dl model.DebugLogger) model.TLSHandshaker {
-	return &tlsHandshakerTrace{
-		thx: tx.newTLSHandshakerStdlib(dl),
-		tx:  tx,
+func (tx *Trace) NewTLSHandshakerStdlib(dl model.DebugLogger, options ...TLSHandshakerOption) model.TLSHandshaker {
+	return newTLSHandshakerTrace(tx, tx.newTLSHandshakerStdlib(dl), options...)
+}
+
+// TLSHandshakerOption is an option you can pass to NewTLSHandshakerStdlib
+// and to NewTLSHandshakerUTLS.
+type TLSHandshakerOption func(thx *tlsHandshakerTrace)
+
+// TLSHandshakerOptionCaptureBytes captures the first size bytes sent and the first
+// size bytes received during each handshake (i.e., the ClientHello and the beginning
+// of the server flight), which we include into the handshake observation, so that
+// we can see what a censor injected. A zero or negative size disables capturing.
+func TLSHandshakerOptionCaptureBytes(size int) TLSHandshakerOption {
+	return func(thx *tlsHandshakerTrace) {
+		thx.captureBytes = size
+	}
+}
+
+// newTLSHandshakerTrace creates a new tlsHandshakerTrace.
+func newTLSHandshakerTrace(
+	tx *Trace, thx model.TLSHandshaker, options ...TLSHandshakerOption) *tlsHandshakerTrace {
+	out := &tlsHandshakerTrace{
+		captureBytes: 0,
+		ech:          false,
+		thx:          thx,
+		tx:           tx,
+	}
+	for _, option := range options {
+		option(out)
 	}
+	return out
 }
 
 // tlsHandshakerTrace is a trace-aware TLS handshaker.
 type tlsHandshakerTrace struct {
-	thx model.TLSHandshaker
-	tx  *Trace
+	captureBytes int
+	ech          bool
+	thx          model.TLSHandshaker
+	tx           *Trace
 }
 
 var _ model.TLSHandshaker = &tlsHandshakerTrace{}
@@ -37,24 +66,107 @@ var _ model.TLSHandshaker = &tlsHandshakerTrace{}
 // Handshake implements model.TLSHandshaker.Handshake.
 func (thx *tlsHandshakerTrace) Handshake(
 	ctx context.Context, conn net.Conn, tlsConfig *tls.Config) (net.Conn, tls.ConnectionState, error) {
-	return thx.thx.Handshake(netxlite.ContextWithTrace(ctx, thx.tx), conn, tlsConfig)
+	if thx.captureBytes <= 0 && !thx.ech {
+		return thx.thx.Handshake(netxlite.ContextWithTrace(ctx, thx.tx), conn, tlsConfig)
+	}
+	trace := &tlsHandshakeTrace{
+		Trace: thx.tx,
+		conn:  nil,
+		ech:   thx.ech,
+	}
+	if thx.captureBytes > 0 {
+		trace.conn = &tlsCaptureConn{
+			Conn: conn,
+			max:  thx.captureBytes,
+		}
+		conn = trace.conn
+	}
+	return thx.thx.Handshake(netxlite.ContextWithTrace(ctx, trace), conn, tlsConfig)
+}
+
+// tlsHandshakeTrace is the model.Trace we use when the handshake observation should
+// contain more information than usual. It behaves like the embedded trace except that
+// the handshake observation also contains the bytes captured by conn, unless conn is
+// nil, and the ECH outcome, if ech is true.
+type tlsHandshakeTrace struct {
+	*Trace
+	conn *tlsCaptureConn
+	ech  bool
+}
+
+// OnTLSHandshakeDone implements model.Trace.OnTLSHandshakeDone.
+func (t *tlsHandshakeTrace) OnTLSHandshakeDone(started time.Time, remoteAddr string, config *tls.Config,
+	state tls.ConnectionState, err error, finished time.Time) {
+	t.Trace.onTLSHandshakeDone(started, remoteAddr, config, state, err, finished, t.conn, t.ech)
+}
+
+// tlsCaptureConn is a net.Conn saving the first bytes sent and received
+// until we take a snapshot of them, when the handshake is done.
+type tlsCaptureConn struct {
+	net.Conn
+	done   bool
+	max    int
+	mu     sync.Mutex
+	rbytes []byte
+	wbytes []byte
+}
+
+// Read implements net.Conn.Read.
+func (c *tlsCaptureConn) Read(b []byte) (int, error) {
+	count, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.rbytes = c.capture(c.rbytes, b[:count])
+	c.mu.Unlock()
+	return count, err
+}
+
+// Write implements net.Conn.Write.
+func (c *tlsCaptureConn) Write(b []byte) (int, error) {
+	count, err := c.Conn.Write(b)
+	c.mu.Lock()
+	c.wbytes = c.capture(c.wbytes, b[:count])
+	c.mu.Unlock()
+	return count, err
+}
+
+// capture appends data to buffer without exceeding the maximum size.
+func (c *tlsCaptureConn) capture(buffer, data []byte) []byte {
+	if c.done {
+		return buffer
+	}
+	if room := c.max - len(buffer); len(data) > room {
+		data = data[:room]
+	}
+	return append(buffer, data...)
+}
+
+// snapshot stops capturing and returns the bytes sent and received.
+func (c *tlsCaptureConn) snapshot() (wbytes, rbytes []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	return c.wbytes, c.rbytes
 }
 
 // OnTLSHandshakeStart implements model.Trace.OnTLSHandshakeStart.
 func (tx *Trace) OnTLSHandshakeStart(now time.Time, remoteAddr string, config *tls.Config) {
 	t := now.Sub(tx.ZeroTime)
-	select {
-	case tx.networkEvent <- NewAnnotationArchivalNetworkEvent(tx.Index, t, "tls_handshake_start"):
-	default: // buffer is full
-	}
+	tx.emitNetworkEvent(NewAnnotationArchivalNetworkEvent(tx.Index, t, "tls_handshake_start"))
 }
 
 // OnTLSHandshakeDone implements model.Trace.OnTLSHandshakeDone.
 func (tx *Trace) OnTLSHandshakeDone(started time.Time, remoteAddr string, config *tls.Config,
 	state tls.ConnectionState, err error, finished time.Time) {
+	tx.onTLSHandshakeDone(started, remoteAddr, config, state, err, finished, nil, false)
+}
+
+// onTLSHandshakeDone is like OnTLSHandshakeDone but also includes into the handshake
+// observation the bytes captured by the given conn, unless the conn is nil, and the
+// outcome of the ECH handshake, if ech is true.
+func (tx *Trace) onTLSHandshakeDone(started time.Time, remoteAddr string, config *tls.Config,
+	state tls.ConnectionState, err error, finished time.Time, capture *tlsCaptureConn, ech bool) {
 	t := finished.Sub(tx.ZeroTime)
-	select {
-	case tx.tlsHandshake <- NewArchivalTLSOrQUICHandshakeResult(
+	ev := NewArchivalTLSOrQUICHandshakeResult(
 		tx.Index,
 		started.Sub(tx.ZeroTime),
 		"tcp",
@@ -63,13 +175,27 @@ func (tx *Trace) OnTLSHandshakeDone(started time.Time, remoteAddr string, config
 		state,
 		err,
 		t,
-	):
-	default: // buffer is full
+	)
+	ev.FailureDetails = tx.newFailureDetails(err)
+	if capture != nil {
+		wbytes, rbytes := capture.snapshot()
+		clientBytes, serverBytes := newArchivalBinaryData(wbytes), newArchivalBinaryData(rbytes)
+		ev.ClientBytes, ev.ServerBytes = &clientBytes, &serverBytes
+	}
+	if ech {
+		status, retryConfigs := netxlite.ECHStatusFromError(err)
+		ev.ECHStatus = status
+		if retryConfigs != nil {
+			data := newArchivalBinaryData(retryConfigs)
+			ev.ECHRetryConfigs = &data
+		}
 	}
 	select {
-	case tx.networkEvent <- NewAnnotationArchivalNetworkEvent(tx.Index, t, "tls_handshake_done"):
+	case tx.tlsHandshake <- ev:
 	default: // buffer is full
+		tx.onDroppedEvent()
 	}
+	tx.emitNetworkEvent(NewAnnotationArchivalNetworkEvent(tx.Index, t, "tls_handshake_done"))
 }
 
 // NewArchivalTLSOrQUICHandshakeResult generates a model.ArchivalTLSOrQUICHandshakeResult
@@ -83,7 +209,7 @@ func NewArchivalTLSOrQUICHandshakeResult(
 		CipherSuite:        netxlite.TLSCipherSuiteString(state.CipherSuite),
 		Failure:            tracex.NewFailure(err),
 		NegotiatedProtocol: state.NegotiatedProtocol,
-		NoTLSVerify:        config.InsecureSkipVerify,
+		NoTLSVerify:        tlsNoVerify(config),
 		PeerCertificates:   TLSPeerCerts(state, err),
 		ServerName:         config.ServerName,
 		T0:                 started.Seconds(),
@@ -94,6 +220,13 @@ func NewArchivalTLSOrQUICHandshakeResult(
 	}
 }
 
+// tlsNoVerify returns whether the given config disables certificate verification. Note
+// that a config with InsecureSkipVerify and VerifyConnection set (e.g., a config returned
+// by netxlite.CertVerifier.WrapTLSConfig) still verifies the certificates.
+func tlsNoVerify(config *tls.Config) bool {
+	return config.InsecureSkipVerify && config.VerifyConnection == nil
+}
+
 // newArchivalBinaryData is a factory that adapts binary data to the
 // model.ArchivalMaybeBinaryData format.
 func newArchivalBinaryData(data []byte) model.ArchivalMaybeBinaryData {
@@ -17,6 +17,7 @@ import (
 	"github.com/bassosimone/oonidsl/internal/netxlite"
 	"github.com/bassosimone/oonidsl/internal/netxlite/filtering"
 	"github.com/bassosimone/oonidsl/internal/testingx"
+	utls "gitlab.com/yawning/utls.git"
 )
 
 func TestNewTLSHandshakerStdlib(t *testing.T) {
@@ -343,6 +344,96 @@ func TestNewTLSHandshakerStdlib(t *testing.T) {
 	})
 }
 
+func TestTLSHandshakerOptionCaptureBytes(t *testing.T) {
+	// handshake performs a TLS handshake with a local server using the given action.
+	handshake := func(t *testing.T, action filtering.TLSAction,
+		newHandshaker func(tx *Trace) model.TLSHandshaker) (*model.ArchivalTLSOrQUICHandshakeResult, error) {
+		server := filtering.NewTLSServer(action)
+		defer server.Close()
+		dialer := netxlite.NewDialerWithoutResolver(model.DiscardLogger)
+		ctx := context.Background()
+		conn, err := dialer.DialContext(ctx, "tcp", server.Endpoint())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		trace := NewTrace(0, time.Now())
+		tlsConfig := &tls.Config{
+			RootCAs:    server.CertPool(),
+			ServerName: "dns.google",
+		}
+		tlsConn, _, err := newHandshaker(trace).Handshake(ctx, conn, tlsConfig)
+		if tlsConn != nil {
+			tlsConn.Close()
+		}
+		ev := trace.FirstTLSHandshakeOrNil()
+		if ev == nil {
+			t.Fatal("expected to see a TLSHandshake event")
+		}
+		return ev, err
+	}
+
+	t.Run("without the option we do not capture", func(t *testing.T) {
+		ev, err := handshake(t, filtering.TLSActionBlockText, func(tx *Trace) model.TLSHandshaker {
+			return tx.NewTLSHandshakerStdlib(model.DiscardLogger)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.ClientBytes != nil || ev.ServerBytes != nil {
+			t.Fatal("expected to see no captured bytes")
+		}
+	})
+
+	t.Run("we capture the ClientHello and the server alert", func(t *testing.T) {
+		ev, err := handshake(t, filtering.TLSActionAlertInternalError, func(tx *Trace) model.TLSHandshaker {
+			return tx.NewTLSHandshakerStdlib(model.DiscardLogger, TLSHandshakerOptionCaptureBytes(1<<14))
+		})
+		if err == nil || ev.Failure == nil {
+			t.Fatal("expected the handshake to fail")
+		}
+		if ev.ClientBytes == nil || len(ev.ClientBytes.Value) < 6 || ev.ClientBytes.Value[0] != 22 {
+			t.Fatal("expected to see a handshake record containing the ClientHello")
+		}
+		if ev.ClientBytes.Value[5] != 1 { // client_hello
+			t.Fatal("expected the record to contain a ClientHello")
+		}
+		if ev.ServerBytes == nil || len(ev.ServerBytes.Value) < 1 || ev.ServerBytes.Value[0] != 21 {
+			t.Fatal("expected to see an alert record")
+		}
+	})
+
+	t.Run("we honour the maximum size", func(t *testing.T) {
+		ev, err := handshake(t, filtering.TLSActionBlockText, func(tx *Trace) model.TLSHandshaker {
+			return tx.NewTLSHandshakerStdlib(model.DiscardLogger, TLSHandshakerOptionCaptureBytes(16))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.ClientBytes == nil || len(ev.ClientBytes.Value) != 16 {
+			t.Fatal("unexpected client bytes", ev.ClientBytes)
+		}
+		if ev.ServerBytes == nil || len(ev.ServerBytes.Value) != 16 {
+			t.Fatal("unexpected server bytes", ev.ServerBytes)
+		}
+	})
+
+	t.Run("the option works with uTLS", func(t *testing.T) {
+		ev, err := handshake(t, filtering.TLSActionBlockText, func(tx *Trace) model.TLSHandshaker {
+			return tx.NewTLSHandshakerUTLS(model.DiscardLogger, &utls.HelloFirefox_55, TLSHandshakerOptionCaptureBytes(1<<14))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.ClientBytes == nil || len(ev.ClientBytes.Value) < 1 || ev.ClientBytes.Value[0] != 22 {
+			t.Fatal("expected to see the ClientHello")
+		}
+		if ev.ServerBytes == nil || len(ev.ServerBytes.Value) < 1 || ev.ServerBytes.Value[0] != 22 {
+			t.Fatal("expected to see the ServerHello")
+		}
+	})
+}
+
 func TestFirstTLSHandshake(t *testing.T) {
 	t.Run("returns nil when buffer is empty", func(t *testing.T) {
 		zeroTime := time.Now()
@@ -469,3 +560,29 @@ func TestTLSPeerCerts(t *testing.T) {
 		})
 	}
 }
+
+func TestTLSNoVerify(t *testing.T) {
+	t.Run("with InsecureSkipVerify", func(t *testing.T) {
+		if !tlsNoVerify(&tls.Config{InsecureSkipVerify: true}) {
+			t.Fatal("expected true")
+		}
+	})
+
+	t.Run("with InsecureSkipVerify and VerifyConnection", func(t *testing.T) {
+		config := &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				return nil
+			},
+		}
+		if tlsNoVerify(config) {
+			t.Fatal("expected false")
+		}
+	})
+
+	t.Run("without InsecureSkipVerify", func(t *testing.T) {
+		if tlsNoVerify(&tls.Config{}) {
+			t.Fatal("expected false")
+		}
+	})
+}
@@ -5,6 +5,8 @@ package measurexlite
 //
 
 import (
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/bassosimone/oonidsl/internal/model"
@@ -23,7 +25,18 @@ import (
 // events. You should drain the channels used by this implementation after
 // each operation you perform (i.e., we expect you to peform step-by-step
 // measurements). If you want larger (or smaller) buffers, then you should
-// construct this data type manually with the desired buffer sizes.
+// pass the TraceOption values configuring the desired buffer sizes.
+//
+// When a buffer is full, we drop the new events and we count how many events
+// we have dropped, which you can read using the DroppedEvents method.
+//
+// Long-lived connections (e.g., streaming downloads) could generate lots of
+// read and write events. Use TraceOptionAggregateReadWrite to merge consecutive
+// read (or write) events on the same conn into a single summary event.
+//
+// Use TraceOptionFailureDetails to also save the details of each failure
+// (e.g., the errno and the time elapsed until the failure) into the
+// x_failure_details field of the events that support it.
 //
 // We have convenience methods for extracting events from the buffered
 // channels. Otherwise, you could read the channels directly. (In which
@@ -62,6 +75,11 @@ type Trace struct {
 	// calls to the netxlite.NewTLSHandshakerUTLS factory.
 	NewTLSHandshakerUTLSFn func(dl model.DebugLogger, id *utls.ClientHelloID) model.TLSHandshaker
 
+	// NewTLSHandshakerECHFn is OPTIONAL and can be used to overide
+	// calls to the netxlite.NewTLSHandshakerECH factory.
+	NewTLSHandshakerECHFn func(
+		dl model.DebugLogger, id *utls.ClientHelloID, echConfigList []byte) model.TLSHandshaker
+
 	// NewDialerWithoutResolverFn is OPTIONAL and can be used to override
 	// calls to the netxlite.NewQUICDialerWithoutResolver factory.
 	NewQUICDialerWithoutResolverFn func(listener model.QUICListener, dl model.DebugLogger) model.QUICDialer
@@ -81,6 +99,35 @@ type Trace struct {
 	// quicHandshake is MANDATORY and buffers QUIC handshake observations.
 	quicHandshake chan *model.ArchivalTLSOrQUICHandshakeResult
 
+	// httpRequest is MANDATORY and buffers HTTP request observations.
+	httpRequest chan *model.ArchivalHTTPRequestResult
+
+	// aggregateReadWrite is OPTIONAL and enables the aggregation of
+	// consecutive read (or write) events on the same conn.
+	aggregateReadWrite bool
+
+	// failureDetails is OPTIONAL and enables saving the
+	// details of each failure into the events.
+	failureDetails bool
+
+	// quicEvents is OPTIONAL and enables translating the quic-go
+	// tracing events into network events.
+	quicEvents bool
+
+	// quicEvent is MANDATORY and buffers the network events describing
+	// the QUIC conns, which we only emit when quicEvents is true.
+	quicEvent chan *model.ArchivalNetworkEvent
+
+	// dropped counts the events dropped because a buffer was full.
+	dropped int64
+
+	// mu protects dropped and pendingReadWrite.
+	mu sync.Mutex
+
+	// pendingReadWrite contains the read or write events we're currently
+	// aggregating indexed by the conn emitting them.
+	pendingReadWrite map[any]*model.ArchivalNetworkEvent
+
 	// TimeNowFn is OPTIONAL and can be used to override calls to time.Now
 	// to produce deterministic timing when testing.
 	TimeNowFn func() time.Time
@@ -113,21 +160,136 @@ const (
 	// QUICHandshakeBufferSize is the buffer for constructing
 	// the Trace's quicHandshake buffered channel.
 	QUICHandshakeBufferSize = 8
+
+	// HTTPRequestBufferSize is the buffer for constructing
+	// the Trace's httpRequest buffered channel.
+	HTTPRequestBufferSize = 8
+
+	// QUICEventBufferSize is the buffer for constructing the Trace's
+	// quicEvent buffered channel. It is larger than the other buffers
+	// because we emit several events for each QUIC packet.
+	QUICEventBufferSize = 1024
 )
 
+// TraceOption is an option you can pass to NewTrace.
+type TraceOption func(tx *Trace)
+
+// TraceOptionNetworkEventBufferSize sets the size of the networkEvent buffer. A
+// negative size is equivalent to zero, which means we drop all the events.
+func TraceOptionNetworkEventBufferSize(size int) TraceOption {
+	return func(tx *Trace) {
+		tx.networkEvent = make(chan *model.ArchivalNetworkEvent, traceBufferSize(size))
+	}
+}
+
+// TraceOptionDNSLookupBufferSize is like TraceOptionNetworkEventBufferSize
+// but sets the size of the dnsLookup buffer.
+func TraceOptionDNSLookupBufferSize(size int) TraceOption {
+	return func(tx *Trace) {
+		tx.dnsLookup = make(chan *model.ArchivalDNSLookupResult, traceBufferSize(size))
+	}
+}
+
+// TraceOptionDelayedDNSResponseBufferSize is like TraceOptionNetworkEventBufferSize
+// but sets the size of the delayedDNSResponse buffer.
+func TraceOptionDelayedDNSResponseBufferSize(size int) TraceOption {
+	return func(tx *Trace) {
+		tx.delayedDNSResponse = make(chan *model.ArchivalDNSLookupResult, traceBufferSize(size))
+	}
+}
+
+// TraceOptionTCPConnectBufferSize is like TraceOptionNetworkEventBufferSize
+// but sets the size of the tcpConnect buffer.
+func TraceOptionTCPConnectBufferSize(size int) TraceOption {
+	return func(tx *Trace) {
+		tx.tcpConnect = make(chan *model.ArchivalTCPConnectResult, traceBufferSize(size))
+	}
+}
+
+// TraceOptionTLSHandshakeBufferSize is like TraceOptionNetworkEventBufferSize
+// but sets the size of the tlsHandshake buffer.
+func TraceOptionTLSHandshakeBufferSize(size int) TraceOption {
+	return func(tx *Trace) {
+		tx.tlsHandshake = make(chan *model.ArchivalTLSOrQUICHandshakeResult, traceBufferSize(size))
+	}
+}
+
+// TraceOptionQUICHandshakeBufferSize is like TraceOptionNetworkEventBufferSize
+// but sets the size of the quicHandshake buffer.
+func TraceOptionQUICHandshakeBufferSize(size int) TraceOption {
+	return func(tx *Trace) {
+		tx.quicHandshake = make(chan *model.ArchivalTLSOrQUICHandshakeResult, traceBufferSize(size))
+	}
+}
+
+// TraceOptionHTTPRequestBufferSize is like TraceOptionNetworkEventBufferSize
+// but sets the size of the httpRequest buffer.
+func TraceOptionHTTPRequestBufferSize(size int) TraceOption {
+	return func(tx *Trace) {
+		tx.httpRequest = make(chan *model.ArchivalHTTPRequestResult, traceBufferSize(size))
+	}
+}
+
+// TraceOptionQUICEventBufferSize is like TraceOptionNetworkEventBufferSize
+// but sets the size of the quicEvent buffer.
+func TraceOptionQUICEventBufferSize(size int) TraceOption {
+	return func(tx *Trace) {
+		tx.quicEvent = make(chan *model.ArchivalNetworkEvent, traceBufferSize(size))
+	}
+}
+
+// TraceOptionAggregateReadWrite enables merging consecutive successful read
+// (or write) events on the same conn into a single event whose NumBytes is
+// the sum of the merged events and whose T is the time of the last one.
+func TraceOptionAggregateReadWrite() TraceOption {
+	return func(tx *Trace) {
+		tx.aggregateReadWrite = true
+	}
+}
+
+// TraceOptionFailureDetails enables saving the details of each failure (i.e., the
+// elapsed time, the errno, the addresses, and the previous failures) into the
+// FailureDetails field of the TCP connect, TLS or QUIC handshake, and network events.
+func TraceOptionFailureDetails() TraceOption {
+	return func(tx *Trace) {
+		tx.failureDetails = true
+	}
+}
+
+// TraceOptionQUICEvents enables hooking into the quic-go tracing of the QUIC
+// conns created by NewQUICDialerWithoutResolver to emit network events describing
+// sent, received, lost, and dropped packets as well as handshake progress. We save
+// these events into a dedicated buffer, which you can drain using QUICEvents, so
+// that they do not crowd out the other network events.
+func TraceOptionQUICEvents() TraceOption {
+	return func(tx *Trace) {
+		tx.quicEvents = true
+	}
+}
+
+// traceBufferSize maps negative buffer sizes to zero.
+func traceBufferSize(size int) int {
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
 // NewTrace creates a new instance of Trace using default settings.
 //
 // We create buffered channels using as buffer sizes the constants that
-// are also defined by this package.
+// are also defined by this package, unless you override them using options.
 //
 // Arguments:
 //
 // - index is the unique index of this trace within the current measurement (use
 // zero if you don't care about giving this trace a unique ID);
 //
-// - zeroTime is the time when we started the current measurement.
-func NewTrace(index int64, zeroTime time.Time) *Trace {
-	return &Trace{
+// - zeroTime is the time when we started the current measurement;
+//
+// - options contains OPTIONAL settings.
+func NewTrace(index int64, zeroTime time.Time, options ...TraceOption) *Trace {
+	tx := &Trace{
 		Index: index,
 		networkEvent: make(
 			chan *model.ArchivalNetworkEvent,
@@ -155,9 +317,38 @@ func NewTrace(index int64, zeroTime time.Time) *Trace {
 			chan *model.ArchivalTLSOrQUICHandshakeResult,
 			QUICHandshakeBufferSize,
 		),
+		httpRequest: make(
+			chan *model.ArchivalHTTPRequestResult,
+			HTTPRequestBufferSize,
+		),
+		quicEvent: make(
+			chan *model.ArchivalNetworkEvent,
+			QUICEventBufferSize,
+		),
 		TimeNowFn: nil, // use default
 		ZeroTime:  zeroTime,
 	}
+	for _, option := range options {
+		option(tx)
+	}
+	return tx
+}
+
+// onDroppedEvent records that we dropped an event because a buffer was full.
+func (tx *Trace) onDroppedEvent() {
+	tx.mu.Lock()
+	tx.dropped++
+	tx.mu.Unlock()
+}
+
+// DroppedEvents returns the number of events dropped because a buffer was
+// full since the previous call of this method and resets the counter.
+func (tx *Trace) DroppedEvents() int64 {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	count := tx.dropped
+	tx.dropped = 0
+	return count
 }
 
 // newStdlibResolver indirectly calls the passed netxlite.NewStdlibResolver
@@ -179,12 +370,16 @@ func (tx *Trace) newParallelUDPResolver(logger model.Logger, dialer model.Dialer
 }
 
 // newParallelDNSOverHTTPSResolver indirectly calls the passed netxlite.NewParallerDNSOverHTTPSResolver
-// thus allowing us to mock this function for testing
+// thus allowing us to mock this function for testing. By default, we build the same resolver
+// as netxlite but using an HTTP transport wrapped using WrapHTTPTransport, so that we
+// also collect the HTTP round trips used for resolving.
 func (tx *Trace) newParallelDNSOverHTTPSResolver(logger model.Logger, URL string) model.Resolver {
 	if tx.NewParallelDNSOverHTTPSResolverFn != nil {
 		return tx.NewParallelDNSOverHTTPSResolverFn(logger, URL)
 	}
-	return netxlite.NewParallelDNSOverHTTPSResolver(logger, URL)
+	client := &http.Client{Transport: tx.WrapHTTPTransport(netxlite.NewHTTPTransportStdlib(logger), 0)}
+	txp := netxlite.WrapDNSTransport(netxlite.NewUnwrappedDNSOverHTTPSTransport(client, URL))
+	return netxlite.WrapResolver(logger, netxlite.NewUnwrappedParallelResolver(txp))
 }
 
 // newDialerWithoutResolver indirectly calls netxlite.NewDialerWithoutResolver
@@ -214,6 +409,16 @@ func (tx *Trace) newTLSHandshakerUTLS(dl model.DebugLogger, id *utls.ClientHello
 	return netxlite.NewTLSHandshakerUTLS(dl, id)
 }
 
+// newTLSHandshakerECH indirectly calls netxlite.NewTLSHandshakerECH
+// thus allowing us to mock this func for testing.
+func (tx *Trace) newTLSHandshakerECH(
+	dl model.DebugLogger, id *utls.ClientHelloID, echConfigList []byte) model.TLSHandshaker {
+	if tx.NewTLSHandshakerECHFn != nil {
+		return tx.NewTLSHandshakerECHFn(dl, id, echConfigList)
+	}
+	return netxlite.NewTLSHandshakerECH(dl, id, echConfigList)
+}
+
 // newQUICDialerWithoutResolver indirectly calls netxlite.NewQUICDialerWithoutResolver
 // thus allowing us to mock this func for testing.
 func (tx *Trace) newQUICDialerWithoutResolver(listener model.QUICListener, dl model.DebugLogger) model.QUICDialer {
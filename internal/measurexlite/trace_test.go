@@ -85,6 +85,12 @@ func TestNewTrace(t *testing.T) {
 			}
 		})
 
+		t.Run("NewTLSHandshakerECHFn is nil", func(t *testing.T) {
+			if trace.NewTLSHandshakerECHFn != nil {
+				t.Fatal("expected nil NewTLSHandshakerECHFn")
+			}
+		})
+
 		t.Run("NewQUICDialerWithoutResolverFn is nil", func(t *testing.T) {
 			if trace.NewQUICDialerWithoutResolverFn != nil {
 				t.Fatal("expected nil NewQUICDialerQithoutResolverFn")
@@ -186,6 +192,25 @@ func TestNewTrace(t *testing.T) {
 			}
 		})
 
+		t.Run("httpRequest has the expected buffer size", func(t *testing.T) {
+			ff := &testingx.FakeFiller{}
+			var idx int
+		Loop:
+			for {
+				ev := &model.ArchivalHTTPRequestResult{}
+				ff.Fill(ev)
+				select {
+				case trace.httpRequest <- ev:
+					idx++
+				default:
+					break Loop
+				}
+			}
+			if idx != HTTPRequestBufferSize {
+				t.Fatal("invalid httpRequest channel buffer size")
+			}
+		})
+
 		t.Run("TimeNowFn is nil", func(t *testing.T) {
 			if trace.TimeNowFn != nil {
 				t.Fatal("expected nil TimeNowFn")
@@ -200,6 +225,60 @@ func TestNewTrace(t *testing.T) {
 	})
 }
 
+func TestNewTraceWithOptions(t *testing.T) {
+	t.Run("buffer size options override the defaults", func(t *testing.T) {
+		trace := NewTrace(
+			0,
+			time.Now(),
+			TraceOptionNetworkEventBufferSize(1),
+			TraceOptionDNSLookupBufferSize(2),
+			TraceOptionDelayedDNSResponseBufferSize(3),
+			TraceOptionTCPConnectBufferSize(4),
+			TraceOptionTLSHandshakeBufferSize(5),
+			TraceOptionQUICHandshakeBufferSize(6),
+			TraceOptionHTTPRequestBufferSize(-1),
+		)
+		sizes := []int{
+			cap(trace.networkEvent),
+			cap(trace.dnsLookup),
+			cap(trace.delayedDNSResponse),
+			cap(trace.tcpConnect),
+			cap(trace.tlsHandshake),
+			cap(trace.quicHandshake),
+			cap(trace.httpRequest),
+		}
+		if !reflect.DeepEqual([]int{1, 2, 3, 4, 5, 6, 0}, sizes) {
+			t.Fatal("unexpected buffer sizes", sizes)
+		}
+		if trace.aggregateReadWrite {
+			t.Fatal("expected aggregation to be disabled")
+		}
+	})
+
+	t.Run("TraceOptionAggregateReadWrite enables aggregation", func(t *testing.T) {
+		trace := NewTrace(0, time.Now(), TraceOptionAggregateReadWrite())
+		if !trace.aggregateReadWrite {
+			t.Fatal("expected aggregation to be enabled")
+		}
+	})
+}
+
+func TestDroppedEvents(t *testing.T) {
+	trace := NewTrace(0, time.Now(), TraceOptionNetworkEventBufferSize(1))
+	for idx := 0; idx < 4; idx++ {
+		trace.OnQUICHandshakeStart(time.Now(), "1.1.1.1:443", nil)
+	}
+	if dropped := trace.DroppedEvents(); dropped != 3 {
+		t.Fatal("unexpected number of dropped events", dropped)
+	}
+	if dropped := trace.DroppedEvents(); dropped != 0 {
+		t.Fatal("expected the counter to be reset", dropped)
+	}
+	if events := trace.NetworkEvents(); len(events) != 1 {
+		t.Fatal("unexpected number of events", len(events))
+	}
+}
+
 func TestTrace(t *testing.T) {
 	t.Run("NewStdlibResolverFn works as intended", func(t *testing.T) {
 		t.Run("when not nil", func(t *testing.T) {
@@ -503,6 +582,52 @@ func TestTrace(t *testing.T) {
 		})
 	})
 
+	t.Run("NewTLSHandshakerECHFn works as intended", func(t *testing.T) {
+		t.Run("when not nil", func(t *testing.T) {
+			mockedErr := errors.New("mocked")
+			tx := &Trace{
+				NewTLSHandshakerECHFn: func(dl model.DebugLogger,
+					id *utls.ClientHelloID, echConfigList []byte) model.TLSHandshaker {
+					return &mocks.TLSHandshaker{
+						MockHandshake: func(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, tls.ConnectionState, error) {
+							return nil, tls.ConnectionState{}, mockedErr
+						},
+					}
+				},
+			}
+			thx := tx.NewTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, nil)
+			ctx := context.Background()
+			conn, state, err := thx.Handshake(ctx, &mocks.Conn{}, &tls.Config{})
+			if !errors.Is(err, mockedErr) {
+				t.Fatal("unexpected err", err)
+			}
+			if !reflect.ValueOf(state).IsZero() {
+				t.Fatal("state is not a zero value")
+			}
+			if conn != nil {
+				t.Fatal("expected nil conn")
+			}
+		})
+
+		t.Run("when nil", func(t *testing.T) {
+			tx := &Trace{
+				NewTLSHandshakerECHFn: nil,
+			}
+			thx := tx.newTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, nil)
+			ctx := context.Background()
+			conn, state, err := thx.Handshake(ctx, &mocks.Conn{}, &tls.Config{})
+			if !errors.Is(err, netxlite.ErrECHInvalidConfigList) {
+				t.Fatal("unexpected err", err)
+			}
+			if !reflect.ValueOf(state).IsZero() {
+				t.Fatal("state is not a zero value")
+			}
+			if conn != nil {
+				t.Fatal("expected nil conn")
+			}
+		})
+	})
+
 	t.Run("NewQUICDialerWithoutResolverFn works as intended", func(t *testing.T) {
 		t.Run("when not nil", func(t *testing.T) {
 			mockedErr := errors.New("mocked")
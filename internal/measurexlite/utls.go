@@ -7,9 +7,18 @@ import (
 
 // NewTLSHandshakerUTLS is equivalent to netxlite.NewTLSHandshakerUTLS
 // except that it returns a model.TLSHandshaker that uses this trace.
-func (tx *Trace) NewTLSHandshakerUTLS(dl model.DebugLogger, id *utls.ClientHelloID) model.TLSHandshaker {
-	return &tlsHandshakerTrace{
-		thx: tx.newTLSHandshakerUTLS(dl, id),
-		tx:  tx,
-	}
+func (tx *Trace) NewTLSHandshakerUTLS(dl model.DebugLogger,
+	id *utls.ClientHelloID, options ...TLSHandshakerOption) model.TLSHandshaker {
+	return newTLSHandshakerTrace(tx, tx.newTLSHandshakerUTLS(dl, id), options...)
+}
+
+// NewTLSHandshakerECH is equivalent to netxlite.NewTLSHandshakerECH
+// except that it returns a model.TLSHandshaker that uses this trace. The
+// handshake observation also contains whether the server accepted, rejected,
+// or ignored ECH, as well as the retry configs it sent back, if any.
+func (tx *Trace) NewTLSHandshakerECH(dl model.DebugLogger, id *utls.ClientHelloID,
+	echConfigList []byte, options ...TLSHandshakerOption) model.TLSHandshaker {
+	thx := newTLSHandshakerTrace(tx, tx.newTLSHandshakerECH(dl, id, echConfigList), options...)
+	thx.ech = true
+	return thx
 }
@@ -1,11 +1,18 @@
 package measurexlite
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/bassosimone/oonidsl/internal/model"
 	"github.com/bassosimone/oonidsl/internal/model/mocks"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+	"github.com/bassosimone/oonidsl/internal/netxlite/filtering"
 	utls "gitlab.com/yawning/utls.git"
 )
 
@@ -27,3 +34,145 @@ func TestNewTLSHandshakerUTLS(t *testing.T) {
 		}
 	})
 }
+
+func TestNewTLSHandshakerECH(t *testing.T) {
+	// echConfigList contains a single X25519 config whose public name is public.example.net.
+	echConfigList, _ := hex.DecodeString("0045fe0d0041070020002011111111111111111111111111111111" +
+		"1111111111111111111111111111111100040001000140127075626c69632e6578616d706c652e6e65740000")
+
+	t.Run("NewTLSHandshakerECH creates a wrapped TLSHandshaker", func(t *testing.T) {
+		underlying := &mocks.TLSHandshaker{}
+		zeroTime := time.Now()
+		trace := NewTrace(0, zeroTime)
+		trace.NewTLSHandshakerECHFn = func(dl model.DebugLogger,
+			id *utls.ClientHelloID, list []byte) model.TLSHandshaker {
+			if !bytes.Equal(list, echConfigList) {
+				t.Fatal("invalid ECHConfigList")
+			}
+			return underlying
+		}
+		thx := trace.NewTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, echConfigList)
+		thxt := thx.(*tlsHandshakerTrace)
+		if thxt.thx != underlying {
+			t.Fatal("invalid TLS handshaker")
+		}
+		if thxt.tx != trace {
+			t.Fatal("invalid trace")
+		}
+		if !thxt.ech {
+			t.Fatal("expected ech to be true")
+		}
+	})
+
+	t.Run("we archive the accepted status and the retry configs", func(t *testing.T) {
+		retryConfigs := []byte{0x00, 0x01, 0x02}
+		errorsList := []error{
+			nil,
+			&netxlite.ECHError{
+				Err:          netxlite.ErrECHRejected,
+				Status:       netxlite.ECHStatusRejected,
+				RetryConfigs: retryConfigs,
+			},
+		}
+		for _, handshakeErr := range errorsList {
+			trace := NewTrace(0, time.Now())
+			trace.NewTLSHandshakerECHFn = func(dl model.DebugLogger,
+				id *utls.ClientHelloID, list []byte) model.TLSHandshaker {
+				return &mocks.TLSHandshaker{
+					MockHandshake: func(ctx context.Context, conn net.Conn,
+						config *tls.Config) (net.Conn, tls.ConnectionState, error) {
+						started := time.Now()
+						netxlite.ContextTraceOrDefault(ctx).OnTLSHandshakeDone(started,
+							"1.1.1.1:443", config, tls.ConnectionState{}, handshakeErr, time.Now())
+						return nil, tls.ConnectionState{}, handshakeErr
+					},
+				}
+			}
+			thx := trace.NewTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, echConfigList)
+			conn := &mocks.Conn{
+				MockRemoteAddr: func() net.Addr {
+					return &mocks.Addr{
+						MockNetwork: func() string {
+							return "tcp"
+						},
+						MockString: func() string {
+							return "1.1.1.1:443"
+						},
+					}
+				},
+			}
+			thx.Handshake(context.Background(), conn, &tls.Config{ServerName: "example.com"})
+			ev := trace.FirstTLSHandshakeOrNil()
+			if ev == nil {
+				t.Fatal("expected to see a TLSHandshake event")
+			}
+			if handshakeErr == nil {
+				if ev.ECHStatus != netxlite.ECHStatusAccepted || ev.ECHRetryConfigs != nil {
+					t.Fatal("unexpected ECH outcome", ev.ECHStatus, ev.ECHRetryConfigs)
+				}
+				continue
+			}
+			if ev.ECHStatus != netxlite.ECHStatusRejected {
+				t.Fatal("unexpected ECH status", ev.ECHStatus)
+			}
+			if ev.ECHRetryConfigs == nil || ev.ECHRetryConfigs.Value != string(retryConfigs) {
+				t.Fatal("unexpected ECH retry configs", ev.ECHRetryConfigs)
+			}
+		}
+	})
+
+	t.Run("we archive the stripped status with a server not supporting ECH", func(t *testing.T) {
+		server := filtering.NewTLSServer(filtering.TLSActionBlockText)
+		defer server.Close()
+		dialer := netxlite.NewDialerWithoutResolver(model.DiscardLogger)
+		ctx := context.Background()
+		conn, err := dialer.DialContext(ctx, "tcp", server.Endpoint())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		trace := NewTrace(0, time.Now())
+		thx := trace.NewTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, echConfigList)
+		tlsConfig := &tls.Config{
+			RootCAs:    server.CertPool(),
+			ServerName: "dns.google",
+		}
+		tlsConn, _, err := thx.Handshake(ctx, conn, tlsConfig)
+		if err == nil || tlsConn != nil {
+			t.Fatal("expected the handshake to fail")
+		}
+		ev := trace.FirstTLSHandshakeOrNil()
+		if ev == nil {
+			t.Fatal("expected to see a TLSHandshake event")
+		}
+		if ev.Failure == nil || *ev.Failure != netxlite.FailureSSLFailedHandshake {
+			t.Fatal("unexpected failure", ev.Failure)
+		}
+		if ev.ECHStatus != netxlite.ECHStatusStripped || ev.ECHRetryConfigs != nil {
+			t.Fatal("unexpected ECH outcome", ev.ECHStatus, ev.ECHRetryConfigs)
+		}
+	})
+
+	t.Run("we do not archive the ECH status without ECH", func(t *testing.T) {
+		trace := NewTrace(0, time.Now())
+		trace.NewTLSHandshakerUTLSFn = func(dl model.DebugLogger, id *utls.ClientHelloID) model.TLSHandshaker {
+			return &mocks.TLSHandshaker{
+				MockHandshake: func(ctx context.Context, conn net.Conn,
+					config *tls.Config) (net.Conn, tls.ConnectionState, error) {
+					netxlite.ContextTraceOrDefault(ctx).OnTLSHandshakeDone(time.Now(),
+						"1.1.1.1:443", config, tls.ConnectionState{}, nil, time.Now())
+					return nil, tls.ConnectionState{}, nil
+				},
+			}
+		}
+		thx := trace.NewTLSHandshakerUTLS(model.DiscardLogger, &utls.HelloChrome_83)
+		thx.Handshake(context.Background(), &mocks.Conn{}, &tls.Config{})
+		ev := trace.FirstTLSHandshakeOrNil()
+		if ev == nil {
+			t.Fatal("expected to see a TLSHandshake event")
+		}
+		if ev.ECHStatus != "" || ev.ECHRetryConfigs != nil {
+			t.Fatal("unexpected ECH outcome", ev.ECHStatus, ev.ECHRetryConfigs)
+		}
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/bassosimone/oonidsl/internal/netxlite/filtering"
 	"github.com/bassosimone/oonidsl/internal/randx"
 )
 
@@ -51,6 +52,12 @@ func TestWebGetTitle(t *testing.T) {
 			body: "<HTML><TiTLe>La commUNity di MSN</tITLE></HTML>",
 		},
 		wantOut: "La commUNity di MSN",
+	}, {
+		name: "with the block page returned by the filtering package",
+		args: args{
+			body: string(filtering.HTTPBlockpage451),
+		},
+		wantOut: "451 Unavailable For Legal Reasons",
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -104,6 +104,35 @@ func (hb *ArchivalMaybeBinaryData) UnmarshalJSON(d []byte) error {
 	return nil
 }
 
+//
+// Failure details
+//
+
+// ArchivalFailureDetails contains the details of a failure that do not fit
+// into the failure string (e.g., the errno and the addresses). We emit this
+// structure as an extension of the OONI data format, alongside the failure.
+type ArchivalFailureDetails struct {
+	Failure    string                    `json:"failure"`
+	Operation  string                    `json:"operation"`
+	Elapsed    float64                   `json:"t_elapsed,omitempty"`
+	Errno      uint64                    `json:"errno,omitempty"`
+	LocalAddr  string                    `json:"local_addr,omitempty"`
+	RemoteAddr string                    `json:"remote_addr,omitempty"`
+	Previous   []ArchivalPreviousFailure `json:"previous,omitempty"`
+}
+
+// ArchivalPreviousFailure contains the details of a failure that we
+// discarded when we reduced several failures to a single one (e.g., when
+// we failed to connect to each of the IP addresses of a domain).
+type ArchivalPreviousFailure struct {
+	Failure    string  `json:"failure"`
+	Operation  string  `json:"operation"`
+	Elapsed    float64 `json:"t_elapsed,omitempty"`
+	Errno      uint64  `json:"errno,omitempty"`
+	LocalAddr  string  `json:"local_addr,omitempty"`
+	RemoteAddr string  `json:"remote_addr,omitempty"`
+}
+
 //
 // DNS lookup
 //
@@ -147,12 +176,13 @@ type ArchivalDNSAnswer struct {
 //
 // See https://github.com/ooni/spec/blob/master/data-formats/df-005-tcpconnect.md.
 type ArchivalTCPConnectResult struct {
-	IP            string                   `json:"ip"`
-	Port          int                      `json:"port"`
-	Status        ArchivalTCPConnectStatus `json:"status"`
-	T0            float64                  `json:"t0,omitempty"`
-	T             float64                  `json:"t"`
-	TransactionID int64                    `json:"transaction_id,omitempty"`
+	IP             string                   `json:"ip"`
+	Port           int                      `json:"port"`
+	Status         ArchivalTCPConnectStatus `json:"status"`
+	FailureDetails *ArchivalFailureDetails  `json:"x_failure_details,omitempty"`
+	T0             float64                  `json:"t0,omitempty"`
+	T              float64                  `json:"t"`
+	TransactionID  int64                    `json:"transaction_id,omitempty"`
 }
 
 // ArchivalTCPConnectStatus is the status of ArchivalTCPConnectResult.
@@ -170,20 +200,29 @@ type ArchivalTCPConnectStatus struct {
 //
 // See https://github.com/ooni/spec/blob/master/data-formats/df-006-tlshandshake.md
 type ArchivalTLSOrQUICHandshakeResult struct {
-	Network            string                    `json:"network"`
-	Address            string                    `json:"address"`
-	CipherSuite        string                    `json:"cipher_suite"`
-	Failure            *string                   `json:"failure"`
-	SoError            *string                   `json:"so_error,omitempty"`
-	NegotiatedProtocol string                    `json:"negotiated_protocol"`
-	NoTLSVerify        bool                      `json:"no_tls_verify"`
-	PeerCertificates   []ArchivalMaybeBinaryData `json:"peer_certificates"`
-	ServerName         string                    `json:"server_name"`
-	T0                 float64                   `json:"t0,omitempty"`
-	T                  float64                   `json:"t"`
-	Tags               []string                  `json:"tags"`
-	TLSVersion         string                    `json:"tls_version"`
-	TransactionID      int64                     `json:"transaction_id,omitempty"`
+	Network                string                    `json:"network"`
+	Address                string                    `json:"address"`
+	CipherSuite            string                    `json:"cipher_suite"`
+	Failure                *string                   `json:"failure"`
+	SoError                *string                   `json:"so_error,omitempty"`
+	NegotiatedProtocol     string                    `json:"negotiated_protocol"`
+	NoTLSVerify            bool                      `json:"no_tls_verify"`
+	PeerCertificates       []ArchivalMaybeBinaryData `json:"peer_certificates"`
+	ServerName             string                    `json:"server_name"`
+	T0                     float64                   `json:"t0,omitempty"`
+	T                      float64                   `json:"t"`
+	Tags                   []string                  `json:"tags"`
+	TLSVersion             string                    `json:"tls_version"`
+	TransactionID          int64                     `json:"transaction_id,omitempty"`
+	FailureDetails         *ArchivalFailureDetails   `json:"x_failure_details,omitempty"`
+	QUICConnectionIDLength int                       `json:"x_quic_connection_id_length,omitempty"`
+	QUICInitialPacketSize  int                       `json:"x_quic_initial_packet_size,omitempty"`
+	QUICVersion            string                    `json:"x_quic_version,omitempty"`
+	QUICVersions           []string                  `json:"x_quic_versions,omitempty"`
+	ClientBytes            *ArchivalMaybeBinaryData  `json:"x_client_bytes,omitempty"`
+	ServerBytes            *ArchivalMaybeBinaryData  `json:"x_server_bytes,omitempty"`
+	ECHStatus              string                    `json:"x_ech_status,omitempty"`
+	ECHRetryConfigs        *ArchivalMaybeBinaryData  `json:"x_ech_retry_configs,omitempty"`
 }
 
 //
@@ -197,6 +236,7 @@ type ArchivalHTTPRequestResult struct {
 	Network       string               `json:"network,omitempty"`
 	Address       string               `json:"address,omitempty"`
 	ALPN          string               `json:"alpn,omitempty"`
+	Protocol      string               `json:"x_protocol,omitempty"`
 	Failure       *string              `json:"failure"`
 	Request       ArchivalHTTPRequest  `json:"request"`
 	Response      ArchivalHTTPResponse `json:"response"`
@@ -318,13 +358,14 @@ type ArchivalHTTPTor struct {
 //
 // See https://github.com/ooni/spec/blob/master/data-formats/df-008-netevents.md.
 type ArchivalNetworkEvent struct {
-	Address       string   `json:"address,omitempty"`
-	Failure       *string  `json:"failure"`
-	NumBytes      int64    `json:"num_bytes,omitempty"`
-	Operation     string   `json:"operation"`
-	Proto         string   `json:"proto,omitempty"`
-	T0            float64  `json:"t0,omitempty"`
-	T             float64  `json:"t"`
-	TransactionID int64    `json:"transaction_id,omitempty"`
-	Tags          []string `json:"tags,omitempty"`
+	Address        string                  `json:"address,omitempty"`
+	Failure        *string                 `json:"failure"`
+	FailureDetails *ArchivalFailureDetails `json:"x_failure_details,omitempty"`
+	NumBytes       int64                   `json:"num_bytes,omitempty"`
+	Operation      string                  `json:"operation"`
+	Proto          string                  `json:"proto,omitempty"`
+	T0             float64                 `json:"t0,omitempty"`
+	T              float64                 `json:"t"`
+	TransactionID  int64                   `json:"transaction_id,omitempty"`
+	Tags           []string                `json:"tags,omitempty"`
 }
@@ -38,7 +38,7 @@ type Trace struct {
 	MockOnQUICHandshakeStart func(now time.Time, remoteAddrs string, config *quic.Config)
 
 	MockOnQUICHandshakeDone func(started time.Time, remoteAddr string, qconn quic.EarlyConnection,
-		config *tls.Config, err error, finished time.Time)
+		config *tls.Config, quicConfig *quic.Config, err error, finished time.Time)
 }
 
 var _ model.Trace = &Trace{}
@@ -84,6 +84,6 @@ func (t *Trace) OnQUICHandshakeStart(now time.Time, remoteAddr string, config *q
 }
 
 func (t *Trace) OnQUICHandshakeDone(started time.Time, remoteAddr string, qconn quic.EarlyConnection,
-	config *tls.Config, err error, finished time.Time) {
-	t.MockOnQUICHandshakeDone(started, remoteAddr, qconn, config, err, finished)
+	config *tls.Config, quicConfig *quic.Config, err error, finished time.Time) {
+	t.MockOnQUICHandshakeDone(started, remoteAddr, qconn, config, quicConfig, err, finished)
 }
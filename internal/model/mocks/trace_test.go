@@ -164,7 +164,7 @@ func TestTrace(t *testing.T) {
 	t.Run("OnQUICHandshakeDone", func(t *testing.T) {
 		var called bool
 		tx := &Trace{
-			MockOnQUICHandshakeDone: func(started time.Time, remoteAddr string, qconn quic.EarlyConnection, config *tls.Config, err error, finished time.Time) {
+			MockOnQUICHandshakeDone: func(started time.Time, remoteAddr string, qconn quic.EarlyConnection, config *tls.Config, quicConfig *quic.Config, err error, finished time.Time) {
 				called = true
 			},
 		}
@@ -173,6 +173,7 @@ func TestTrace(t *testing.T) {
 			"1.1.1.1:443",
 			nil,
 			&tls.Config{},
+			&quic.Config{},
 			nil,
 			time.Now(),
 		)
@@ -0,0 +1,102 @@
+package mocks
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+)
+
+// WebSocketConn allows to mock model.WebSocketConn.
+type WebSocketConn struct {
+	// MockReadMessage allows to mock the ReadMessage method.
+	MockReadMessage func() (int, []byte, error)
+
+	// MockWriteMessage allows to mock the WriteMessage method.
+	MockWriteMessage func(messageType int, data []byte) error
+
+	// MockSubprotocol allows to mock the Subprotocol method.
+	MockSubprotocol func() string
+
+	// MockLocalAddr allows to mock the LocalAddr method.
+	MockLocalAddr func() net.Addr
+
+	// MockRemoteAddr allows to mock the RemoteAddr method.
+	MockRemoteAddr func() net.Addr
+
+	// MockSetReadDeadline allows to mock the SetReadDeadline method.
+	MockSetReadDeadline func(t time.Time) error
+
+	// MockSetWriteDeadline allows to mock the SetWriteDeadline method.
+	MockSetWriteDeadline func(t time.Time) error
+
+	// MockClose allows to mock the Close method.
+	MockClose func() error
+}
+
+var _ model.WebSocketConn = &WebSocketConn{}
+
+// ReadMessage calls MockReadMessage.
+func (c *WebSocketConn) ReadMessage() (int, []byte, error) {
+	return c.MockReadMessage()
+}
+
+// WriteMessage calls MockWriteMessage.
+func (c *WebSocketConn) WriteMessage(messageType int, data []byte) error {
+	return c.MockWriteMessage(messageType, data)
+}
+
+// Subprotocol calls MockSubprotocol.
+func (c *WebSocketConn) Subprotocol() string {
+	return c.MockSubprotocol()
+}
+
+// LocalAddr calls MockLocalAddr.
+func (c *WebSocketConn) LocalAddr() net.Addr {
+	return c.MockLocalAddr()
+}
+
+// RemoteAddr calls MockRemoteAddr.
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.MockRemoteAddr()
+}
+
+// SetReadDeadline calls MockSetReadDeadline.
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return c.MockSetReadDeadline(t)
+}
+
+// SetWriteDeadline calls MockSetWriteDeadline.
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.MockSetWriteDeadline(t)
+}
+
+// Close calls MockClose.
+func (c *WebSocketConn) Close() error {
+	return c.MockClose()
+}
+
+// WebSocketDialer allows to mock model.WebSocketDialer.
+type WebSocketDialer struct {
+	// MockDialContext allows to mock the DialContext method.
+	MockDialContext func(ctx context.Context, URL string,
+		header http.Header) (model.WebSocketConn, *http.Response, error)
+
+	// MockCloseIdleConnections allows to mock the CloseIdleConnections method.
+	MockCloseIdleConnections func()
+}
+
+var _ model.WebSocketDialer = &WebSocketDialer{}
+
+// DialContext calls MockDialContext.
+func (d *WebSocketDialer) DialContext(ctx context.Context, URL string,
+	header http.Header) (model.WebSocketConn, *http.Response, error) {
+	return d.MockDialContext(ctx, URL, header)
+}
+
+// CloseIdleConnections calls MockCloseIdleConnections.
+func (d *WebSocketDialer) CloseIdleConnections() {
+	d.MockCloseIdleConnections()
+}
@@ -0,0 +1,146 @@
+package mocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+)
+
+func TestWebSocketConn(t *testing.T) {
+	t.Run("ReadMessage", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		c := &WebSocketConn{
+			MockReadMessage: func() (int, []byte, error) {
+				return 0, nil, expected
+			},
+		}
+		mt, data, err := c.ReadMessage()
+		if !errors.Is(err, expected) {
+			t.Fatal("not the error we expected", err)
+		}
+		if mt != 0 || data != nil {
+			t.Fatal("expected zero values")
+		}
+	})
+
+	t.Run("WriteMessage", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		c := &WebSocketConn{
+			MockWriteMessage: func(messageType int, data []byte) error {
+				return expected
+			},
+		}
+		err := c.WriteMessage(1, []byte("abc"))
+		if !errors.Is(err, expected) {
+			t.Fatal("not the error we expected", err)
+		}
+	})
+
+	t.Run("Subprotocol", func(t *testing.T) {
+		c := &WebSocketConn{
+			MockSubprotocol: func() string {
+				return "chat"
+			},
+		}
+		if c.Subprotocol() != "chat" {
+			t.Fatal("unexpected subprotocol")
+		}
+	})
+
+	t.Run("LocalAddr", func(t *testing.T) {
+		expected := &net.TCPAddr{Port: 1234}
+		c := &WebSocketConn{
+			MockLocalAddr: func() net.Addr {
+				return expected
+			},
+		}
+		if c.LocalAddr() != expected {
+			t.Fatal("unexpected addr")
+		}
+	})
+
+	t.Run("RemoteAddr", func(t *testing.T) {
+		expected := &net.TCPAddr{Port: 443}
+		c := &WebSocketConn{
+			MockRemoteAddr: func() net.Addr {
+				return expected
+			},
+		}
+		if c.RemoteAddr() != expected {
+			t.Fatal("unexpected addr")
+		}
+	})
+
+	t.Run("SetReadDeadline", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		c := &WebSocketConn{
+			MockSetReadDeadline: func(t time.Time) error {
+				return expected
+			},
+		}
+		if err := c.SetReadDeadline(time.Now()); !errors.Is(err, expected) {
+			t.Fatal("not the error we expected", err)
+		}
+	})
+
+	t.Run("SetWriteDeadline", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		c := &WebSocketConn{
+			MockSetWriteDeadline: func(t time.Time) error {
+				return expected
+			},
+		}
+		if err := c.SetWriteDeadline(time.Now()); !errors.Is(err, expected) {
+			t.Fatal("not the error we expected", err)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		c := &WebSocketConn{
+			MockClose: func() error {
+				return expected
+			},
+		}
+		if err := c.Close(); !errors.Is(err, expected) {
+			t.Fatal("not the error we expected", err)
+		}
+	})
+}
+
+func TestWebSocketDialer(t *testing.T) {
+	t.Run("DialContext", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		d := &WebSocketDialer{
+			MockDialContext: func(ctx context.Context, URL string,
+				header http.Header) (model.WebSocketConn, *http.Response, error) {
+				return nil, nil, expected
+			},
+		}
+		conn, resp, err := d.DialContext(context.Background(), "wss://example.com/", nil)
+		if !errors.Is(err, expected) {
+			t.Fatal("not the error we expected", err)
+		}
+		if conn != nil || resp != nil {
+			t.Fatal("expected nil conn and response")
+		}
+	})
+
+	t.Run("CloseIdleConnections", func(t *testing.T) {
+		var called bool
+		d := &WebSocketDialer{
+			MockCloseIdleConnections: func() {
+				called = true
+			},
+		}
+		d.CloseIdleConnections()
+		if !called {
+			t.Fatal("not called")
+		}
+	})
+}
@@ -178,6 +178,11 @@ type HTTPSSvc struct {
 
 	// IPv6 contains the IPv6 hints (which may be empty).
 	IPv6 []string
+
+	// ECHConfigList contains the OPTIONAL ECHConfigList (see
+	// draft-ietf-tls-esni), which is nil if the reply did not
+	// contain the "ech" SvcParam.
+	ECHConfigList []byte
 }
 
 // QUICListener listens for QUIC connections.
@@ -443,6 +448,8 @@ type Trace interface {
 	//
 	// - config is the non-nil TLS config we are using;
 	//
+	// - quicConfig is the possibly-nil QUIC config we are using;
+	//
 	// - err is the result of the handshake: either an error or nil;
 	//
 	// - finished is right after the handshake.
@@ -450,7 +457,7 @@ type Trace interface {
 	// The error passed to this function will always be wrapped such that the
 	// string returned by Error is an OONI error.
 	OnQUICHandshakeDone(started time.Time, remoteAddr string, qconn quic.EarlyConnection,
-		config *tls.Config, err error, finished time.Time)
+		config *tls.Config, quicConfig *quic.Config, err error, finished time.Time)
 }
 
 // UDPLikeConn is a net.PacketConn with some extra functions
@@ -498,3 +505,50 @@ type UnderlyingNetwork interface {
 	// GetaddrinfoResolverNetwork returns the resolver network.
 	GetaddrinfoResolverNetwork() string
 }
+
+// WebSocketConn is a WebSocket connection. The message types are
+// the ones defined by RFC 6455 (e.g., 1 for text and 2 for binary
+// messages), which netxlite exports as WebSocketTextMessage and
+// WebSocketBinaryMessage. Control messages are handled internally.
+type WebSocketConn interface {
+	// ReadMessage reads the next data message.
+	ReadMessage() (messageType int, data []byte, err error)
+
+	// WriteMessage writes a data message.
+	WriteMessage(messageType int, data []byte) error
+
+	// Subprotocol returns the subprotocol negotiated during the handshake.
+	Subprotocol() string
+
+	// LocalAddr returns the local address.
+	LocalAddr() net.Addr
+
+	// RemoteAddr returns the remote address.
+	RemoteAddr() net.Addr
+
+	// SetReadDeadline sets the read deadline.
+	SetReadDeadline(t time.Time) error
+
+	// SetWriteDeadline sets the write deadline.
+	SetWriteDeadline(t time.Time) error
+
+	// Close attempts to send a close message to the peer and then
+	// closes the underlying network connection.
+	Close() error
+}
+
+// WebSocketDialer dials WebSocket connections.
+type WebSocketDialer interface {
+	// DialContext connects to the given ws:// or wss:// URL using the
+	// given additional request headers and performs the WebSocket handshake.
+	//
+	// The returned *http.Response is the response to the upgrade request, which
+	// is also returned when the handshake fails because the server did not
+	// accept it. In such a case, the response body contains a snapshot of the
+	// server's response body. When the response is not nil, its Request field
+	// contains the upgrade request we sent.
+	DialContext(ctx context.Context, URL string, header http.Header) (WebSocketConn, *http.Response, error)
+
+	// CloseIdleConnections closes idle connections, if any.
+	CloseIdleConnections()
+}
@@ -0,0 +1,202 @@
+package netxlite
+
+//
+// Byte counting
+//
+
+import (
+	"context"
+	"net"
+
+	"github.com/bassosimone/oonidsl/internal/atomicx"
+	"github.com/bassosimone/oonidsl/internal/model"
+)
+
+// ByteCounter counts the bytes sent and received by the connections
+// it wraps. Each wrapped connection has its own counters, which you
+// can access using the ByteCountingConn interface, and additionally
+// updates the counters of the ByteCounter itself. Hence, you can use
+// a single ByteCounter to account the data usage of an experiment.
+//
+// A ByteCounter is a model.DialerWrapper, so you can pass it to the dialer
+// constructors (e.g., NewDialerWithResolver) to count TCP traffic. You
+// can use WrapQUICListener to count QUIC traffic.
+//
+// Use NewByteCounter to construct.
+type ByteCounter struct {
+	// received is the number of bytes received.
+	received atomicx.Int64
+
+	// sent is the number of bytes sent.
+	sent atomicx.Int64
+}
+
+var _ model.DialerWrapper = &ByteCounter{}
+
+// NewByteCounter creates a new ByteCounter.
+func NewByteCounter() *ByteCounter {
+	return &ByteCounter{}
+}
+
+// BytesReceived returns the number of bytes received so far.
+func (bc *ByteCounter) BytesReceived() int64 {
+	return bc.received.Load()
+}
+
+// BytesSent returns the number of bytes sent so far.
+func (bc *ByteCounter) BytesSent() int64 {
+	return bc.sent.Load()
+}
+
+// KibiBytesReceived returns the number of KiB received so far, which is
+// the unit used by model.Experiment to report data usage.
+func (bc *ByteCounter) KibiBytesReceived() float64 {
+	return float64(bc.BytesReceived()) / 1024
+}
+
+// KibiBytesSent is like KibiBytesReceived but for the bytes sent.
+func (bc *ByteCounter) KibiBytesSent() float64 {
+	return float64(bc.BytesSent()) / 1024
+}
+
+// WrapDialer implements model.DialerWrapper.
+func (bc *ByteCounter) WrapDialer(dialer model.Dialer) model.Dialer {
+	return &byteCounterDialer{Dialer: dialer, counter: bc}
+}
+
+// WrapQUICListener returns a QUICListener whose listening conns are counted.
+func (bc *ByteCounter) WrapQUICListener(listener model.QUICListener) model.QUICListener {
+	return &byteCounterQUICListener{QUICListener: listener, counter: bc}
+}
+
+// WrapNetConn returns a version of the given conn that counts bytes. The
+// returned conn implements the ByteCountingConn interface.
+func (bc *ByteCounter) WrapNetConn(conn net.Conn) net.Conn {
+	return &byteCounterConn{Conn: conn, conn: &ByteCounter{}, global: bc}
+}
+
+// WrapUDPLikeConn returns a version of the given conn that counts bytes. The
+// returned conn implements the ByteCountingConn interface.
+func (bc *ByteCounter) WrapUDPLikeConn(conn model.UDPLikeConn) model.UDPLikeConn {
+	return &byteCounterUDPLikeConn{UDPLikeConn: conn, conn: &ByteCounter{}, global: bc}
+}
+
+// ByteCountingConn is the interface implemented by the conns wrapped
+// by a ByteCounter, which allows to access per-connection counters.
+type ByteCountingConn interface {
+	// BytesReceived returns the bytes received by this conn.
+	BytesReceived() int64
+
+	// BytesSent returns the bytes sent by this conn.
+	BytesSent() int64
+}
+
+// byteCounterAccount updates the per-connection and the global counters.
+func byteCounterAccount(conn, global *atomicx.Int64, count int) {
+	if count > 0 {
+		conn.Add(int64(count))
+		global.Add(int64(count))
+	}
+}
+
+// byteCounterDialer is the model.Dialer returned by ByteCounter.WrapDialer.
+type byteCounterDialer struct {
+	model.Dialer
+	counter *ByteCounter
+}
+
+// DialContext implements model.Dialer.DialContext.
+func (d *byteCounterDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.counter.WrapNetConn(conn), nil
+}
+
+// byteCounterConn is the net.Conn returned by ByteCounter.WrapNetConn.
+type byteCounterConn struct {
+	net.Conn
+	conn   *ByteCounter
+	global *ByteCounter
+}
+
+var _ ByteCountingConn = &byteCounterConn{}
+
+// Read implements net.Conn.Read.
+func (c *byteCounterConn) Read(b []byte) (int, error) {
+	count, err := c.Conn.Read(b)
+	byteCounterAccount(&c.conn.received, &c.global.received, count)
+	return count, err
+}
+
+// Write implements net.Conn.Write.
+func (c *byteCounterConn) Write(b []byte) (int, error) {
+	count, err := c.Conn.Write(b)
+	byteCounterAccount(&c.conn.sent, &c.global.sent, count)
+	return count, err
+}
+
+// BytesReceived implements ByteCountingConn.
+func (c *byteCounterConn) BytesReceived() int64 {
+	return c.conn.BytesReceived()
+}
+
+// BytesSent implements ByteCountingConn.
+func (c *byteCounterConn) BytesSent() int64 {
+	return c.conn.BytesSent()
+}
+
+// byteCounterQUICListener is the model.QUICListener returned by ByteCounter.WrapQUICListener.
+type byteCounterQUICListener struct {
+	model.QUICListener
+	counter *ByteCounter
+}
+
+// Listen implements model.QUICListener.Listen.
+func (ql *byteCounterQUICListener) Listen(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	return ql.listenContext(context.Background(), addr)
+}
+
+// listenContext implements quicListenerContext.
+func (ql *byteCounterQUICListener) listenContext(
+	ctx context.Context, addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	pconn, err := quicListenerListenContext(ctx, ql.QUICListener, addr)
+	if err != nil {
+		return nil, err
+	}
+	return ql.counter.WrapUDPLikeConn(pconn), nil
+}
+
+// byteCounterUDPLikeConn is the model.UDPLikeConn returned by ByteCounter.WrapUDPLikeConn.
+type byteCounterUDPLikeConn struct {
+	model.UDPLikeConn
+	conn   *ByteCounter
+	global *ByteCounter
+}
+
+var _ ByteCountingConn = &byteCounterUDPLikeConn{}
+
+// WriteTo implements model.UDPLikeConn.WriteTo.
+func (c *byteCounterUDPLikeConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	count, err := c.UDPLikeConn.WriteTo(p, addr)
+	byteCounterAccount(&c.conn.sent, &c.global.sent, count)
+	return count, err
+}
+
+// ReadFrom implements model.UDPLikeConn.ReadFrom.
+func (c *byteCounterUDPLikeConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	count, addr, err := c.UDPLikeConn.ReadFrom(p)
+	byteCounterAccount(&c.conn.received, &c.global.received, count)
+	return count, addr, err
+}
+
+// BytesReceived implements ByteCountingConn.
+func (c *byteCounterUDPLikeConn) BytesReceived() int64 {
+	return c.conn.BytesReceived()
+}
+
+// BytesSent implements ByteCountingConn.
+func (c *byteCounterUDPLikeConn) BytesSent() int64 {
+	return c.conn.BytesSent()
+}
@@ -0,0 +1,207 @@
+package netxlite
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/model/mocks"
+)
+
+func TestByteCounter(t *testing.T) {
+	t.Run("NewByteCounter returns zero counters", func(t *testing.T) {
+		bc := NewByteCounter()
+		if bc.BytesReceived() != 0 || bc.BytesSent() != 0 {
+			t.Fatal("expected zero bytes")
+		}
+		if bc.KibiBytesReceived() != 0 || bc.KibiBytesSent() != 0 {
+			t.Fatal("expected zero kibibytes")
+		}
+	})
+
+	t.Run("KibiBytes are computed correctly", func(t *testing.T) {
+		bc := NewByteCounter()
+		bc.received.Add(1536)
+		bc.sent.Add(512)
+		if bc.KibiBytesReceived() != 1.5 {
+			t.Fatal("unexpected kibibytes received", bc.KibiBytesReceived())
+		}
+		if bc.KibiBytesSent() != 0.5 {
+			t.Fatal("unexpected kibibytes sent", bc.KibiBytesSent())
+		}
+	})
+
+	t.Run("WrapDialer produces the expected chain", func(t *testing.T) {
+		bc := NewByteCounter()
+		d := NewDialerWithoutResolver(model.DiscardLogger, bc)
+		logger := d.(*dialerLogger)
+		reso := logger.Dialer.(*dialerResolverWithTracing)
+		logger = reso.Dialer.(*dialerLogger)
+		bcd := logger.Dialer.(*byteCounterDialer)
+		if bcd.counter != bc {
+			t.Fatal("invalid counter")
+		}
+		_ = bcd.Dialer.(*dialerErrWrapper)
+	})
+}
+
+func TestByteCounterDialer(t *testing.T) {
+	t.Run("on success", func(t *testing.T) {
+		expected := &mocks.Conn{}
+		bc := NewByteCounter()
+		d := bc.WrapDialer(&mocks.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return expected, nil
+			},
+		})
+		conn, err := d.DialContext(context.Background(), "tcp", "8.8.8.8:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bcc := conn.(*byteCounterConn)
+		if bcc.Conn != expected {
+			t.Fatal("unexpected conn")
+		}
+		if bcc.global != bc {
+			t.Fatal("unexpected counter")
+		}
+	})
+
+	t.Run("on failure", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		bc := NewByteCounter()
+		d := bc.WrapDialer(&mocks.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, expected
+			},
+		})
+		conn, err := d.DialContext(context.Background(), "tcp", "8.8.8.8:443")
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+}
+
+func TestByteCounterConn(t *testing.T) {
+	t.Run("we count per connection and globally", func(t *testing.T) {
+		bc := NewByteCounter()
+		underlying := &mocks.Conn{
+			MockRead: func(b []byte) (int, error) {
+				return len(b), nil
+			},
+			MockWrite: func(b []byte) (int, error) {
+				return len(b), nil
+			},
+		}
+		first, second := bc.WrapNetConn(underlying), bc.WrapNetConn(underlying)
+		if _, err := first.Read(make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := first.Write(make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := second.Read(make([]byte, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		fc := first.(ByteCountingConn)
+		if fc.BytesReceived() != 100 || fc.BytesSent() != 10 {
+			t.Fatal("unexpected first conn counters")
+		}
+		sc := second.(ByteCountingConn)
+		if sc.BytesReceived() != 1000 || sc.BytesSent() != 0 {
+			t.Fatal("unexpected second conn counters")
+		}
+		if bc.BytesReceived() != 1100 || bc.BytesSent() != 10 {
+			t.Fatal("unexpected global counters")
+		}
+	})
+
+	t.Run("we count partial I/O on failure", func(t *testing.T) {
+		bc := NewByteCounter()
+		conn := bc.WrapNetConn(&mocks.Conn{
+			MockRead: func(b []byte) (int, error) {
+				return 4, io.EOF
+			},
+			MockWrite: func(b []byte) (int, error) {
+				return 0, io.ErrClosedPipe
+			},
+		})
+		if _, err := conn.Read(make([]byte, 10)); !errors.Is(err, io.EOF) {
+			t.Fatal("unexpected err", err)
+		}
+		if _, err := conn.Write(make([]byte, 10)); !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatal("unexpected err", err)
+		}
+		if bc.BytesReceived() != 4 || bc.BytesSent() != 0 {
+			t.Fatal("unexpected global counters")
+		}
+	})
+}
+
+func TestByteCounterQUICListener(t *testing.T) {
+	t.Run("on success", func(t *testing.T) {
+		expected := &mocks.UDPLikeConn{}
+		bc := NewByteCounter()
+		ql := bc.WrapQUICListener(&mocks.QUICListener{
+			MockListen: func(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+				return expected, nil
+			},
+		})
+		pconn, err := ql.Listen(&net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bcc := pconn.(*byteCounterUDPLikeConn)
+		if bcc.UDPLikeConn != expected {
+			t.Fatal("unexpected conn")
+		}
+	})
+
+	t.Run("on failure", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		bc := NewByteCounter()
+		ql := bc.WrapQUICListener(&mocks.QUICListener{
+			MockListen: func(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+				return nil, expected
+			},
+		})
+		pconn, err := ql.Listen(&net.UDPAddr{})
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if pconn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+}
+
+func TestByteCounterUDPLikeConn(t *testing.T) {
+	bc := NewByteCounter()
+	pconn := bc.WrapUDPLikeConn(&mocks.UDPLikeConn{
+		MockWriteTo: func(p []byte, addr net.Addr) (int, error) {
+			return len(p), nil
+		},
+		MockReadFrom: func(p []byte) (int, net.Addr, error) {
+			return 1200, nil, nil
+		},
+	})
+	if _, err := pconn.WriteTo(make([]byte, 1252), &net.UDPAddr{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pconn.ReadFrom(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	bcc := pconn.(ByteCountingConn)
+	if bcc.BytesReceived() != 1200 || bcc.BytesSent() != 1252 {
+		t.Fatal("unexpected conn counters")
+	}
+	if bc.BytesReceived() != 1200 || bc.BytesSent() != 1252 {
+		t.Fatal("unexpected global counters")
+	}
+}
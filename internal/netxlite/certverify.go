@@ -0,0 +1,280 @@
+package netxlite
+
+//
+// Certificate chain verification with reports
+//
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// ErrCertPinMismatch indicates that no certificate in the chain matches
+// the SPKI pins configured for the CertVerifier.
+var ErrCertPinMismatch = errors.New("netxlite: no certificate matches the SPKI pins")
+
+// CertVerifier verifies certificate chains like the standard library does
+// and additionally produces a CertVerificationReport explaining why the
+// verification succeeded or failed. It also supports SPKI pinning.
+//
+// Use NewCertVerifier to construct.
+type CertVerifier struct {
+	// pins contains the SPKI pins.
+	pins map[string]bool
+
+	// roots contains the root CAs.
+	roots *x509.CertPool
+
+	// timeNow is the OPTIONAL function returning the current time (for testing).
+	timeNow func() time.Time
+}
+
+// NewCertVerifier creates a new CertVerifier using the given roots and
+// SPKI pins. A nil roots means we use the default cert pool (i.e., the
+// same we use when tls.Config.RootCAs is nil). Each pin is the base64
+// encoding of the SHA256 of a certificate's SubjectPublicKeyInfo, which
+// you can compute using CertSPKIPin. When there are pins, verification also
+// requires a certificate in the verified chain to match one of them.
+func NewCertVerifier(roots *x509.CertPool, pins ...string) *CertVerifier {
+	if roots == nil {
+		roots = defaultCertPool
+	}
+	v := &CertVerifier{
+		pins:    map[string]bool{},
+		roots:   roots,
+		timeNow: nil,
+	}
+	for _, pin := range pins {
+		v.pins[pin] = true
+	}
+	return v
+}
+
+// CertSPKIPin returns the SPKI pin of the given certificate.
+func CertSPKIPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// CertVerificationCert describes a certificate inside a CertVerificationReport.
+type CertVerificationCert struct {
+	// Subject is the certificate subject.
+	Subject string `json:"subject"`
+
+	// Issuer is the certificate issuer.
+	Issuer string `json:"issuer"`
+
+	// NotBefore is the beginning of the validity period.
+	NotBefore time.Time `json:"not_before"`
+
+	// NotAfter is the end of the validity period.
+	NotAfter time.Time `json:"not_after"`
+
+	// SPKIPin is the SPKI pin of the certificate (see CertSPKIPin).
+	SPKIPin string `json:"spki_pin"`
+}
+
+// newCertVerificationCert creates a new CertVerificationCert.
+func newCertVerificationCert(cert *x509.Certificate) *CertVerificationCert {
+	return &CertVerificationCert{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		SPKIPin:   CertSPKIPin(cert),
+	}
+}
+
+// CertVerificationReport explains the result of a certificate verification.
+type CertVerificationReport struct {
+	// ServerName is the name for which we verified the certificate.
+	ServerName string `json:"server_name"`
+
+	// Verified indicates whether the verification succeeded.
+	Verified bool `json:"verified"`
+
+	// Failure is the OONI failure string or nil on success.
+	Failure *string `json:"failure"`
+
+	// Presented contains the certificates presented by the server.
+	Presented []*CertVerificationCert `json:"presented"`
+
+	// Chain contains the verified chain, from the leaf certificate to the
+	// root certificate, or is empty if we could not build any chain.
+	Chain []*CertVerificationCert `json:"chain"`
+
+	// Anchor is the root certificate anchoring Chain or nil.
+	Anchor *CertVerificationCert `json:"anchor"`
+
+	// Expired indicates that a presented certificate has expired.
+	Expired bool `json:"expired"`
+
+	// NotYetValid indicates that a presented certificate is not yet valid.
+	NotYetValid bool `json:"not_yet_valid"`
+
+	// HostnameMismatch indicates that the leaf certificate is
+	// not valid for ServerName.
+	HostnameMismatch bool `json:"hostname_mismatch"`
+
+	// MissingIssuer is the issuer of the topmost certificate we could
+	// link starting from the leaf, when we could not build a chain because
+	// neither the presented certificates nor the roots contain such an
+	// issuer. This field is empty when the topmost certificate is self
+	// signed (see UntrustedRoot) or when we could build a chain.
+	MissingIssuer string `json:"missing_issuer"`
+
+	// UntrustedRoot indicates that the chain presented by the server ends
+	// with a self-signed certificate not included in the roots.
+	UntrustedRoot bool `json:"untrusted_root"`
+
+	// PinMatched is nil when there are no pins, and otherwise indicates
+	// whether a certificate in the verified chain matches a pin.
+	PinMatched *bool `json:"pin_matched"`
+}
+
+// Verify verifies the certificates presented by a server (leaf first) for the
+// given server name and returns a report along with the error that occurred,
+// if any. The error is the same error the standard library would return, or
+// ErrCertPinMismatch, so ClassifyTLSHandshakeError can classify it.
+func (v *CertVerifier) Verify(
+	serverName string, certs []*x509.Certificate) (*CertVerificationReport, error) {
+	report := &CertVerificationReport{ServerName: serverName}
+	err := v.verify(report, certs)
+	if err != nil {
+		failure := ClassifyTLSHandshakeError(err)
+		report.Failure = &failure
+	}
+	report.Verified = err == nil
+	return report, err
+}
+
+// verify implements Verify.
+func (v *CertVerifier) verify(report *CertVerificationReport, certs []*x509.Certificate) error {
+	if len(certs) <= 0 {
+		return x509.CertificateInvalidError{Detail: "no certificates"}
+	}
+	now := v.now()
+	intermediates := x509.NewCertPool()
+	for idx, cert := range certs {
+		report.Presented = append(report.Presented, newCertVerificationCert(cert))
+		report.Expired = report.Expired || now.After(cert.NotAfter)
+		report.NotYetValid = report.NotYetValid || now.Before(cert.NotBefore)
+		if idx > 0 {
+			intermediates.AddCert(cert)
+		}
+	}
+	leaf := certs[0]
+	report.HostnameMismatch = leaf.VerifyHostname(report.ServerName) != nil
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       report.ServerName,
+		Intermediates: intermediates,
+		Roots:         v.roots,
+		CurrentTime:   now,
+	})
+	if err != nil {
+		var unknownAuthority x509.UnknownAuthorityError
+		if errors.As(err, &unknownAuthority) {
+			v.explainUnknownAuthority(report, certs)
+		}
+		v.maybeCheckPins(report, certs)
+		return err
+	}
+	for _, cert := range chains[0] {
+		report.Chain = append(report.Chain, newCertVerificationCert(cert))
+	}
+	report.Anchor = report.Chain[len(report.Chain)-1]
+	if !v.maybeCheckPins(report, chains[0]) {
+		return ErrCertPinMismatch
+	}
+	return nil
+}
+
+// explainUnknownAuthority fills the report fields explaining why we could
+// not build a chain to any of the roots.
+func (v *CertVerifier) explainUnknownAuthority(report *CertVerificationReport, certs []*x509.Certificate) {
+	top := certs[0]
+	used := map[*x509.Certificate]bool{top: true}
+	for {
+		issuer := certVerifyFindIssuer(top, certs, used)
+		if issuer == nil {
+			break
+		}
+		used[issuer] = true
+		top = issuer
+	}
+	if bytes.Equal(top.RawIssuer, top.RawSubject) &&
+		top.CheckSignature(top.SignatureAlgorithm, top.RawTBSCertificate, top.Signature) == nil {
+		report.UntrustedRoot = true
+		return
+	}
+	report.MissingIssuer = top.Issuer.String()
+}
+
+// certVerifyFindIssuer returns the unused certificate among certs that signed cert or nil.
+func certVerifyFindIssuer(cert *x509.Certificate, certs []*x509.Certificate,
+	used map[*x509.Certificate]bool) *x509.Certificate {
+	for _, candidate := range certs {
+		if used[candidate] || !bytes.Equal(candidate.RawSubject, cert.RawIssuer) {
+			continue
+		}
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// maybeCheckPins checks whether any of certs matches the pins, sets the
+// report accordingly, and returns whether verification should proceed.
+func (v *CertVerifier) maybeCheckPins(report *CertVerificationReport, certs []*x509.Certificate) bool {
+	if len(v.pins) <= 0 {
+		return true
+	}
+	matched := false
+	for _, cert := range certs {
+		if v.pins[CertSPKIPin(cert)] {
+			matched = true
+			break
+		}
+	}
+	report.PinMatched = &matched
+	return matched
+}
+
+// now returns the current time.
+func (v *CertVerifier) now() time.Time {
+	if v.timeNow != nil {
+		return v.timeNow()
+	}
+	return time.Now()
+}
+
+// WrapTLSConfig returns a clone of config that verifies the server certificates
+// using this CertVerifier rather than using the standard library verification.
+// We call the OPTIONAL onReport callback with the report of each verification.
+// Note that the returned config has InsecureSkipVerify set to true, because
+// that is how we disable the standard library verification, and we ignore the
+// RootCAs, because we use the roots configured for this CertVerifier.
+func (v *CertVerifier) WrapTLSConfig(
+	config *tls.Config, onReport func(report *CertVerificationReport)) *tls.Config {
+	config = ClonedTLSConfigOrNewEmptyConfig(config)
+	serverName := config.ServerName
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		name := serverName
+		if name == "" {
+			name = state.ServerName
+		}
+		report, err := v.Verify(name, state.PeerCertificates)
+		if onReport != nil {
+			onReport(report)
+		}
+		return err
+	}
+	return config
+}
@@ -0,0 +1,230 @@
+package netxlite
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// certVerifyTestCert is a certificate along with its private key.
+type certVerifyTestCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCertVerifyTestCert creates a certificate signed by parent or a
+// self-signed certificate when parent is nil.
+func newCertVerifyTestCert(t *testing.T, name string, isCA bool,
+	parent *certVerifyTestCert, notBefore, notAfter time.Time) *certVerifyTestCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{name}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+	}
+	signer, signerCert := key, template
+	if parent != nil {
+		signer, signerCert = parent.key, parent.cert
+	}
+	data, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certVerifyTestCert{cert: cert, key: key}
+}
+
+func TestCertVerifier(t *testing.T) {
+	now := time.Now()
+	notBefore, notAfter := now.Add(-time.Hour), now.Add(time.Hour)
+	root := newCertVerifyTestCert(t, "Root CA", true, nil, notBefore, notAfter)
+	intermediate := newCertVerifyTestCert(t, "Intermediate CA", true, root, notBefore, notAfter)
+	leaf := newCertVerifyTestCert(t, "www.example.com", false, intermediate, notBefore, notAfter)
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+
+	t.Run("with a valid chain", func(t *testing.T) {
+		v := NewCertVerifier(roots)
+		report, err := v.Verify("www.example.com", []*x509.Certificate{leaf.cert, intermediate.cert})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Verified || report.Failure != nil {
+			t.Fatal("expected verified report")
+		}
+		if len(report.Chain) != 3 || len(report.Presented) != 2 {
+			t.Fatal("unexpected chain length")
+		}
+		if report.Anchor.Subject != "CN=Root CA" {
+			t.Fatal("unexpected anchor", report.Anchor.Subject)
+		}
+		if report.PinMatched != nil {
+			t.Fatal("expected nil PinMatched")
+		}
+	})
+
+	t.Run("with a missing intermediate", func(t *testing.T) {
+		v := NewCertVerifier(roots)
+		report, err := v.Verify("www.example.com", []*x509.Certificate{leaf.cert})
+		var unknownAuthority x509.UnknownAuthorityError
+		if !errors.As(err, &unknownAuthority) {
+			t.Fatal("unexpected err", err)
+		}
+		if report.Verified || *report.Failure != FailureSSLUnknownAuthority {
+			t.Fatal("unexpected report")
+		}
+		if report.MissingIssuer != "CN=Intermediate CA" || report.UntrustedRoot {
+			t.Fatal("unexpected missing issuer", report.MissingIssuer)
+		}
+		if len(report.Chain) != 0 || report.Anchor != nil {
+			t.Fatal("expected no chain")
+		}
+	})
+
+	t.Run("with an untrusted root", func(t *testing.T) {
+		v := NewCertVerifier(x509.NewCertPool())
+		report, _ := v.Verify("www.example.com",
+			[]*x509.Certificate{leaf.cert, intermediate.cert, root.cert})
+		if report.Verified || !report.UntrustedRoot || report.MissingIssuer != "" {
+			t.Fatalf("unexpected report %+v", report)
+		}
+	})
+
+	t.Run("with the wrong hostname", func(t *testing.T) {
+		v := NewCertVerifier(roots)
+		report, err := v.Verify("www.example.org", []*x509.Certificate{leaf.cert, intermediate.cert})
+		if ClassifyTLSHandshakeError(err) != FailureSSLInvalidHostname {
+			t.Fatal("unexpected err", err)
+		}
+		if !report.HostnameMismatch || report.Expired {
+			t.Fatal("unexpected report")
+		}
+	})
+
+	t.Run("with an expired leaf", func(t *testing.T) {
+		v := NewCertVerifier(roots)
+		v.timeNow = func() time.Time {
+			return notAfter.Add(time.Minute)
+		}
+		report, err := v.Verify("www.example.com", []*x509.Certificate{leaf.cert, intermediate.cert})
+		if ClassifyTLSHandshakeError(err) != FailureSSLInvalidCertificate {
+			t.Fatal("unexpected err", err)
+		}
+		if !report.Expired || report.NotYetValid {
+			t.Fatal("unexpected report")
+		}
+	})
+
+	t.Run("without certificates", func(t *testing.T) {
+		v := NewCertVerifier(roots)
+		report, err := v.Verify("www.example.com", nil)
+		if ClassifyTLSHandshakeError(err) != FailureSSLInvalidCertificate {
+			t.Fatal("unexpected err", err)
+		}
+		if report.Verified {
+			t.Fatal("expected not verified")
+		}
+	})
+
+	t.Run("with a matching pin", func(t *testing.T) {
+		v := NewCertVerifier(roots, CertSPKIPin(intermediate.cert))
+		report, err := v.Verify("www.example.com", []*x509.Certificate{leaf.cert, intermediate.cert})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.PinMatched == nil || !*report.PinMatched {
+			t.Fatal("expected a pin match")
+		}
+	})
+
+	t.Run("without a matching pin", func(t *testing.T) {
+		other := newCertVerifyTestCert(t, "Other CA", true, nil, notBefore, notAfter)
+		v := NewCertVerifier(roots, CertSPKIPin(other.cert))
+		report, err := v.Verify("www.example.com", []*x509.Certificate{leaf.cert, intermediate.cert})
+		if !errors.Is(err, ErrCertPinMismatch) {
+			t.Fatal("unexpected err", err)
+		}
+		if report.PinMatched == nil || *report.PinMatched || report.Verified {
+			t.Fatal("unexpected report")
+		}
+		if len(report.Chain) != 3 {
+			t.Fatal("we should still report the chain")
+		}
+	})
+
+	t.Run("WrapTLSConfig", func(t *testing.T) {
+		// handshake runs a TLS handshake where the server uses the given chain
+		handshake := func(t *testing.T, v *CertVerifier, chain ...*certVerifyTestCert) (
+			*CertVerificationReport, error) {
+			server, client := net.Pipe()
+			defer client.Close()
+			tlsCert := tls.Certificate{PrivateKey: chain[0].key}
+			for _, entry := range chain {
+				tlsCert.Certificate = append(tlsCert.Certificate, entry.cert.Raw)
+			}
+			go func() {
+				defer server.Close()
+				tls.Server(server, &tls.Config{Certificates: []tls.Certificate{tlsCert}}).Handshake()
+			}()
+			var report *CertVerificationReport
+			config := v.WrapTLSConfig(&tls.Config{ServerName: "www.example.com"},
+				func(r *CertVerificationReport) {
+					report = r
+				})
+			err := tls.Client(client, config).HandshakeContext(context.Background())
+			return report, err
+		}
+
+		t.Run("on success", func(t *testing.T) {
+			report, err := handshake(t, NewCertVerifier(roots), leaf, intermediate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report == nil || !report.Verified {
+				t.Fatal("unexpected report")
+			}
+		})
+
+		t.Run("on failure", func(t *testing.T) {
+			report, err := handshake(t, NewCertVerifier(roots), leaf)
+			if ClassifyTLSHandshakeError(err) != FailureSSLUnknownAuthority {
+				t.Fatal("unexpected err", err)
+			}
+			if report == nil || report.MissingIssuer != "CN=Intermediate CA" {
+				t.Fatal("unexpected report")
+			}
+		})
+	})
+
+	t.Run("NewCertVerifier with nil roots uses the default pool", func(t *testing.T) {
+		v := NewCertVerifier(nil)
+		if v.roots != defaultCertPool {
+			t.Fatal("unexpected roots")
+		}
+	})
+}
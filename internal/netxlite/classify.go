@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/bassosimone/oonidsl/internal/scrubber"
+	"github.com/gorilla/websocket"
 	"github.com/lucas-clemente/quic-go"
 )
 
@@ -245,6 +246,100 @@ func quicIsCertificateError(alert uint8) bool {
 	}
 }
 
+// These strings allow us to string-match HTTP/2 errors. We cannot use
+// errors.As because both net/http and oohttp use a bundled copy of the
+// golang.org/x/net/http2 code where the error types are unexported.
+const (
+	HTTP2StreamErrorPrefix     = "stream error: stream ID "
+	HTTP2GoAwayErrorPrefix     = "http2: server sent GOAWAY and closed the connection"
+	HTTP2ConnectionErrorPrefix = "connection error: "
+)
+
+// ClassifyHTTPStreamError maps an error occurred after the handshake while
+// performing an HTTP round trip or reading the response body to an OONI
+// failure string. We put inside this classifier the errors that depend on
+// HTTP/2 and HTTP/3 framing, i.e., HTTP/2 RST_STREAM, GOAWAY and connection
+// errors, and QUIC errors closing a stream or the whole connection.
+//
+// If the input error is an *ErrWrapper we don't perform
+// the classification again and we return its Failure.
+//
+// If this classifier fails, it calls ClassifyGenericError
+// and returns to the caller its return value.
+func ClassifyHTTPStreamError(err error) string {
+
+	// Robustness: handle the case where we're passed a wrapped error.
+	var errwrapper *ErrWrapper
+	if errors.As(err, &errwrapper) {
+		return errwrapper.Error() // we've already wrapped it
+	}
+
+	if failure := classifyQUICStreamError(err); failure != "" {
+		return failure
+	}
+	if failure := classifyHTTP2StreamError(err); failure != "" {
+		return failure
+	}
+	return ClassifyGenericError(err)
+}
+
+// classifyQUICStreamError is the subset of ClassifyHTTPStreamError that
+// handles QUIC errors. This function returns an empty string if it cannot
+// classify the error.
+func classifyQUICStreamError(err error) string {
+	var (
+		streamError      *quic.StreamError
+		statelessReset   *quic.StatelessResetError
+		idleTimeout      *quic.IdleTimeoutError
+		applicationError *quic.ApplicationError
+		transportError   *quic.TransportError
+	)
+
+	if errors.As(err, &streamError) {
+		// the peer reset the stream (e.g., using H3_REQUEST_CANCELLED)
+		return FailureHTTP3StreamReset
+	}
+	if errors.As(err, &statelessReset) {
+		return FailureQUICStatelessReset
+	}
+	if errors.As(err, &idleTimeout) {
+		return FailureGenericTimeoutError
+	}
+	if errors.As(err, &applicationError) {
+		return FailureQUICApplicationError
+	}
+	if errors.As(err, &transportError) {
+		if transportError.ErrorCode == quic.ConnectionRefused {
+			return FailureConnectionRefused
+		}
+		// See the corresponding comment in ClassifyQUICHandshakeError.
+		if transportError.ErrorCode == quic.InternalError {
+			if s := failuresMap[transportError.ErrorMessage]; s != "" {
+				return s
+			}
+		}
+		return FailureQUICTransportError
+	}
+	return "" // not found
+}
+
+// classifyHTTP2StreamError is the subset of ClassifyHTTPStreamError that
+// handles HTTP/2 errors. This function returns an empty string if it cannot
+// classify the error.
+func classifyHTTP2StreamError(err error) string {
+	s := err.Error()
+	if strings.Contains(s, HTTP2StreamErrorPrefix) {
+		return FailureHTTP2StreamReset
+	}
+	if strings.Contains(s, HTTP2GoAwayErrorPrefix) {
+		return FailureHTTP2Goaway
+	}
+	if strings.HasPrefix(s, HTTP2ConnectionErrorPrefix) {
+		return FailureHTTP2ConnectionError
+	}
+	return "" // not found
+}
+
 // ErrDNSBogon indicates that we found a bogon address. Code that
 // filters for DNS bogons MUST use this error.
 var ErrDNSBogon = errors.New("dns: detected bogon address")
@@ -357,5 +452,44 @@ func ClassifyTLSHandshakeError(err error) string {
 		// Test case: https://expired.badssl.com/
 		return FailureSSLInvalidCertificate
 	}
+	if errors.Is(err, ErrCertPinMismatch) {
+		// There is no specific failure for pinning, so we use the failure
+		// that is closest in meaning and let the CertVerificationReport
+		// explain what actually happened.
+		return FailureSSLInvalidCertificate
+	}
+	if errors.Is(err, ErrECHRejected) || errors.Is(err, ErrECHStripped) {
+		// There is no specific failure for ECH, so we use a generic
+		// failure and let the ECH status explain what actually happened.
+		return FailureSSLFailedHandshake
+	}
+	return ClassifyGenericError(err)
+}
+
+// ClassifyWebSocketError maps an error occurred during the WebSocket
+// handshake or while exchanging messages to an OONI failure string.
+//
+// If the input error is an *ErrWrapper we don't perform
+// the classification again and we return its Failure.
+//
+// If this classifier fails, it calls ClassifyGenericError and
+// returns to the caller its return value.
+func ClassifyWebSocketError(err error) string {
+
+	// Robustness: handle the case where we're passed a wrapped error.
+	var errwrapper *ErrWrapper
+	if errors.As(err, &errwrapper) {
+		return errwrapper.Error() // we've already wrapped it
+	}
+
+	if errors.Is(err, websocket.ErrBadHandshake) {
+		// the server did not accept the upgrade (e.g., a block page)
+		return FailureWebSocketBadHandshake
+	}
+	var closeError *websocket.CloseError
+	if errors.As(err, &closeError) {
+		// the peer sent us a close message
+		return FailureWebSocketClosed
+	}
 	return ClassifyGenericError(err)
 }
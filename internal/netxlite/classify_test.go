@@ -4,12 +4,15 @@ import (
 	"context"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/pion/stun"
+	"golang.org/x/net/http2"
 )
 
 func TestClassifyGenericError(t *testing.T) {
@@ -332,9 +335,131 @@ func TestClassifyTLSHandshakeError(t *testing.T) {
 		}
 	})
 
+	t.Run("for ErrCertPinMismatch", func(t *testing.T) {
+		if ClassifyTLSHandshakeError(ErrCertPinMismatch) != FailureSSLInvalidCertificate {
+			t.Fatal("unexpected result")
+		}
+	})
+
+	t.Run("for ErrECHRejected and ErrECHStripped", func(t *testing.T) {
+		for _, err := range []error{ErrECHRejected, ErrECHStripped} {
+			err = &ECHError{Err: err, Status: ECHStatusStripped}
+			if ClassifyTLSHandshakeError(err) != FailureSSLFailedHandshake {
+				t.Fatal("unexpected result")
+			}
+		}
+	})
+
 	t.Run("for another kind of error", func(t *testing.T) {
 		if ClassifyTLSHandshakeError(io.EOF) != FailureEOFError {
 			t.Fatal("unexpected result")
 		}
 	})
 }
+
+func TestClassifyHTTPStreamError(t *testing.T) {
+	t.Run("for input being already an ErrWrapper", func(t *testing.T) {
+		err := &ErrWrapper{Failure: FailureEOFError}
+		if ClassifyHTTPStreamError(err) != FailureEOFError {
+			t.Fatal("did not classify existing ErrWrapper correctly")
+		}
+	})
+
+	var testcases = []struct {
+		name   string
+		err    error
+		expect string
+	}{{
+		name:   "for an HTTP/3 stream reset",
+		err:    &quic.StreamError{StreamID: 0, ErrorCode: 0x10c},
+		expect: FailureHTTP3StreamReset,
+	}, {
+		name:   "for a stateless reset",
+		err:    &quic.StatelessResetError{},
+		expect: FailureQUICStatelessReset,
+	}, {
+		name:   "for an idle timeout",
+		err:    &quic.IdleTimeoutError{},
+		expect: FailureGenericTimeoutError,
+	}, {
+		name:   "for a QUIC application error",
+		err:    &quic.ApplicationError{Remote: true, ErrorCode: 0x101},
+		expect: FailureQUICApplicationError,
+	}, {
+		name:   "for a wrapped QUIC application error",
+		err:    fmt.Errorf("http3: %w", &quic.ApplicationError{ErrorCode: 0x102}),
+		expect: FailureQUICApplicationError,
+	}, {
+		name:   "for a QUIC connection refused error",
+		err:    &quic.TransportError{ErrorCode: quic.ConnectionRefused},
+		expect: FailureConnectionRefused,
+	}, {
+		name:   "for a QUIC TransportError wrapping an OONI error",
+		err:    &quic.TransportError{ErrorCode: quic.InternalError, ErrorMessage: FailureHostUnreachable},
+		expect: FailureHostUnreachable,
+	}, {
+		name:   "for another QUIC TransportError",
+		err:    &quic.TransportError{Remote: true, ErrorCode: quic.ProtocolViolation},
+		expect: FailureQUICTransportError,
+	}, {
+		name:   "for an HTTP/2 RST_STREAM",
+		err:    http2.StreamError{StreamID: 1, Code: http2.ErrCodeRefusedStream},
+		expect: FailureHTTP2StreamReset,
+	}, {
+		name:   "for an HTTP/2 RST_STREAM with a cause",
+		err:    http2.StreamError{StreamID: 3, Code: http2.ErrCodeCancel, Cause: io.EOF},
+		expect: FailureHTTP2StreamReset,
+	}, {
+		name:   "for an HTTP/2 GOAWAY",
+		err:    http2.GoAwayError{LastStreamID: 1, ErrCode: http2.ErrCodeEnhanceYourCalm},
+		expect: FailureHTTP2Goaway,
+	}, {
+		name:   "for an HTTP/2 connection error",
+		err:    http2.ConnectionError(http2.ErrCodeProtocol),
+		expect: FailureHTTP2ConnectionError,
+	}, {
+		name:   "for a system call error",
+		err:    ECONNRESET,
+		expect: FailureConnectionReset,
+	}, {
+		name:   "for another kind of error",
+		err:    io.EOF,
+		expect: FailureEOFError,
+	}}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ClassifyHTTPStreamError(tc.err); got != tc.expect {
+				t.Fatal("unexpected failure", got)
+			}
+		})
+	}
+}
+
+func TestClassifyWebSocketError(t *testing.T) {
+	t.Run("for input being already an ErrWrapper", func(t *testing.T) {
+		err := &ErrWrapper{Failure: FailureEOFError}
+		if ClassifyWebSocketError(err) != FailureEOFError {
+			t.Fatal("did not classify existing ErrWrapper correctly")
+		}
+	})
+
+	t.Run("for a bad handshake", func(t *testing.T) {
+		if ClassifyWebSocketError(websocket.ErrBadHandshake) != FailureWebSocketBadHandshake {
+			t.Fatal("unexpected result")
+		}
+	})
+
+	t.Run("for a close message", func(t *testing.T) {
+		err := &websocket.CloseError{Code: websocket.CloseGoingAway}
+		if ClassifyWebSocketError(err) != FailureWebSocketClosed {
+			t.Fatal("unexpected result")
+		}
+	})
+
+	t.Run("for another kind of error", func(t *testing.T) {
+		if ClassifyWebSocketError(io.EOF) != FailureEOFError {
+			t.Fatal("unexpected result")
+		}
+	})
+}
@@ -114,6 +114,13 @@ func NewDialerWithResolver(dl model.DebugLogger, r model.Resolver, w ...model.Di
 // the overall time spent trying all addresses and timing out.
 func WrapDialer(logger model.DebugLogger, resolver model.Resolver,
 	baseDialer model.Dialer, wrappers ...model.DialerWrapper) (outDialer model.Dialer) {
+	return wrapDialer(logger, resolver, baseDialer, 0, wrappers...)
+}
+
+// wrapDialer is the implementation of WrapDialer and NewDialerWithResolverHappyEyeballs. When
+// the happyEyeballsDelay is zero, we try each IP address sequentially.
+func wrapDialer(logger model.DebugLogger, resolver model.Resolver, baseDialer model.Dialer,
+	happyEyeballsDelay time.Duration, wrappers ...model.DialerWrapper) (outDialer model.Dialer) {
 	outDialer = &dialerErrWrapper{
 		Dialer: baseDialer,
 	}
@@ -130,7 +137,8 @@ func WrapDialer(logger model.DebugLogger, resolver model.Resolver,
 				DebugLogger:     logger,
 				operationSuffix: "_address",
 			},
-			Resolver: resolver,
+			Resolver:           resolver,
+			happyEyeballsDelay: happyEyeballsDelay,
 		},
 		DebugLogger: logger,
 	}
@@ -163,7 +171,8 @@ func (d *DialerSystem) configuredTimeout() time.Duration {
 }
 
 func (d *DialerSystem) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	return TProxy.DialContext(ctx, d.configuredTimeout(), network, address)
+	tp := ContextUnderlyingNetworkOrDefault(ctx)
+	return tp.DialContext(ctx, d.configuredTimeout(), network, address)
 }
 
 func (d *DialerSystem) CloseIdleConnections() {
@@ -175,6 +184,11 @@ func (d *DialerSystem) CloseIdleConnections() {
 type dialerResolverWithTracing struct {
 	Dialer   model.Dialer
 	Resolver model.Resolver
+
+	// happyEyeballsDelay is the OPTIONAL delay between starting two
+	// consecutive happy eyeballs connect attempts. When zero, we use
+	// the QUIRKy algorithm that tries each IP address sequentially.
+	happyEyeballsDelay time.Duration
 }
 
 var _ model.Dialer = &dialerResolverWithTracing{}
@@ -187,6 +201,9 @@ var _ model.Dialer = &dialerResolverWithTracing{}
 // 2. cycle through the available IP addresses and try to dial each of them;
 //
 // 3. trace the TCP (or UDP) connect and allow wrapping the returned conn.
+//
+// When happy eyeballs is enabled, step 2 uses staggered parallel connect
+// attempts rather than trying each IP address sequentially.
 func (d *dialerResolverWithTracing) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	// QUIRK: this routine and the related routines in quirks.go cannot
 	// be changed easily until we use events tracing to measure.
@@ -201,35 +218,51 @@ func (d *dialerResolverWithTracing) DialContext(ctx context.Context, network, ad
 		return nil, err
 	}
 	addrs = quirkSortIPAddrs(addrs)
+	if d.happyEyeballsDelay > 0 {
+		return d.dialHappyEyeballs(ctx, network, onlyhost, onlyport, addrs)
+	}
 	var errorslist []error
 	trace := ContextTraceOrDefault(ctx)
 	for _, addr := range addrs {
 		target := net.JoinHostPort(addr, onlyport)
-		started := trace.TimeNow()
-		conn, err := d.Dialer.DialContext(ctx, network, target)
-		finished := trace.TimeNow()
-		// TODO(bassosimone): to make the code robust to future refactoring we have
-		// moved error wrapping inside this type. This change opens up the possibility
-		// of simplifying the dialing chain by removing dialerErrWrapper. We'll be
-		// able to implement this refactoring once netx is gone. We cannot complete
-		// this refactoring _before_ because WrapDialer inserts extra wrappers
-		// provided by netx in the dialers chain _before_ this dialer and the dialers
-		// that netx insert assume that they wrap a dialer with error wrapping.
-		//
-		// Because error wrapping should be idempotent, it should not be a problem
-		// to have two error wrapping dialers in the chain except that, of course, it
-		// would be less efficient than just having a single wrapper.
-		err = MaybeNewErrWrapper(ClassifyGenericError, ConnectOperation, err)
-		trace.OnConnectDone(started, network, onlyhost, target, err, finished)
+		conn, err := d.dialAddress(ctx, trace, network, onlyhost, target)
 		if err == nil {
-			conn = &dialerErrWrapperConn{conn}
-			return trace.MaybeWrapNetConn(conn), nil
+			return conn, nil
 		}
 		errorslist = append(errorslist, err)
 	}
 	return nil, quirkReduceErrors(errorslist)
 }
 
+// dialAddress performs and traces a single connect attempt to the given target.
+func (d *dialerResolverWithTracing) dialAddress(ctx context.Context,
+	trace model.Trace, network, domain, target string) (net.Conn, error) {
+	started := trace.TimeNow()
+	conn, err := d.Dialer.DialContext(ctx, network, target)
+	finished := trace.TimeNow()
+	// TODO(bassosimone): to make the code robust to future refactoring we have
+	// moved error wrapping inside this type. This change opens up the possibility
+	// of simplifying the dialing chain by removing dialerErrWrapper. We'll be
+	// able to implement this refactoring once netx is gone. We cannot complete
+	// this refactoring _before_ because WrapDialer inserts extra wrappers
+	// provided by netx in the dialers chain _before_ this dialer and the dialers
+	// that netx insert assume that they wrap a dialer with error wrapping.
+	//
+	// Because error wrapping should be idempotent, it should not be a problem
+	// to have two error wrapping dialers in the chain except that, of course, it
+	// would be less efficient than just having a single wrapper.
+	if err != nil {
+		err = NewErrWrapper(ClassifyGenericError, ConnectOperation, err).withDetails(
+			finished.Sub(started), "", target)
+	}
+	trace.OnConnectDone(started, network, domain, target, err, finished)
+	if err != nil {
+		return nil, err
+	}
+	conn = newDialerErrWrapperConn(conn, finished, target)
+	return trace.MaybeWrapNetConn(conn), nil
+}
+
 // lookupHost ensures we correctly handle IP addresses.
 func (d *dialerResolverWithTracing) lookupHost(ctx context.Context, hostname string) ([]string, error) {
 	if net.ParseIP(hostname) != nil {
@@ -326,11 +359,13 @@ type dialerErrWrapper struct {
 var _ model.Dialer = &dialerErrWrapper{}
 
 func (d *dialerErrWrapper) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	started := time.Now()
 	conn, err := d.Dialer.DialContext(ctx, network, address)
 	if err != nil {
-		return nil, NewErrWrapper(ClassifyGenericError, ConnectOperation, err)
+		return nil, NewErrWrapper(ClassifyGenericError, ConnectOperation, err).withDetails(
+			time.Since(started), "", address)
 	}
-	return &dialerErrWrapperConn{Conn: conn}, nil
+	return newDialerErrWrapperConn(conn, time.Now(), address), nil
 }
 
 func (d *dialerErrWrapper) CloseIdleConnections() {
@@ -340,6 +375,22 @@ func (d *dialerErrWrapper) CloseIdleConnections() {
 // dialerErrWrapperConn is a net.Conn that performs error wrapping.
 type dialerErrWrapperConn struct {
 	net.Conn
+
+	// established is the OPTIONAL time when we established the connection.
+	established time.Time
+
+	// remoteAddr is the OPTIONAL address we dialed.
+	remoteAddr string
+}
+
+// newDialerErrWrapperConn creates a new dialerErrWrapperConn for a
+// connection established at the given time with the given address.
+func newDialerErrWrapperConn(conn net.Conn, established time.Time, remoteAddr string) *dialerErrWrapperConn {
+	return &dialerErrWrapperConn{
+		Conn:        conn,
+		established: established,
+		remoteAddr:  remoteAddr,
+	}
 }
 
 var _ net.Conn = &dialerErrWrapperConn{}
@@ -347,7 +398,7 @@ var _ net.Conn = &dialerErrWrapperConn{}
 func (c *dialerErrWrapperConn) Read(b []byte) (int, error) {
 	count, err := c.Conn.Read(b)
 	if err != nil {
-		return 0, NewErrWrapper(ClassifyGenericError, ReadOperation, err)
+		return 0, c.newErrWrapper(ReadOperation, err)
 	}
 	return count, nil
 }
@@ -355,7 +406,7 @@ func (c *dialerErrWrapperConn) Read(b []byte) (int, error) {
 func (c *dialerErrWrapperConn) Write(b []byte) (int, error) {
 	count, err := c.Conn.Write(b)
 	if err != nil {
-		return 0, NewErrWrapper(ClassifyGenericError, WriteOperation, err)
+		return 0, c.newErrWrapper(WriteOperation, err)
 	}
 	return count, nil
 }
@@ -363,11 +414,22 @@ func (c *dialerErrWrapperConn) Write(b []byte) (int, error) {
 func (c *dialerErrWrapperConn) Close() error {
 	err := c.Conn.Close()
 	if err != nil {
-		return NewErrWrapper(ClassifyGenericError, CloseOperation, err)
+		return c.newErrWrapper(CloseOperation, err)
 	}
 	return nil
 }
 
+// newErrWrapper wraps an I/O error including the connection details,
+// when this connection has been created by newDialerErrWrapperConn.
+func (c *dialerErrWrapperConn) newErrWrapper(op string, err error) *ErrWrapper {
+	ew := NewErrWrapper(ClassifyGenericError, op, err)
+	if c.established.IsZero() {
+		return ew
+	}
+	return ew.withDetails(time.Since(c.established),
+		errWrapperAddrString(c.Conn.LocalAddr()), c.remoteAddr)
+}
+
 // ErrNoDialer is the type of error returned by "null" dialers
 // when you attempt to dial with them.
 var ErrNoDialer = errors.New("no configured dialer")
@@ -688,6 +688,61 @@ func TestDialerErrWrapper(t *testing.T) {
 				t.Fatal("expected nil conn")
 			}
 		})
+
+		t.Run("we include the failure details", func(t *testing.T) {
+			d := &dialerErrWrapper{
+				Dialer: &mocks.Dialer{
+					MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+						time.Sleep(10 * time.Millisecond)
+						return nil, ECONNREFUSED
+					},
+				},
+			}
+			_, err := d.DialContext(context.Background(), "tcp", "8.8.8.8:443")
+			var ew *ErrWrapper
+			if !errors.As(err, &ew) {
+				t.Fatal("not an ErrWrapper", err)
+			}
+			if ew.Elapsed < 10*time.Millisecond || ew.RemoteAddr != "8.8.8.8:443" {
+				t.Fatal("unexpected details", ew.Elapsed, ew.RemoteAddr)
+			}
+			if ew.Errno != uint64(ECONNREFUSED) {
+				t.Fatal("unexpected errno", ew.Errno)
+			}
+		})
+
+		t.Run("we include the details of I/O failures", func(t *testing.T) {
+			d := &dialerErrWrapper{
+				Dialer: &mocks.Dialer{
+					MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+						conn := &mocks.Conn{
+							MockRead: func(b []byte) (int, error) {
+								return 0, ECONNRESET
+							},
+							MockLocalAddr: func() net.Addr {
+								return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 54321}
+							},
+						}
+						return conn, nil
+					},
+				},
+			}
+			conn, err := d.DialContext(context.Background(), "tcp", "8.8.8.8:443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = conn.Read(make([]byte, 8))
+			var ew *ErrWrapper
+			if !errors.As(err, &ew) {
+				t.Fatal("not an ErrWrapper", err)
+			}
+			if ew.LocalAddr != "10.0.0.1:54321" || ew.RemoteAddr != "8.8.8.8:443" {
+				t.Fatal("unexpected addresses", ew.LocalAddr, ew.RemoteAddr)
+			}
+			if ew.Failure != FailureConnectionReset || ew.Operation != ReadOperation {
+				t.Fatal("unexpected failure", ew.Failure, ew.Operation)
+			}
+		})
 	})
 
 	t.Run("CloseIdleConnections", func(t *testing.T) {
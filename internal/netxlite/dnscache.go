@@ -0,0 +1,304 @@
+package netxlite
+
+//
+// TTL-aware, bounded DNS cache
+//
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/miekg/dns"
+)
+
+// DNSCacheConfig contains the configuration of a DNSCache. The zero value
+// of this structure is a valid configuration using the defaults.
+type DNSCacheConfig struct {
+	// MaxEntries is the OPTIONAL maximum number of entries. When the cache is
+	// full, we evict the least recently used entry. When zero or negative, we
+	// use DNSCacheDefaultMaxEntries.
+	MaxEntries int
+
+	// MaxTTL is the OPTIONAL maximum time for which we cache a response
+	// regardless of the TTL of its records. When zero or negative, we
+	// use DNSCacheDefaultMaxTTL.
+	MaxTTL time.Duration
+
+	// NegativeTTL is the OPTIONAL time for which we cache negative answers
+	// (i.e., NXDOMAIN and responses without answers). When zero or negative,
+	// we use DNSCacheDefaultNegativeTTL.
+	NegativeTTL time.Duration
+
+	// NoTTL is the OPTIONAL time for which we cache responses that do not
+	// carry TTLs, such as the responses of the getaddrinfo transport. When
+	// zero or negative, we do not cache such responses.
+	NoTTL time.Duration
+}
+
+const (
+	// DNSCacheDefaultMaxEntries is the default value of DNSCacheConfig.MaxEntries.
+	DNSCacheDefaultMaxEntries = 1024
+
+	// DNSCacheDefaultMaxTTL is the default value of DNSCacheConfig.MaxTTL.
+	DNSCacheDefaultMaxTTL = time.Hour
+
+	// DNSCacheDefaultNegativeTTL is the default value of DNSCacheConfig.NegativeTTL.
+	DNSCacheDefaultNegativeTTL = 30 * time.Second
+)
+
+// DNSCacheStats contains statistics about a DNSCache.
+type DNSCacheStats struct {
+	// Hits is the number of queries we answered using the cache.
+	Hits int64
+
+	// NegativeHits is the number of Hits returning a negative answer.
+	NegativeHits int64
+
+	// Misses is the number of queries we forwarded to the transport.
+	Misses int64
+
+	// Evictions is the number of entries we evicted to make room for new ones.
+	Evictions int64
+
+	// Entries is the number of entries currently in the cache.
+	Entries int
+}
+
+// DNSCache is a TTL-aware, bounded DNS cache with LRU eviction and negative
+// caching. A DNSCache is a model.DNSTransportWrapper, so you can pass it to the
+// resolver constructors (e.g., NewParallelUDPResolver) to cache the DNS
+// responses of any lookup (i.e., LookupHost, LookupHTTPS, and LookupNS). You
+// can share the same DNSCache among several transports, because we include
+// the transport network and address into the cache key.
+//
+// We only cache responses we successfully received and, among them, we do not
+// cache the ones with an Rcode different from NOERROR and NXDOMAIN (e.g.,
+// SERVFAIL), since they usually indicate a transient failure.
+//
+// Use NewDNSCache to construct.
+type DNSCache struct {
+	// config is the configuration.
+	config DNSCacheConfig
+
+	// entries maps a key to the corresponding element of lru.
+	entries map[dnsCacheKey]*list.Element
+
+	// lru contains *dnsCacheEntry with the most recently used first.
+	lru *list.List
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// stats contains the statistics.
+	stats DNSCacheStats
+
+	// timeNow is the OPTIONAL function returning the current time (for testing).
+	timeNow func() time.Time
+}
+
+var _ model.DNSTransportWrapper = &DNSCache{}
+
+// NewDNSCache creates a new DNSCache using the given config. A nil config
+// is equivalent to a zero-initialized config.
+func NewDNSCache(config *DNSCacheConfig) *DNSCache {
+	if config == nil {
+		config = &DNSCacheConfig{}
+	}
+	c := &DNSCache{
+		config:  *config,
+		entries: map[dnsCacheKey]*list.Element{},
+		lru:     list.New(),
+		mu:      sync.Mutex{},
+		stats:   DNSCacheStats{},
+		timeNow: nil,
+	}
+	if c.config.MaxEntries <= 0 {
+		c.config.MaxEntries = DNSCacheDefaultMaxEntries
+	}
+	if c.config.MaxTTL <= 0 {
+		c.config.MaxTTL = DNSCacheDefaultMaxTTL
+	}
+	if c.config.NegativeTTL <= 0 {
+		c.config.NegativeTTL = DNSCacheDefaultNegativeTTL
+	}
+	return c
+}
+
+// WrapDNSTransport implements model.DNSTransportWrapper.
+func (c *DNSCache) WrapDNSTransport(txp model.DNSTransport) model.DNSTransport {
+	return &dnsTransportCache{DNSTransport: txp, cache: c}
+}
+
+// Stats returns the current statistics.
+func (c *DNSCache) Stats() DNSCacheStats {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// Flush removes all the entries from the cache.
+func (c *DNSCache) Flush() {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	c.entries = map[dnsCacheKey]*list.Element{}
+	c.lru.Init()
+}
+
+// dnsCacheKey is the key of a DNSCache entry.
+type dnsCacheKey struct {
+	network string
+	address string
+	domain  string
+	qtype   uint16
+}
+
+// dnsCacheEntry is an entry of a DNSCache.
+type dnsCacheEntry struct {
+	// key is the entry key.
+	key dnsCacheKey
+
+	// expires is when the entry expires.
+	expires time.Time
+
+	// negative indicates whether this is a negative answer.
+	negative bool
+
+	// response is the cached response.
+	response model.DNSResponse
+}
+
+// now returns the current time.
+func (c *DNSCache) now() time.Time {
+	if c.timeNow != nil {
+		return c.timeNow()
+	}
+	return time.Now()
+}
+
+// get returns the cached response for the given key, if any, and updates
+// the statistics accordingly.
+func (c *DNSCache) get(key dnsCacheKey) (model.DNSResponse, bool) {
+	now := c.now()
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	elem, found := c.entries[key]
+	if !found {
+		c.stats.Misses++
+		return nil, false
+	}
+	entry := elem.Value.(*dnsCacheEntry)
+	if !now.Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.stats.Misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+	if entry.negative {
+		c.stats.NegativeHits++
+	}
+	return entry.response, true
+}
+
+// put caches the given response, if cacheable.
+func (c *DNSCache) put(key dnsCacheKey, response model.DNSResponse) {
+	ttl, negative, good := c.ttl(response)
+	if !good {
+		return
+	}
+	entry := &dnsCacheEntry{
+		key:      key,
+		expires:  c.now().Add(ttl),
+		negative: negative,
+		response: response,
+	}
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	if elem, found := c.entries[key]; found {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// ttl returns for how long we should cache the given response, whether the
+// response is negative, and whether we should cache the response at all.
+func (c *DNSCache) ttl(response model.DNSResponse) (time.Duration, bool, bool) {
+	data := response.Bytes()
+	if len(data) <= 0 {
+		// the response does not carry TTLs (e.g., getaddrinfo)
+		return c.config.NoTTL, false, c.config.NoTTL > 0
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(data); err != nil {
+		return 0, false, false
+	}
+	switch msg.Rcode {
+	case dns.RcodeNameError:
+		return c.config.NegativeTTL, true, true
+	case dns.RcodeSuccess:
+		if len(msg.Answer) <= 0 {
+			return c.config.NegativeTTL, true, true
+		}
+		ttl := c.config.MaxTTL
+		for _, rr := range msg.Answer {
+			if value := time.Duration(rr.Header().Ttl) * time.Second; value < ttl {
+				ttl = value
+			}
+		}
+		return ttl, false, ttl > 0
+	default:
+		return 0, false, false
+	}
+}
+
+// dnsTransportCache is the model.DNSTransport returned by DNSCache.WrapDNSTransport.
+type dnsTransportCache struct {
+	model.DNSTransport
+	cache *DNSCache
+}
+
+// RoundTrip implements model.DNSTransport.RoundTrip.
+func (txp *dnsTransportCache) RoundTrip(
+	ctx context.Context, query model.DNSQuery) (model.DNSResponse, error) {
+	key := dnsCacheKey{
+		network: txp.DNSTransport.Network(),
+		address: txp.DNSTransport.Address(),
+		domain:  strings.ToLower(dns.Fqdn(query.Domain())),
+		qtype:   query.Type(),
+	}
+	if response, found := txp.cache.get(key); found {
+		return &dnsCachedResponse{DNSResponse: response, query: query}, nil
+	}
+	response, err := txp.DNSTransport.RoundTrip(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	txp.cache.put(key, response)
+	return response, nil
+}
+
+// dnsCachedResponse is a cached model.DNSResponse returned to a distinct query.
+type dnsCachedResponse struct {
+	model.DNSResponse
+	query model.DNSQuery
+}
+
+// Query implements model.DNSResponse.Query.
+func (r *dnsCachedResponse) Query() model.DNSQuery {
+	return r.query
+}
@@ -0,0 +1,298 @@
+package netxlite
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/model/mocks"
+	"github.com/miekg/dns"
+)
+
+// dnsCacheTestServer is a fake DNS server for testing the DNSCache.
+type dnsCacheTestServer struct {
+	// rcode is the rcode to return.
+	rcode int
+
+	// roundTrips counts the round trips.
+	roundTrips int
+
+	// ttl is the TTL of the records.
+	ttl uint32
+}
+
+// transport returns a transport using the fake server.
+func (s *dnsCacheTestServer) transport() model.DNSTransport {
+	return &mocks.DNSTransport{
+		MockRoundTrip: func(ctx context.Context, query model.DNSQuery) (model.DNSResponse, error) {
+			s.roundTrips++
+			rawQuery, err := query.Bytes()
+			if err != nil {
+				return nil, err
+			}
+			msg := &dns.Msg{}
+			if err := msg.Unpack(rawQuery); err != nil {
+				return nil, err
+			}
+			reply := &dns.Msg{}
+			reply.SetRcode(msg, s.rcode)
+			header := dns.RR_Header{
+				Name:   msg.Question[0].Name,
+				Rrtype: msg.Question[0].Qtype,
+				Class:  dns.ClassINET,
+				Ttl:    s.ttl,
+			}
+			if s.rcode == dns.RcodeSuccess {
+				switch msg.Question[0].Qtype {
+				case dns.TypeA:
+					reply.Answer = append(reply.Answer, &dns.A{Hdr: header, A: net.IPv4(8, 8, 8, 8)})
+				case dns.TypeNS:
+					reply.Answer = append(reply.Answer, &dns.NS{Hdr: header, Ns: "ns1.google.com."})
+				}
+			}
+			rawReply, err := reply.Pack()
+			if err != nil {
+				return nil, err
+			}
+			return (&DNSDecoderMiekg{}).DecodeResponse(rawReply, query)
+		},
+		MockRequiresPadding: func() bool {
+			return false
+		},
+		MockNetwork: func() string {
+			return "udp"
+		},
+		MockAddress: func() string {
+			return "8.8.8.8:53"
+		},
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	// newResolver creates a resolver using the given cache and server
+	// and a clock that we can advance at will.
+	newResolver := func(config *DNSCacheConfig, server *dnsCacheTestServer) (
+		*DNSCache, model.Resolver, *time.Time) {
+		cache := NewDNSCache(config)
+		now := time.Now()
+		cache.timeNow = func() time.Time {
+			return now
+		}
+		reso := NewUnwrappedParallelResolver(cache.WrapDNSTransport(server.transport()))
+		return cache, reso, &now
+	}
+
+	t.Run("we honour the TTL", func(t *testing.T) {
+		server := &dnsCacheTestServer{ttl: 60}
+		cache, reso, now := newResolver(nil, server)
+		for idx := 0; idx < 2; idx++ {
+			addrs, err := reso.LookupHost(context.Background(), "dns.google")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != 1 || addrs[0] != "8.8.8.8" {
+				t.Fatal("unexpected addrs", addrs)
+			}
+		}
+		if server.roundTrips != 2 { // A and AAAA
+			t.Fatal("unexpected number of round trips", server.roundTrips)
+		}
+		*now = now.Add(61 * time.Second)
+		if _, err := reso.LookupHost(context.Background(), "DNS.google."); err != nil {
+			t.Fatal(err)
+		}
+		if server.roundTrips != 4 {
+			t.Fatal("unexpected number of round trips", server.roundTrips)
+		}
+		stats := cache.Stats()
+		expected := DNSCacheStats{Hits: 2, NegativeHits: 1, Misses: 4, Evictions: 0, Entries: 2}
+		if stats != expected {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("we do not cache records with zero TTL", func(t *testing.T) {
+		server := &dnsCacheTestServer{ttl: 0}
+		cache, reso, _ := newResolver(nil, server)
+		for idx := 0; idx < 2; idx++ {
+			if _, err := reso.LookupNS(context.Background(), "google.com"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if server.roundTrips != 2 {
+			t.Fatal("unexpected number of round trips", server.roundTrips)
+		}
+		if cache.Stats().Entries != 0 {
+			t.Fatal("expected no entries")
+		}
+	})
+
+	t.Run("we cache NXDOMAIN for NegativeTTL", func(t *testing.T) {
+		server := &dnsCacheTestServer{rcode: dns.RcodeNameError, ttl: 60}
+		config := &DNSCacheConfig{NegativeTTL: 5 * time.Second}
+		cache, reso, now := newResolver(config, server)
+		for idx := 0; idx < 2; idx++ {
+			_, err := reso.LookupHTTPS(context.Background(), "nxdomain.example.com")
+			if !errors.Is(err, ErrOODNSNoSuchHost) {
+				t.Fatal("unexpected err", err)
+			}
+		}
+		if server.roundTrips != 1 {
+			t.Fatal("unexpected number of round trips", server.roundTrips)
+		}
+		*now = now.Add(5 * time.Second)
+		if _, err := reso.LookupHTTPS(context.Background(), "nxdomain.example.com"); err == nil {
+			t.Fatal("expected an error")
+		}
+		if server.roundTrips != 2 {
+			t.Fatal("unexpected number of round trips", server.roundTrips)
+		}
+		if cache.Stats().NegativeHits != 1 {
+			t.Fatal("unexpected negative hits")
+		}
+	})
+
+	t.Run("we do not cache SERVFAIL", func(t *testing.T) {
+		server := &dnsCacheTestServer{rcode: dns.RcodeServerFailure, ttl: 60}
+		_, reso, _ := newResolver(nil, server)
+		for idx := 0; idx < 2; idx++ {
+			if _, err := reso.LookupNS(context.Background(), "google.com"); err == nil {
+				t.Fatal("expected an error")
+			}
+		}
+		if server.roundTrips != 2 {
+			t.Fatal("unexpected number of round trips", server.roundTrips)
+		}
+	})
+
+	t.Run("we evict the least recently used entry", func(t *testing.T) {
+		server := &dnsCacheTestServer{ttl: 60}
+		cache, reso, _ := newResolver(&DNSCacheConfig{MaxEntries: 2}, server)
+		for _, domain := range []string{"a.example.com", "b.example.com", "a.example.com", "c.example.com"} {
+			if _, err := reso.LookupNS(context.Background(), domain); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats := cache.Stats()
+		if stats.Entries != 2 || stats.Evictions != 1 || stats.Hits != 1 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+		// b.example.com should have been evicted
+		if _, err := reso.LookupNS(context.Background(), "a.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reso.LookupNS(context.Background(), "b.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if server.roundTrips != 4 {
+			t.Fatal("unexpected number of round trips", server.roundTrips)
+		}
+	})
+
+	t.Run("we cap the TTL using MaxTTL", func(t *testing.T) {
+		server := &dnsCacheTestServer{ttl: 3600}
+		_, reso, now := newResolver(&DNSCacheConfig{MaxTTL: time.Minute}, server)
+		if _, err := reso.LookupNS(context.Background(), "google.com"); err != nil {
+			t.Fatal(err)
+		}
+		*now = now.Add(time.Minute)
+		if _, err := reso.LookupNS(context.Background(), "google.com"); err != nil {
+			t.Fatal(err)
+		}
+		if server.roundTrips != 2 {
+			t.Fatal("unexpected number of round trips", server.roundTrips)
+		}
+	})
+
+	t.Run("we do not cache transport errors", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		cache := NewDNSCache(nil)
+		var roundTrips int
+		txp := cache.WrapDNSTransport(&mocks.DNSTransport{
+			MockRoundTrip: func(ctx context.Context, query model.DNSQuery) (model.DNSResponse, error) {
+				roundTrips++
+				return nil, expected
+			},
+			MockNetwork: func() string {
+				return "udp"
+			},
+			MockAddress: func() string {
+				return "8.8.8.8:53"
+			},
+		})
+		query := (&DNSEncoderMiekg{}).Encode("dns.google", dns.TypeA, false)
+		for idx := 0; idx < 2; idx++ {
+			if _, err := txp.RoundTrip(context.Background(), query); !errors.Is(err, expected) {
+				t.Fatal("unexpected err", err)
+			}
+		}
+		if roundTrips != 2 {
+			t.Fatal("unexpected number of round trips", roundTrips)
+		}
+	})
+
+	t.Run("responses without TTLs", func(t *testing.T) {
+		newTransport := func(cache *DNSCache, roundTrips *int) model.DNSTransport {
+			return cache.WrapDNSTransport(&mocks.DNSTransport{
+				MockRoundTrip: func(ctx context.Context, query model.DNSQuery) (model.DNSResponse, error) {
+					*roundTrips++
+					return &dnsOverGetaddrinfoResponse{addrs: []string{"8.8.8.8"}, query: query}, nil
+				},
+				MockNetwork: func() string {
+					return StdlibResolverGetaddrinfo
+				},
+				MockAddress: func() string {
+					return ""
+				},
+			})
+		}
+		query := (&DNSEncoderMiekg{}).Encode("dns.google", dns.TypeANY, false)
+
+		t.Run("are not cached by default", func(t *testing.T) {
+			var roundTrips int
+			txp := newTransport(NewDNSCache(nil), &roundTrips)
+			for idx := 0; idx < 2; idx++ {
+				if _, err := txp.RoundTrip(context.Background(), query); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if roundTrips != 2 {
+				t.Fatal("unexpected number of round trips", roundTrips)
+			}
+		})
+
+		t.Run("are cached for NoTTL", func(t *testing.T) {
+			var roundTrips int
+			txp := newTransport(NewDNSCache(&DNSCacheConfig{NoTTL: time.Minute}), &roundTrips)
+			otherQuery := (&DNSEncoderMiekg{}).Encode("dns.google", dns.TypeANY, false)
+			if _, err := txp.RoundTrip(context.Background(), query); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := txp.RoundTrip(context.Background(), otherQuery)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if roundTrips != 1 {
+				t.Fatal("unexpected number of round trips", roundTrips)
+			}
+			if resp.Query() != otherQuery {
+				t.Fatal("the cached response should refer to the new query")
+			}
+		})
+	})
+
+	t.Run("Flush removes all the entries", func(t *testing.T) {
+		server := &dnsCacheTestServer{ttl: 60}
+		cache, reso, _ := newResolver(nil, server)
+		if _, err := reso.LookupNS(context.Background(), "google.com"); err != nil {
+			t.Fatal(err)
+		}
+		cache.Flush()
+		if cache.Stats().Entries != 0 {
+			t.Fatal("expected no entries")
+		}
+	})
+}
@@ -117,6 +117,8 @@ func (r *dnsResponse) DecodeHTTPS() (*model.HTTPSSvc, error) {
 					for _, ip := range extv.Hint {
 						out.IPv6 = append(out.IPv6, ip.String())
 					}
+				case *dns.SVCBECHConfig:
+					out.ECHConfigList = extv.ECH
 				}
 			}
 		}
@@ -268,6 +268,33 @@ func TestDNSDecoderMiekg(t *testing.T) {
 				if diff := cmp.Diff(v6, reply.IPv6); diff != "" {
 					t.Fatal(diff)
 				}
+				if reply.ECHConfigList != nil {
+					t.Fatal("expected nil ECHConfigList")
+				}
+			})
+
+			t.Run("with ECHConfigList", func(t *testing.T) {
+				ech := []byte{0x00, 0x04, 0xfe, 0x0d, 0x00, 0x00}
+				d := &DNSDecoderMiekg{}
+				queryID := dns.Id()
+				rawQuery := dnsGenQuery(dns.TypeHTTPS, queryID)
+				rawResponse := dnsGenHTTPSReplySuccessWithECH(rawQuery, nil, []string{"1.1.1.1"}, nil, ech)
+				query := &mocks.DNSQuery{
+					MockID: func() uint16 {
+						return queryID
+					},
+				}
+				resp, err := d.DecodeResponse(rawResponse, query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reply, err := resp.DecodeHTTPS()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(ech, reply.ECHConfigList); diff != "" {
+					t.Fatal(diff)
+				}
 			})
 		})
 
@@ -710,6 +737,12 @@ func dnsGenLookupHostReplySuccess(rawQuery []byte, cname *dnsCNAMEAnswer, ips ..
 // dnsGenHTTPSReplySuccess generates a successful HTTPS response containing
 // the given (possibly nil) alpns, ipv4s, and ipv6s.
 func dnsGenHTTPSReplySuccess(rawQuery []byte, alpns, ipv4s, ipv6s []string) []byte {
+	return dnsGenHTTPSReplySuccessWithECH(rawQuery, alpns, ipv4s, ipv6s, nil)
+}
+
+// dnsGenHTTPSReplySuccessWithECH is like dnsGenHTTPSReplySuccess but
+// also includes the given ECHConfigList when it is not nil.
+func dnsGenHTTPSReplySuccessWithECH(rawQuery []byte, alpns, ipv4s, ipv6s []string, ech []byte) []byte {
 	query := new(dns.Msg)
 	err := query.Unpack(rawQuery)
 	runtimex.PanicOnError(err, "query.Unpack failed")
@@ -750,6 +783,9 @@ func dnsGenHTTPSReplySuccess(rawQuery []byte, alpns, ipv4s, ipv6s []string) []by
 		}
 		answer.Value = append(answer.Value, &dns.SVCBIPv6Hint{Hint: addrs})
 	}
+	if ech != nil {
+		answer.Value = append(answer.Value, &dns.SVCBECHConfig{ECH: ech})
+	}
 	data, err := reply.Pack()
 	runtimex.PanicOnError(err, "reply.Pack failed")
 	return data
@@ -73,7 +73,7 @@ func (txp *dnsOverGetaddrinfoTransport) lookup(
 	ctx, cancel := context.WithTimeout(ctx, txp.timeout())
 	defer cancel()
 	go func() {
-		addrs, cname, err := txp.lookupfn()(ctx, hostname)
+		addrs, cname, err := txp.lookupfn(ctx)(ctx, hostname)
 		if err != nil {
 			errch <- err
 			return
@@ -100,17 +100,20 @@ func (txp *dnsOverGetaddrinfoTransport) timeout() time.Duration {
 	return 15 * time.Second
 }
 
-func (txp *dnsOverGetaddrinfoTransport) lookupfn() func(ctx context.Context, domain string) ([]string, string, error) {
+func (txp *dnsOverGetaddrinfoTransport) lookupfn(
+	ctx context.Context) func(ctx context.Context, domain string) ([]string, string, error) {
 	if txp.testableLookupANY != nil {
 		return txp.testableLookupANY
 	}
-	return TProxy.GetaddrinfoLookupANY
+	return ContextUnderlyingNetworkOrDefault(ctx).GetaddrinfoLookupANY
 }
 
 func (txp *dnsOverGetaddrinfoTransport) RequiresPadding() bool {
 	return false
 }
 
+// Network returns the resolver network. Because this method does not receive a
+// context, we always use TProxy rather than any context-bound UnderlyingNetwork.
 func (txp *dnsOverGetaddrinfoTransport) Network() string {
 	return TProxy.GetaddrinfoResolverNetwork()
 }
@@ -49,7 +49,7 @@ func TestDNSOverGetaddrinfo(t *testing.T) {
 
 	t.Run("check default lookup host func not nil", func(t *testing.T) {
 		txp := &dnsOverGetaddrinfoTransport{}
-		if txp.lookupfn() == nil {
+		if txp.lookupfn(context.Background()) == nil {
 			t.Fatal("expected non-nil func here")
 		}
 	})
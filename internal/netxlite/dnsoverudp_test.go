@@ -253,7 +253,7 @@ func TestDNSOverUDPTransport(t *testing.T) {
 
 		t.Run("using a real server", func(t *testing.T) {
 			srvr := &filtering.DNSServer{
-				OnQuery: func(domain string) filtering.DNSAction {
+				OnQuery: func(query *filtering.DNSQuery) filtering.DNSAction {
 					return filtering.DNSActionCache
 				},
 				Cache: map[string][]string{
@@ -286,7 +286,7 @@ func TestDNSOverUDPTransport(t *testing.T) {
 	t.Run("recording delayed DNS responses", func(t *testing.T) {
 		t.Run("without any context-injected traces", func(t *testing.T) {
 			srvr := &filtering.DNSServer{
-				OnQuery: func(domain string) filtering.DNSAction {
+				OnQuery: func(query *filtering.DNSQuery) filtering.DNSAction {
 					return filtering.DNSActionLocalHostPlusCache
 				},
 				Cache: map[string][]string{
@@ -326,7 +326,7 @@ func TestDNSOverUDPTransport(t *testing.T) {
 				goodError                bool
 			)
 			srvr := &filtering.DNSServer{
-				OnQuery: func(domain string) filtering.DNSAction {
+				OnQuery: func(query *filtering.DNSQuery) filtering.DNSAction {
 					return filtering.DNSActionLocalHostPlusCache
 				},
 				Cache: map[string][]string{
@@ -421,7 +421,7 @@ func TestDNSOverUDPTransport(t *testing.T) {
 				goodError                bool
 			)
 			srvr := &filtering.DNSServer{
-				OnQuery: func(domain string) filtering.DNSAction {
+				OnQuery: func(query *filtering.DNSQuery) filtering.DNSAction {
 					return filtering.DNSActionLocalHostPlusCache
 				},
 				Cache: map[string][]string{
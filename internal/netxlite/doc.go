@@ -51,7 +51,9 @@
 // 3. resolving domain names with getaddrinfo.
 //
 // By overriding the TProxy variable, you can control these operations and route
-// traffic to, e.g., a wireguard peer where you implement censorship.
+// traffic to, e.g., a wireguard peer where you implement censorship. To use
+// distinct networks concurrently, bind a network to the context passed to the
+// dialers and the resolvers using ContextWithUnderlyingNetwork.
 //
 // # Operations
 //
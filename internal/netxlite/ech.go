@@ -0,0 +1,532 @@
+package netxlite
+
+//
+// Encrypted Client Hello (ECH)
+//
+// Neither Go 1.19 nor the utls fork we use support ECH, therefore we let utls
+// generate the inner ClientHello and we replace it on the wire with an outer
+// ClientHello containing the inner one encrypted using HPKE (see echhello.go).
+//
+// We also implement GREASE ECH (see NewTLSHandshakerECHGREASE), where the
+// outer ClientHello looks like a genuine ECH attempt but does not contain any
+// inner ClientHello, which is enough to measure whether censors block the
+// ClientHellos offering ECH to a given server.
+//
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	utls "gitlab.com/yawning/utls.git"
+)
+
+// ECHConfigVersion is the only ECHConfig version we know how to
+// parse, i.e., the one defined by draft-ietf-tls-esni-13 and later.
+const ECHConfigVersion = 0xfe0d
+
+// ECHExtensionType is the code point of the encrypted_client_hello extension.
+const ECHExtensionType = 0xfe0d
+
+// ECHCipherSuite is an HPKE symmetric cipher suite.
+type ECHCipherSuite struct {
+	// KDFID is the HPKE KDF identifier.
+	KDFID uint16
+
+	// AEADID is the HPKE AEAD identifier.
+	AEADID uint16
+}
+
+// ECHConfig is a parsed ECHConfig.
+type ECHConfig struct {
+	// ConfigID is the config identifier.
+	ConfigID uint8
+
+	// KEMID is the HPKE KEM identifier.
+	KEMID uint16
+
+	// PublicKey is the HPKE public key.
+	PublicKey []byte
+
+	// CipherSuites contains the supported HPKE cipher suites.
+	CipherSuites []ECHCipherSuite
+
+	// MaximumNameLength is the length used to pad the inner server name.
+	MaximumNameLength uint8
+
+	// PublicName is the server name to use in the outer ClientHello.
+	PublicName string
+
+	// Raw is the whole serialized ECHConfig, which we need to encrypt
+	// the inner ClientHello.
+	Raw []byte
+}
+
+// ErrECHInvalidConfigList indicates that we cannot parse an ECHConfigList.
+var ErrECHInvalidConfigList = errors.New("ech: invalid ECHConfigList")
+
+// ErrECHNoSupportedConfig indicates that an ECHConfigList does not contain
+// any ECHConfig with a version we know how to parse or, when we need to encrypt
+// the inner ClientHello, using HPKE algorithms we support.
+var ErrECHNoSupportedConfig = errors.New("ech: no supported ECHConfig")
+
+// ParseECHConfigList parses an ECHConfigList, such as the one contained
+// in model.HTTPSSvc.ECHConfigList. We skip the configs whose version is
+// not ECHConfigVersion, as mandated by draft-ietf-tls-esni, and we fail
+// with ErrECHNoSupportedConfig if there are no configs left.
+func ParseECHConfigList(data []byte) ([]*ECHConfig, error) {
+	reader := &echReader{data}
+	list, good := reader.readVector16()
+	if !good || !reader.empty() {
+		return nil, ErrECHInvalidConfigList
+	}
+	var out []*ECHConfig
+	for !list.empty() {
+		raw := list.data
+		version, good := list.readUint16()
+		if !good {
+			return nil, ErrECHInvalidConfigList
+		}
+		contents, good := list.readVector16()
+		if !good {
+			return nil, ErrECHInvalidConfigList
+		}
+		if version != ECHConfigVersion {
+			continue
+		}
+		config, err := parseECHConfigContents(contents)
+		if err != nil {
+			return nil, err
+		}
+		config.Raw = raw[:len(raw)-len(list.data)]
+		out = append(out, config)
+	}
+	if len(out) <= 0 {
+		return nil, ErrECHNoSupportedConfig
+	}
+	return out, nil
+}
+
+// parseECHConfigContents parses the contents of an ECHConfig.
+func parseECHConfigContents(reader *echReader) (*ECHConfig, error) {
+	config := &ECHConfig{}
+	var good bool
+	if config.ConfigID, good = reader.readUint8(); !good {
+		return nil, ErrECHInvalidConfigList
+	}
+	if config.KEMID, good = reader.readUint16(); !good {
+		return nil, ErrECHInvalidConfigList
+	}
+	publicKey, good := reader.readVector16()
+	if !good || publicKey.empty() {
+		return nil, ErrECHInvalidConfigList
+	}
+	config.PublicKey = publicKey.data
+	suites, good := reader.readVector16()
+	if !good || suites.empty() {
+		return nil, ErrECHInvalidConfigList
+	}
+	for !suites.empty() {
+		kdf, good := suites.readUint16()
+		if !good {
+			return nil, ErrECHInvalidConfigList
+		}
+		aead, good := suites.readUint16()
+		if !good {
+			return nil, ErrECHInvalidConfigList
+		}
+		config.CipherSuites = append(config.CipherSuites, ECHCipherSuite{KDFID: kdf, AEADID: aead})
+	}
+	if config.MaximumNameLength, good = reader.readUint8(); !good {
+		return nil, ErrECHInvalidConfigList
+	}
+	publicName, good := reader.readVector8()
+	if !good || publicName.empty() {
+		return nil, ErrECHInvalidConfigList
+	}
+	config.PublicName = string(publicName.data)
+	if _, good := reader.readVector16(); !good || !reader.empty() { // extensions
+		return nil, ErrECHInvalidConfigList
+	}
+	return config, nil
+}
+
+// echReader reads the fields of TLS-encoded structures.
+type echReader struct {
+	data []byte
+}
+
+// empty returns whether we have consumed all the data.
+func (r *echReader) empty() bool {
+	return len(r.data) <= 0
+}
+
+// read reads count bytes.
+func (r *echReader) read(count int) ([]byte, bool) {
+	if len(r.data) < count {
+		return nil, false
+	}
+	out := r.data[:count]
+	r.data = r.data[count:]
+	return out, true
+}
+
+// readUint8 reads a uint8.
+func (r *echReader) readUint8() (uint8, bool) {
+	data, good := r.read(1)
+	if !good {
+		return 0, false
+	}
+	return data[0], true
+}
+
+// readUint16 reads a big endian uint16.
+func (r *echReader) readUint16() (uint16, bool) {
+	data, good := r.read(2)
+	if !good {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(data), true
+}
+
+// readVector8 reads a vector with a uint8 length prefix.
+func (r *echReader) readVector8() (*echReader, bool) {
+	length, good := r.readUint8()
+	if !good {
+		return nil, false
+	}
+	data, good := r.read(int(length))
+	return &echReader{data}, good
+}
+
+// readVector16 reads a vector with a uint16 length prefix.
+func (r *echReader) readVector16() (*echReader, bool) {
+	length, good := r.readUint16()
+	if !good {
+		return nil, false
+	}
+	data, good := r.read(int(length))
+	return &echReader{data}, good
+}
+
+// ECH statuses, i.e., the possible outcomes of a handshake performed by
+// a handshaker created using NewTLSHandshakerECH.
+const (
+	// ECHStatusAccepted means that the server decrypted the inner ClientHello
+	// and continued the handshake using it.
+	ECHStatusAccepted = "accepted"
+
+	// ECHStatusRejected means that the server could not decrypt the inner
+	// ClientHello and sent us retry configs, so it supports ECH.
+	ECHStatusRejected = "rejected"
+
+	// ECHStatusStripped means that the server continued the handshake using the
+	// outer ClientHello without sending us retry configs. Either the server does
+	// not support ECH or a middlebox removed the extension.
+	ECHStatusStripped = "stripped"
+
+	// ECHStatusOffered means that we offered ECH but we cannot tell the outcome,
+	// e.g., because the connection was reset before the ServerHello.
+	ECHStatusOffered = "offered"
+)
+
+// ErrECHRejected indicates that the server rejected ECH sending retry configs.
+var ErrECHRejected = errors.New("ech: server rejected ECH")
+
+// ErrECHStripped indicates that the server did not acknowledge ECH.
+var ErrECHStripped = errors.New("ech: server did not acknowledge ECH")
+
+// ErrECHHelloRetryRequest indicates that the server sent a HelloRetryRequest, which we
+// do not support because we cannot encrypt a second inner ClientHello.
+var ErrECHHelloRetryRequest = errors.New("ech: HelloRetryRequest is not supported")
+
+// ECHError is the error returned by the handshakers created using NewTLSHandshakerECH
+// when the handshake fails. It wraps the underlying error, which is ErrECHRejected or
+// ErrECHStripped unless the server accepted ECH or we cannot tell the outcome.
+type ECHError struct {
+	// Err is the underlying error.
+	Err error
+
+	// Status is the ECH status (e.g., ECHStatusRejected).
+	Status string
+
+	// RetryConfigs contains the ECHConfigList sent by the server
+	// when rejecting ECH, which is nil in all the other cases.
+	RetryConfigs []byte
+}
+
+// Error implements error.
+func (e *ECHError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap allows to access the underlying error.
+func (e *ECHError) Unwrap() error {
+	return e.Err
+}
+
+// ECHStatusFromError returns the ECH status and retry configs given the error returned
+// by a handshaker created using NewTLSHandshakerECH. A nil error means that the server
+// accepted ECH, because the handshake cannot succeed otherwise.
+func ECHStatusFromError(err error) (string, []byte) {
+	if err == nil {
+		return ECHStatusAccepted, nil
+	}
+	var echErr *ECHError
+	if errors.As(err, &echErr) {
+		return echErr.Status, echErr.RetryConfigs
+	}
+	return ECHStatusOffered, nil
+}
+
+// NewTLSHandshakerECH creates a new TLS handshaker using gitlab.com/yawning/utls
+// that performs an ECH handshake using the first config inside the given ECHConfigList
+// whose HPKE algorithms we support. The id is the address of something like
+// utls.HelloChrome_Auto and MUST NOT be utls.HelloGolang, because we need to
+// customize the ClientHello extensions.
+//
+// The config.ServerName passed to Handshake is the name in the inner ClientHello, while
+// the outer ClientHello uses the config's public name. We verify the certificate against
+// the inner name, therefore the handshake succeeds only when the server accepts ECH. If
+// the handshake fails, the error is an *ECHError and ECHStatusFromError tells whether the
+// server accepted ECH, rejected it sending retry configs, or did not acknowledge it.
+//
+// We do not support HelloRetryRequest, which causes ErrECHHelloRetryRequest.
+//
+// Passing a nil `id` will make this function panic.
+func NewTLSHandshakerECH(
+	logger model.DebugLogger, id *utls.ClientHelloID, echConfigList []byte) model.TLSHandshaker {
+	return &tlsHandshakerECH{
+		DebugLogger:   logger,
+		ECHConfigList: echConfigList,
+		ID:            *id,
+	}
+}
+
+// tlsHandshakerECH is the handshaker returned by NewTLSHandshakerECH.
+type tlsHandshakerECH struct {
+	// DebugLogger is the MANDATORY logger.
+	DebugLogger model.DebugLogger
+
+	// ECHConfigList is the MANDATORY ECHConfigList.
+	ECHConfigList []byte
+
+	// ID is the MANDATORY utls ClientHelloID.
+	ID utls.ClientHelloID
+}
+
+var _ model.TLSHandshaker = &tlsHandshakerECH{}
+
+// Handshake implements model.TLSHandshaker.
+func (h *tlsHandshakerECH) Handshake(
+	ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, tls.ConnectionState, error) {
+	configs, err := ParseECHConfigList(h.ECHConfigList)
+	if err != nil {
+		return nil, tls.ConnectionState{}, err
+	}
+	echConfig, suite, err := echSelectConfig(configs)
+	if err != nil {
+		return nil, tls.ConnectionState{}, err
+	}
+	th := newTLSHandshaker(&tlsHandshakerConfigurable{
+		NewConn: newConnUTLSECH(&h.ID, echConfig, suite),
+	}, h.DebugLogger)
+	return th.Handshake(ctx, conn, config)
+}
+
+// echSelectConfig returns the first config using the DHKEM(X25519, HKDF-SHA256)
+// KEM along with its first HPKE cipher suite that we support.
+func echSelectConfig(configs []*ECHConfig) (*ECHConfig, ECHCipherSuite, error) {
+	for _, config := range configs {
+		if config.KEMID != hpkeKEMX25519HKDFSHA256 {
+			continue
+		}
+		for _, suite := range config.CipherSuites {
+			if hpkeSupportedSuite(suite) {
+				return config, suite, nil
+			}
+		}
+	}
+	return nil, ECHCipherSuite{}, ErrECHNoSupportedConfig
+}
+
+// echConn is the TLSConn created by tlsHandshakerECH.
+type echConn struct {
+	*utlsConn
+	conn *echHelloConn
+}
+
+// HandshakeContext implements TLSConn.HandshakeContext. When the
+// handshake fails, it returns an *ECHError containing the ECH outcome.
+func (c *echConn) HandshakeContext(ctx context.Context) error {
+	err := c.utlsConn.HandshakeContext(ctx)
+	status, retryConfigs := c.conn.outcome(err)
+	switch status {
+	case ECHStatusAccepted:
+		if err == nil {
+			return nil
+		}
+	case ECHStatusRejected:
+		err = ErrECHRejected
+	case ECHStatusStripped:
+		err = ErrECHStripped
+	}
+	return &ECHError{Err: err, Status: status, RetryConfigs: retryConfigs}
+}
+
+// newConnUTLSECH returns a NewConn function for creating echConn instances.
+func newConnUTLSECH(id *utls.ClientHelloID, echConfig *ECHConfig,
+	suite ECHCipherSuite) func(conn net.Conn, config *tls.Config) (TLSConn, error) {
+	return func(conn net.Conn, config *tls.Config) (TLSConn, error) {
+		hconn := &echHelloConn{
+			Conn:   conn,
+			config: echConfig,
+			reader: rand.Reader,
+			suite:  suite,
+		}
+		tlsconn, err := newConnUTLSWithHelloID(hconn, config, id)
+		if err != nil {
+			return nil, err
+		}
+		uconn := tlsconn.(*utlsConn)
+		// Note: see newConnUTLSECHGREASE for why we build the handshake state.
+		if err := uconn.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+		ext := &utls.GenericExtension{Id: ECHExtensionType, Data: []byte{echClientHelloTypeInner}}
+		uconn.Extensions = echInsertExtension(uconn.Extensions, ext)
+		return &echConn{utlsConn: uconn, conn: hconn}, nil
+	}
+}
+
+// NewTLSHandshakerECHGREASE creates a new TLS handshaker using gitlab.com/yawning/utls
+// that sends a GREASE ECH extension built using the first config inside the given
+// ECHConfigList. That is, the extension uses the config ID, the cipher suite and
+// the sizes of a genuine extension, but the encapsulated key and the payload are
+// random bytes, so the server cannot accept ECH. The id is the address of something
+// like utls.HelloChrome_Auto and MUST NOT be utls.HelloGolang, because we need to
+// customize the ClientHello extensions.
+//
+// Because there is no inner ClientHello, the handshaker uses the config's public
+// name as the SNI and ignores the config.ServerName passed to Handshake except for
+// sizing the extension. Hence, the server certificate is verified against the
+// public name, exactly like a client whose ECH offer was rejected.
+//
+// Passing a nil `id` will make this function panic.
+func NewTLSHandshakerECHGREASE(
+	logger model.DebugLogger, id *utls.ClientHelloID, echConfigList []byte) model.TLSHandshaker {
+	return &tlsHandshakerECHGREASE{
+		DebugLogger:   logger,
+		ECHConfigList: echConfigList,
+		ID:            *id,
+	}
+}
+
+// tlsHandshakerECHGREASE is the handshaker returned by NewTLSHandshakerECHGREASE.
+type tlsHandshakerECHGREASE struct {
+	// DebugLogger is the MANDATORY logger.
+	DebugLogger model.DebugLogger
+
+	// ECHConfigList is the MANDATORY ECHConfigList.
+	ECHConfigList []byte
+
+	// ID is the MANDATORY utls ClientHelloID.
+	ID utls.ClientHelloID
+}
+
+var _ model.TLSHandshaker = &tlsHandshakerECHGREASE{}
+
+// Handshake implements model.TLSHandshaker.
+func (h *tlsHandshakerECHGREASE) Handshake(
+	ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, tls.ConnectionState, error) {
+	configs, err := ParseECHConfigList(h.ECHConfigList)
+	if err != nil {
+		return nil, tls.ConnectionState{}, err
+	}
+	echConfig := configs[0]
+	innerServerName := config.ServerName
+	config = config.Clone() // operate on a clone
+	config.ServerName = echConfig.PublicName
+	th := newTLSHandshaker(&tlsHandshakerConfigurable{
+		NewConn: newConnUTLSECHGREASE(&h.ID, echConfig, innerServerName),
+	}, h.DebugLogger)
+	return th.Handshake(ctx, conn, config)
+}
+
+// newConnUTLSECHGREASE returns a NewConn function for creating utlsConn
+// instances that send a GREASE ECH extension.
+func newConnUTLSECHGREASE(id *utls.ClientHelloID, echConfig *ECHConfig,
+	innerServerName string) func(conn net.Conn, config *tls.Config) (TLSConn, error) {
+	return func(conn net.Conn, config *tls.Config) (TLSConn, error) {
+		tlsconn, err := newConnUTLSWithHelloID(conn, config, id)
+		if err != nil {
+			return nil, err
+		}
+		uconn := tlsconn.(*utlsConn)
+		// Note: building the handshake state applies the parrot, so we can
+		// then add our extension, and UConn.Handshake will marshal again
+		// the ClientHello without applying the parrot again.
+		if err := uconn.BuildHandshakeState(); err != nil {
+			return nil, err
+		}
+		ext, err := newECHGREASEExtension(rand.Reader, echConfig, innerServerName)
+		if err != nil {
+			return nil, err
+		}
+		uconn.Extensions = echInsertExtension(uconn.Extensions, ext)
+		return uconn, nil
+	}
+}
+
+// echInsertExtension adds the ECH extension before the padding
+// extension, which must be the last one, if present.
+func echInsertExtension(exts []utls.TLSExtension, ext utls.TLSExtension) []utls.TLSExtension {
+	if count := len(exts); count > 0 {
+		if _, found := exts[count-1].(*utls.UtlsPaddingExtension); found {
+			out := append([]utls.TLSExtension{}, exts[:count-1]...)
+			return append(out, ext, exts[count-1])
+		}
+	}
+	return append(exts, ext)
+}
+
+// echInnerClientHelloBaseLength approximates the length of an encoded inner ClientHello
+// without the server name, assuming most extensions are compressed in the outer one.
+const echInnerClientHelloBaseLength = 128
+
+// echAEADTagLength is the length of the tag of all the AEADs defined by HPKE.
+const echAEADTagLength = 16
+
+// newECHGREASEExtension creates an outer encrypted_client_hello extension using
+// the given config where the encapsulated key and the payload are random bytes. We
+// size the payload following the padding scheme recommended by draft-ietf-tls-esni
+// so that the extension has the same size as a genuine one.
+func newECHGREASEExtension(reader io.Reader,
+	config *ECHConfig, innerServerName string) (*utls.GenericExtension, error) {
+	enc := make([]byte, len(config.PublicKey))
+	if _, err := io.ReadFull(reader, enc); err != nil {
+		return nil, err
+	}
+	nameLength := len(innerServerName)
+	if maxLength := int(config.MaximumNameLength); maxLength > nameLength {
+		nameLength = maxLength
+	}
+	innerLength := echInnerClientHelloBaseLength + nameLength
+	innerLength += 31 - ((innerLength + 31) % 32) // round to a multiple of 32
+	payload := make([]byte, innerLength+echAEADTagLength)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	data := echNewOuterExtension(config, config.CipherSuites[0], enc, payload)
+	return &utls.GenericExtension{Id: ECHExtensionType, Data: data}, nil
+}
+
+// echAppendUint16 appends v to b in big endian byte order.
+func echAppendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
@@ -0,0 +1,973 @@
+package netxlite
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/model/mocks"
+	"github.com/google/go-cmp/cmp"
+	utls "gitlab.com/yawning/utls.git"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// echGenConfig generates the serialized ECHConfig described by config.
+func echGenConfig(version uint16, config *ECHConfig) []byte {
+	var contents []byte
+	contents = append(contents, config.ConfigID)
+	contents = echAppendUint16(contents, config.KEMID)
+	contents = echAppendUint16(contents, uint16(len(config.PublicKey)))
+	contents = append(contents, config.PublicKey...)
+	contents = echAppendUint16(contents, uint16(4*len(config.CipherSuites)))
+	for _, suite := range config.CipherSuites {
+		contents = echAppendUint16(contents, suite.KDFID)
+		contents = echAppendUint16(contents, suite.AEADID)
+	}
+	contents = append(contents, config.MaximumNameLength)
+	contents = append(contents, uint8(len(config.PublicName)))
+	contents = append(contents, config.PublicName...)
+	contents = echAppendUint16(contents, 0) // extensions
+	out := echAppendUint16(nil, version)
+	out = echAppendUint16(out, uint16(len(contents)))
+	return append(out, contents...)
+}
+
+// echGenConfigList generates an ECHConfigList containing the given configs.
+func echGenConfigList(configs ...[]byte) []byte {
+	var list []byte
+	for _, config := range configs {
+		list = append(list, config...)
+	}
+	out := echAppendUint16(nil, uint16(len(list)))
+	return append(out, list...)
+}
+
+// echTestConfig returns the ECHConfig used by tests.
+func echTestConfig() *ECHConfig {
+	return &ECHConfig{
+		ConfigID:          7,
+		KEMID:             0x0020, // DHKEM(X25519, HKDF-SHA256)
+		PublicKey:         bytes.Repeat([]byte{0x11}, 32),
+		CipherSuites:      []ECHCipherSuite{{KDFID: 0x0001, AEADID: 0x0001}},
+		MaximumNameLength: 64,
+		PublicName:        "example.com",
+	}
+}
+
+func TestParseECHConfigList(t *testing.T) {
+	t.Run("with a valid list", func(t *testing.T) {
+		expect := echTestConfig()
+		expect.Raw = echGenConfig(ECHConfigVersion, expect)
+		data := echGenConfigList(expect.Raw)
+		configs, err := ParseECHConfigList(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]*ECHConfig{expect}, configs); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("we skip unsupported versions", func(t *testing.T) {
+		expect := echTestConfig()
+		expect.Raw = echGenConfig(ECHConfigVersion, expect)
+		data := echGenConfigList(
+			echGenConfig(0xfe0a, &ECHConfig{PublicName: "x"}),
+			expect.Raw,
+		)
+		configs, err := ParseECHConfigList(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]*ECHConfig{expect}, configs); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("with only unsupported versions", func(t *testing.T) {
+		data := echGenConfigList(echGenConfig(0xfe0a, echTestConfig()))
+		configs, err := ParseECHConfigList(data)
+		if !errors.Is(err, ErrECHNoSupportedConfig) {
+			t.Fatal("unexpected error", err)
+		}
+		if len(configs) != 0 {
+			t.Fatal("expected no configs")
+		}
+	})
+
+	t.Run("with invalid data", func(t *testing.T) {
+		valid := echGenConfigList(echGenConfig(ECHConfigVersion, echTestConfig()))
+		noSuites := echTestConfig()
+		noSuites.CipherSuites = nil
+		noPublicName := echTestConfig()
+		noPublicName.PublicName = ""
+		inputs := map[string][]byte{
+			"empty":          nil,
+			"truncated":      valid[:len(valid)-1],
+			"trailing":       append(append([]byte{}, valid...), 0),
+			"no suites":      echGenConfigList(echGenConfig(ECHConfigVersion, noSuites)),
+			"no public name": echGenConfigList(echGenConfig(ECHConfigVersion, noPublicName)),
+		}
+		for name, data := range inputs {
+			t.Run(name, func(t *testing.T) {
+				configs, err := ParseECHConfigList(data)
+				if !errors.Is(err, ErrECHInvalidConfigList) {
+					t.Fatal("unexpected error", err)
+				}
+				if len(configs) != 0 {
+					t.Fatal("expected no configs")
+				}
+			})
+		}
+	})
+}
+
+func Test_newECHGREASEExtension(t *testing.T) {
+	t.Run("on success", func(t *testing.T) {
+		config := echTestConfig()
+		ext, err := newECHGREASEExtension(bytes.NewReader(make([]byte, 1024)), config, "www.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ext.Id != ECHExtensionType {
+			t.Fatal("unexpected extension type", ext.Id)
+		}
+		reader := &echReader{ext.Data}
+		if chtype, _ := reader.readUint8(); chtype != 0 {
+			t.Fatal("expected an outer ClientHello extension")
+		}
+		if kdf, _ := reader.readUint16(); kdf != 0x0001 {
+			t.Fatal("unexpected KDF", kdf)
+		}
+		if aead, _ := reader.readUint16(); aead != 0x0001 {
+			t.Fatal("unexpected AEAD", aead)
+		}
+		if configID, _ := reader.readUint8(); configID != 7 {
+			t.Fatal("unexpected config ID", configID)
+		}
+		enc, good := reader.readVector16()
+		if !good || len(enc.data) != len(config.PublicKey) {
+			t.Fatal("unexpected enc")
+		}
+		payload, good := reader.readVector16()
+		// the max name length is 64 hence we expect 128+64=192 bytes, which is
+		// already a multiple of 32, and then the AEAD tag
+		if !good || len(payload.data) != 192+echAEADTagLength {
+			t.Fatal("unexpected payload")
+		}
+		if !reader.empty() {
+			t.Fatal("expected no trailing data")
+		}
+	})
+
+	t.Run("we round the payload length", func(t *testing.T) {
+		config := echTestConfig()
+		config.MaximumNameLength = 0
+		ext, err := newECHGREASEExtension(bytes.NewReader(make([]byte, 1024)), config, "www.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := 1 + 2 + 2 + 1 + 2 + 32 + 2 + 160 + echAEADTagLength
+		if len(ext.Data) != expect {
+			t.Fatal("unexpected length", len(ext.Data))
+		}
+	})
+
+	t.Run("on failure to read random bytes", func(t *testing.T) {
+		ext, err := newECHGREASEExtension(&bytes.Reader{}, echTestConfig(), "www.example.org")
+		if !errors.Is(err, io.EOF) {
+			t.Fatal("unexpected error", err)
+		}
+		if ext != nil {
+			t.Fatal("expected nil extension")
+		}
+	})
+}
+
+func Test_echInsertExtension(t *testing.T) {
+	ext := &utls.GenericExtension{Id: ECHExtensionType}
+
+	t.Run("without padding", func(t *testing.T) {
+		exts := []utls.TLSExtension{&utls.SNIExtension{}}
+		out := echInsertExtension(exts, ext)
+		if len(out) != 2 || out[1] != ext {
+			t.Fatal("expected the extension to be the last one")
+		}
+	})
+
+	t.Run("with padding", func(t *testing.T) {
+		padding := &utls.UtlsPaddingExtension{}
+		exts := []utls.TLSExtension{&utls.SNIExtension{}, padding}
+		out := echInsertExtension(exts, ext)
+		if len(out) != 3 || out[1] != ext || out[2] != padding {
+			t.Fatal("expected the extension to be before the padding")
+		}
+		if exts[1] != padding {
+			t.Fatal("we should not modify the original slice")
+		}
+	})
+}
+
+// echRecordingListener is a net.Listener recording the first
+// bytes sent by the client, i.e., the ClientHello.
+type echRecordingListener struct {
+	net.Listener
+	mu   sync.Mutex
+	data []byte
+}
+
+func (l *echRecordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &echRecordingConn{Conn: conn, l: l}, nil
+}
+
+func (l *echRecordingListener) recorded() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.data
+}
+
+type echRecordingConn struct {
+	net.Conn
+	l *echRecordingListener
+}
+
+func (c *echRecordingConn) Read(b []byte) (int, error) {
+	count, err := c.Conn.Read(b)
+	c.l.mu.Lock()
+	if len(c.l.data) < 1<<14 {
+		c.l.data = append(c.l.data, b[:count]...)
+	}
+	c.l.mu.Unlock()
+	return count, err
+}
+
+func TestNewTLSHandshakerECHGREASE(t *testing.T) {
+	t.Run("we send GREASE ECH and use the public name as the SNI", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+		listener := &echRecordingListener{Listener: srv.Listener}
+		srv.Listener = listener
+		srv.StartTLS()
+		defer srv.Close()
+		echConfigList := echGenConfigList(echGenConfig(ECHConfigVersion, echTestConfig()))
+		th := NewTLSHandshakerECHGREASE(model.DiscardLogger, &utls.HelloChrome_83, echConfigList)
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &tls.Config{
+			RootCAs:    srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+			ServerName: "www.example.org",
+			NextProtos: []string{"http/1.1"},
+		}
+		tlsConn, state, err := th.Handshake(context.Background(), conn, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tlsConn.Close()
+		if state.ServerName != "" {
+			// note: the client side state does not include the SNI
+			t.Fatal("unexpected server name", state.ServerName)
+		}
+		clientHello := string(listener.recorded())
+		if !strings.Contains(clientHello, "example.com") {
+			t.Fatal("expected the public name in the ClientHello")
+		}
+		if strings.Contains(clientHello, "www.example.org") {
+			t.Fatal("did not expect the inner server name in the ClientHello")
+		}
+		if !strings.Contains(clientHello, "\xfe\x0d") {
+			t.Fatal("expected the ECH extension in the ClientHello")
+		}
+		if config.ServerName != "www.example.org" {
+			t.Fatal("we should not modify the original config")
+		}
+	})
+
+	t.Run("with an invalid ECHConfigList", func(t *testing.T) {
+		th := NewTLSHandshakerECHGREASE(model.DiscardLogger, &utls.HelloChrome_83, nil)
+		conn, state, err := th.Handshake(context.Background(), &mocks.Conn{}, &tls.Config{})
+		if !errors.Is(err, ErrECHInvalidConfigList) {
+			t.Fatal("unexpected error", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+		if state.HandshakeComplete {
+			t.Fatal("expected zero state")
+		}
+	})
+}
+
+// echTestKeyPair returns an ECHConfig using DHKEM(X25519, HKDF-SHA256), as parsed
+// by ParseECHConfigList, along with the corresponding private key.
+func echTestKeyPair(t *testing.T) (*ECHConfig, []byte) {
+	privateKey := bytes.Repeat([]byte{0x44}, curve25519.ScalarSize)
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := echTestConfig()
+	config.PublicKey = publicKey
+	config.PublicName = "public.example.net"
+	configs, err := ParseECHConfigList(echGenConfigList(echGenConfig(ECHConfigVersion, config)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configs[0], privateKey
+}
+
+// echTestAcceptConfirmation computes the acceptance confirmation like a server that
+// accepted ECH, given a ServerHello whose random ends with zero bytes.
+func echTestAcceptConfirmation(h func() hash.Hash, inner, serverHello []byte) []byte {
+	secret := hkdf.Extract(h, inner[6:6+echRandomLength], nil)
+	return echExpandLabel(h, secret, "ech accept confirmation",
+		echTranscriptHash(h, inner, serverHello), echAcceptConfirmationLength)
+}
+
+// echTestServer is a TLS server accepting ECH. Because crypto/tls does not support ECH, we
+// decrypt the inner ClientHello and we pass it to crypto/tls. To include the acceptance
+// confirmation into the ServerHello random, we take advantage of crypto/tls generating the
+// ServerHello using only the ClientHello and the random bytes we provide. So, we generate
+// the ServerHello a first time, we compute the confirmation, and we then perform the real
+// handshake providing random bytes that include the confirmation.
+type echTestServer struct {
+	config     *ECHConfig
+	privateKey []byte
+	tlsConfig  *tls.Config
+}
+
+// startECHTestServer starts an echTestServer and returns its listener.
+func startECHTestServer(t *testing.T, config *ECHConfig, privateKey []byte,
+	tlsConfig *tls.Config) *echRecordingListener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	recorder := &echRecordingListener{Listener: listener}
+	srv := &echTestServer{config: config, privateKey: privateKey, tlsConfig: tlsConfig}
+	go func() {
+		for {
+			conn, err := recorder.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return recorder
+}
+
+// serve serves the given conn.
+func (s *echTestServer) serve(conn net.Conn) error {
+	defer conn.Close()
+	header := make([]byte, echRecordHeaderLength)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	outerMsg := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(conn, outerMsg); err != nil {
+		return err
+	}
+	innerMsg, err := s.decrypt(outerMsg)
+	if err != nil {
+		return err
+	}
+	innerRecord := append(echAppendUint16(header[:3:3], uint16(len(innerMsg))), innerMsg...)
+	random := make([]byte, echRandomLength)
+	serverHello, err := s.serverHello(innerRecord, random)
+	if err != nil {
+		return err
+	}
+	sh, _ := echParseServerHello(serverHello)
+	h := echCipherSuiteHash(sh.cipherSuite)
+	copy(random[echRandomLength-echAcceptConfirmationLength:],
+		echTestAcceptConfirmation(h, innerMsg, serverHello))
+	tlsConn := tls.Server(&echTestServerConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(innerRecord), conn),
+	}, s.newTLSConfig(random))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, tlsConn)
+	return err
+}
+
+// decrypt decrypts the inner ClientHello contained by the given outer ClientHello.
+func (s *echTestServer) decrypt(outerMsg []byte) ([]byte, error) {
+	outer, err := echParseClientHello(outerMsg)
+	if err != nil {
+		return nil, err
+	}
+	ext := outer.extension(ECHExtensionType)
+	if ext == nil {
+		return nil, errors.New("missing ECH extension")
+	}
+	reader := &echReader{ext.data}
+	reader.readUint8() // outer
+	kdf, _ := reader.readUint16()
+	aead, _ := reader.readUint16()
+	reader.readUint8() // config ID
+	enc, _ := reader.readVector16()
+	payload, good := reader.readVector16()
+	if !good {
+		return nil, errors.New("invalid ECH extension")
+	}
+	suite := ECHCipherSuite{KDFID: kdf, AEADID: aead}
+	info := append([]byte("tls ech\x00"), s.config.Raw...)
+	hpkeCtx, err := hpkeSetupBaseRecipient(s.privateKey, enc.data, suite, info)
+	if err != nil {
+		return nil, err
+	}
+	ext.data = echNewOuterExtension(s.config, suite, enc.data, make([]byte, len(payload.data)))
+	encoded, err := hpkeCtx.open(outer.marshalBody(), payload.data)
+	if err != nil {
+		return nil, err
+	}
+	// skip the fields preceding the extensions and then the extensions
+	reader = &echReader{encoded}
+	reader.read(2 + echRandomLength)
+	reader.readVector8()
+	reader.readVector16()
+	reader.readVector8()
+	if _, good := reader.readVector16(); !good || len(bytes.Trim(reader.data, "\x00")) > 0 {
+		return nil, errors.New("invalid EncodedClientHelloInner")
+	}
+	body := encoded[:len(encoded)-len(reader.data)]
+	msg := append([]byte{echHandshakeTypeClientHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	inner, err := echParseClientHello(msg)
+	if err != nil {
+		return nil, err
+	}
+	inner.sessionID = outer.sessionID
+	return inner.marshal(), nil
+}
+
+// serverHello returns the ServerHello generated by crypto/tls.
+func (s *echTestServer) serverHello(innerRecord, random []byte) ([]byte, error) {
+	reader := bytes.NewReader(innerRecord)
+	var written []byte
+	conn := &mocks.Conn{
+		MockRead: reader.Read,
+		MockWrite: func(b []byte) (int, error) {
+			written = append(written, b...)
+			return len(b), nil
+		},
+		MockClose: func() error {
+			return nil
+		},
+	}
+	tls.Server(conn, s.newTLSConfig(random)).Handshake() // fails reading the client flight
+	serverHello, _ := echParseServerFlight(written)
+	if serverHello == nil {
+		return nil, errors.New("missing ServerHello")
+	}
+	return serverHello, nil
+}
+
+// newTLSConfig returns the config to use given the ServerHello random.
+func (s *echTestServer) newTLSConfig(random []byte) *tls.Config {
+	config := s.tlsConfig.Clone()
+	config.SessionTicketsDisabled = true
+	config.Rand = io.MultiReader(bytes.NewReader(random), bytes.NewReader(bytes.Repeat([]byte{0x55}, 1<<16)))
+	return config
+}
+
+// echTestServerConn is the net.Conn used by echTestServer.
+type echTestServerConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *echTestServerConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func TestNewTLSHandshakerECH(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	rootCAs := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	echConfig, privateKey := echTestKeyPair(t)
+	echConfigList := echGenConfigList(echConfig.Raw)
+
+	t.Run("when the server accepts ECH", func(t *testing.T) {
+		listener := startECHTestServer(t, echConfig, privateKey, srv.TLS)
+		th := NewTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, echConfigList)
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &tls.Config{RootCAs: rootCAs, ServerName: "example.com"}
+		tlsConn, _, err := th.Handshake(context.Background(), conn, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tlsConn.Close()
+		if status, _ := ECHStatusFromError(err); status != ECHStatusAccepted {
+			t.Fatal("unexpected status", status)
+		}
+		clientHello := string(listener.recorded())
+		if !strings.Contains(clientHello, "public.example.net") {
+			t.Fatal("expected the public name in the ClientHello")
+		}
+		if strings.Contains(clientHello, "example.com") {
+			t.Fatal("did not expect the inner server name in the ClientHello")
+		}
+	})
+
+	t.Run("when the server accepts ECH but the certificate is invalid", func(t *testing.T) {
+		listener := startECHTestServer(t, echConfig, privateKey, srv.TLS)
+		th := NewTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, echConfigList)
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		config := &tls.Config{RootCAs: rootCAs, ServerName: "www.example.org"}
+		tlsConn, _, err := th.Handshake(context.Background(), conn, config)
+		if err == nil || err.Error() != FailureSSLInvalidHostname {
+			t.Fatal("unexpected error", err)
+		}
+		if tlsConn != nil {
+			t.Fatal("expected nil conn")
+		}
+		if status, _ := ECHStatusFromError(err); status != ECHStatusAccepted {
+			t.Fatal("unexpected status", status)
+		}
+	})
+
+	t.Run("when the server does not support ECH", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+		listener := &echRecordingListener{Listener: srv.Listener}
+		srv.Listener = listener
+		srv.StartTLS()
+		defer srv.Close()
+		th := NewTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, echConfigList)
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		config := &tls.Config{RootCAs: rootCAs, ServerName: "www.example.org"}
+		tlsConn, _, err := th.Handshake(context.Background(), conn, config)
+		if !errors.Is(err, ErrECHStripped) || err.Error() != FailureSSLFailedHandshake {
+			t.Fatal("unexpected error", err)
+		}
+		if tlsConn != nil {
+			t.Fatal("expected nil conn")
+		}
+		if status, retryConfigs := ECHStatusFromError(err); status != ECHStatusStripped || retryConfigs != nil {
+			t.Fatal("unexpected status", status, retryConfigs)
+		}
+		clientHello := string(listener.recorded())
+		if !strings.Contains(clientHello, "public.example.net") {
+			t.Fatal("expected the public name in the ClientHello")
+		}
+		if strings.Contains(clientHello, "www.example.org") {
+			t.Fatal("did not expect the inner server name in the ClientHello")
+		}
+	})
+
+	t.Run("when the connection fails before the ServerHello", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		conn := &mocks.Conn{
+			MockWrite: func(b []byte) (int, error) {
+				return len(b), nil
+			},
+			MockRead: func(b []byte) (int, error) {
+				return 0, expected
+			},
+			MockRemoteAddr: func() net.Addr {
+				return &mocks.Addr{MockString: func() string { return "127.0.0.1:443" }}
+			},
+			MockSetDeadline: func(t time.Time) error {
+				return nil
+			},
+		}
+		th := NewTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, echConfigList)
+		config := &tls.Config{RootCAs: rootCAs, ServerName: "www.example.org"}
+		_, _, err := th.Handshake(context.Background(), conn, config)
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected error", err)
+		}
+		if status, _ := ECHStatusFromError(err); status != ECHStatusOffered {
+			t.Fatal("unexpected status", status)
+		}
+	})
+
+	t.Run("with an invalid ECHConfigList", func(t *testing.T) {
+		th := NewTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, nil)
+		conn, _, err := th.Handshake(context.Background(), &mocks.Conn{}, &tls.Config{})
+		if !errors.Is(err, ErrECHInvalidConfigList) {
+			t.Fatal("unexpected error", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("without any config we can use", func(t *testing.T) {
+		unsupported := echTestConfig()
+		unsupported.KEMID = 0x0010 // DHKEM(P-256, HKDF-SHA256)
+		echConfigList := echGenConfigList(echGenConfig(ECHConfigVersion, unsupported))
+		th := NewTLSHandshakerECH(model.DiscardLogger, &utls.HelloChrome_83, echConfigList)
+		conn, _, err := th.Handshake(context.Background(), &mocks.Conn{}, &tls.Config{})
+		if !errors.Is(err, ErrECHNoSupportedConfig) {
+			t.Fatal("unexpected error", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+}
+
+func Test_echSelectConfig(t *testing.T) {
+	t.Run("we skip unsupported KEMs and cipher suites", func(t *testing.T) {
+		unsupportedKEM := echTestConfig()
+		unsupportedKEM.KEMID = 0x0010
+		expect := echTestConfig()
+		expect.CipherSuites = []ECHCipherSuite{
+			{KDFID: hpkeKDFHKDFSHA256, AEADID: 0xffff},
+			{KDFID: hpkeKDFHKDFSHA256, AEADID: hpkeAEADChaCha20Poly1305},
+		}
+		config, suite, err := echSelectConfig([]*ECHConfig{unsupportedKEM, expect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config != expect || suite != expect.CipherSuites[1] {
+			t.Fatal("unexpected config or suite")
+		}
+	})
+
+	t.Run("without any supported config", func(t *testing.T) {
+		unsupported := echTestConfig()
+		unsupported.CipherSuites = []ECHCipherSuite{{KDFID: 0xffff, AEADID: hpkeAEADAES128GCM}}
+		_, _, err := echSelectConfig([]*ECHConfig{unsupported})
+		if !errors.Is(err, ErrECHNoSupportedConfig) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+// echTestInnerClientHello returns an inner ClientHello message.
+func echTestInnerClientHello() *echClientHello {
+	keyShares := echAppendUint16(nil, 0x0a0a) // GREASE
+	keyShares = echAppendUint16(keyShares, 1)
+	keyShares = append(keyShares, 0)
+	keyShares = echAppendUint16(keyShares, echGroupX25519)
+	keyShares = echAppendUint16(keyShares, curve25519.PointSize)
+	keyShares = append(keyShares, bytes.Repeat([]byte{0x99}, curve25519.PointSize)...)
+	keyShares = echAppendUint16(keyShares, 23) // secp256r1
+	keyShares = echAppendUint16(keyShares, 1)
+	keyShares = append(keyShares, 0)
+	return &echClientHello{
+		version:            tls.VersionTLS12,
+		random:             bytes.Repeat([]byte{0x88}, echRandomLength),
+		sessionID:          bytes.Repeat([]byte{0x77}, 32),
+		cipherSuites:       echAppendUint16(nil, tls.TLS_AES_128_GCM_SHA256),
+		compressionMethods: []byte{0},
+		extensions: []echExtension{
+			{id: echExtensionServerName, data: echNewServerNameExtension("www.example.org")},
+			{id: echExtensionKeyShare, data: append(echAppendUint16(nil, uint16(len(keyShares))), keyShares...)},
+			{id: echExtensionPreSharedKey, data: []byte{0}},
+			{id: ECHExtensionType, data: []byte{echClientHelloTypeInner}},
+		},
+	}
+}
+
+func Test_echNewClientHelloOuter(t *testing.T) {
+	t.Run("on success", func(t *testing.T) {
+		echConfig, privateKey := echTestKeyPair(t)
+		inner := echTestInnerClientHello()
+		outerMsg, outerKey, err := echNewClientHelloOuter(rand.Reader, inner, echConfig, echConfig.CipherSuites[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		outer, err := echParseClientHello(outerMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(outer.random, inner.random) || !bytes.Equal(outer.sessionID, inner.sessionID) {
+			t.Fatal("unexpected random or session ID")
+		}
+		ids := []uint16{}
+		for _, ext := range outer.extensions {
+			ids = append(ids, ext.id)
+		}
+		if diff := cmp.Diff([]uint16{echExtensionServerName, echExtensionKeyShare, ECHExtensionType}, ids); diff != "" {
+			t.Fatal(diff)
+		}
+		if sni := outer.extension(echExtensionServerName); !bytes.Equal(sni.data, echNewServerNameExtension("public.example.net")) {
+			t.Fatal("unexpected server name")
+		}
+		outerPublicKey, _ := curve25519.X25519(outerKey, curve25519.Basepoint)
+		expectShares := echAppendUint16(nil, 0x0a0a)
+		expectShares = echAppendUint16(expectShares, 1)
+		expectShares = append(expectShares, 0)
+		expectShares = echAppendUint16(expectShares, echGroupX25519)
+		expectShares = echAppendUint16(expectShares, curve25519.PointSize)
+		expectShares = append(expectShares, outerPublicKey...)
+		expectShares = append(echAppendUint16(nil, uint16(len(expectShares))), expectShares...)
+		if !bytes.Equal(outer.extension(echExtensionKeyShare).data, expectShares) {
+			t.Fatal("unexpected key share")
+		}
+		srv := &echTestServer{config: echConfig, privateKey: privateKey}
+		decrypted, err := srv.decrypt(outerMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, inner.marshal()) {
+			t.Fatal("unexpected inner ClientHello")
+		}
+	})
+
+	t.Run("we pad the inner ClientHello", func(t *testing.T) {
+		echConfig, _ := echTestKeyPair(t)
+		inner := echTestInnerClientHello()
+		long := echEncodeClientHelloInner(inner, echConfig)
+		inner.extensions[0].data = echNewServerNameExtension("a.org")
+		short := echEncodeClientHelloInner(inner, echConfig)
+		inner.extensions = inner.extensions[1:]
+		nameless := echEncodeClientHelloInner(inner, echConfig)
+		if len(long)%32 != 0 || len(long) != len(short) || len(nameless) != len(short) {
+			t.Fatal("unexpected lengths", len(long), len(short), len(nameless))
+		}
+	})
+
+	t.Run("without the ECH extension", func(t *testing.T) {
+		echConfig, _ := echTestKeyPair(t)
+		inner := echTestInnerClientHello()
+		inner.extensions = inner.extensions[:3]
+		_, _, err := echNewClientHelloOuter(rand.Reader, inner, echConfig, echConfig.CipherSuites[0])
+		if !errors.Is(err, errECHInvalidClientHello) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("on failure to read random bytes", func(t *testing.T) {
+		echConfig, _ := echTestKeyPair(t)
+		inner := echTestInnerClientHello()
+		_, _, err := echNewClientHelloOuter(bytes.NewReader(nil), inner, echConfig, echConfig.CipherSuites[0])
+		if !errors.Is(err, io.EOF) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+// echTestServerFlight generates the beginning of a TLS 1.3 server flight where the ServerHello
+// has the given random and the EncryptedExtensions contain the given extensions, using the key
+// share of the given outer ClientHello, i.e., what a server not accepting ECH would send.
+func echTestServerFlight(t *testing.T, outer, random []byte, extensions ...echExtension) []byte {
+	ch, err := echParseClientHello(outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares := &echReader{ch.extension(echExtensionKeyShare).data[2:]}
+	var clientPublicKey []byte
+	for !shares.empty() {
+		group, _ := shares.readUint16()
+		share, _ := shares.readVector16()
+		if group == echGroupX25519 {
+			clientPublicKey = share.data
+		}
+	}
+	serverPrivateKey := bytes.Repeat([]byte{0x66}, curve25519.ScalarSize)
+	serverPublicKey, _ := curve25519.X25519(serverPrivateKey, curve25519.Basepoint)
+	sharedSecret, err := curve25519.X25519(serverPrivateKey, clientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := echAppendUint16(nil, tls.VersionTLS12)
+	body = append(body, random...)
+	body = append(body, uint8(len(ch.sessionID)))
+	body = append(body, ch.sessionID...)
+	body = echAppendUint16(body, tls.TLS_AES_128_GCM_SHA256)
+	body = append(body, 0)
+	shExtensions := echAppendUint16(nil, echExtensionSupportedVersions)
+	shExtensions = echAppendUint16(shExtensions, 2)
+	shExtensions = echAppendUint16(shExtensions, tls.VersionTLS13)
+	shExtensions = echAppendUint16(shExtensions, echExtensionKeyShare)
+	shExtensions = echAppendUint16(shExtensions, uint16(4+len(serverPublicKey)))
+	shExtensions = echAppendUint16(shExtensions, echGroupX25519)
+	shExtensions = echAppendUint16(shExtensions, uint16(len(serverPublicKey)))
+	shExtensions = append(shExtensions, serverPublicKey...)
+	body = echAppendUint16(body, uint16(len(shExtensions)))
+	body = append(body, shExtensions...)
+	serverHello := append([]byte{echHandshakeTypeServerHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	var eeExtensions []byte
+	for _, ext := range extensions {
+		eeExtensions = echAppendUint16(eeExtensions, ext.id)
+		eeExtensions = echAppendUint16(eeExtensions, uint16(len(ext.data)))
+		eeExtensions = append(eeExtensions, ext.data...)
+	}
+	eeBody := append(echAppendUint16(nil, uint16(len(eeExtensions))), eeExtensions...)
+	plaintext := append([]byte{echHandshakeTypeEncryptedExts, 0, byte(len(eeBody) >> 8), byte(len(eeBody))}, eeBody...)
+	plaintext = append(plaintext, echRecordTypeHandshake, 0, 0) // content type and padding
+	aead, iv, err := echServerHandshakeTrafficKeys(
+		sha256.New, tls.TLS_AES_128_GCM_SHA256, sharedSecret, append(append([]byte{}, outer...), serverHello...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte{echRecordTypeApplicationData, 3, 3}
+	header = echAppendUint16(header, uint16(len(plaintext)+aead.Overhead()))
+	flight := []byte{echRecordTypeHandshake, 3, 3}
+	flight = echAppendUint16(flight, uint16(len(serverHello)))
+	flight = append(flight, serverHello...)
+	flight = append(flight, 20, 3, 3, 0, 1, 1) // ChangeCipherSpec
+	flight = append(flight, header...)
+	return append(flight, aead.Seal(nil, iv, plaintext, header)...)
+}
+
+func Test_echServerFlightOutcome(t *testing.T) {
+	echConfig, _ := echTestKeyPair(t)
+	inner := echTestInnerClientHello()
+	outer, privateKey, err := echNewClientHelloOuter(rand.Reader, inner, echConfig, echConfig.CipherSuites[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := bytes.Repeat([]byte{0x42}, echRandomLength)
+	retryConfigs := echGenConfigList(echConfig.Raw)
+
+	t.Run("when the server accepts ECH", func(t *testing.T) {
+		random := append(random[:24:24], make([]byte, echAcceptConfirmationLength)...)
+		flight := echTestServerFlight(t, outer, random)
+		serverHello, _ := echParseServerFlight(flight)
+		copy(random[24:], echTestAcceptConfirmation(sha256.New, inner.marshal(), serverHello))
+		flight = echTestServerFlight(t, outer, random)
+		status, retry := echServerFlightOutcome(inner.marshal(), outer, privateKey, flight)
+		if status != ECHStatusAccepted || retry != nil {
+			t.Fatal("unexpected outcome", status, retry)
+		}
+	})
+
+	t.Run("when the server rejects ECH", func(t *testing.T) {
+		flight := echTestServerFlight(t, outer, random, echExtension{id: 16, data: []byte{0, 3, 2, 'h', '2'}},
+			echExtension{id: ECHExtensionType, data: retryConfigs})
+		status, retry := echServerFlightOutcome(inner.marshal(), outer, privateKey, flight)
+		if status != ECHStatusRejected || !bytes.Equal(retry, retryConfigs) {
+			t.Fatal("unexpected outcome", status, retry)
+		}
+	})
+
+	t.Run("when the server does not acknowledge ECH", func(t *testing.T) {
+		flight := echTestServerFlight(t, outer, random)
+		status, retry := echServerFlightOutcome(inner.marshal(), outer, privateKey, flight)
+		if status != ECHStatusStripped || retry != nil {
+			t.Fatal("unexpected outcome", status, retry)
+		}
+	})
+
+	t.Run("when the server negotiates TLS 1.2", func(t *testing.T) {
+		flight := echTestServerFlight(t, outer, random)
+		// replace supported_versions with an unknown extension so the version is TLS 1.2
+		flight = bytes.Replace(flight, []byte{0, echExtensionSupportedVersions, 0, 2, 3, 4}, []byte{0xff, 0, 0, 2, 3, 4}, 1)
+		status, _ := echServerFlightOutcome(inner.marshal(), outer, privateKey, flight)
+		if status != ECHStatusStripped {
+			t.Fatal("unexpected status", status)
+		}
+	})
+
+	t.Run("when we cannot tell the outcome", func(t *testing.T) {
+		valid := echTestServerFlight(t, outer, random)
+		hrr := echTestServerFlight(t, outer, []byte(echHelloRetryRequestRandom))
+		otherKey := bytes.Repeat([]byte{0x01}, curve25519.ScalarSize)
+		serverHelloRecordLength := echRecordHeaderLength + (int(valid[3])<<8 | int(valid[4]))
+		inputs := map[string][]byte{
+			"without any data":             nil,
+			"with a truncated ServerHello": valid[:serverHelloRecordLength-1],
+			"with a HelloRetryRequest":     hrr,
+			"without an encrypted record":  valid[:serverHelloRecordLength+6],
+		}
+		for name, flight := range inputs {
+			t.Run(name, func(t *testing.T) {
+				status, _ := echServerFlightOutcome(inner.marshal(), outer, privateKey, flight)
+				if status != ECHStatusOffered {
+					t.Fatal("unexpected status", status)
+				}
+			})
+		}
+		t.Run("with the wrong key", func(t *testing.T) {
+			status, _ := echServerFlightOutcome(inner.marshal(), outer, otherKey, valid)
+			if status != ECHStatusOffered {
+				t.Fatal("unexpected status", status)
+			}
+		})
+	})
+}
+
+func Test_echHelloConn(t *testing.T) {
+	t.Run("we do not send a second ClientHello", func(t *testing.T) {
+		var written []byte
+		conn := &echHelloConn{
+			Conn: &mocks.Conn{
+				MockWrite: func(b []byte) (int, error) {
+					written = append(written, b...)
+					return len(b), nil
+				},
+			},
+			inner: []byte{echHandshakeTypeClientHello},
+		}
+		ccs := []byte{20, 3, 3, 0, 1, 1}
+		count, err := conn.Write(append(append([]byte{}, ccs...), 22, 3, 3, 0, 1, echHandshakeTypeClientHello))
+		if !errors.Is(err, ErrECHHelloRetryRequest) || count != 0 {
+			t.Fatal("unexpected result", count, err)
+		}
+		if _, err := conn.Write(ccs); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(written, ccs) {
+			t.Fatal("unexpected written bytes")
+		}
+	})
+
+	t.Run("with an invalid first record", func(t *testing.T) {
+		conn := &echHelloConn{Conn: &mocks.Conn{}}
+		count, err := conn.Write([]byte{23, 3, 3, 0, 0})
+		if !errors.Is(err, errECHInvalidClientHello) || count != 0 {
+			t.Fatal("unexpected result", count, err)
+		}
+	})
+}
+
+func TestECHStatusFromError(t *testing.T) {
+	inputs := map[string]struct {
+		err    error
+		status string
+		retry  []byte
+	}{
+		"with nil": {nil, ECHStatusAccepted, nil},
+		"with a wrapped ECHError": {&ErrWrapper{WrappedErr: &ECHError{
+			Err:          ErrECHRejected,
+			Status:       ECHStatusRejected,
+			RetryConfigs: []byte{1},
+		}}, ECHStatusRejected, []byte{1}},
+		"with another error": {io.EOF, ECHStatusOffered, nil},
+	}
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			status, retry := ECHStatusFromError(input.err)
+			if status != input.status || !bytes.Equal(retry, input.retry) {
+				t.Fatal("unexpected result", status, retry)
+			}
+		})
+	}
+}
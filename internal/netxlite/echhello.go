@@ -0,0 +1,694 @@
+package netxlite
+
+//
+// ECH ClientHelloOuter construction and outcome detection
+//
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/bassosimone/oonidsl/internal/runtimex"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// TLS code points used when constructing the ClientHelloOuter and
+// when parsing the beginning of the server flight.
+const (
+	echRecordTypeHandshake        = 22
+	echRecordTypeApplicationData  = 23
+	echHandshakeTypeClientHello   = 1
+	echHandshakeTypeServerHello   = 2
+	echHandshakeTypeEncryptedExts = 8
+	echExtensionServerName        = 0
+	echExtensionPreSharedKey      = 41
+	echExtensionEarlyData         = 42
+	echExtensionSupportedVersions = 43
+	echExtensionKeyShare          = 51
+	echGroupX25519                = 29
+	echClientHelloTypeOuter       = 0
+	echClientHelloTypeInner       = 1
+	echRecordHeaderLength         = 5
+	echHandshakeHeaderLength      = 4
+	echRandomLength               = 32
+	echAcceptConfirmationLength   = 8
+	echAcceptConfirmationOffset   = echHandshakeHeaderLength + 2 + echRandomLength - 8
+	echTLSNonceLength             = 12
+	echMaxServerBytes             = 1 << 16
+	echHelloRetryRequestRandom    = "\xcf\x21\xad\x74\xe5\x9a\x61\x11\xbe\x1d\x8c\x02\x1e\x65\xb8\x91" +
+		"\xc2\xa2\x11\x16\x7a\xbb\x8c\x5e\x07\x9e\x09\xe2\xc8\xa8\x33\x9c"
+)
+
+// errECHInvalidClientHello indicates that we could not parse the ClientHello
+// generated by utls, which should not happen unless there's a bug.
+var errECHInvalidClientHello = errors.New("ech: invalid ClientHello")
+
+// echExtension is a TLS extension.
+type echExtension struct {
+	id   uint16
+	data []byte
+}
+
+// echClientHello is a parsed ClientHello message body.
+type echClientHello struct {
+	version            uint16
+	random             []byte
+	sessionID          []byte
+	cipherSuites       []byte
+	compressionMethods []byte
+	extensions         []echExtension
+}
+
+// echParseClientHello parses a ClientHello message including its header.
+func echParseClientHello(msg []byte) (*echClientHello, error) {
+	reader := &echReader{msg}
+	if kind, good := reader.readUint8(); !good || kind != echHandshakeTypeClientHello {
+		return nil, errECHInvalidClientHello
+	}
+	length, good := reader.read(3)
+	if !good || int(length[0])<<16|int(length[1])<<8|int(length[2]) != len(reader.data) {
+		return nil, errECHInvalidClientHello
+	}
+	ch := &echClientHello{}
+	if ch.version, good = reader.readUint16(); !good {
+		return nil, errECHInvalidClientHello
+	}
+	if ch.random, good = reader.read(echRandomLength); !good {
+		return nil, errECHInvalidClientHello
+	}
+	sessionID, good := reader.readVector8()
+	if !good {
+		return nil, errECHInvalidClientHello
+	}
+	ch.sessionID = sessionID.data
+	cipherSuites, good := reader.readVector16()
+	if !good {
+		return nil, errECHInvalidClientHello
+	}
+	ch.cipherSuites = cipherSuites.data
+	compressionMethods, good := reader.readVector8()
+	if !good {
+		return nil, errECHInvalidClientHello
+	}
+	ch.compressionMethods = compressionMethods.data
+	extensions, good := reader.readVector16()
+	if !good || !reader.empty() {
+		return nil, errECHInvalidClientHello
+	}
+	for !extensions.empty() {
+		id, good := extensions.readUint16()
+		if !good {
+			return nil, errECHInvalidClientHello
+		}
+		data, good := extensions.readVector16()
+		if !good {
+			return nil, errECHInvalidClientHello
+		}
+		ch.extensions = append(ch.extensions, echExtension{id: id, data: data.data})
+	}
+	return ch, nil
+}
+
+// marshalBody serializes the ClientHello body, i.e., without the message header.
+func (ch *echClientHello) marshalBody() []byte {
+	out := echAppendUint16(nil, ch.version)
+	out = append(out, ch.random...)
+	out = append(out, uint8(len(ch.sessionID)))
+	out = append(out, ch.sessionID...)
+	out = echAppendUint16(out, uint16(len(ch.cipherSuites)))
+	out = append(out, ch.cipherSuites...)
+	out = append(out, uint8(len(ch.compressionMethods)))
+	out = append(out, ch.compressionMethods...)
+	var extensions []byte
+	for _, ext := range ch.extensions {
+		extensions = echAppendUint16(extensions, ext.id)
+		extensions = echAppendUint16(extensions, uint16(len(ext.data)))
+		extensions = append(extensions, ext.data...)
+	}
+	out = echAppendUint16(out, uint16(len(extensions)))
+	return append(out, extensions...)
+}
+
+// marshal serializes the whole ClientHello message.
+func (ch *echClientHello) marshal() []byte {
+	body := ch.marshalBody()
+	out := []byte{echHandshakeTypeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(out, body...)
+}
+
+// extension returns the extension with the given ID or nil.
+func (ch *echClientHello) extension(id uint16) *echExtension {
+	for idx := range ch.extensions {
+		if ch.extensions[idx].id == id {
+			return &ch.extensions[idx]
+		}
+	}
+	return nil
+}
+
+// echNewOuterExtension serializes an outer encrypted_client_hello extension.
+func echNewOuterExtension(config *ECHConfig, suite ECHCipherSuite, enc, payload []byte) []byte {
+	data := []byte{echClientHelloTypeOuter}
+	data = echAppendUint16(data, suite.KDFID)
+	data = echAppendUint16(data, suite.AEADID)
+	data = append(data, config.ConfigID)
+	data = echAppendUint16(data, uint16(len(enc)))
+	data = append(data, enc...)
+	data = echAppendUint16(data, uint16(len(payload)))
+	return append(data, payload...)
+}
+
+// echNewServerNameExtension serializes a server_name extension.
+func echNewServerNameExtension(serverName string) []byte {
+	data := echAppendUint16(nil, uint16(3+len(serverName)))
+	data = append(data, 0) // host_name
+	data = echAppendUint16(data, uint16(len(serverName)))
+	return append(data, serverName...)
+}
+
+// echNewKeyShareExtension rewrites the key_share extension of the inner ClientHello
+// such that it only contains the given X25519 public key and the GREASE entries.
+func echNewKeyShareExtension(data, publicKey []byte) ([]byte, error) {
+	reader := &echReader{data}
+	shares, good := reader.readVector16()
+	if !good || !reader.empty() {
+		return nil, errECHInvalidClientHello
+	}
+	var out []byte
+	x25519 := func() {
+		out = echAppendUint16(out, echGroupX25519)
+		out = echAppendUint16(out, uint16(len(publicKey)))
+		out = append(out, publicKey...)
+		publicKey = nil
+	}
+	for !shares.empty() {
+		group, good := shares.readUint16()
+		if !good {
+			return nil, errECHInvalidClientHello
+		}
+		share, good := shares.readVector16()
+		if !good {
+			return nil, errECHInvalidClientHello
+		}
+		switch {
+		case group == echGroupX25519 && publicKey != nil:
+			x25519()
+		case echIsGREASE(group):
+			out = echAppendUint16(out, group)
+			out = echAppendUint16(out, uint16(len(share.data)))
+			out = append(out, share.data...)
+		}
+	}
+	if publicKey != nil {
+		x25519()
+	}
+	return append(echAppendUint16(nil, uint16(len(out))), out...), nil
+}
+
+// echIsGREASE returns whether v is a GREASE value (see RFC 8701).
+func echIsGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// echEncodeClientHelloInner returns the EncodedClientHelloInner corresponding to
+// the given inner ClientHello, padded as recommended by draft-ietf-tls-esni.
+func echEncodeClientHelloInner(inner *echClientHello, config *ECHConfig) []byte {
+	encoded := *inner
+	encoded.sessionID = nil // the server copies it from the outer ClientHello
+	out := encoded.marshalBody()
+	var padding int
+	if sni := inner.extension(echExtensionServerName); sni != nil {
+		// The extension contains the list length, the name type and the name length.
+		if nameLength := len(sni.data) - 5; int(config.MaximumNameLength) > nameLength {
+			padding = int(config.MaximumNameLength) - nameLength
+		}
+	} else {
+		padding = int(config.MaximumNameLength) + 9
+	}
+	padding += 31 - ((len(out) + padding - 1) % 32)
+	return append(out, make([]byte, padding)...)
+}
+
+// echNewClientHelloOuter creates the outer ClientHello containing the encrypted inner
+// ClientHello, using the config's public name as the SNI and a fresh X25519 key
+// share, whose private key we return to decrypt the server flight if the server
+// rejects ECH. The other fields and extensions are copied from the inner ClientHello.
+func echNewClientHelloOuter(reader io.Reader, inner *echClientHello,
+	config *ECHConfig, suite ECHCipherSuite) ([]byte, []byte, error) {
+	outer := &echClientHello{
+		version:            inner.version,
+		random:             make([]byte, echRandomLength),
+		sessionID:          inner.sessionID,
+		cipherSuites:       inner.cipherSuites,
+		compressionMethods: inner.compressionMethods,
+	}
+	if _, err := io.ReadFull(reader, outer.random); err != nil {
+		return nil, nil, err
+	}
+	privateKey := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(reader, privateKey); err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := append([]byte("tls ech\x00"), config.Raw...)
+	enc, hpkeCtx, err := hpkeSetupBaseSender(reader, config.PublicKey, suite, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	encodedInner := echEncodeClientHelloInner(inner, config)
+	payload := make([]byte, len(encodedInner)+hpkeCtx.aead.Overhead())
+	echIndex := -1
+	for _, ext := range inner.extensions {
+		switch ext.id {
+		case echExtensionServerName:
+			ext.data = echNewServerNameExtension(config.PublicName)
+		case echExtensionKeyShare:
+			if ext.data, err = echNewKeyShareExtension(ext.data, publicKey); err != nil {
+				return nil, nil, err
+			}
+		case ECHExtensionType:
+			echIndex = len(outer.extensions)
+			ext.data = echNewOuterExtension(config, suite, enc, payload)
+		case echExtensionPreSharedKey, echExtensionEarlyData:
+			continue // these extensions are bound to the inner ClientHello
+		}
+		outer.extensions = append(outer.extensions, ext)
+	}
+	if echIndex < 0 {
+		return nil, nil, errECHInvalidClientHello
+	}
+	aad := outer.marshalBody() // the payload is all zeros
+	payload = hpkeCtx.seal(aad, encodedInner)
+	outer.extensions[echIndex].data = echNewOuterExtension(config, suite, enc, payload)
+	return outer.marshal(), privateKey, nil
+}
+
+// echHelloConn is the net.Conn used by utls when performing an ECH handshake. It replaces
+// the ClientHello written by utls, which becomes the inner ClientHello, with the outer
+// ClientHello containing the encrypted inner ClientHello. It also saves the beginning of
+// the server flight, which we need to know whether the server accepted ECH.
+type echHelloConn struct {
+	net.Conn
+
+	// config is the ECHConfig to use.
+	config *ECHConfig
+
+	// reader is the source of randomness.
+	reader io.Reader
+
+	// suite is the HPKE cipher suite to use.
+	suite ECHCipherSuite
+
+	// mu provides mutual exclusion for the following fields.
+	mu sync.Mutex
+
+	// done indicates that the handshake is done.
+	done bool
+
+	// inner is the inner ClientHello message.
+	inner []byte
+
+	// outer is the outer ClientHello message.
+	outer []byte
+
+	// privateKey is the private key of the outer X25519 key share.
+	privateKey []byte
+
+	// rbytes contains the beginning of the server flight.
+	rbytes []byte
+}
+
+// Read implements net.Conn.Read.
+func (c *echHelloConn) Read(b []byte) (int, error) {
+	count, err := c.Conn.Read(b)
+	c.mu.Lock()
+	if !c.done && len(c.rbytes) < echMaxServerBytes {
+		c.rbytes = append(c.rbytes, b[:count]...)
+	}
+	c.mu.Unlock()
+	return count, err
+}
+
+// Write implements net.Conn.Write.
+func (c *echHelloConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	sentHello, done := c.inner != nil, c.done
+	c.mu.Unlock()
+	if !sentHello {
+		record, err := c.newOuterRecord(b)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.Conn.Write(record); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if !done && echContainsClientHello(b) {
+		// We do not support sending a second ClientHello, which would
+		// otherwise contain the inner ClientHello in the clear.
+		return 0, ErrECHHelloRetryRequest
+	}
+	return c.Conn.Write(b)
+}
+
+// newOuterRecord parses the record containing the inner ClientHello and
+// returns the record containing the corresponding outer ClientHello.
+func (c *echHelloConn) newOuterRecord(record []byte) ([]byte, error) {
+	if len(record) < echRecordHeaderLength || record[0] != echRecordTypeHandshake ||
+		int(record[3])<<8|int(record[4]) != len(record)-echRecordHeaderLength {
+		return nil, errECHInvalidClientHello
+	}
+	innerMsg := append([]byte{}, record[echRecordHeaderLength:]...)
+	inner, err := echParseClientHello(innerMsg)
+	if err != nil {
+		return nil, err
+	}
+	outerMsg, privateKey, err := echNewClientHelloOuter(c.reader, inner, c.config, c.suite)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.inner, c.outer, c.privateKey = innerMsg, outerMsg, privateKey
+	c.mu.Unlock()
+	out := append([]byte{}, record[:3]...) // record type and legacy version
+	out = echAppendUint16(out, uint16(len(outerMsg)))
+	return append(out, outerMsg...), nil
+}
+
+// echContainsClientHello returns whether the given bytes contain
+// a record containing a ClientHello message.
+func echContainsClientHello(data []byte) bool {
+	for len(data) > echRecordHeaderLength {
+		length := int(data[3])<<8 | int(data[4])
+		if data[0] == echRecordTypeHandshake && length > 0 &&
+			data[echRecordHeaderLength] == echHandshakeTypeClientHello {
+			return true
+		}
+		if len(data) < echRecordHeaderLength+length {
+			break
+		}
+		data = data[echRecordHeaderLength+length:]
+	}
+	return false
+}
+
+// outcome stops saving the server flight and returns the ECH status and the retry
+// configs given the error returned by the handshake. Because the handshake cannot
+// succeed unless the server decrypted the inner ClientHello, a nil error always
+// means that the server accepted ECH.
+func (c *echHelloConn) outcome(err error) (string, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	rbytes := c.rbytes
+	c.rbytes = nil
+	if err == nil {
+		return ECHStatusAccepted, nil
+	}
+	if c.inner == nil {
+		return ECHStatusOffered, nil
+	}
+	return echServerFlightOutcome(c.inner, c.outer, c.privateKey, rbytes)
+}
+
+// echServerFlightOutcome determines the ECH status and the retry configs by inspecting
+// the beginning of the server flight. If the ServerHello contains the ECH acceptance
+// confirmation, the server accepted ECH. Otherwise, we decrypt the EncryptedExtensions
+// using the outer ClientHello key share to check whether there are retry configs.
+func echServerFlightOutcome(inner, outer, privateKey, data []byte) (string, []byte) {
+	serverHello, encrypted := echParseServerFlight(data)
+	if serverHello == nil {
+		return ECHStatusOffered, nil
+	}
+	sh, good := echParseServerHello(serverHello)
+	if !good || string(sh.random) == echHelloRetryRequestRandom {
+		return ECHStatusOffered, nil
+	}
+	if sh.version != tls.VersionTLS13 {
+		return ECHStatusStripped, nil // ECH requires TLS 1.3
+	}
+	h := echCipherSuiteHash(sh.cipherSuite)
+	if h == nil {
+		return ECHStatusOffered, nil
+	}
+	if echAcceptConfirmed(h, inner, serverHello) {
+		return ECHStatusAccepted, nil
+	}
+	if sh.group != echGroupX25519 || encrypted == nil {
+		return ECHStatusOffered, nil
+	}
+	sharedSecret, err := curve25519.X25519(privateKey, sh.keyExchange)
+	if err != nil {
+		return ECHStatusOffered, nil
+	}
+	transcript := append(append([]byte{}, outer...), serverHello...)
+	plaintext, err := echDecryptServerRecord(h, sh.cipherSuite, sharedSecret, transcript, encrypted)
+	if err != nil {
+		return ECHStatusOffered, nil
+	}
+	extensions, good := echParseEncryptedExtensions(plaintext)
+	if !good {
+		return ECHStatusOffered, nil
+	}
+	if retryConfigs := extensions[ECHExtensionType]; retryConfigs != nil {
+		return ECHStatusRejected, retryConfigs
+	}
+	return ECHStatusStripped, nil
+}
+
+// echParseServerFlight returns the ServerHello message and the first encrypted
+// record contained in the beginning of the server flight. Either or both return
+// values are nil if the data does not contain them.
+func echParseServerFlight(data []byte) (serverHello, encrypted []byte) {
+	var handshake []byte
+	for len(data) >= echRecordHeaderLength {
+		length := int(data[3])<<8 | int(data[4])
+		if len(data) < echRecordHeaderLength+length {
+			break
+		}
+		record := data[:echRecordHeaderLength+length]
+		data = data[echRecordHeaderLength+length:]
+		switch record[0] {
+		case echRecordTypeHandshake:
+			handshake = append(handshake, record[echRecordHeaderLength:]...)
+		case echRecordTypeApplicationData:
+			encrypted = record
+		}
+		if encrypted != nil {
+			break
+		}
+	}
+	if len(handshake) < echHandshakeHeaderLength || handshake[0] != echHandshakeTypeServerHello {
+		return nil, nil
+	}
+	length := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+	if len(handshake) < echHandshakeHeaderLength+length {
+		return nil, nil
+	}
+	return handshake[:echHandshakeHeaderLength+length], encrypted
+}
+
+// echServerHello contains the ServerHello fields we need.
+type echServerHello struct {
+	random      []byte
+	cipherSuite uint16
+	version     uint16
+	group       uint16
+	keyExchange []byte
+}
+
+// echParseServerHello parses a ServerHello message including its header.
+func echParseServerHello(msg []byte) (*echServerHello, bool) {
+	reader := &echReader{msg[echHandshakeHeaderLength:]}
+	sh := &echServerHello{}
+	var good bool
+	if sh.version, good = reader.readUint16(); !good {
+		return nil, false
+	}
+	if sh.random, good = reader.read(echRandomLength); !good {
+		return nil, false
+	}
+	if _, good = reader.readVector8(); !good { // session ID
+		return nil, false
+	}
+	if sh.cipherSuite, good = reader.readUint16(); !good {
+		return nil, false
+	}
+	if _, good = reader.readUint8(); !good { // compression method
+		return nil, false
+	}
+	if reader.empty() {
+		return sh, true // no extensions
+	}
+	extensions, good := reader.readVector16()
+	if !good {
+		return nil, false
+	}
+	for !extensions.empty() {
+		id, good := extensions.readUint16()
+		if !good {
+			return nil, false
+		}
+		data, good := extensions.readVector16()
+		if !good {
+			return nil, false
+		}
+		switch id {
+		case echExtensionSupportedVersions:
+			if sh.version, good = data.readUint16(); !good {
+				return nil, false
+			}
+		case echExtensionKeyShare:
+			if sh.group, good = data.readUint16(); !good {
+				return nil, false
+			}
+			keyExchange, good := data.readVector16()
+			if !good {
+				return nil, false
+			}
+			sh.keyExchange = keyExchange.data
+		}
+	}
+	return sh, true
+}
+
+// echCipherSuiteHash returns the hash of the given TLS 1.3 cipher suite or nil.
+func echCipherSuiteHash(suite uint16) func() hash.Hash {
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256, tls.TLS_CHACHA20_POLY1305_SHA256:
+		return sha256.New
+	case tls.TLS_AES_256_GCM_SHA384:
+		return sha512.New384
+	default:
+		return nil
+	}
+}
+
+// echAcceptConfirmed returns whether the ServerHello contains the ECH acceptance
+// confirmation computed using the inner ClientHello transcript.
+func echAcceptConfirmed(h func() hash.Hash, inner, serverHello []byte) bool {
+	confirmation := serverHello[echAcceptConfirmationOffset : echAcceptConfirmationOffset+echAcceptConfirmationLength]
+	zeroed := append([]byte{}, serverHello...)
+	copy(zeroed[echAcceptConfirmationOffset:], make([]byte, echAcceptConfirmationLength))
+	secret := hkdf.Extract(h, inner[echHandshakeHeaderLength+2:echHandshakeHeaderLength+2+echRandomLength], nil)
+	expect := echExpandLabel(h, secret, "ech accept confirmation",
+		echTranscriptHash(h, inner, zeroed), echAcceptConfirmationLength)
+	return bytes.Equal(confirmation, expect)
+}
+
+// echTranscriptHash returns the hash of the given handshake messages.
+func echTranscriptHash(h func() hash.Hash, messages ...[]byte) []byte {
+	hasher := h()
+	for _, msg := range messages {
+		hasher.Write(msg)
+	}
+	return hasher.Sum(nil)
+}
+
+// echExpandLabel implements the HKDF-Expand-Label function of TLS 1.3.
+func echExpandLabel(h func() hash.Hash, secret []byte, label string, context []byte, length int) []byte {
+	info := echAppendUint16(nil, uint16(length))
+	info = append(info, uint8(len("tls13 ")+len(label)))
+	info = append(info, "tls13 "...)
+	info = append(info, label...)
+	info = append(info, uint8(len(context)))
+	info = append(info, context...)
+	out := make([]byte, length)
+	_, err := io.ReadFull(hkdf.Expand(h, secret, info), out)
+	runtimex.PanicOnError(err, "hkdf.Expand failed") // only fails with very large lengths
+	return out
+}
+
+// echServerHandshakeTrafficKeys derives the server handshake traffic key
+// and IV using the TLS 1.3 key schedule without a PSK.
+func echServerHandshakeTrafficKeys(h func() hash.Hash, cipherSuite uint16,
+	sharedSecret, transcript []byte) (cipher.AEAD, []byte, error) {
+	size := h().Size()
+	earlySecret := hkdf.Extract(h, make([]byte, size), nil)
+	derived := echExpandLabel(h, earlySecret, "derived", echTranscriptHash(h), size)
+	handshakeSecret := hkdf.Extract(h, sharedSecret, derived)
+	trafficSecret := echExpandLabel(h, handshakeSecret, "s hs traffic", echTranscriptHash(h, transcript), size)
+	iv := echExpandLabel(h, trafficSecret, "iv", nil, echTLSNonceLength)
+	if cipherSuite == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		aead, err := chacha20poly1305.New(echExpandLabel(h, trafficSecret, "key", nil, chacha20poly1305.KeySize))
+		return aead, iv, err
+	}
+	keyLength := 16
+	if cipherSuite == tls.TLS_AES_256_GCM_SHA384 {
+		keyLength = 32
+	}
+	block, err := aes.NewCipher(echExpandLabel(h, trafficSecret, "key", nil, keyLength))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, iv, err
+}
+
+// errECHInvalidServerRecord indicates that the first encrypted
+// record sent by the server does not contain handshake messages.
+var errECHInvalidServerRecord = errors.New("ech: invalid server record")
+
+// echDecryptServerRecord decrypts the first encrypted record sent by the
+// server, which is the first record protected by the handshake keys.
+func echDecryptServerRecord(h func() hash.Hash, cipherSuite uint16,
+	sharedSecret, transcript, record []byte) ([]byte, error) {
+	aead, iv, err := echServerHandshakeTrafficKeys(h, cipherSuite, sharedSecret, transcript)
+	if err != nil {
+		return nil, err
+	}
+	// Note: the nonce is the IV because the record sequence number is zero.
+	plaintext, err := aead.Open(nil, iv, record[echRecordHeaderLength:], record[:echRecordHeaderLength])
+	if err != nil {
+		return nil, err
+	}
+	plaintext = bytes.TrimRight(plaintext, "\x00")
+	if len(plaintext) <= 0 || plaintext[len(plaintext)-1] != echRecordTypeHandshake {
+		return nil, errECHInvalidServerRecord
+	}
+	return plaintext[:len(plaintext)-1], nil
+}
+
+// echParseEncryptedExtensions parses the EncryptedExtensions message at the
+// beginning of the given handshake messages and returns its extensions.
+func echParseEncryptedExtensions(data []byte) (map[uint16][]byte, bool) {
+	reader := &echReader{data}
+	if kind, good := reader.readUint8(); !good || kind != echHandshakeTypeEncryptedExts {
+		return nil, false
+	}
+	if _, good := reader.read(3); !good { // length
+		return nil, false
+	}
+	extensions, good := reader.readVector16()
+	if !good {
+		return nil, false
+	}
+	out := map[uint16][]byte{}
+	for !extensions.empty() {
+		id, good := extensions.readUint16()
+		if !good {
+			return nil, false
+		}
+		data, good := extensions.readVector16()
+		if !good {
+			return nil, false
+		}
+		out[id] = data.data
+	}
+	return out, true
+}
@@ -1,5 +1,5 @@
 // Code generated by go generate; DO NOT EDIT.
-// Generated: 2022-09-04 17:20:35.875185 +0200 CEST m=+0.342616543
+// Generated: 2026-10-19 13:41:58.747635117 +0000 UTC m=+0.167987140
 
 package netxlite
 
@@ -33,6 +33,10 @@ const (
 	FailureDestinationAddressRequired  = "destination_address_required"
 	FailureEOFError                    = "eof_error"
 	FailureGenericTimeoutError         = "generic_timeout_error"
+	FailureHTTP2ConnectionError        = "http2_connection_error"
+	FailureHTTP2Goaway                 = "http2_goaway"
+	FailureHTTP2StreamReset            = "http2_stream_reset"
+	FailureHTTP3StreamReset            = "http3_stream_reset"
 	FailureHostUnreachable             = "host_unreachable"
 	FailureInterrupted                 = "interrupted"
 	FailureInvalidArgument             = "invalid_argument"
@@ -48,12 +52,17 @@ const (
 	FailureOperationWouldBlock         = "operation_would_block"
 	FailurePermissionDenied            = "permission_denied"
 	FailureProtocolNotSupported        = "protocol_not_supported"
+	FailureQUICApplicationError        = "quic_application_error"
 	FailureQUICIncompatibleVersion     = "quic_incompatible_version"
+	FailureQUICStatelessReset          = "quic_stateless_reset"
+	FailureQUICTransportError          = "quic_transport_error"
 	FailureSSLFailedHandshake          = "ssl_failed_handshake"
 	FailureSSLInvalidCertificate       = "ssl_invalid_certificate"
 	FailureSSLInvalidHostname          = "ssl_invalid_hostname"
 	FailureSSLUnknownAuthority         = "ssl_unknown_authority"
 	FailureTimedOut                    = "timed_out"
+	FailureWebSocketBadHandshake       = "websocket_bad_handshake"
+	FailureWebSocketClosed             = "websocket_closed"
 	FailureWrongProtocolType           = "wrong_protocol_type"
 )
 
@@ -85,6 +94,10 @@ var failuresMap = map[string]string{
 	"eof_error":                      "eof_error",
 	"generic_timeout_error":          "generic_timeout_error",
 	"host_unreachable":               "host_unreachable",
+	"http2_connection_error":         "http2_connection_error",
+	"http2_goaway":                   "http2_goaway",
+	"http2_stream_reset":             "http2_stream_reset",
+	"http3_stream_reset":             "http3_stream_reset",
 	"interrupted":                    "interrupted",
 	"invalid_argument":               "invalid_argument",
 	"json_parse_error":               "json_parse_error",
@@ -99,11 +112,16 @@ var failuresMap = map[string]string{
 	"operation_would_block":          "operation_would_block",
 	"permission_denied":              "permission_denied",
 	"protocol_not_supported":         "protocol_not_supported",
+	"quic_application_error":         "quic_application_error",
 	"quic_incompatible_version":      "quic_incompatible_version",
+	"quic_stateless_reset":           "quic_stateless_reset",
+	"quic_transport_error":           "quic_transport_error",
 	"ssl_failed_handshake":           "ssl_failed_handshake",
 	"ssl_invalid_certificate":        "ssl_invalid_certificate",
 	"ssl_invalid_hostname":           "ssl_invalid_hostname",
 	"ssl_unknown_authority":          "ssl_unknown_authority",
 	"timed_out":                      "timed_out",
+	"websocket_bad_handshake":        "websocket_bad_handshake",
+	"websocket_closed":               "websocket_closed",
 	"wrong_protocol_type":            "wrong_protocol_type",
 }
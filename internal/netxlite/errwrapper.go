@@ -3,6 +3,9 @@ package netxlite
 import (
 	"encoding/json"
 	"errors"
+	"net"
+	"syscall"
+	"time"
 )
 
 // ErrWrapper is our error wrapper for Go errors. The key objective of
@@ -49,6 +52,27 @@ type ErrWrapper struct {
 
 	// WrappedErr is the error that we're wrapping.
 	WrappedErr error
+
+	// Elapsed is the OPTIONAL time elapsed until the failure. For connect,
+	// TLS handshake, and QUIC handshake failures this is the time elapsed
+	// since the beginning of the operation. For I/O failures this is the
+	// time elapsed since we established the connection.
+	Elapsed time.Duration
+
+	// Errno is the OPTIONAL value of the underlying syscall.Errno,
+	// if any. We automatically set this field when wrapping.
+	Errno uint64
+
+	// LocalAddr is the OPTIONAL local address.
+	LocalAddr string
+
+	// RemoteAddr is the OPTIONAL remote address.
+	RemoteAddr string
+
+	// Previous OPTIONALLY contains the failures we discarded when we
+	// reduced several failures to this one (e.g., when we failed to
+	// connect to each of the IP addresses of a domain).
+	Previous []*ErrWrapper
 }
 
 // Error returns the OONI failure string for this error.
@@ -80,7 +104,8 @@ type classifier func(err error) string
 // If the err argument has already been classified, the returned
 // error wrapper will use the same classification string and
 // will determine whether to keep the major operation as documented
-// in the ErrWrapper.Operation documentation.
+// in the ErrWrapper.Operation documentation. It will also inherit
+// the optional fields of the already existing error wrapper.
 func NewErrWrapper(c classifier, op string, err error) *ErrWrapper {
 	var wrapper *ErrWrapper
 	if errors.As(err, &wrapper) {
@@ -88,6 +113,11 @@ func NewErrWrapper(c classifier, op string, err error) *ErrWrapper {
 			Failure:    wrapper.Failure,
 			Operation:  classifyOperation(wrapper, op),
 			WrappedErr: err,
+			Elapsed:    wrapper.Elapsed,
+			Errno:      wrapper.Errno,
+			LocalAddr:  wrapper.LocalAddr,
+			RemoteAddr: wrapper.RemoteAddr,
+			Previous:   wrapper.Previous,
 		}
 	}
 	if c == nil {
@@ -99,11 +129,39 @@ func NewErrWrapper(c classifier, op string, err error) *ErrWrapper {
 	if err == nil {
 		panic("nil err")
 	}
-	return &ErrWrapper{
+	var errno syscall.Errno
+	ew := &ErrWrapper{
 		Failure:    c(err),
 		Operation:  op,
 		WrappedErr: err,
 	}
+	if errors.As(err, &errno) {
+		ew.Errno = uint64(errno)
+	}
+	return ew
+}
+
+// withDetails sets the optional timing and addresses fields of the
+// ErrWrapper and returns the ErrWrapper itself. We do not override a
+// field with an empty value (e.g., an empty address).
+func (e *ErrWrapper) withDetails(elapsed time.Duration, localAddr, remoteAddr string) *ErrWrapper {
+	e.Elapsed = elapsed
+	if localAddr != "" {
+		e.LocalAddr = localAddr
+	}
+	if remoteAddr != "" {
+		e.RemoteAddr = remoteAddr
+	}
+	return e
+}
+
+// errWrapperAddrString returns the string representation of addr or
+// an empty string if addr is nil.
+func errWrapperAddrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
 }
 
 // TODO(https://github.com/ooni/probe/issues/2163): we can really
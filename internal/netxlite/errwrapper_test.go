@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/bassosimone/oonidsl/internal/atomicx"
 )
@@ -122,6 +123,26 @@ func TestNewErrWrapper(t *testing.T) {
 			t.Fatal("we cannot use errors.Is to retrieve the real syscall error")
 		}
 	})
+
+	t.Run("we set Errno for syscall errors", func(t *testing.T) {
+		ew := NewErrWrapper(ClassifyGenericError, ReadOperation, fmt.Errorf("read: %w", ECONNRESET))
+		if ew.Errno != uint64(ECONNRESET) {
+			t.Fatal("unexpected errno", ew.Errno)
+		}
+	})
+
+	t.Run("we inherit the optional fields of an already wrapped error", func(t *testing.T) {
+		ew := NewErrWrapper(ClassifyGenericError, ConnectOperation, ECONNREFUSED).withDetails(
+			time.Second, "", "8.8.8.8:443")
+		ew.Previous = []*ErrWrapper{NewTopLevelGenericErrWrapper(io.EOF)}
+		ew2 := NewTopLevelGenericErrWrapper(ew)
+		if ew2.Elapsed != time.Second || ew2.RemoteAddr != "8.8.8.8:443" || ew2.LocalAddr != "" {
+			t.Fatal("did not inherit timing and addresses")
+		}
+		if ew2.Errno != uint64(ECONNREFUSED) || len(ew2.Previous) != 1 {
+			t.Fatal("did not inherit errno and previous errors")
+		}
+	})
 }
 
 func TestMaybeNewErrWrapper(t *testing.T) {
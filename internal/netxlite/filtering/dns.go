@@ -1,13 +1,20 @@
 package filtering
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"io"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/miekg/dns"
 	"github.com/bassosimone/oonidsl/internal/runtimex"
+	"github.com/google/martian/v3/mitm"
+	"github.com/miekg/dns"
 )
 
 // DNSAction is a DNS filtering action that a DNSServer should take.
@@ -20,6 +27,9 @@ const (
 	// DNSActionRefused replies with Refused.
 	DNSActionRefused = DNSAction("refused")
 
+	// DNSActionServFail replies with SERVFAIL.
+	DNSActionServFail = DNSAction("servfail")
+
 	// DNSActionLocalHost replies with `127.0.0.1` and `::1`.
 	DNSActionLocalHost = DNSAction("localhost")
 
@@ -37,17 +47,65 @@ const (
 	// Cache actions returning first a localhost response followed
 	// by a subsequent response obtained using the cache.
 	DNSActionLocalHostPlusCache = DNSAction("localhost+cache")
+
+	// DNSActionInjectThenAnswer is like DNSActionLocalHostPlusCache
+	// but the first response contains bogon addresses, like the ones
+	// injected by some censors (e.g., `10.10.34.34`).
+	DNSActionInjectThenAnswer = DNSAction("inject-then-answer")
+
+	// DNSActionWrongQueryID replies using the cache with a
+	// response whose ID does not match the query ID.
+	DNSActionWrongQueryID = DNSAction("wrong-query-id")
+
+	// DNSActionTruncated returns an empty reply with the TC bit set.
+	DNSActionTruncated = DNSAction("truncated")
+
+	// DNSActionBogonCNAME replies with a CNAME chain whose last
+	// name resolves to bogon addresses.
+	DNSActionBogonCNAME = DNSAction("bogon-cname")
 )
 
-// DNSServer is a DNS server implementing filtering policies.
+// DNSQuery is a query received by a DNSServer.
+type DNSQuery struct {
+	// ClientAddr is the client endpoint (e.g., `127.0.0.1:54321`).
+	ClientAddr string
+
+	// Domain is the queried FQDN (e.g., `dns.google.`).
+	Domain string
+
+	// Network is the network where we received the query. It is
+	// one of "udp", "tcp", "dot", and "doh".
+	Network string
+
+	// QueryType is the query type (e.g., dns.TypeA).
+	QueryType uint16
+}
+
+// DNSServer is a DNS server implementing filtering policies. All the
+// listeners started using the same DNSServer share the same policy.
 type DNSServer struct {
 	// Cache is the OPTIONAL DNS cache. Note that the keys of the map
 	// must be FQDNs (i.e., including the final `.`).
+	//
+	// The cache is keyed on names only: we answer A queries using the IPv4
+	// addresses and AAAA queries using the IPv6 addresses, such that a name
+	// with only IPv4 addresses gets an empty AAAA answer. Any other policy
+	// depending on the query type (e.g., NODATA for HTTPS) must go through
+	// OnQuery, which receives the query type along with the name.
 	Cache map[string][]string
 
 	// OnQuery is the MANDATORY hook called whenever we
-	// receive a query for the given domain.
-	OnQuery func(domain string) DNSAction
+	// receive a query, which decides the action to take.
+	OnQuery func(query *DNSQuery) DNSAction
+
+	// cert is the fake CA certificate used by DoT and DoH.
+	cert *x509.Certificate
+
+	// config is the config to generate certificates on the fly.
+	config *mitm.Config
+
+	// once allows to lazily initialize cert and config.
+	once sync.Once
 
 	// onTimeout is the OPTIONAL channel where we emit a true
 	// value each time there's a timeout. If you set this value
@@ -63,7 +121,7 @@ type DNSListener interface {
 	LocalAddr() net.Addr
 }
 
-// Start starts this server.
+// Start starts this server listening on UDP.
 func (p *DNSServer) Start(address string) (DNSListener, error) {
 	pconn, _, err := p.start(address)
 	return pconn, err
@@ -110,33 +168,64 @@ func (p *DNSServer) emit(pconn net.PacketConn, addr net.Addr, reply ...*dns.Msg)
 }
 
 func (p *DNSServer) serveAsync(pconn net.PacketConn, addr net.Addr, buffer []byte) {
+	replies, _ := p.answer("udp", addr.String(), buffer)
+	for idx, reply := range replies {
+		if idx > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		p.emit(pconn, addr, reply)
+	}
+}
+
+// answer returns the replies to the given raw query. It returns false
+// if the query is invalid and an empty list if we should not reply.
+func (p *DNSServer) answer(network, clientAddr string, rawQuery []byte) ([]*dns.Msg, bool) {
 	query := &dns.Msg{}
-	if err := query.Unpack(buffer); err != nil {
-		return
+	if err := query.Unpack(rawQuery); err != nil {
+		return nil, false
 	}
 	if len(query.Question) < 1 {
-		return // just discard the query
+		return nil, false // just discard the query
 	}
 	name := query.Question[0].Name
-	switch p.OnQuery(name) {
+	action := p.OnQuery(&DNSQuery{
+		ClientAddr: clientAddr,
+		Domain:     name,
+		Network:    network,
+		QueryType:  query.Question[0].Qtype,
+	})
+	switch action {
 	case DNSActionNXDOMAIN:
-		p.emit(pconn, addr, p.nxdomain(query))
+		return []*dns.Msg{p.nxdomain(query)}, true
+	case DNSActionServFail:
+		return []*dns.Msg{p.servfail(query)}, true
 	case DNSActionLocalHost:
-		p.emit(pconn, addr, p.localHost(query))
+		return []*dns.Msg{p.localHost(query)}, true
 	case DNSActionNoAnswer:
-		p.emit(pconn, addr, p.empty(query))
+		return []*dns.Msg{p.empty(query)}, true
 	case DNSActionTimeout:
 		if p.onTimeout != nil {
 			p.onTimeout <- true
 		}
+		return nil, true
 	case DNSActionCache:
-		p.emit(pconn, addr, p.cache(name, query))
+		return []*dns.Msg{p.cache(name, query)}, true
 	case DNSActionLocalHostPlusCache:
-		p.emit(pconn, addr, p.localHost(query))
-		time.Sleep(10 * time.Millisecond)
-		p.emit(pconn, addr, p.cache(name, query))
+		return []*dns.Msg{p.localHost(query), p.cache(name, query)}, true
+	case DNSActionInjectThenAnswer:
+		return []*dns.Msg{p.bogon(query), p.cache(name, query)}, true
+	case DNSActionWrongQueryID:
+		reply := p.cache(name, query)
+		reply.Id = query.Id + 1
+		return []*dns.Msg{reply}, true
+	case DNSActionTruncated:
+		reply := p.empty(query)
+		reply.Truncated = true
+		return []*dns.Msg{reply}, true
+	case DNSActionBogonCNAME:
+		return []*dns.Msg{p.bogonCNAME(query)}, true
 	default:
-		p.emit(pconn, addr, p.refused(query))
+		return []*dns.Msg{p.refused(query)}, true
 	}
 }
 
@@ -152,6 +241,28 @@ func (p *DNSServer) nxdomain(query *dns.Msg) *dns.Msg {
 	return m
 }
 
+func (p *DNSServer) servfail(query *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(query, dns.RcodeServerFailure)
+	return m
+}
+
+// dnsBogonIPv4 and dnsBogonIPv6 are the bogon addresses we inject.
+var (
+	dnsBogonIPv4 = net.IPv4(10, 10, 34, 34)
+	dnsBogonIPv6 = net.ParseIP("fd00::10:10:34:34")
+)
+
+func (p *DNSServer) bogon(query *dns.Msg) *dns.Msg {
+	return dnsComposeResponse(query, dnsBogonIPv6, dnsBogonIPv4)
+}
+
+func (p *DNSServer) bogonCNAME(query *dns.Msg) *dns.Msg {
+	name := query.Question[0].Name
+	cnames := []string{"bogon-1." + name, "bogon-2." + name}
+	return dnsComposeResponseWithCNAMEs(query, cnames, dnsBogonIPv6, dnsBogonIPv4)
+}
+
 func (p *DNSServer) localHost(query *dns.Msg) *dns.Msg {
 	return dnsComposeResponse(query, net.IPv6loopback, net.IPv4(127, 0, 0, 1))
 }
@@ -175,12 +286,31 @@ func dnsComposeQuery(domain string, qtype uint16) *dns.Msg {
 }
 
 func dnsComposeResponse(query *dns.Msg, ips ...net.IP) *dns.Msg {
+	return dnsComposeResponseWithCNAMEs(query, nil, ips...)
+}
+
+// dnsComposeResponseWithCNAMEs composes a response where the queried name
+// is an alias for the first entry in cnames, which is an alias for the second
+// one, and so on. The addresses belong to the last name in the chain.
+func dnsComposeResponseWithCNAMEs(query *dns.Msg, cnames []string, ips ...net.IP) *dns.Msg {
 	runtimex.PanicIfTrue(len(query.Question) != 1, "expecting a single question")
 	question := query.Question[0]
 	reply := new(dns.Msg)
 	reply.Compress = true
 	reply.MsgHdr.RecursionAvailable = true
 	reply.SetReply(query)
+	for _, cname := range cnames {
+		reply.Answer = append(reply.Answer, &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    0,
+			},
+			Target: cname,
+		})
+		question.Name = cname
+	}
 	for _, ip := range ips {
 		isIPv6 := strings.Contains(ip.String(), ":")
 		if !isIPv6 && question.Qtype == dns.TypeA {
@@ -221,3 +351,243 @@ func (p *DNSServer) cache(name string, query *dns.Msg) *dns.Msg {
 	}
 	return dnsComposeResponse(query, ipAddrs...)
 }
+
+// StartTCP starts this server listening on TCP.
+func (p *DNSServer) StartTCP(address string) (DNSListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return p.startStream("tcp", listener), nil
+}
+
+// StartDoT starts this server listening for DNS-over-TLS. Use
+// CertPool to obtain the CA that signs the server certificates.
+func (p *DNSServer) StartDoT(address string) (DNSListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return p.startStream("dot", tls.NewListener(listener, p.tlsConfig())), nil
+}
+
+func (p *DNSServer) startStream(network string, listener net.Listener) *dnsStreamListener {
+	sl := &dnsStreamListener{
+		Listener: listener,
+		conns:    map[net.Conn]bool{},
+		done:     make(chan interface{}),
+		mu:       sync.Mutex{},
+	}
+	go p.streamMainloop(network, sl)
+	return sl
+}
+
+func (p *DNSServer) streamMainloop(network string, sl *dnsStreamListener) {
+	defer close(sl.done)
+	for {
+		conn, err := sl.Accept()
+		if err != nil {
+			if strings.HasSuffix(err.Error(), "use of closed network connection") {
+				return
+			}
+			continue
+		}
+		if !sl.track(conn) {
+			conn.Close()
+			return
+		}
+		go p.serveStream(network, sl, conn)
+	}
+}
+
+func (p *DNSServer) serveStream(network string, sl *dnsStreamListener, conn net.Conn) {
+	defer sl.untrack(conn)
+	for {
+		rawQuery, err := dnsReadStreamMessage(conn)
+		if err != nil {
+			return
+		}
+		replies, good := p.answer(network, conn.RemoteAddr().String(), rawQuery)
+		if !good {
+			return
+		}
+		for _, reply := range replies {
+			rawReply, err := reply.Pack()
+			if err != nil {
+				continue
+			}
+			if err := dnsWriteStreamMessage(conn, rawReply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dnsReadStreamMessage reads a length-prefixed DNS message (RFC 7766).
+func dnsReadStreamMessage(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// dnsWriteStreamMessage writes a length-prefixed DNS message (RFC 7766).
+func dnsWriteStreamMessage(conn net.Conn, message []byte) error {
+	runtimex.PanicIfTrue(len(message) > 0xffff, "message too large")
+	buffer := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(buffer, uint16(len(message)))
+	_, err := conn.Write(append(buffer, message...))
+	return err
+}
+
+// dnsStreamListener is the DNSListener returned by StartTCP and StartDoT.
+type dnsStreamListener struct {
+	net.Listener
+
+	// conns contains the conns we're currently serving.
+	conns map[net.Conn]bool
+
+	// done is closed when the accept loop has terminated.
+	done chan interface{}
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+}
+
+// LocalAddr implements DNSListener.LocalAddr.
+func (sl *dnsStreamListener) LocalAddr() net.Addr {
+	return sl.Addr()
+}
+
+// Close implements DNSListener.Close. It also closes the conns we're serving.
+func (sl *dnsStreamListener) Close() error {
+	err := sl.Listener.Close()
+	<-sl.done
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	for conn := range sl.conns {
+		conn.Close()
+	}
+	sl.conns = nil
+	return err
+}
+
+// track returns false if the listener is closed and we should stop serving.
+func (sl *dnsStreamListener) track(conn net.Conn) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.conns == nil {
+		return false
+	}
+	sl.conns[conn] = true
+	return true
+}
+
+func (sl *dnsStreamListener) untrack(conn net.Conn) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	conn.Close()
+	delete(sl.conns, conn) // works with a nil map
+}
+
+// DNSServerDoHPath is the URL path where StartDoH serves DoH queries.
+const DNSServerDoHPath = "/dns-query"
+
+// StartDoH starts this server listening for DNS-over-HTTPS at
+// DNSServerDoHPath. Because the HTTP transport allows for a single
+// response, actions emitting several replies only send the first one.
+// Use CertPool to obtain the CA that signs the server certificates.
+func (p *DNSServer) StartDoH(address string) (DNSListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(DNSServerDoHPath, p.serveDoH)
+	dl := &dnsDoHListener{
+		addr:   listener.Addr(),
+		done:   make(chan interface{}),
+		server: &http.Server{Handler: mux, TLSConfig: p.tlsConfig()},
+	}
+	go func() {
+		defer close(dl.done)
+		dl.server.ServeTLS(listener, "", "") // using TLSConfig
+	}()
+	return dl, nil
+}
+
+func (p *DNSServer) serveDoH(w http.ResponseWriter, r *http.Request) {
+	var (
+		rawQuery []byte
+		err      error
+	)
+	switch r.Method {
+	case "GET": // see RFC 8484 Sec. 4.1
+		rawQuery, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case "POST":
+		rawQuery, err = io.ReadAll(io.LimitReader(r.Body, 1<<17))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	replies, good := p.answer("doh", r.RemoteAddr, rawQuery)
+	if !good {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(replies) <= 0 {
+		<-r.Context().Done() // never reply like we do for the other transports
+		return
+	}
+	rawReply, err := replies[0].Pack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(rawReply)
+}
+
+// dnsDoHListener is the DNSListener returned by StartDoH.
+type dnsDoHListener struct {
+	addr   net.Addr
+	done   chan interface{}
+	server *http.Server
+}
+
+// LocalAddr implements DNSListener.LocalAddr.
+func (dl *dnsDoHListener) LocalAddr() net.Addr {
+	return dl.addr
+}
+
+// Close implements DNSListener.Close.
+func (dl *dnsDoHListener) Close() error {
+	err := dl.server.Close()
+	<-dl.done
+	return err
+}
+
+// tlsConfig returns the TLS config used by DoT and DoH.
+func (p *DNSServer) tlsConfig() *tls.Config {
+	p.once.Do(func() {
+		p.cert, _, p.config = tlsConfigMITM()
+	})
+	return p.config.TLS()
+}
+
+// CertPool returns the CA used by DoT and DoH as a cert pool.
+func (p *DNSServer) CertPool() *x509.CertPool {
+	p.tlsConfig() // lazy initialization
+	o := x509.NewCertPool()
+	o.AddCert(p.cert)
+	return o
+}
@@ -1,10 +1,16 @@
 package filtering
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
+	"io"
 	"net"
+	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/bassosimone/oonidsl/internal/model/mocks"
@@ -16,7 +22,7 @@ func TestDNSServer(t *testing.T) {
 		*DNSServer, DNSListener, <-chan interface{}, error) {
 		p := &DNSServer{
 			Cache: cache,
-			OnQuery: func(domain string) DNSAction {
+			OnQuery: func(query *DNSQuery) DNSAction {
 				return action
 			},
 			onTimeout: make(chan bool),
@@ -248,6 +254,454 @@ func TestDNSServer(t *testing.T) {
 		<-done // wait for background goroutine to exit
 	})
 
+	t.Run("DNSActionServFail", func(t *testing.T) {
+		_, listener, done, err := newServer(DNSActionServFail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := dns.Exchange(newQuery(dns.TypeA), listener.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Rcode != dns.RcodeServerFailure {
+			t.Fatal("unexpected rcode")
+		}
+		listener.Close()
+		<-done // wait for background goroutine to exit
+	})
+
+	t.Run("DNSActionInjectThenAnswer", func(t *testing.T) {
+		cache := map[string][]string{
+			"dns.google.": {"8.8.8.8"},
+		}
+		_, listener, done, err := newServerWithCache(DNSActionInjectThenAnswer, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dns.Dial("udp", listener.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.WriteMsg(newQuery(dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		var addrs []string
+		for len(addrs) < 2 {
+			reply, err := conn.ReadMsg()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ans := range reply.Answer {
+				if v, ok := ans.(*dns.A); ok {
+					addrs = append(addrs, v.A.String())
+				}
+			}
+		}
+		if addrs[0] != "10.10.34.34" || addrs[1] != "8.8.8.8" {
+			t.Fatal("unexpected addrs", addrs)
+		}
+		listener.Close()
+		<-done // wait for background goroutine to exit
+	})
+
+	t.Run("DNSActionWrongQueryID", func(t *testing.T) {
+		cache := map[string][]string{
+			"dns.google.": {"8.8.8.8"},
+		}
+		_, listener, done, err := newServerWithCache(DNSActionWrongQueryID, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dns.Dial("udp", listener.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		query := newQuery(dns.TypeA)
+		if err := conn.WriteMsg(query); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := conn.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Id == query.Id || len(reply.Answer) != 1 {
+			t.Fatal("unexpected reply", reply)
+		}
+		listener.Close()
+		<-done // wait for background goroutine to exit
+	})
+
+	t.Run("DNSActionTruncated", func(t *testing.T) {
+		_, listener, done, err := newServer(DNSActionTruncated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := dns.Exchange(newQuery(dns.TypeA), listener.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reply.Truncated || len(reply.Answer) != 0 {
+			t.Fatal("expected an empty truncated reply")
+		}
+		listener.Close()
+		<-done // wait for background goroutine to exit
+	})
+
+	t.Run("DNSActionBogonCNAME", func(t *testing.T) {
+		_, listener, done, err := newServer(DNSActionBogonCNAME)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := dns.Exchange(newQuery(dns.TypeAAAA), listener.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 3 {
+			t.Fatal("unexpected number of answers", len(reply.Answer))
+		}
+		expectCNAMEs := []string{"bogon-1.dns.google.", "bogon-2.dns.google."}
+		for idx, cname := range expectCNAMEs {
+			v, ok := reply.Answer[idx].(*dns.CNAME)
+			if !ok || v.Target != cname {
+				t.Fatal("unexpected answer", reply.Answer[idx])
+			}
+		}
+		v, ok := reply.Answer[2].(*dns.AAAA)
+		if !ok || v.Hdr.Name != "bogon-2.dns.google." || v.AAAA.String() != "fd00::10:10:34:34" {
+			t.Fatal("unexpected answer", reply.Answer[2])
+		}
+		listener.Close()
+		<-done // wait for background goroutine to exit
+	})
+
+	t.Run("OnQuery receives the whole question", func(t *testing.T) {
+		var got *DNSQuery
+		p := &DNSServer{
+			OnQuery: func(query *DNSQuery) DNSAction {
+				got = query
+				return DNSActionNXDOMAIN
+			},
+		}
+		listener, err := p.StartTCP("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		clnt := &dns.Client{Net: "tcp"}
+		conn, err := clnt.Dial(listener.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, _, err := clnt.ExchangeWithConn(newQuery(dns.TypeAAAA), conn); err != nil {
+			t.Fatal(err)
+		}
+		expect := &DNSQuery{
+			ClientAddr: conn.LocalAddr().String(),
+			Domain:     "dns.google.",
+			Network:    "tcp",
+			QueryType:  dns.TypeAAAA,
+		}
+		if *got != *expect {
+			t.Fatal("unexpected query", got)
+		}
+	})
+
+	t.Run("answers depending on the query type", func(t *testing.T) {
+		p := &DNSServer{
+			Cache: map[string][]string{"dns.google.": {"8.8.8.8", "2001:4860:4860::8888"}},
+			OnQuery: func(query *DNSQuery) DNSAction {
+				if query.QueryType == dns.TypeHTTPS {
+					return DNSActionNoAnswer
+				}
+				return DNSActionCache
+			},
+		}
+		listener, done, err := p.start("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			listener.Close()
+			<-done // wait for background goroutine to exit
+		}()
+		exchange := func(qtype uint16) *dns.Msg {
+			reply, err := dns.Exchange(newQuery(qtype), listener.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Rcode != dns.RcodeSuccess {
+				t.Fatal("unexpected rcode", reply.Rcode)
+			}
+			return reply
+		}
+		if reply := exchange(dns.TypeA); len(reply.Answer) != 1 ||
+			reply.Answer[0].(*dns.A).A.String() != "8.8.8.8" {
+			t.Fatal("unexpected A reply", reply)
+		}
+		if reply := exchange(dns.TypeAAAA); len(reply.Answer) != 1 ||
+			reply.Answer[0].(*dns.AAAA).AAAA.String() != "2001:4860:4860::8888" {
+			t.Fatal("unexpected AAAA reply", reply)
+		}
+		if reply := exchange(dns.TypeHTTPS); len(reply.Answer) != 0 {
+			t.Fatal("unexpected HTTPS reply", reply)
+		}
+	})
+
+	t.Run("StartTCP", func(t *testing.T) {
+		t.Run("with two replies", func(t *testing.T) {
+			p := &DNSServer{
+				Cache: map[string][]string{"dns.google.": {"8.8.8.8"}},
+				OnQuery: func(query *DNSQuery) DNSAction {
+					return DNSActionInjectThenAnswer
+				},
+			}
+			listener, err := p.StartTCP("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			conn, err := dns.Dial("tcp", listener.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			query := newQuery(dns.TypeA)
+			if err := conn.WriteMsg(query); err != nil {
+				t.Fatal(err)
+			}
+			for _, expect := range []string{"10.10.34.34", "8.8.8.8"} {
+				reply, err := conn.ReadMsg()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if reply.Id != query.Id || len(reply.Answer) != 1 {
+					t.Fatal("unexpected reply", reply)
+				}
+				if v, ok := reply.Answer[0].(*dns.A); !ok || v.A.String() != expect {
+					t.Fatal("unexpected answer", reply.Answer[0])
+				}
+			}
+		})
+
+		t.Run("Close closes the conns we're serving", func(t *testing.T) {
+			p := &DNSServer{
+				OnQuery: func(query *DNSQuery) DNSAction {
+					return DNSActionTimeout
+				},
+			}
+			listener, err := p.StartTCP("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dns.Dial("tcp", listener.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := conn.WriteMsg(newQuery(dns.TypeA)); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(100 * time.Millisecond) // give the server time to read the query
+			listener.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err = conn.ReadMsg(); !errors.Is(err, io.EOF) {
+				t.Fatal("unexpected err", err)
+			}
+		})
+
+		t.Run("with invalid address", func(t *testing.T) {
+			p := &DNSServer{}
+			listener, err := p.StartTCP("127.0.0.1")
+			if err == nil || !strings.HasSuffix(err.Error(), "missing port in address") {
+				t.Fatal("unexpected err", err)
+			}
+			if listener != nil {
+				t.Fatal("expected nil listener")
+			}
+		})
+	})
+
+	t.Run("StartDoT", func(t *testing.T) {
+		t.Run("with valid address", func(t *testing.T) {
+			p := &DNSServer{
+				Cache: map[string][]string{"dns.google.": {"8.8.8.8"}},
+				OnQuery: func(query *DNSQuery) DNSAction {
+					if query.Network != "dot" {
+						return DNSActionRefused
+					}
+					return DNSActionCache
+				},
+			}
+			listener, err := p.StartDoT("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			clnt := &dns.Client{
+				Net: "tcp-tls",
+				TLSConfig: &tls.Config{
+					RootCAs:    p.CertPool(),
+					ServerName: "dns.google",
+				},
+			}
+			reply, _, err := clnt.Exchange(newQuery(dns.TypeA), listener.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reply.Answer) != 1 {
+				t.Fatal("unexpected number of answers")
+			}
+			if v, ok := reply.Answer[0].(*dns.A); !ok || v.A.String() != "8.8.8.8" {
+				t.Fatal("unexpected answer", reply.Answer[0])
+			}
+		})
+
+		t.Run("with invalid address", func(t *testing.T) {
+			p := &DNSServer{}
+			listener, err := p.StartDoT("127.0.0.1")
+			if err == nil || !strings.HasSuffix(err.Error(), "missing port in address") {
+				t.Fatal("unexpected err", err)
+			}
+			if listener != nil {
+				t.Fatal("expected nil listener")
+			}
+		})
+	})
+
+	t.Run("StartDoH", func(t *testing.T) {
+		newDoHServer := func(t *testing.T, action DNSAction) (*DNSServer, DNSListener, *http.Client) {
+			p := &DNSServer{
+				Cache: map[string][]string{"dns.google.": {"8.8.8.8"}},
+				OnQuery: func(query *DNSQuery) DNSAction {
+					if query.Network != "doh" {
+						return DNSActionRefused
+					}
+					return action
+				},
+			}
+			listener, err := p.StartDoH("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			clnt := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						RootCAs:    p.CertPool(),
+						ServerName: "dns.google",
+					},
+				},
+			}
+			return p, listener, clnt
+		}
+
+		roundTrip := func(t *testing.T, clnt *http.Client, req *http.Request) *dns.Msg {
+			resp, err := clnt.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				t.Fatal("unexpected status code", resp.StatusCode)
+			}
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply := &dns.Msg{}
+			if err := reply.Unpack(data); err != nil {
+				t.Fatal(err)
+			}
+			return reply
+		}
+
+		t.Run("with POST", func(t *testing.T) {
+			_, listener, clnt := newDoHServer(t, DNSActionInjectThenAnswer)
+			defer listener.Close()
+			query, err := newQuery(dns.TypeA).Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			URL := "https://" + listener.LocalAddr().String() + DNSServerDoHPath
+			req, err := http.NewRequest("POST", URL, bytes.NewReader(query))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply := roundTrip(t, clnt, req)
+			// we can only send the first reply over HTTP
+			if v, ok := reply.Answer[0].(*dns.A); !ok || v.A.String() != "10.10.34.34" {
+				t.Fatal("unexpected answer", reply.Answer[0])
+			}
+		})
+
+		t.Run("with GET", func(t *testing.T) {
+			_, listener, clnt := newDoHServer(t, DNSActionServFail)
+			defer listener.Close()
+			query, err := newQuery(dns.TypeA).Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			URL := "https://" + listener.LocalAddr().String() + DNSServerDoHPath +
+				"?dns=" + base64.RawURLEncoding.EncodeToString(query)
+			req, err := http.NewRequest("GET", URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply := roundTrip(t, clnt, req); reply.Rcode != dns.RcodeServerFailure {
+				t.Fatal("unexpected rcode")
+			}
+		})
+
+		t.Run("with invalid query", func(t *testing.T) {
+			_, listener, clnt := newDoHServer(t, DNSActionNXDOMAIN)
+			defer listener.Close()
+			URL := "https://" + listener.LocalAddr().String() + DNSServerDoHPath
+			req, err := http.NewRequest("POST", URL, strings.NewReader("\x07"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := clnt.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatal("unexpected status code", resp.StatusCode)
+			}
+		})
+
+		t.Run("with timeout", func(t *testing.T) {
+			_, listener, clnt := newDoHServer(t, DNSActionTimeout)
+			defer listener.Close()
+			query, err := newQuery(dns.TypeA).Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			clnt.Timeout = 250 * time.Millisecond
+			URL := "https://" + listener.LocalAddr().String() + DNSServerDoHPath
+			resp, err := clnt.Post(URL, "application/dns-message", bytes.NewReader(query))
+			if err == nil || !strings.HasSuffix(err.Error(), "(Client.Timeout exceeded while awaiting headers)") {
+				t.Fatal("unexpected err", err)
+			}
+			if resp != nil {
+				t.Fatal("expected nil resp")
+			}
+		})
+
+		t.Run("with invalid address", func(t *testing.T) {
+			p := &DNSServer{}
+			listener, err := p.StartDoH("127.0.0.1")
+			if err == nil || !strings.HasSuffix(err.Error(), "missing port in address") {
+				t.Fatal("unexpected err", err)
+			}
+			if listener != nil {
+				t.Fatal("expected nil listener")
+			}
+		})
+	})
+
 	t.Run("Start with invalid address", func(t *testing.T) {
 		p := &DNSServer{}
 		listener, err := p.Start("127.0.0.1")
@@ -1,3 +1,4 @@
 // Package filtering allows to implement self-censorship. We expose proxies
-// implementing filtering policies for DNS, TLS, and HTTP.
+// implementing filtering policies for DNS, TLS, HTTP, and QUIC, as well as a
+// TCP proxy interfering with connections in the path to the origin.
 package filtering
@@ -1,13 +1,16 @@
 package filtering
 
 import (
+	"bytes"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"html/template"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 
 	"github.com/google/martian/v3/mitm"
 	"github.com/miekg/dns"
@@ -33,8 +36,57 @@ const (
 	// HTTPActionDoH causes the proxy to return a sensible reply
 	// with static IP addresses if the request is DoH.
 	HTTPActionDoH = HTTPAction("doh")
+
+	// HTTPAction200 causes the proxy to return a block page along
+	// with the 200 status code, like many censors do.
+	HTTPAction200 = HTTPAction("200")
+
+	// HTTPActionRedirect causes the proxy to return a 302 redirect
+	// to a block portal (see HTTPServerOptionRedirectURL).
+	HTTPActionRedirect = HTTPAction("redirect")
+
+	// HTTPActionInjectHeaders causes the proxy to return a 403 block
+	// page including the headers added by transparent proxies (e.g., the
+	// `Via` and `X-Squid-Error` headers added by Squid).
+	HTTPActionInjectHeaders = HTTPAction("inject-headers")
+
+	// HTTPActionTruncatedBody causes the proxy to send only the first
+	// half of the 200 block page and then to close the connection.
+	HTTPActionTruncatedBody = HTTPAction("truncated-body")
 )
 
+// HTTPDefaultRedirectURL is the default URL used by HTTPActionRedirect.
+const HTTPDefaultRedirectURL = "http://blocked.example.com/"
+
+// HTTPServerOption is an option for NewHTTPServerCleartext and NewHTTPServerTLS.
+type HTTPServerOption func(p *HTTPServer)
+
+// HTTPServerOptionBodyTemplate sets the template for generating the body
+// of block pages. The template receives an HTTPBodyTemplateData instance. By
+// default, we return the content of HTTPBlockpage451.
+func HTTPServerOptionBodyTemplate(tmpl *template.Template) HTTPServerOption {
+	return func(p *HTTPServer) {
+		p.tmpl = tmpl
+	}
+}
+
+// HTTPServerOptionRedirectURL sets the URL used by HTTPActionRedirect. By
+// default, we use HTTPDefaultRedirectURL.
+func HTTPServerOptionRedirectURL(URL string) HTTPServerOption {
+	return func(p *HTTPServer) {
+		p.redirectURL = URL
+	}
+}
+
+// HTTPBodyTemplateData contains the data passed to the body template.
+type HTTPBodyTemplateData struct {
+	// Host is the value of the request's Host header.
+	Host string
+
+	// URL is the request URL (e.g., `/index.html`).
+	URL string
+}
+
 // HTTPServer is a server that implements filtering policies.
 type HTTPServer struct {
 	// action is the action to implement.
@@ -49,21 +101,27 @@ type HTTPServer struct {
 	// privkey is the private key that signed the cert.
 	privkey *rsa.PrivateKey
 
+	// redirectURL is the URL used by HTTPActionRedirect.
+	redirectURL string
+
 	// server is the underlying server.
 	server *http.Server
 
+	// tmpl is the OPTIONAL template for block pages.
+	tmpl *template.Template
+
 	// url contains the server URL
 	url *url.URL
 }
 
 // NewHTTPServerCleartext creates a new HTTPServer using cleartext HTTP.
-func NewHTTPServerCleartext(action HTTPAction) *HTTPServer {
-	return newHTTPOrHTTPSServer(action, false)
+func NewHTTPServerCleartext(action HTTPAction, options ...HTTPServerOption) *HTTPServer {
+	return newHTTPOrHTTPSServer(action, false, options...)
 }
 
 // NewHTTPServerTLS creates a new HTTP server using HTTPS.
-func NewHTTPServerTLS(action HTTPAction) *HTTPServer {
-	return newHTTPOrHTTPSServer(action, true)
+func NewHTTPServerTLS(action HTTPAction, options ...HTTPServerOption) *HTTPServer {
+	return newHTTPOrHTTPSServer(action, true, options...)
 }
 
 // Close closes the server ASAP.
@@ -88,20 +146,25 @@ func (p *HTTPServer) TLSConfig() *tls.Config {
 }
 
 // newHTTPOrHTTPSServer is an internal factory for creating a new instance.
-func newHTTPOrHTTPSServer(action HTTPAction, enableTLS bool) *HTTPServer {
+func newHTTPOrHTTPSServer(action HTTPAction, enableTLS bool, options ...HTTPServerOption) *HTTPServer {
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	runtimex.PanicOnError(err, "net.Listen failed")
 	srv := &HTTPServer{
-		action:  action,
-		cert:    nil,
-		config:  nil,
-		privkey: nil,
-		server:  nil,
+		action:      action,
+		cert:        nil,
+		config:      nil,
+		privkey:     nil,
+		redirectURL: HTTPDefaultRedirectURL,
+		server:      nil,
+		tmpl:        nil,
 		url: &url.URL{
 			Scheme: "",
 			Host:   listener.Addr().String(),
 		},
 	}
+	for _, option := range options {
+		option(srv)
+	}
 	srv.server = &http.Server{Handler: srv}
 	switch enableTLS {
 	case false:
@@ -131,15 +194,50 @@ func (p *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case HTTPActionReset, HTTPActionTimeout, HTTPActionEOF:
 		p.hijack(w, r, p.action)
 	case HTTPAction451:
-		w.WriteHeader(http.StatusUnavailableForLegalReasons)
-		w.Write(HTTPBlockpage451)
+		p.blockpage(w, r, http.StatusUnavailableForLegalReasons)
 	case HTTPActionDoH:
 		httpServeDNSOverHTTPS(w, r)
+	case HTTPAction200:
+		p.blockpage(w, r, http.StatusOK)
+	case HTTPActionRedirect:
+		http.Redirect(w, r, p.redirectURL, http.StatusFound)
+	case HTTPActionInjectHeaders:
+		w.Header().Set("Via", "1.1 proxy (squid/3.5.27)")
+		w.Header().Set("X-Cache", "MISS from proxy")
+		w.Header().Set("X-Squid-Error", "ERR_ACCESS_DENIED 0")
+		p.blockpage(w, r, http.StatusForbidden)
+	case HTTPActionTruncatedBody:
+		body := p.body(r)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(body[:len(body)/2]) // the server closes the conn after a short write
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
+// body returns the body of block pages.
+func (p *HTTPServer) body(r *http.Request) []byte {
+	if p.tmpl == nil {
+		return HTTPBlockpage451
+	}
+	data := &HTTPBodyTemplateData{
+		Host: r.Host,
+		URL:  r.URL.String(),
+	}
+	var body bytes.Buffer
+	if err := p.tmpl.Execute(&body, data); err != nil {
+		return HTTPBlockpage451
+	}
+	return body.Bytes()
+}
+
+func (p *HTTPServer) blockpage(w http.ResponseWriter, r *http.Request, statusCode int) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(statusCode)
+	w.Write(p.body(r))
+}
+
 func (p *HTTPServer) hijack(w http.ResponseWriter, r *http.Request, policy HTTPAction) {
 	// Note:
 	//
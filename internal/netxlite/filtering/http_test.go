@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"html/template"
 	"io"
 	"net/http"
 	"net/url"
@@ -125,6 +126,148 @@ func TestHTTPServer(t *testing.T) {
 		srvr.Close()
 	})
 
+	t.Run("HTTPAction200", func(t *testing.T) {
+		ctx := context.Background()
+		srvr := NewHTTPServerCleartext(HTTPAction200)
+		resp, err := httpGET(ctx, "GET", srvr.URL(), "nexa.polito.it", srvr.TLSConfig(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatal("unexpected status code", resp.StatusCode)
+		}
+		data, err := netxlite.ReadAllContext(ctx, resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(HTTPBlockpage451, data) {
+			t.Fatal("unexpected data")
+		}
+		resp.Body.Close()
+		srvr.Close()
+	})
+
+	t.Run("HTTPActionRedirect", func(t *testing.T) {
+		// noRedirect prevents the client from following the redirect
+		noRedirect := func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		t.Run("with the default URL", func(t *testing.T) {
+			srvr := NewHTTPServerCleartext(HTTPActionRedirect)
+			defer srvr.Close()
+			clnt := &http.Client{CheckRedirect: noRedirect}
+			resp, err := clnt.Get(srvr.URL().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 302 {
+				t.Fatal("unexpected status code", resp.StatusCode)
+			}
+			if location := resp.Header.Get("Location"); location != HTTPDefaultRedirectURL {
+				t.Fatal("unexpected location", location)
+			}
+		})
+
+		t.Run("with a custom URL", func(t *testing.T) {
+			portal := NewHTTPServerCleartext(HTTPAction200)
+			defer portal.Close()
+			srvr := NewHTTPServerCleartext(
+				HTTPActionRedirect, HTTPServerOptionRedirectURL(portal.URL().String()+"/blocked"))
+			defer srvr.Close()
+			resp, err := http.Get(srvr.URL().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 200 || resp.Request.URL.Path != "/blocked" {
+				t.Fatal("unexpected final response", resp.StatusCode, resp.Request.URL)
+			}
+		})
+	})
+
+	t.Run("HTTPActionInjectHeaders", func(t *testing.T) {
+		ctx := context.Background()
+		srvr := NewHTTPServerTLS(HTTPActionInjectHeaders)
+		resp, err := httpGET(ctx, "GET", srvr.URL(), "nexa.polito.it", srvr.TLSConfig(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 403 {
+			t.Fatal("unexpected status code", resp.StatusCode)
+		}
+		if resp.Header.Get("Via") == "" || resp.Header.Get("X-Squid-Error") == "" {
+			t.Fatal("missing injected headers", resp.Header)
+		}
+		srvr.Close()
+	})
+
+	t.Run("HTTPActionTruncatedBody", func(t *testing.T) {
+		ctx := context.Background()
+		srvr := NewHTTPServerCleartext(HTTPActionTruncatedBody)
+		resp, err := httpGET(ctx, "GET", srvr.URL(), "nexa.polito.it", srvr.TLSConfig(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ContentLength != int64(len(HTTPBlockpage451)) {
+			t.Fatal("unexpected content length", resp.ContentLength)
+		}
+		data, err := io.ReadAll(resp.Body)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatal("unexpected err", err)
+		}
+		if !bytes.Equal(HTTPBlockpage451[:len(HTTPBlockpage451)/2], data) {
+			t.Fatal("unexpected data")
+		}
+		resp.Body.Close()
+		srvr.Close()
+	})
+
+	t.Run("HTTPServerOptionBodyTemplate", func(t *testing.T) {
+		t.Run("with a valid template", func(t *testing.T) {
+			ctx := context.Background()
+			tmpl := template.Must(template.New("").Parse(
+				"<html><head><title>Blocked: {{.Host}}</title></head><body>{{.URL}}</body></html>"))
+			srvr := NewHTTPServerCleartext(HTTPAction200, HTTPServerOptionBodyTemplate(tmpl))
+			URL := srvr.URL().ResolveReference(&url.URL{Path: "/<index>"})
+			resp, err := httpGET(ctx, "GET", URL, "nexa.polito.it", srvr.TLSConfig(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := netxlite.ReadAllContext(ctx, resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect := "<html><head><title>Blocked: nexa.polito.it</title></head><body>/%3Cindex%3E</body></html>"
+			if string(data) != expect {
+				t.Fatal("unexpected data", string(data))
+			}
+			resp.Body.Close()
+			srvr.Close()
+		})
+
+		t.Run("with a template that fails", func(t *testing.T) {
+			ctx := context.Background()
+			tmpl := template.Must(template.New("").Parse("{{.Nonexistent}}"))
+			srvr := NewHTTPServerCleartext(HTTPAction451, HTTPServerOptionBodyTemplate(tmpl))
+			resp, err := httpGET(ctx, "GET", srvr.URL(), "nexa.polito.it", srvr.TLSConfig(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := netxlite.ReadAllContext(ctx, resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(HTTPBlockpage451, data) {
+				t.Fatal("unexpected data")
+			}
+			resp.Body.Close()
+			srvr.Close()
+		})
+	})
+
 	t.Run("unknown action", func(t *testing.T) {
 		ctx := context.Background()
 		srvr := NewHTTPServerCleartext("")
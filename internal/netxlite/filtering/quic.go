@@ -0,0 +1,325 @@
+package filtering
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/bassosimone/oonidsl/internal/runtimex"
+	"github.com/google/martian/v3/mitm"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// QUICAction is a QUIC filtering action that this server should take.
+type QUICAction string
+
+const (
+	// QUICActionPass serves HTTP/3 without any filtering.
+	QUICActionPass = QUICAction("pass")
+
+	// QUICActionDrop drops all the UDP datagrams.
+	QUICActionDrop = QUICAction("drop")
+
+	// QUICActionDropAfterInitial delivers the first datagram sent by
+	// each client, i.e., the Initial packet, to the server and then drops
+	// all the datagrams of the flow, including the server's responses,
+	// like a censor that blocks after inspecting the Initial packet.
+	QUICActionDropAfterInitial = QUICAction("drop-after-initial")
+
+	// QUICActionStatelessReset lets the handshake complete and then
+	// answers to the client's 1-RTT packets with stateless resets.
+	QUICActionStatelessReset = QUICAction("stateless-reset")
+
+	// QUICActionVersionNegotiation answers to the client's long header
+	// packets with a version negotiation packet that does not include any
+	// version the client supports.
+	QUICActionVersionNegotiation = QUICAction("version-negotiation")
+
+	// QUICActionBlackholeSNI drops all the datagrams to and from a
+	// client that sends a ClientHello containing a blocked SNI.
+	QUICActionBlackholeSNI = QUICAction("blackhole-sni")
+)
+
+// QUICServerResponseBody is the body the QUICServer sends in
+// response to HTTP/3 requests when the action allows it.
+var QUICServerResponseBody = []byte("Bonsoir, Elliot!\n")
+
+// quicServerConnectionIDLength is the length of the connection IDs chosen by
+// the server, which we need to know to parse the client's 1-RTT packets.
+const quicServerConnectionIDLength = 8
+
+// quicVersionGREASE is a reserved QUIC version that clients do not support.
+const quicVersionGREASE = 0x1a2a3a4a
+
+// QUICServer is an HTTP/3 server implementing filtering policies.
+type QUICServer struct {
+	// action is the action to perform.
+	action QUICAction
+
+	// blackholed contains the blackholed client endpoints.
+	blackholed map[string]bool
+
+	// blockedSNIs contains the SNIs to blackhole.
+	blockedSNIs map[string]bool
+
+	// cert is the fake CA certificate.
+	cert *x509.Certificate
+
+	// config is the config to generate certificates on the fly.
+	config *mitm.Config
+
+	// done is closed when the background goroutine has terminated.
+	done chan bool
+
+	// endpoint is the endpoint where we're listening.
+	endpoint string
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// pconn is the UDP conn.
+	pconn net.PacketConn
+
+	// resetKey is the key for generating stateless resets.
+	resetKey quic.StatelessResetKey
+
+	// seen contains the client endpoints from which we received datagrams.
+	seen map[string]bool
+
+	// server is the HTTP/3 server.
+	server *http3.Server
+}
+
+// NewQUICServer creates and starts a new QUICServer that executes the given
+// action. The blockedSNIs argument is only meaningful for QUICActionBlackholeSNI.
+func NewQUICServer(action QUICAction, blockedSNIs ...string) *QUICServer {
+	cert, _, config := tlsConfigMITM()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	runtimex.PanicOnError(err, "net.ListenUDP failed")
+	server := &QUICServer{
+		action:      action,
+		blackholed:  map[string]bool{},
+		blockedSNIs: map[string]bool{},
+		cert:        cert,
+		config:      config,
+		done:        make(chan bool),
+		endpoint:    udpConn.LocalAddr().String(),
+		mu:          sync.Mutex{},
+		pconn:       nil, // set below
+		resetKey:    quic.StatelessResetKey{},
+		seen:        map[string]bool{},
+		server:      nil, // set below
+	}
+	for _, sni := range blockedSNIs {
+		server.blockedSNIs[sni] = true
+	}
+	_, err = rand.Read(server.resetKey[:])
+	runtimex.PanicOnError(err, "rand.Read failed")
+	// Note: we MUST NOT embed the *net.UDPConn because otherwise quic-go
+	// would read and write using its OOB methods, bypassing our filtering.
+	server.pconn = &quicFilteringConn{PacketConn: udpConn, server: server}
+	server.server = &http3.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(QUICServerResponseBody)
+		}),
+		TLSConfig: &tls.Config{GetConfigForClient: server.getConfigForClient},
+		QuicConfig: &quic.Config{
+			ConnectionIDLength: quicServerConnectionIDLength,
+			StatelessResetKey:  &server.resetKey,
+		},
+	}
+	go server.mainloop()
+	return server
+}
+
+// CertPool returns the internal CA as a cert pool.
+func (p *QUICServer) CertPool() *x509.CertPool {
+	o := x509.NewCertPool()
+	o.AddCert(p.cert)
+	return o
+}
+
+// Endpoint returns the endpoint where the server is listening.
+func (p *QUICServer) Endpoint() string {
+	return p.endpoint
+}
+
+// TLSConfig returns a suitable base TLS config for the client.
+func (p *QUICServer) TLSConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"h3"},
+		RootCAs:    p.CertPool(),
+	}
+}
+
+// Close closes this server as soon as possible.
+func (p *QUICServer) Close() error {
+	p.server.Close()
+	err := p.pconn.Close()
+	<-p.done
+	return err
+}
+
+func (p *QUICServer) mainloop() {
+	defer close(p.done)
+	p.server.Serve(p.pconn)
+}
+
+// errQUICBlockedSNI indicates that the client used a blocked SNI.
+var errQUICBlockedSNI = errors.New("filtering: blocked SNI")
+
+func (p *QUICServer) getConfigForClient(info *tls.ClientHelloInfo) (*tls.Config, error) {
+	if p.action == QUICActionBlackholeSNI && p.blockedSNIs[info.ServerName] {
+		p.mu.Lock()
+		p.blackholed[info.Conn.RemoteAddr().String()] = true
+		p.mu.Unlock()
+		return nil, errQUICBlockedSNI // the client won't see the CONNECTION_CLOSE
+	}
+	return p.config.TLS(), nil
+}
+
+// filterIncoming returns whether to deliver to the server the given datagram.
+func (p *QUICServer) filterIncoming(pconn net.PacketConn, data []byte, addr net.Addr) bool {
+	switch p.action {
+	case QUICActionDrop:
+		return false
+	case QUICActionDropAfterInitial:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.seen[addr.String()] {
+			return false
+		}
+		p.seen[addr.String()] = true
+		return true
+	case QUICActionStatelessReset:
+		if len(data) <= 0 || quicIsLongHeader(data) {
+			return true
+		}
+		if reset := p.statelessReset(data); reset != nil {
+			pconn.WriteTo(reset, addr)
+		}
+		return false
+	case QUICActionVersionNegotiation:
+		if packet := quicVersionNegotiation(data); packet != nil {
+			pconn.WriteTo(packet, addr)
+		}
+		return false
+	case QUICActionBlackholeSNI:
+		return !p.isBlackholed(addr)
+	default:
+		return true
+	}
+}
+
+// filterOutgoing returns whether to send to the client the given datagram.
+func (p *QUICServer) filterOutgoing(addr net.Addr) bool {
+	switch p.action {
+	case QUICActionDrop, QUICActionDropAfterInitial:
+		return false
+	case QUICActionBlackholeSNI:
+		return !p.isBlackholed(addr)
+	default:
+		return true
+	}
+}
+
+func (p *QUICServer) isBlackholed(addr net.Addr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.blackholed[addr.String()]
+}
+
+// statelessReset returns a stateless reset for the given 1-RTT packet
+// or nil if the packet is too short to send a stateless reset. We compute
+// the token like quic-go does, so the client recognizes it.
+func (p *QUICServer) statelessReset(data []byte) []byte {
+	const (
+		resetTokenLength  = 16
+		minimumResetSize  = 21 // see RFC 9000 Sec. 10.3
+		preferredResetLen = 40
+	)
+	// Note: the reset MUST be shorter than the packet triggering it
+	size := len(data) - 1
+	if size > preferredResetLen {
+		size = preferredResetLen
+	}
+	if size < minimumResetSize || len(data) < 1+quicServerConnectionIDLength {
+		return nil
+	}
+	hasher := hmac.New(sha256.New, p.resetKey[:])
+	hasher.Write(data[1 : 1+quicServerConnectionIDLength])
+	reset := make([]byte, size)
+	rand.Read(reset)
+	reset[0] = 0x40 | (reset[0] & 0x3f) // short header with the fixed bit set
+	copy(reset[size-resetTokenLength:], hasher.Sum(nil)[:resetTokenLength])
+	return reset
+}
+
+// quicIsLongHeader returns whether the packet has a long header.
+func quicIsLongHeader(data []byte) bool {
+	return data[0]&0x80 != 0
+}
+
+// quicVersionNegotiation returns a version negotiation packet in response to
+// the given long header packet or nil if data is not a valid long header packet.
+func quicVersionNegotiation(data []byte) []byte {
+	if len(data) < 6 || !quicIsLongHeader(data) {
+		return nil
+	}
+	dcidLen := int(data[5])
+	if len(data) < 7+dcidLen {
+		return nil
+	}
+	dcid := data[6 : 6+dcidLen]
+	scidLen := int(data[6+dcidLen])
+	if len(data) < 7+dcidLen+scidLen {
+		return nil
+	}
+	scid := data[7+dcidLen : 7+dcidLen+scidLen]
+	var first [1]byte
+	rand.Read(first[:])
+	out := []byte{0x80 | first[0], 0, 0, 0, 0} // version negotiation
+	// the client's source connection ID becomes our destination one
+	out = append(out, byte(len(scid)))
+	out = append(out, scid...)
+	out = append(out, byte(len(dcid)))
+	out = append(out, dcid...)
+	var version [4]byte
+	binary.BigEndian.PutUint32(version[:], quicVersionGREASE)
+	return append(out, version[:]...)
+}
+
+// quicFilteringConn is the net.PacketConn used by QUICServer.
+type quicFilteringConn struct {
+	net.PacketConn
+	server *QUICServer
+}
+
+// ReadFrom implements net.PacketConn.ReadFrom.
+func (c *quicFilteringConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		count, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return 0, nil, err
+		}
+		if c.server.filterIncoming(c.PacketConn, p[:count], addr) {
+			return count, addr, nil
+		}
+	}
+}
+
+// WriteTo implements net.PacketConn.WriteTo.
+func (c *quicFilteringConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.server.filterOutgoing(addr) {
+		return len(p), nil // pretend we've sent it
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
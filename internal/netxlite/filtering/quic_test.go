@@ -0,0 +1,171 @@
+package filtering
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+	"github.com/lucas-clemente/quic-go"
+)
+
+func TestQUICServer(t *testing.T) {
+	// dial performs a QUIC handshake with srv using the given SNI.
+	dial := func(srv *QUICServer, sni string) (quic.EarlyConnection, error) {
+		dialer := netxlite.NewQUICDialerWithoutResolver(netxlite.NewQUICListener(), model.DiscardLogger)
+		defer dialer.CloseIdleConnections()
+		config := srv.TLSConfig()
+		config.ServerName = sni
+		quicConfig := &quic.Config{HandshakeIdleTimeout: 250 * time.Millisecond}
+		return dialer.DialContext(context.Background(), srv.Endpoint(), config, quicConfig)
+	}
+
+	t.Run("QUICActionPass", func(t *testing.T) {
+		t.Run("QUIC handshake", func(t *testing.T) {
+			srv := NewQUICServer(QUICActionPass)
+			defer srv.Close()
+			qconn, err := dial(srv, "dns.google")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer qconn.CloseWithError(0, "")
+			if qconn.ConnectionState().TLS.NegotiatedProtocol != "h3" {
+				t.Fatal("unexpected negotiated protocol")
+			}
+		})
+
+		t.Run("HTTP/3 round trip", func(t *testing.T) {
+			srv := NewQUICServer(QUICActionPass)
+			defer srv.Close()
+			dialer := netxlite.NewQUICDialerWithoutResolver(netxlite.NewQUICListener(), model.DiscardLogger)
+			config := srv.TLSConfig()
+			config.ServerName = "dns.google"
+			txp := netxlite.NewHTTP3Transport(model.DiscardLogger, dialer, config)
+			defer txp.CloseIdleConnections()
+			req, err := http.NewRequest("GET", "https://"+srv.Endpoint()+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := txp.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(QUICServerResponseBody) {
+				t.Fatal("unexpected body", string(data))
+			}
+		})
+	})
+
+	t.Run("QUICActionDrop", func(t *testing.T) {
+		srv := NewQUICServer(QUICActionDrop)
+		defer srv.Close()
+		qconn, err := dial(srv, "dns.google")
+		if err == nil || err.Error() != netxlite.FailureGenericTimeoutError {
+			t.Fatal("unexpected err", err)
+		}
+		if qconn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("QUICActionDropAfterInitial", func(t *testing.T) {
+		srv := NewQUICServer(QUICActionDropAfterInitial)
+		defer srv.Close()
+		qconn, err := dial(srv, "dns.google")
+		if err == nil || err.Error() != netxlite.FailureGenericTimeoutError {
+			t.Fatal("unexpected err", err)
+		}
+		if qconn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("QUICActionStatelessReset", func(t *testing.T) {
+		srv := NewQUICServer(QUICActionStatelessReset)
+		defer srv.Close()
+		qconn, err := dial(srv, "dns.google")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer qconn.CloseWithError(0, "")
+		// the client sends 1-RTT packets, e.g., to acknowledge the
+		// server's HANDSHAKE_DONE, and the server resets the conn
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = qconn.AcceptStream(ctx)
+		var reset *quic.StatelessResetError
+		if !errors.As(err, &reset) {
+			t.Fatal("unexpected err", err)
+		}
+	})
+
+	t.Run("QUICActionVersionNegotiation", func(t *testing.T) {
+		srv := NewQUICServer(QUICActionVersionNegotiation)
+		defer srv.Close()
+		qconn, err := dial(srv, "dns.google")
+		if err == nil || err.Error() != netxlite.FailureQUICIncompatibleVersion {
+			t.Fatal("unexpected err", err)
+		}
+		if qconn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("QUICActionBlackholeSNI", func(t *testing.T) {
+		t.Run("with a blocked SNI", func(t *testing.T) {
+			srv := NewQUICServer(QUICActionBlackholeSNI, "www.example.com")
+			defer srv.Close()
+			qconn, err := dial(srv, "www.example.com")
+			if err == nil || err.Error() != netxlite.FailureGenericTimeoutError {
+				t.Fatal("unexpected err", err)
+			}
+			if qconn != nil {
+				t.Fatal("expected nil conn")
+			}
+		})
+
+		t.Run("with another SNI", func(t *testing.T) {
+			srv := NewQUICServer(QUICActionBlackholeSNI, "www.example.com")
+			defer srv.Close()
+			qconn, err := dial(srv, "dns.google")
+			if err != nil {
+				t.Fatal(err)
+			}
+			qconn.CloseWithError(0, "")
+		})
+	})
+}
+
+func Test_quicVersionNegotiation(t *testing.T) {
+	t.Run("with a valid long header packet", func(t *testing.T) {
+		packet := []byte{0xc0, 0, 0, 0, 1, 2, 0xaa, 0xbb, 1, 0xcc}
+		out := quicVersionNegotiation(packet)
+		expect := []byte{0, 0, 0, 0, 1, 0xcc, 2, 0xaa, 0xbb, 0x1a, 0x2a, 0x3a, 0x4a}
+		if out[0]&0x80 == 0 || string(out[1:]) != string(expect) {
+			t.Fatal("unexpected packet", out)
+		}
+	})
+
+	t.Run("with invalid packets", func(t *testing.T) {
+		inputs := [][]byte{
+			{0xc0, 0, 0},                   // too short
+			{0x40, 0, 0, 0, 1, 2, 0, 0, 0}, // short header
+			{0xc0, 0, 0, 0, 1, 8, 0xaa},    // truncated DCID
+			{0xc0, 0, 0, 0, 1, 1, 0xaa, 4}, // truncated SCID
+		}
+		for _, input := range inputs {
+			if out := quicVersionNegotiation(input); out != nil {
+				t.Fatal("expected nil for", input)
+			}
+		}
+	})
+}
@@ -0,0 +1,421 @@
+package filtering
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Scenario describes a censored network. We run such a network on the
+// loopback interface: each domain resolves to loopback addresses, on each
+// address we run TCPProxy instances for HTTP and HTTPS, which forward to a
+// local origin, and all the filtering policies depend on the configuration.
+// The proxies forward the hosts listed in HTTP to HTTPServer instances and
+// the SNIs listed in TLS to TLSServer instances rather than to the origin.
+//
+// You typically write a scenario as a JSON file and load it using the
+// LoadScenario function. For example:
+//
+//	{
+//	    "Addresses": {
+//	        "www.example.com": ["127.0.0.2"],
+//	        "www.example.org": ["127.0.0.3"]
+//	    },
+//	    "DNS": {"www.example.org": "nxdomain"},
+//	    "SNIs": {"www.example.com": "reset"},
+//	    "Hosts": {"www.example.com": "block-page"},
+//	    "HTTP": {"www.example.org": "redirect"},
+//	    "TLS": {"www.example.org": "mitm"}
+//	}
+type Scenario struct {
+	// Addresses maps each domain to the loopback addresses that the
+	// DNSServer returns when the DNS action is DNSActionCache.
+	Addresses map[string][]string
+
+	// Blackholed contains the addresses where we accept connections
+	// but we drop all the following segments.
+	Blackholed []string
+
+	// DNS maps each domain to the DNS action to take. When a domain
+	// is not listed here, we use DNSActionCache.
+	DNS map[string]DNSAction
+
+	// HTTPPort is the OPTIONAL port for HTTP. If zero, we use a
+	// random port, which is the same for all the addresses.
+	HTTPPort int
+
+	// HTTP maps HTTP Host headers to the action taken by the HTTPServer
+	// to which we forward the conns using such hosts on the HTTP port.
+	HTTP map[string]HTTPAction
+
+	// HTTPSPort is like HTTPPort but for HTTPS.
+	HTTPSPort int
+
+	// Hosts maps HTTP Host headers to the action to take. Because the
+	// proxy takes this action, it takes precedence over HTTP.
+	Hosts map[string]TCPProxyAction
+
+	// SNIs maps SNIs to the action to take. Because the proxy
+	// takes this action, it takes precedence over TLS.
+	SNIs map[string]TCPProxyAction
+
+	// TLS maps SNIs to the action taken by the TLSServer to which
+	// we forward the conns using such SNIs on the HTTPS port.
+	TLS map[string]TLSAction
+
+	// ThrottleRate is the OPTIONAL TCPProxyConfig.ThrottleRate.
+	ThrottleRate int
+}
+
+// ErrScenarioInvalidAddress indicates that a Scenario contains
+// an address that is not a loopback IP address.
+var ErrScenarioInvalidAddress = errors.New("filtering: scenario address is not a loopback IP address")
+
+// ErrScenarioInvalidAction indicates that a Scenario contains
+// an action that is not one of the actions we implement.
+var ErrScenarioInvalidAction = errors.New("filtering: scenario action is not valid")
+
+// LoadScenario loads a Scenario from the given JSON file.
+func LoadScenario(filename string) (*Scenario, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var scenario Scenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return nil, err
+	}
+	if err := scenario.validate(); err != nil {
+		return nil, err
+	}
+	return &scenario, nil
+}
+
+// scenarioDNSActions contains the valid DNS actions.
+var scenarioDNSActions = map[DNSAction]bool{
+	DNSActionNXDOMAIN:           true,
+	DNSActionRefused:            true,
+	DNSActionServFail:           true,
+	DNSActionLocalHost:          true,
+	DNSActionNoAnswer:           true,
+	DNSActionTimeout:            true,
+	DNSActionCache:              true,
+	DNSActionLocalHostPlusCache: true,
+	DNSActionInjectThenAnswer:   true,
+	DNSActionWrongQueryID:       true,
+	DNSActionTruncated:          true,
+	DNSActionBogonCNAME:         true,
+}
+
+// scenarioTCPProxyActions contains the valid TCPProxy actions.
+var scenarioTCPProxyActions = map[TCPProxyAction]bool{
+	TCPProxyActionPass:      true,
+	TCPProxyActionReset:     true,
+	TCPProxyActionDrop:      true,
+	TCPProxyActionThrottle:  true,
+	TCPProxyActionBlockPage: true,
+}
+
+// scenarioHTTPActions contains the valid HTTPServer actions.
+var scenarioHTTPActions = map[HTTPAction]bool{
+	HTTPActionReset:         true,
+	HTTPActionTimeout:       true,
+	HTTPActionEOF:           true,
+	HTTPAction451:           true,
+	HTTPActionDoH:           true,
+	HTTPAction200:           true,
+	HTTPActionRedirect:      true,
+	HTTPActionInjectHeaders: true,
+	HTTPActionTruncatedBody: true,
+}
+
+// scenarioTLSActions contains the valid TLSServer actions.
+var scenarioTLSActions = map[TLSAction]bool{
+	TLSActionReset:                 true,
+	TLSActionTimeout:               true,
+	TLSActionEOF:                   true,
+	TLSActionAlertInternalError:    true,
+	TLSActionAlertUnrecognizedName: true,
+	TLSActionBlockText:             true,
+	TLSActionSelfSigned:            true,
+	TLSActionExpired:               true,
+	TLSActionWrongHost:             true,
+	TLSActionMITM:                  true,
+	TLSActionStallAfterServerHello: true,
+}
+
+// validate returns an error if the scenario contains invalid actions.
+func (s *Scenario) validate() error {
+	for domain, action := range s.DNS {
+		if !scenarioDNSActions[action] {
+			return fmt.Errorf("%w: %s: %s", ErrScenarioInvalidAction, domain, action)
+		}
+	}
+	for name, action := range s.Hosts {
+		if !scenarioTCPProxyActions[action] {
+			return fmt.Errorf("%w: %s: %s", ErrScenarioInvalidAction, name, action)
+		}
+	}
+	for name, action := range s.SNIs {
+		if !scenarioTCPProxyActions[action] {
+			return fmt.Errorf("%w: %s: %s", ErrScenarioInvalidAction, name, action)
+		}
+	}
+	for name, action := range s.HTTP {
+		if !scenarioHTTPActions[action] {
+			return fmt.Errorf("%w: %s: %s", ErrScenarioInvalidAction, name, action)
+		}
+	}
+	for name, action := range s.TLS {
+		if !scenarioTLSActions[action] {
+			return fmt.Errorf("%w: %s: %s", ErrScenarioInvalidAction, name, action)
+		}
+	}
+	return nil
+}
+
+// ScenarioResponseBody is the body returned by the ScenarioNetwork
+// origin server in response to any HTTP request.
+var ScenarioResponseBody = []byte("Bonsoir, Elliot!\n")
+
+// ScenarioNetwork is a running Scenario.
+type ScenarioNetwork struct {
+	// closers contains what we need to close.
+	closers []interface{ Close() error }
+
+	// dns is the DNS server endpoint.
+	dns string
+
+	// httpPort is the port we're using for HTTP.
+	httpPort int
+
+	// httpsPort is the port we're using for HTTPS.
+	httpsPort int
+
+	// certs contains the fake CA certificates used by the HTTPS
+	// origin and by the TLSServer instances.
+	certs []*x509.Certificate
+
+	// once allows to call Close just once.
+	once sync.Once
+
+	// server is the DNS server.
+	server *DNSServer
+}
+
+// Start starts the servers implementing the Scenario.
+func (s *Scenario) Start() (*ScenarioNetwork, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	addresses, err := s.addresses()
+	if err != nil {
+		return nil, err
+	}
+	sn := &ScenarioNetwork{}
+	if err := sn.start(s, addresses); err != nil {
+		sn.Close()
+		return nil, err
+	}
+	return sn, nil
+}
+
+// addresses returns the deduplicated addresses used by the scenario.
+func (s *Scenario) addresses() ([]string, error) {
+	uniq := map[string]bool{}
+	var out []string
+	all := append([]string{}, s.Blackholed...)
+	for _, addrs := range s.Addresses {
+		all = append(all, addrs...)
+	}
+	for _, addr := range all {
+		ip := net.ParseIP(addr)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("%w: %s", ErrScenarioInvalidAddress, addr)
+		}
+		if !uniq[addr] {
+			uniq[addr] = true
+			out = append(out, addr)
+		}
+	}
+	return out, nil
+}
+
+func (sn *ScenarioNetwork) start(s *Scenario, addresses []string) error {
+	sn.server = &DNSServer{
+		Cache: map[string][]string{},
+		OnQuery: func(query *DNSQuery) DNSAction {
+			if action, found := s.DNS[strings.TrimSuffix(query.Domain, ".")]; found {
+				return action
+			}
+			return DNSActionCache
+		},
+	}
+	for domain, addrs := range s.Addresses {
+		sn.server.Cache[domain+"."] = addrs
+	}
+	listener, err := sn.server.Start("127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	sn.closers = append(sn.closers, listener)
+	sn.dns = listener.LocalAddr().String()
+
+	httpOrigin, err := sn.startOrigin(false)
+	if err != nil {
+		return err
+	}
+	httpsOrigin, err := sn.startOrigin(true)
+	if err != nil {
+		return err
+	}
+	httpOrigins := sn.startHTTPServers(s.HTTP)
+	httpsOrigins := sn.startTLSServers(s.TLS)
+
+	blackholed := map[string]bool{}
+	for _, addr := range s.Blackholed {
+		blackholed[addr] = true
+	}
+	sn.httpPort, sn.httpsPort = s.HTTPPort, s.HTTPSPort
+	for _, addr := range addresses {
+		httpConfig := &TCPProxyConfig{
+			Origin:       httpOrigin,
+			Rules:        s.Hosts,
+			Origins:      httpOrigins,
+			ThrottleRate: s.ThrottleRate,
+		}
+		httpsConfig := &TCPProxyConfig{
+			Origin:       httpsOrigin,
+			Rules:        s.SNIs,
+			Origins:      httpsOrigins,
+			ThrottleRate: s.ThrottleRate,
+		}
+		if blackholed[addr] {
+			httpConfig.DefaultAction, httpConfig.Rules = TCPProxyActionDrop, nil
+			httpsConfig.DefaultAction, httpsConfig.Rules = TCPProxyActionDrop, nil
+		}
+		if err := sn.startProxy(httpConfig, addr, &sn.httpPort); err != nil {
+			return err
+		}
+		if err := sn.startProxy(httpsConfig, addr, &sn.httpsPort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startProxy starts a TCPProxy at the given address and port. If the port is
+// zero, we use a random port and we set the port to the selected port.
+func (sn *ScenarioNetwork) startProxy(config *TCPProxyConfig, addr string, port *int) error {
+	proxy, err := newTCPProxy(config, net.JoinHostPort(addr, strconv.Itoa(*port)))
+	if err != nil {
+		return err
+	}
+	sn.closers = append(sn.closers, proxy)
+	if *port == 0 {
+		_, value, _ := net.SplitHostPort(proxy.Endpoint())
+		*port, _ = strconv.Atoi(value)
+	}
+	return nil
+}
+
+// startOrigin starts an origin server and returns its endpoint.
+func (sn *ScenarioNetwork) startOrigin(enableTLS bool) (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(ScenarioResponseBody)
+		}),
+	}
+	sn.closers = append(sn.closers, srv)
+	switch enableTLS {
+	case false:
+		go srv.Serve(listener)
+	case true:
+		cert, _, config := tlsConfigMITM()
+		sn.certs = append(sn.certs, cert)
+		srv.TLSConfig = config.TLS()
+		go srv.ServeTLS(listener, "", "") // using srv.TLSConfig
+	}
+	return listener.Addr().String(), nil
+}
+
+// startHTTPServers starts an HTTPServer for each action and returns
+// the map from each host to the endpoint of the corresponding server.
+func (sn *ScenarioNetwork) startHTTPServers(hosts map[string]HTTPAction) map[string]string {
+	servers := map[HTTPAction]*HTTPServer{}
+	origins := map[string]string{}
+	for host, action := range hosts {
+		srv, found := servers[action]
+		if !found {
+			srv = NewHTTPServerCleartext(action)
+			sn.closers = append(sn.closers, srv)
+			servers[action] = srv
+		}
+		origins[host] = srv.URL().Host
+	}
+	return origins
+}
+
+// startTLSServers starts a TLSServer for each action and returns
+// the map from each SNI to the endpoint of the corresponding server.
+func (sn *ScenarioNetwork) startTLSServers(snis map[string]TLSAction) map[string]string {
+	servers := map[TLSAction]*TLSServer{}
+	origins := map[string]string{}
+	for sni, action := range snis {
+		srv, found := servers[action]
+		if !found {
+			srv = NewTLSServer(action)
+			sn.closers = append(sn.closers, srv)
+			sn.certs = append(sn.certs, srv.cert)
+			servers[action] = srv
+		}
+		origins[sni] = srv.Endpoint()
+	}
+	return origins
+}
+
+// DNSEndpoint returns the endpoint of the DNS-over-UDP server.
+func (sn *ScenarioNetwork) DNSEndpoint() string {
+	return sn.dns
+}
+
+// HTTPPort returns the port we use for HTTP.
+func (sn *ScenarioNetwork) HTTPPort() int {
+	return sn.httpPort
+}
+
+// HTTPSPort returns the port we use for HTTPS.
+func (sn *ScenarioNetwork) HTTPSPort() int {
+	return sn.httpsPort
+}
+
+// CertPool returns the CAs used by the HTTPS origin and by the
+// TLSServer instances as a cert pool.
+func (sn *ScenarioNetwork) CertPool() *x509.CertPool {
+	o := x509.NewCertPool()
+	for _, cert := range sn.certs {
+		o.AddCert(cert)
+	}
+	return o
+}
+
+// Close closes all the servers. This method is idempotent.
+func (sn *ScenarioNetwork) Close() error {
+	sn.once.Do(func() {
+		for _, closer := range sn.closers {
+			closer.Close()
+		}
+	})
+	return nil
+}
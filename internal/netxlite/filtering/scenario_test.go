@@ -0,0 +1,218 @@
+package filtering
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+)
+
+func TestScenario(t *testing.T) {
+	t.Run("LoadScenario", func(t *testing.T) {
+		t.Run("with a valid file", func(t *testing.T) {
+			scenario, err := LoadScenario("testdata/scenario.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if scenario.SNIs["blocked.example.com"] != TCPProxyActionReset {
+				t.Fatal("unexpected scenario", scenario)
+			}
+			if scenario.TLS["blocked.example.org"] != TLSActionExpired {
+				t.Fatal("unexpected scenario", scenario)
+			}
+		})
+
+		t.Run("with a nonexistent file", func(t *testing.T) {
+			scenario, err := LoadScenario("testdata/nonexistent.json")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if scenario != nil {
+				t.Fatal("expected nil scenario")
+			}
+		})
+
+		t.Run("with an invalid action", func(t *testing.T) {
+			scenario, err := LoadScenario("testdata/invalid-action.json")
+			if !errors.Is(err, ErrScenarioInvalidAction) {
+				t.Fatal("unexpected err", err)
+			}
+			if err.Error() != "filtering: scenario action is not valid: www.example.org: nxdomian" {
+				t.Fatal("unexpected err", err)
+			}
+			if scenario != nil {
+				t.Fatal("expected nil scenario")
+			}
+		})
+
+		t.Run("with an invalid file", func(t *testing.T) {
+			scenario, err := LoadScenario("testdata/invalid.json")
+			if err == nil || err.Error() != "unexpected end of JSON input" {
+				t.Fatal("unexpected err", err)
+			}
+			if scenario != nil {
+				t.Fatal("expected nil scenario")
+			}
+		})
+	})
+
+	t.Run("Start with a non-loopback address", func(t *testing.T) {
+		scenario := &Scenario{
+			Addresses: map[string][]string{"www.example.com": {"93.184.216.34"}},
+		}
+		sn, err := scenario.Start()
+		if !errors.Is(err, ErrScenarioInvalidAddress) {
+			t.Fatal("unexpected err", err)
+		}
+		if sn != nil {
+			t.Fatal("expected nil network")
+		}
+	})
+
+	t.Run("Start with an invalid action", func(t *testing.T) {
+		scenario := &Scenario{
+			Addresses: map[string][]string{"www.example.com": {"127.0.0.1"}},
+			SNIs:      map[string]TCPProxyAction{"www.example.com": "rest"},
+		}
+		sn, err := scenario.Start()
+		if !errors.Is(err, ErrScenarioInvalidAction) {
+			t.Fatal("unexpected err", err)
+		}
+		if sn != nil {
+			t.Fatal("expected nil network")
+		}
+	})
+
+	t.Run("Start with a busy port", func(t *testing.T) {
+		proxy := NewTCPProxy(&TCPProxyConfig{})
+		defer proxy.Close()
+		_, value, _ := strings.Cut(proxy.Endpoint(), ":")
+		port, _ := strconv.Atoi(value)
+		scenario := &Scenario{
+			Addresses: map[string][]string{"www.example.com": {"127.0.0.1"}},
+			HTTPPort:  port,
+		}
+		sn, err := scenario.Start()
+		if err == nil || !strings.HasSuffix(err.Error(), "address already in use") {
+			t.Fatal("unexpected err", err)
+		}
+		if sn != nil {
+			t.Fatal("expected nil network")
+		}
+	})
+
+	if testing.Short() {
+		t.Skip("skip test in short mode") // we need 127.0.0.0/8 routed to loopback
+	}
+
+	scenario, err := LoadScenario("testdata/scenario.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn, err := scenario.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Close()
+
+	// fetch fetches the given URL using the scenario network
+	fetch := func(scheme, domain string, port int) (string, error) {
+		dialer := netxlite.NewDialerWithoutResolver(model.DiscardLogger)
+		reso := netxlite.NewParallelUDPResolver(model.DiscardLogger, dialer, sn.DNSEndpoint())
+		txp := &http.Transport{
+			DialContext:     netxlite.NewDialerWithResolver(model.DiscardLogger, reso).DialContext,
+			TLSClientConfig: &tls.Config{RootCAs: sn.CertPool()},
+		}
+		clnt := &http.Client{Transport: txp, Timeout: time.Second}
+		defer clnt.CloseIdleConnections()
+		resp, err := clnt.Get(scheme + "://" + domain + ":" + strconv.Itoa(port) + "/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return string(data), err
+	}
+
+	for _, scheme := range []string{"http", "https"} {
+		port := sn.HTTPPort()
+		if scheme == "https" {
+			port = sn.HTTPSPort()
+		}
+
+		t.Run(scheme, func(t *testing.T) {
+			t.Run("without censorship", func(t *testing.T) {
+				body, err := fetch(scheme, "www.example.com", port)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body != string(ScenarioResponseBody) {
+					t.Fatal("unexpected body", body)
+				}
+			})
+
+			t.Run("with DNS censorship", func(t *testing.T) {
+				_, err := fetch(scheme, "www.example.org", port)
+				if err == nil || !strings.HasSuffix(err.Error(), netxlite.FailureDNSNXDOMAINError) {
+					t.Fatal("unexpected err", err)
+				}
+			})
+
+			t.Run("with a blackholed address", func(t *testing.T) {
+				_, err := fetch(scheme, "www.example.net", port)
+				if err == nil || !strings.Contains(err.Error(), "Client.Timeout exceeded") {
+					t.Fatal("unexpected err", err)
+				}
+			})
+		})
+	}
+
+	t.Run("with a block page", func(t *testing.T) {
+		body, err := fetch("http", "blocked.example.com", sn.HTTPPort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != string(HTTPBlockpage451) {
+			t.Fatal("unexpected body", body)
+		}
+	})
+
+	t.Run("with a reset after the ClientHello", func(t *testing.T) {
+		_, err := fetch("https", "blocked.example.com", sn.HTTPSPort())
+		if err == nil || !strings.HasSuffix(err.Error(), netxlite.FailureConnectionReset) {
+			t.Fatal("unexpected err", err)
+		}
+	})
+
+	t.Run("with an HTTPServer serving a 200 block page", func(t *testing.T) {
+		body, err := fetch("http", "blocked.example.org", sn.HTTPPort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != string(HTTPBlockpage451) {
+			t.Fatal("unexpected body", body)
+		}
+	})
+
+	t.Run("with a TLSServer using an expired certificate", func(t *testing.T) {
+		_, err := fetch("https", "blocked.example.org", sn.HTTPSPort())
+		if err == nil || !strings.Contains(err.Error(), "certificate has expired") {
+			t.Fatal("unexpected err", err)
+		}
+	})
+
+	t.Run("Close is idempotent", func(t *testing.T) {
+		for idx := 0; idx < 2; idx++ {
+			if err := sn.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,355 @@
+package filtering
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/runtimex"
+)
+
+// TCPProxyAction is a filtering action that a TCPProxy should take.
+type TCPProxyAction string
+
+const (
+	// TCPProxyActionPass forwards the traffic to the origin.
+	TCPProxyActionPass = TCPProxyAction("pass")
+
+	// TCPProxyActionReset resets the connection after
+	// receiving the ClientHello or the HTTP request.
+	TCPProxyActionReset = TCPProxyAction("reset")
+
+	// TCPProxyActionDrop drops all the segments following the
+	// ClientHello or the HTTP request, so the connection times out.
+	TCPProxyActionDrop = TCPProxyAction("drop")
+
+	// TCPProxyActionThrottle forwards the traffic to the origin
+	// limiting the throughput to the configured rate.
+	TCPProxyActionThrottle = TCPProxyAction("throttle")
+
+	// TCPProxyActionBlockPage returns a 451 response including
+	// HTTPBlockpage451 and closes the connection. If the client is
+	// using TLS, it sees the response as a protocol violation.
+	TCPProxyActionBlockPage = TCPProxyAction("block-page")
+)
+
+// TCPProxyDefaultThrottleRate is the default TCPProxyConfig.ThrottleRate.
+const TCPProxyDefaultThrottleRate = 1024
+
+// TCPProxyConfig contains the TCPProxy config.
+type TCPProxyConfig struct {
+	// Origin is the MANDATORY endpoint to which we forward conns.
+	Origin string
+
+	// DefaultAction is the OPTIONAL action to take when no rule
+	// matches. If empty, we use TCPProxyActionPass.
+	DefaultAction TCPProxyAction
+
+	// Rules OPTIONALLY maps an SNI or an HTTP Host header to the
+	// action to take. When no rule matches, we use DefaultAction.
+	Rules map[string]TCPProxyAction
+
+	// Origins OPTIONALLY maps an SNI or an HTTP Host header to the
+	// endpoint to which we forward conns instead of Origin.
+	Origins map[string]string
+
+	// ThrottleRate is the OPTIONAL rate in bytes per second used by
+	// TCPProxyActionThrottle. If zero, we use TCPProxyDefaultThrottleRate.
+	ThrottleRate int
+}
+
+// TCPProxy is a TCP proxy sitting in the path between the client and
+// the origin. It reads the first bytes sent by the client, extracts the
+// SNI from the ClientHello or the Host header from the HTTP request, and
+// uses such a name to decide which action to take.
+type TCPProxy struct {
+	// config is the proxy config.
+	config *TCPProxyConfig
+
+	// conns contains the conns we're currently using.
+	conns map[net.Conn]bool
+
+	// done is closed when the background goroutine has terminated.
+	done chan bool
+
+	// endpoint is the endpoint where we're listening.
+	endpoint string
+
+	// listener is the TCP listener.
+	listener net.Listener
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+}
+
+// NewTCPProxy creates and starts a new TCPProxy using the given config.
+func NewTCPProxy(config *TCPProxyConfig) *TCPProxy {
+	proxy, err := newTCPProxy(config, "127.0.0.1:0")
+	runtimex.PanicOnError(err, "newTCPProxy failed")
+	return proxy
+}
+
+// newTCPProxy creates and starts a new TCPProxy listening at address.
+func newTCPProxy(config *TCPProxyConfig, address string) (*TCPProxy, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &TCPProxy{
+		config:   config,
+		conns:    map[net.Conn]bool{},
+		done:     make(chan bool),
+		endpoint: listener.Addr().String(),
+		listener: listener,
+		mu:       sync.Mutex{},
+	}
+	go proxy.mainloop()
+	return proxy, nil
+}
+
+// Endpoint returns the endpoint where the proxy is listening.
+func (p *TCPProxy) Endpoint() string {
+	return p.endpoint
+}
+
+// Close closes the proxy and the conns it's using as soon as possible.
+func (p *TCPProxy) Close() error {
+	err := p.listener.Close()
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+	return err
+}
+
+func (p *TCPProxy) mainloop() {
+	defer close(p.done)
+	for p.oneloop() {
+		// nothing
+	}
+}
+
+func (p *TCPProxy) oneloop() bool {
+	conn, err := p.listener.Accept()
+	if err != nil {
+		return !errors.Is(err, net.ErrClosed)
+	}
+	if !p.track(conn) {
+		conn.Close()
+		return false
+	}
+	go p.handle(conn)
+	return true // we can continue running
+}
+
+// track returns false if the proxy is closed and we should stop.
+func (p *TCPProxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		return false
+	}
+	p.conns[conn] = true
+	return true
+}
+
+func (p *TCPProxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.Close()
+	delete(p.conns, conn) // works with a nil map
+}
+
+// tcpProxyMaxFirstFlight is the maximum number of bytes we
+// read from the client to find out the server name.
+const tcpProxyMaxFirstFlight = 1 << 16
+
+func (p *TCPProxy) handle(clientConn net.Conn) {
+	defer p.untrack(clientConn)
+	reader := bufio.NewReaderSize(clientConn, tcpProxyMaxFirstFlight)
+	firstFlight, err := tcpProxyPeekFirstFlight(reader)
+	if err != nil {
+		return
+	}
+	serverName := tcpProxyServerName(firstFlight)
+	origin, found := p.config.Origins[serverName]
+	if !found {
+		origin = p.config.Origin
+	}
+	action, found := p.config.Rules[serverName]
+	if !found {
+		action = p.config.DefaultAction
+	}
+	switch action {
+	case TCPProxyActionReset:
+		if tc, ok := clientConn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+	case TCPProxyActionDrop:
+		io.Copy(io.Discard, reader) // until the client or Close closes the conn
+	case TCPProxyActionBlockPage:
+		clientConn.Write(tcpProxyBlockPage())
+	case TCPProxyActionThrottle:
+		rate := p.config.ThrottleRate
+		if rate <= 0 {
+			rate = TCPProxyDefaultThrottleRate
+		}
+		p.forward(clientConn, reader, origin, rate)
+	default:
+		p.forward(clientConn, reader, origin, 0)
+	}
+}
+
+// forward forwards traffic between the client and the origin. A
+// positive rate limits the throughput in each direction.
+func (p *TCPProxy) forward(clientConn net.Conn, clientReader io.Reader, origin string, rate int) {
+	originConn, err := net.Dial("tcp", origin)
+	if err != nil {
+		return
+	}
+	if !p.track(originConn) {
+		originConn.Close()
+		return
+	}
+	defer p.untrack(originConn)
+	done := make(chan bool, 2)
+	go func() {
+		tcpProxyCopy(originConn, clientReader, rate)
+		done <- true
+	}()
+	go func() {
+		tcpProxyCopy(clientConn, originConn, rate)
+		done <- true
+	}()
+	<-done // as soon as one direction is done, the deferred calls close both conns
+}
+
+// tcpProxyCopy copies from src to dst. A positive rate
+// limits the throughput to rate bytes per second.
+func tcpProxyCopy(dst io.Writer, src io.Reader, rate int) {
+	if rate <= 0 {
+		io.Copy(dst, src)
+		return
+	}
+	// use small chunks such that the throughput is smooth
+	chunk := rate / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	buffer := make([]byte, chunk)
+	for {
+		count, err := src.Read(buffer)
+		if count > 0 {
+			if _, err := dst.Write(buffer[:count]); err != nil {
+				return
+			}
+			time.Sleep(time.Duration(count) * time.Second / time.Duration(rate))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// tcpProxyPeekFirstFlight returns the TLS record containing the ClientHello
+// or the HTTP request headers without consuming them from the reader. If
+// the client is not using TLS or HTTP, it returns the first bytes we read.
+func tcpProxyPeekFirstFlight(reader *bufio.Reader) ([]byte, error) {
+	header, err := reader.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] == 22 { // handshake record
+		size := 5 + int(binary.BigEndian.Uint16(header[3:5]))
+		if size > reader.Size() {
+			size = reader.Size()
+		}
+		return reader.Peek(size)
+	}
+	for {
+		data, _ := reader.Peek(reader.Buffered())
+		if bytes.Contains(data, []byte("\r\n\r\n")) || len(data) >= reader.Size() {
+			return data, nil
+		}
+		if _, err := reader.Peek(len(data) + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// tcpProxyServerName returns the SNI or the Host header contained
+// in the first flight or an empty string if there's none.
+func tcpProxyServerName(firstFlight []byte) string {
+	if len(firstFlight) > 0 && firstFlight[0] == 22 {
+		return tlsParseServerName(firstFlight)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(firstFlight)))
+	if err != nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return req.Host
+}
+
+// errTLSStopHandshake stops the handshake after parsing the ClientHello.
+var errTLSStopHandshake = errors.New("filtering: stop handshake")
+
+// tlsParseServerName returns the SNI in the given ClientHello record or an empty
+// string. We let the stdlib parse the ClientHello and stop the handshake.
+func tlsParseServerName(record []byte) (sni string) {
+	conn := tls.Server(&tlsReadOnlyConn{reader: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = info.ServerName
+			return nil, errTLSStopHandshake
+		},
+	})
+	conn.Handshake()
+	return
+}
+
+// tlsReadOnlyConn is the net.Conn used by tlsParseServerName.
+type tlsReadOnlyConn struct {
+	net.Conn // only for satisfying the interface
+	reader   io.Reader
+}
+
+// Read implements net.Conn.Read.
+func (c *tlsReadOnlyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Write implements net.Conn.Write.
+func (c *tlsReadOnlyConn) Write(p []byte) (int, error) {
+	return 0, net.ErrClosed
+}
+
+// Close implements net.Conn.Close.
+func (c *tlsReadOnlyConn) Close() error {
+	return nil
+}
+
+// tcpProxyBlockPage returns the HTTP response containing HTTPBlockpage451.
+func tcpProxyBlockPage() []byte {
+	var builder strings.Builder
+	builder.WriteString("HTTP/1.1 451 Unavailable For Legal Reasons\r\n")
+	builder.WriteString("Content-Type: text/html\r\n")
+	builder.WriteString(fmt.Sprintf("Content-Length: %d\r\n", len(HTTPBlockpage451)))
+	builder.WriteString("Connection: close\r\n")
+	builder.WriteString("\r\n")
+	builder.Write(HTTPBlockpage451)
+	return []byte(builder.String())
+}
@@ -0,0 +1,254 @@
+package filtering
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+)
+
+func TestTCPProxy(t *testing.T) {
+	body := strings.Repeat("Bonsoir, Elliot!\n", 64)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+
+	// newProxy creates an origin and a proxy forwarding to it
+	newProxy := func(useTLS bool, action TCPProxyAction, throttleRate int) (
+		*TCPProxy, *httptest.Server) {
+		origin := httptest.NewUnstartedServer(handler)
+		if useTLS {
+			origin.StartTLS()
+		} else {
+			origin.Start()
+		}
+		proxy := NewTCPProxy(&TCPProxyConfig{
+			Origin: origin.Listener.Addr().String(),
+			Rules: map[string]TCPProxyAction{
+				"example.com": action,
+			},
+			ThrottleRate: throttleRate,
+		})
+		return proxy, origin
+	}
+
+	// get fetches a webpage using the proxy and the given host
+	get := func(proxy *TCPProxy, origin *httptest.Server, scheme, host string) (*http.Response, error) {
+		txp := origin.Client().Transport.(*http.Transport).Clone()
+		txp.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, proxy.Endpoint())
+		}
+		txp.TLSClientConfig.ServerName = host
+		clnt := &http.Client{Transport: txp, Timeout: 2 * time.Second}
+		defer clnt.CloseIdleConnections()
+		resp, err := clnt.Get(scheme + "://" + host + "/")
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(strings.NewReader(string(data)))
+		return resp, nil
+	}
+
+	expectBody := func(t *testing.T, resp *http.Response, status int, expect string) {
+		if resp.StatusCode != status {
+			t.Fatal("unexpected status code", resp.StatusCode)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if string(data) != expect {
+			t.Fatal("unexpected body", string(data))
+		}
+	}
+
+	for _, scheme := range []string{"http", "https"} {
+		t.Run(scheme, func(t *testing.T) {
+			useTLS := scheme == "https"
+
+			t.Run("TCPProxyActionPass", func(t *testing.T) {
+				proxy, origin := newProxy(useTLS, TCPProxyActionPass, 0)
+				defer origin.Close()
+				defer proxy.Close()
+				resp, err := get(proxy, origin, scheme, "example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectBody(t, resp, 200, body)
+			})
+
+			t.Run("without a matching rule", func(t *testing.T) {
+				proxy, origin := newProxy(useTLS, TCPProxyActionReset, 0)
+				defer origin.Close()
+				defer proxy.Close()
+				resp, err := get(proxy, origin, scheme, "127.0.0.1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectBody(t, resp, 200, body)
+			})
+
+			t.Run("TCPProxyActionReset", func(t *testing.T) {
+				proxy, origin := newProxy(useTLS, TCPProxyActionReset, 0)
+				defer origin.Close()
+				defer proxy.Close()
+				resp, err := get(proxy, origin, scheme, "example.com")
+				if err == nil || !strings.HasSuffix(err.Error(), "connection reset by peer") {
+					t.Fatal("unexpected err", err)
+				}
+				if resp != nil {
+					t.Fatal("expected nil resp")
+				}
+			})
+
+			t.Run("TCPProxyActionDrop", func(t *testing.T) {
+				proxy, origin := newProxy(useTLS, TCPProxyActionDrop, 0)
+				defer origin.Close()
+				defer proxy.Close()
+				resp, err := get(proxy, origin, scheme, "example.com")
+				if err == nil || !strings.Contains(err.Error(), "Client.Timeout exceeded") {
+					t.Fatal("unexpected err", err)
+				}
+				if resp != nil {
+					t.Fatal("expected nil resp")
+				}
+			})
+
+			t.Run("TCPProxyActionThrottle", func(t *testing.T) {
+				// the body is ~1 KiB, hence it should take ~one second
+				rate := 0 // use the default
+				if useTLS {
+					// the TLS handshake is ~2 KiB so be more generous
+					rate = 8 * TCPProxyDefaultThrottleRate
+				}
+				proxy, origin := newProxy(useTLS, TCPProxyActionThrottle, rate)
+				defer origin.Close()
+				defer proxy.Close()
+				t0 := time.Now()
+				resp, err := get(proxy, origin, scheme, "example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectBody(t, resp, 200, body)
+				if elapsed := time.Since(t0); elapsed < 200*time.Millisecond {
+					t.Fatal("not throttled", elapsed)
+				}
+			})
+		})
+	}
+
+	t.Run("TCPProxyActionBlockPage", func(t *testing.T) {
+		t.Run("with HTTP", func(t *testing.T) {
+			proxy, origin := newProxy(false, TCPProxyActionBlockPage, 0)
+			defer origin.Close()
+			defer proxy.Close()
+			resp, err := get(proxy, origin, "http", "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectBody(t, resp, 451, string(HTTPBlockpage451))
+		})
+
+		t.Run("with HTTPS", func(t *testing.T) {
+			proxy, origin := newProxy(true, TCPProxyActionBlockPage, 0)
+			defer origin.Close()
+			defer proxy.Close()
+			resp, err := get(proxy, origin, "https", "example.com")
+			if err == nil || !strings.HasSuffix(err.Error(), "server gave HTTP response to HTTPS client") {
+				t.Fatal("unexpected err", err)
+			}
+			if resp != nil {
+				t.Fatal("expected nil resp")
+			}
+		})
+	})
+
+	t.Run("with Origins", func(t *testing.T) {
+		proxy, origin := newProxy(false, TCPProxyActionPass, 0)
+		defer origin.Close()
+		defer proxy.Close()
+		server := NewHTTPServerCleartext(HTTPAction451)
+		defer server.Close()
+		proxy.config.Origins = map[string]string{"example.org": server.URL().Host}
+		resp, err := get(proxy, origin, "http", "example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectBody(t, resp, 451, string(HTTPBlockpage451))
+		resp, err = get(proxy, origin, "http", "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectBody(t, resp, 200, body)
+	})
+
+	t.Run("with netxlite and a reset after the ClientHello", func(t *testing.T) {
+		proxy, origin := newProxy(true, TCPProxyActionReset, 0)
+		defer origin.Close()
+		defer proxy.Close()
+		dialer := netxlite.NewDialerWithoutResolver(model.DiscardLogger)
+		conn, err := dialer.DialContext(context.Background(), "tcp", proxy.Endpoint())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		handshaker := netxlite.NewTLSHandshakerStdlib(model.DiscardLogger)
+		config := &tls.Config{ServerName: "example.com", NextProtos: []string{"http/1.1"}}
+		tlsConn, _, err := handshaker.Handshake(context.Background(), conn, config)
+		if err == nil || err.Error() != netxlite.FailureConnectionReset {
+			t.Fatal("unexpected err", err)
+		}
+		if tlsConn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("Close closes the conns", func(t *testing.T) {
+		proxy, origin := newProxy(false, TCPProxyActionDrop, 0)
+		defer origin.Close()
+		conn, err := net.Dial("tcp", proxy.Endpoint())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond) // give the proxy time to read the request
+		proxy.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := bufio.NewReader(conn).ReadByte(); !errors.Is(err, io.EOF) {
+			t.Fatal("unexpected err", err)
+		}
+	})
+}
+
+func Test_tcpProxyServerName(t *testing.T) {
+	t.Run("with an HTTP request", func(t *testing.T) {
+		name := tcpProxyServerName([]byte("GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n"))
+		if name != "example.com" {
+			t.Fatal("unexpected name", name)
+		}
+	})
+
+	t.Run("with garbage", func(t *testing.T) {
+		if name := tcpProxyServerName([]byte("\x17\x03\x03")); name != "" {
+			t.Fatal("unexpected name", name)
+		}
+		if name := tcpProxyServerName([]byte("\x16\x03\x01\x00\x02\x01\x00")); name != "" {
+			t.Fatal("unexpected name", name)
+		}
+	})
+}
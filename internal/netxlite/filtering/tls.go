@@ -2,10 +2,18 @@ package filtering
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"errors"
+	"io"
+	"math/big"
 	"net"
 	"time"
 
@@ -37,8 +45,32 @@ const (
 	// TLSActionBlockText returns a static piece of text
 	// to the client saying this website is blocked.
 	TLSActionBlockText = TLSAction("block-text")
+
+	// TLSActionSelfSigned completes the handshake using a
+	// self-signed certificate for the requested SNI.
+	TLSActionSelfSigned = TLSAction("self-signed")
+
+	// TLSActionExpired completes the handshake using an expired
+	// certificate for the requested SNI signed by our CA.
+	TLSActionExpired = TLSAction("expired")
+
+	// TLSActionWrongHost completes the handshake using a certificate
+	// signed by our CA for TLSWrongHostName rather than the SNI.
+	TLSActionWrongHost = TLSAction("wrong-host")
+
+	// TLSActionMITM completes the handshake using a certificate for
+	// the requested SNI signed by our CA and then reads and discards
+	// the data sent by the client until the client closes the conn.
+	TLSActionMITM = TLSAction("mitm")
+
+	// TLSActionStallAfterServerHello sends the ServerHello and then
+	// stalls until the client gives up or we close the server.
+	TLSActionStallAfterServerHello = TLSAction("stall-after-server-hello")
 )
 
+// TLSWrongHostName is the name used by TLSActionWrongHost.
+const TLSWrongHostName = "wrong.host.example"
+
 // TLSServer is a TLS server implementing filtering policies.
 type TLSServer struct {
 	// action is the action to perform.
@@ -140,6 +172,9 @@ const (
 
 func (p *TLSServer) handle(ctx context.Context, tcpConn net.Conn) {
 	defer tcpConn.Close()
+	if p.action == TLSActionStallAfterServerHello {
+		tcpConn = &tlsStallingConn{Conn: tcpConn, ctx: ctx}
+	}
 	tlsConn := tls.Server(tcpConn, &tls.Config{
 		GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			switch p.action {
@@ -155,8 +190,14 @@ func (p *TLSServer) handle(ctx context.Context, tcpConn net.Conn) {
 			case TLSActionEOF:
 				p.eof(tcpConn)
 				return nil, errors.New("already closed the connection")
-			case TLSActionBlockText:
+			case TLSActionBlockText, TLSActionMITM, TLSActionStallAfterServerHello:
 				return p.config.TLSForHost(info.ServerName).GetCertificate(info)
+			case TLSActionSelfSigned:
+				return p.forgeCertificate(info.ServerName, time.Now(), true)
+			case TLSActionExpired:
+				return p.forgeCertificate(info.ServerName, time.Now().Add(-48*time.Hour), false)
+			case TLSActionWrongHost:
+				return p.forgeCertificate(TLSWrongHostName, time.Now(), false)
 			default:
 				p.reset(tcpConn)
 				return nil, errors.New("already RST the connection")
@@ -166,10 +207,81 @@ func (p *TLSServer) handle(ctx context.Context, tcpConn net.Conn) {
 	if err := tlsConn.Handshake(); err != nil {
 		return
 	}
-	p.blockText(tlsConn)
+	switch p.action {
+	case TLSActionMITM:
+		io.Copy(io.Discard, tlsConn)
+	default:
+		p.blockText(tlsConn)
+	}
 	tlsConn.Close()
 }
 
+// forgeCertificate creates a certificate for the given name, valid for one day
+// starting from notBefore, which is either self-signed or signed by our CA.
+func (p *TLSServer) forgeCertificate(
+	name string, notBefore time.Time, selfSigned bool) (*tls.Certificate, error) {
+	if name == "" {
+		name = "localhost" // the client did not send any SNI
+	}
+	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"OONI"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	parent, signer := p.cert, crypto.Signer(p.privkey)
+	if selfSigned {
+		parent, signer = template, privkey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, privkey.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: privkey}, nil
+}
+
+// tlsStallingConn is the conn used by TLSActionStallAfterServerHello.
+type tlsStallingConn struct {
+	net.Conn
+	ctx     context.Context
+	stalled bool
+}
+
+// Write implements net.Conn.Write. We only forward the first TLS record, which
+// contains the ServerHello, and then we stall until the context is done.
+func (c *tlsStallingConn) Write(b []byte) (int, error) {
+	if !c.stalled && len(b) >= 5 {
+		c.stalled = true
+		size := 5 + int(binary.BigEndian.Uint16(b[3:5]))
+		if size > len(b) {
+			size = len(b)
+		}
+		if _, err := c.Conn.Write(b[:size]); err != nil {
+			return 0, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, 300*time.Second)
+	defer cancel()
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
 func (p *TLSServer) timeout(ctx context.Context, tcpConn net.Conn) error {
 	ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
 	defer cancel()
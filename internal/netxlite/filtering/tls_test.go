@@ -6,10 +6,12 @@ import (
 	"crypto/tls"
 	"errors"
 	"io"
+	"net"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/bassosimone/oonidsl/internal/model"
 	"github.com/bassosimone/oonidsl/internal/netxlite"
 )
 
@@ -144,3 +146,205 @@ func TestTLSServer(t *testing.T) {
 		})
 	})
 }
+
+func TestTLSServerForgedCertificates(t *testing.T) {
+	// handshake handshakes with the server like we do when measuring
+	handshake := func(ctx context.Context, srv *TLSServer, config *tls.Config) (net.Conn, error) {
+		dialer := netxlite.NewDialerWithoutResolver(model.DiscardLogger)
+		conn, err := dialer.DialContext(ctx, "tcp", srv.Endpoint())
+		if err != nil {
+			return nil, err
+		}
+		handshaker := netxlite.NewTLSHandshakerStdlib(model.DiscardLogger)
+		tlsConn, _, err := handshaker.Handshake(ctx, conn, config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	expectFailure := []struct {
+		action  TLSAction
+		failure string
+	}{{
+		action:  TLSActionSelfSigned,
+		failure: netxlite.FailureSSLUnknownAuthority,
+	}, {
+		action:  TLSActionExpired,
+		failure: netxlite.FailureSSLInvalidCertificate,
+	}, {
+		action:  TLSActionWrongHost,
+		failure: netxlite.FailureSSLInvalidHostname,
+	}}
+	for _, entry := range expectFailure {
+		t.Run(string(entry.action), func(t *testing.T) {
+			srv := NewTLSServer(entry.action)
+			defer srv.Close()
+			config := &tls.Config{ServerName: "dns.google", RootCAs: srv.CertPool()}
+			conn, err := handshake(context.Background(), srv, config)
+			if err == nil || err.Error() != entry.failure {
+				t.Fatal("unexpected err", err)
+			}
+			if conn != nil {
+				t.Fatal("expected nil conn")
+			}
+		})
+	}
+
+	t.Run("the certificates are otherwise valid", func(t *testing.T) {
+		for _, action := range []TLSAction{TLSActionSelfSigned, TLSActionExpired, TLSActionWrongHost} {
+			srv := NewTLSServer(action)
+			config := &tls.Config{ServerName: "dns.google", InsecureSkipVerify: true}
+			conn, err := handshake(context.Background(), srv, config)
+			if err != nil {
+				t.Fatal(action, err)
+			}
+			conn.Close()
+			srv.Close()
+		}
+	})
+
+	t.Run(string(TLSActionMITM), func(t *testing.T) {
+		t.Run("with our CA", func(t *testing.T) {
+			srv := NewTLSServer(TLSActionMITM)
+			defer srv.Close()
+			config := &tls.Config{ServerName: "dns.google", RootCAs: srv.CertPool()}
+			conn, err := handshake(context.Background(), srv, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			cert := conn.(netxlite.TLSConn).ConnectionState().PeerCertificates[0]
+			if cert.VerifyHostname("dns.google") != nil {
+				t.Fatal("the certificate is not valid for the SNI")
+			}
+		})
+
+		t.Run("with the default CA", func(t *testing.T) {
+			srv := NewTLSServer(TLSActionMITM)
+			defer srv.Close()
+			config := &tls.Config{ServerName: "dns.google", RootCAs: netxlite.NewDefaultCertPool()}
+			conn, err := handshake(context.Background(), srv, config)
+			if err == nil || err.Error() != netxlite.FailureSSLUnknownAuthority {
+				t.Fatal("unexpected err", err)
+			}
+			if conn != nil {
+				t.Fatal("expected nil conn")
+			}
+		})
+	})
+
+	t.Run(string(TLSActionStallAfterServerHello), func(t *testing.T) {
+		srv := NewTLSServer(TLSActionStallAfterServerHello)
+		defer srv.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+		config := &tls.Config{ServerName: "dns.google", RootCAs: srv.CertPool()}
+		conn, err := handshake(ctx, srv, config)
+		if err == nil || err.Error() != netxlite.FailureGenericTimeoutError {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("without SNI", func(t *testing.T) {
+		srv := NewTLSServer(TLSActionExpired)
+		defer srv.Close()
+		config := &tls.Config{InsecureSkipVerify: true}
+		conn, err := handshake(context.Background(), srv, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		cert := conn.(netxlite.TLSConn).ConnectionState().PeerCertificates[0]
+		if cert.Subject.CommonName != "localhost" {
+			t.Fatal("unexpected common name", cert.Subject.CommonName)
+		}
+	})
+}
+
+func TestTLSServerInterceptionDetection(t *testing.T) {
+	// handshake handshakes with the server without verifying the certificates
+	// like we do when measuring, and returns the connection state.
+	handshake := func(t *testing.T, srv *TLSServer, config *tls.Config) tls.ConnectionState {
+		conn, err := tls.Dial("tcp", srv.Endpoint(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState()
+	}
+
+	t.Run("we detect a forged chain", func(t *testing.T) {
+		srv := NewTLSServer(TLSActionBlockText)
+		defer srv.Close()
+		// the genuine certificate is the one issued by another CA
+		genuineCA, _, _ := tlsConfigMITM()
+		store := netxlite.NewTLSExpectedCertStore()
+		store.AddSPKIPin("dns.google", netxlite.CertSPKIPin(genuineCA))
+		state := handshake(t, srv, &tls.Config{ServerName: "dns.google", InsecureSkipVerify: true})
+		evidence := store.Check("dns.google", state)
+		if !evidence.Known || !evidence.Intercepted {
+			t.Fatalf("expected interception %+v", evidence)
+		}
+		if !strings.Contains(evidence.Issuer, "jafar") {
+			t.Fatal("unexpected issuer", evidence.Issuer)
+		}
+		if evidence.LeafFingerprint != netxlite.TLSCertFingerprint(state.PeerCertificates[0]) {
+			t.Fatal("unexpected leaf fingerprint")
+		}
+	})
+
+	t.Run("we identify the issuing CA when we verify the chain", func(t *testing.T) {
+		srv := NewTLSServer(TLSActionBlockText)
+		defer srv.Close()
+		store := netxlite.NewTLSExpectedCertStore()
+		store.AddLeafFingerprint("dns.google", strings.Repeat("00", 32))
+		state := handshake(t, srv, &tls.Config{ServerName: "dns.google", RootCAs: srv.CertPool()})
+		evidence := store.Check("dns.google", state)
+		if !evidence.Intercepted {
+			t.Fatal("expected interception")
+		}
+		if evidence.IssuingCA == nil || evidence.IssuingCA.SPKIPin != netxlite.CertSPKIPin(srv.cert) {
+			t.Fatalf("unexpected issuing CA %+v", evidence.IssuingCA)
+		}
+	})
+
+	t.Run("we do not flag the expected chain", func(t *testing.T) {
+		srv := NewTLSServer(TLSActionBlockText)
+		defer srv.Close()
+		store := netxlite.NewTLSExpectedCertStore()
+		store.AddSPKIPin("DNS.google.", netxlite.CertSPKIPin(srv.cert))
+		state := handshake(t, srv, &tls.Config{ServerName: "dns.google", RootCAs: srv.CertPool()})
+		evidence := store.Check("dns.google", state)
+		if !evidence.Known || evidence.Intercepted || !evidence.MatchedSPKIPin {
+			t.Fatalf("unexpected evidence %+v", evidence)
+		}
+	})
+
+	t.Run("we match the leaf fingerprint", func(t *testing.T) {
+		srv := NewTLSServer(TLSActionBlockText)
+		defer srv.Close()
+		config := &tls.Config{ServerName: "dns.google", InsecureSkipVerify: true}
+		store := netxlite.NewTLSExpectedCertStore()
+		store.AddCertificate("dns.google", handshake(t, srv, config).PeerCertificates[0])
+		evidence := store.Check("dns.google", handshake(t, srv, config))
+		if evidence.Intercepted || !evidence.MatchedFingerprint {
+			t.Fatalf("unexpected evidence %+v", evidence)
+		}
+	})
+
+	t.Run("we cannot say anything for unknown domains", func(t *testing.T) {
+		srv := NewTLSServer(TLSActionBlockText)
+		defer srv.Close()
+		store := netxlite.NewTLSExpectedCertStore()
+		state := handshake(t, srv, &tls.Config{ServerName: "dns.google", InsecureSkipVerify: true})
+		evidence := store.Check("dns.google", state)
+		if evidence.Known || evidence.Intercepted {
+			t.Fatalf("unexpected evidence %+v", evidence)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package netxlite
+
+//
+// Happy eyeballs (RFC 8305) dialing
+//
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+)
+
+// HappyEyeballsDefaultDelay is the default delay between starting two
+// consecutive connect attempts, i.e., the "Connection Attempt Delay"
+// recommended by RFC 8305 Section 8.
+const HappyEyeballsDefaultDelay = 250 * time.Millisecond
+
+// NewDialerWithResolverHappyEyeballs is like NewDialerWithResolver except that
+// the returned dialer uses happy eyeballs (RFC 8305) to connect, i.e., it starts
+// staggered, parallel connect attempts alternating IPv4 and IPv6 addresses.
+//
+// The delay argument is the time to wait before starting the next connect
+// attempt when the previous one has not completed yet. If delay is zero or
+// negative, we use HappyEyeballsDefaultDelay.
+//
+// Each connect attempt is traced using model.Trace.OnConnectDone. Attempts we
+// interrupt because another attempt succeeded are traced as well, typically
+// with the FailureInterrupted failure.
+//
+// You should use this dialer to communicate with the OONI backend or with
+// test helpers, where what matters is to connect quickly. When measuring,
+// you should instead use dialers that try each address sequentially, or
+// even better connect to each IP address explicitly.
+func NewDialerWithResolverHappyEyeballs(dl model.DebugLogger, r model.Resolver,
+	delay time.Duration, w ...model.DialerWrapper) model.Dialer {
+	if delay <= 0 {
+		delay = HappyEyeballsDefaultDelay
+	}
+	return wrapDialer(dl, r, &DialerSystem{}, delay, w...)
+}
+
+// happyEyeballsResult is the result of a single happy eyeballs connect attempt.
+type happyEyeballsResult struct {
+	// idx is the index of the address we used.
+	idx int
+
+	// conn is the conn (nil on failure).
+	conn net.Conn
+
+	// err is the error (nil on success).
+	err error
+}
+
+// dialHappyEyeballs implements happy eyeballs given the already sorted addrs.
+func (d *dialerResolverWithTracing) dialHappyEyeballs(ctx context.Context,
+	network, onlyhost, onlyport string, addrs []string) (net.Conn, error) {
+	addrs = happyEyeballsInterleave(addrs)
+	if len(addrs) <= 0 {
+		return nil, quirkReduceErrors(nil)
+	}
+	trace := ContextTraceOrDefault(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Note: the channel is buffered such that the background goroutines
+	// do not block when we have already returned to the caller.
+	results := make(chan *happyEyeballsResult, len(addrs))
+	errorslist := make([]error, len(addrs))
+	var (
+		next    int
+		pending int
+		timer   *time.Timer
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	// startNext starts the next connect attempt and rearms the timer.
+	startNext := func() {
+		idx := next
+		next++
+		pending++
+		target := net.JoinHostPort(addrs[idx], onlyport)
+		go func() {
+			conn, err := d.dialAddress(ctx, trace, network, onlyhost, target)
+			results <- &happyEyeballsResult{idx: idx, conn: conn, err: err}
+		}()
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		if next < len(addrs) {
+			timer = time.NewTimer(d.happyEyeballsDelay)
+		}
+	}
+
+	startNext()
+	for pending > 0 {
+		var timeout <-chan time.Time
+		if timer != nil {
+			timeout = timer.C
+		}
+		select {
+		case <-timeout:
+			timer = nil // we have drained the channel
+			startNext()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go happyEyeballsCloseLateConns(results, pending)
+				return r.conn, nil
+			}
+			errorslist[r.idx] = r.err
+			if next < len(addrs) {
+				startNext() // don't wait for the timer, as RFC 8305 suggests
+			}
+		}
+	}
+
+	// QUIRK: we reduce the errors in the order in which we attempted
+	// to connect such that we can still apply quirkReduceErrors.
+	return nil, quirkReduceErrors(errorslist)
+}
+
+// happyEyeballsCloseLateConns waits for the remaining attempts to terminate
+// and closes the connections established after we chose a winner.
+func happyEyeballsCloseLateConns(results <-chan *happyEyeballsResult, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+// happyEyeballsInterleave takes in input addresses sorted by quirkSortIPAddrs
+// and returns in output addresses where IPv4 and IPv6 alternate.
+//
+// RFC 8305 Section 4 suggests to start with IPv6. We start with IPv4 instead
+// because that is consistent with quirkSortIPAddrs and because we mainly use
+// happy eyeballs to connect quickly on networks with broken IPv6.
+func happyEyeballsInterleave(addrs []string) (out []string) {
+	var v4, v6 []string
+	for _, addr := range addrs {
+		if isIPv6(addr) {
+			v6 = append(v6, addr)
+			continue
+		}
+		v4 = append(v4, addr)
+	}
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v4) > 0 {
+			out = append(out, v4[0])
+			v4 = v4[1:]
+		}
+		if len(v6) > 0 {
+			out = append(out, v6[0])
+			v6 = v6[1:]
+		}
+	}
+	return
+}
@@ -0,0 +1,278 @@
+package netxlite
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/bassosimone/oonidsl/internal/model/mocks"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewDialerWithResolverHappyEyeballs(t *testing.T) {
+	t.Run("produces a chain with the expected types", func(t *testing.T) {
+		d := NewDialerWithResolverHappyEyeballs(log.Log, &NullResolver{}, time.Second)
+		logger := d.(*dialerLogger)
+		if logger.DebugLogger != log.Log {
+			t.Fatal("invalid logger")
+		}
+		reso := logger.Dialer.(*dialerResolverWithTracing)
+		if _, okay := reso.Resolver.(*NullResolver); !okay {
+			t.Fatal("invalid Resolver type")
+		}
+		if reso.happyEyeballsDelay != time.Second {
+			t.Fatal("invalid happyEyeballsDelay")
+		}
+		logger = reso.Dialer.(*dialerLogger)
+		errWrapper := logger.Dialer.(*dialerErrWrapper)
+		_ = errWrapper.Dialer.(*DialerSystem)
+	})
+
+	t.Run("uses the default delay if the delay is zero", func(t *testing.T) {
+		d := NewDialerWithResolverHappyEyeballs(log.Log, &NullResolver{}, 0)
+		reso := d.(*dialerLogger).Dialer.(*dialerResolverWithTracing)
+		if reso.happyEyeballsDelay != HappyEyeballsDefaultDelay {
+			t.Fatal("invalid happyEyeballsDelay")
+		}
+	})
+}
+
+func TestDialerResolverWithTracingHappyEyeballs(t *testing.T) {
+	newResolver := func(addrs ...string) *mocks.Resolver {
+		return &mocks.Resolver{
+			MockLookupHost: func(ctx context.Context, domain string) ([]string, error) {
+				return addrs, nil
+			},
+		}
+	}
+
+	t.Run("returns the first successful conn", func(t *testing.T) {
+		expectedConn := &mocks.Conn{}
+		d := &dialerResolverWithTracing{
+			Dialer: &mocks.Dialer{
+				MockDialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+					return expectedConn, nil
+				},
+			},
+			Resolver:           newResolver("1.1.1.1", "8.8.8.8"),
+			happyEyeballsDelay: time.Hour, // we should not start the second attempt
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", "dot.dns:853")
+		if err != nil {
+			t.Fatal(err)
+		}
+		errWrapperConn := conn.(*dialerErrWrapperConn)
+		if errWrapperConn.Conn != expectedConn {
+			t.Fatal("unexpected conn")
+		}
+	})
+
+	t.Run("starts the next attempt after the delay", func(t *testing.T) {
+		expectedConn := &mocks.Conn{}
+		d := &dialerResolverWithTracing{
+			Dialer: &mocks.Dialer{
+				MockDialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+					if address == "8.8.8.8:853" {
+						<-ctx.Done() // simulate an attempt that is stuck
+						return nil, ctx.Err()
+					}
+					return expectedConn, nil
+				},
+			},
+			Resolver:           newResolver("8.8.8.8", "2001:4860:4860::8888"),
+			happyEyeballsDelay: 10 * time.Millisecond,
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", "dot.dns:853")
+		if err != nil {
+			t.Fatal(err)
+		}
+		errWrapperConn := conn.(*dialerErrWrapperConn)
+		if errWrapperConn.Conn != expectedConn {
+			t.Fatal("unexpected conn")
+		}
+	})
+
+	t.Run("starts the next attempt immediately on failure", func(t *testing.T) {
+		expectedConn := &mocks.Conn{}
+		d := &dialerResolverWithTracing{
+			Dialer: &mocks.Dialer{
+				MockDialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+					if address == "8.8.8.8:853" {
+						return nil, io.EOF
+					}
+					return expectedConn, nil
+				},
+			},
+			Resolver:           newResolver("8.8.8.8", "2001:4860:4860::8888"),
+			happyEyeballsDelay: time.Hour, // we would block if we waited for the timer
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", "dot.dns:853")
+		if err != nil {
+			t.Fatal(err)
+		}
+		errWrapperConn := conn.(*dialerErrWrapperConn)
+		if errWrapperConn.Conn != expectedConn {
+			t.Fatal("unexpected conn")
+		}
+	})
+
+	t.Run("closes connections established after the winner", func(t *testing.T) {
+		closed := make(chan bool)
+		winnerConn := &mocks.Conn{}
+		lateConn := &mocks.Conn{
+			MockClose: func() error {
+				close(closed)
+				return nil
+			},
+		}
+		proceed := make(chan bool)
+		d := &dialerResolverWithTracing{
+			Dialer: &mocks.Dialer{
+				MockDialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+					if address == "8.8.8.8:853" {
+						<-proceed // wait for the winner to be chosen
+						return lateConn, nil
+					}
+					return winnerConn, nil
+				},
+			},
+			Resolver:           newResolver("8.8.8.8", "2001:4860:4860::8888"),
+			happyEyeballsDelay: time.Millisecond,
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", "dot.dns:853")
+		if err != nil {
+			t.Fatal(err)
+		}
+		errWrapperConn := conn.(*dialerErrWrapperConn)
+		if errWrapperConn.Conn != winnerConn {
+			t.Fatal("unexpected conn")
+		}
+		close(proceed)
+		<-closed // we would block here if the late conn was not closed
+	})
+
+	t.Run("reduces errors when all attempts fail", func(t *testing.T) {
+		mu := &sync.Mutex{}
+		errorsList := map[string]error{
+			"8.8.8.8:853":                errors.New("a mocked error"),
+			"[2001:4860:4860::8888]:853": io.EOF,
+		}
+		d := &dialerResolverWithTracing{
+			Dialer: &mocks.Dialer{
+				MockDialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+					defer mu.Unlock()
+					mu.Lock()
+					return nil, errorsList[address]
+				},
+			},
+			Resolver:           newResolver("2001:4860:4860::8888", "8.8.8.8"),
+			happyEyeballsDelay: time.Millisecond,
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", "dot.dns:853")
+		if err == nil || err.Error() != FailureEOFError {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("traces each connect attempt", func(t *testing.T) {
+		mu := &sync.Mutex{}
+		var traced []string
+		tx := &mocks.Trace{
+			MockTimeNow: time.Now,
+			MockOnConnectDone: func(started time.Time, network, domain, remoteAddr string, err error, finished time.Time) {
+				defer mu.Unlock()
+				mu.Lock()
+				traced = append(traced, remoteAddr)
+			},
+			MockMaybeWrapNetConn: func(conn net.Conn) net.Conn {
+				return conn
+			},
+		}
+		ctx := ContextWithTrace(context.Background(), tx)
+		d := &dialerResolverWithTracing{
+			Dialer: &mocks.Dialer{
+				MockDialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+					return nil, io.EOF
+				},
+			},
+			Resolver:           newResolver("8.8.8.8", "2001:4860:4860::8888"),
+			happyEyeballsDelay: time.Hour,
+		}
+		conn, err := d.DialContext(ctx, "tcp", "dot.dns:853")
+		if !errors.Is(err, io.EOF) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+		expected := []string{"8.8.8.8:853", "[2001:4860:4860::8888]:853"}
+		mu.Lock()
+		diff := cmp.Diff(expected, traced)
+		mu.Unlock()
+		if diff != "" {
+			t.Fatal(diff)
+		}
+	})
+
+	t.Run("handles the case where there are no valid addresses", func(t *testing.T) {
+		d := &dialerResolverWithTracing{
+			Dialer:             &mocks.Dialer{},
+			Resolver:           newResolver("antani"),
+			happyEyeballsDelay: time.Millisecond,
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", "dot.dns:853")
+		if !errors.Is(err, errReduceErrorsEmptyList) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+}
+
+func TestHappyEyeballsInterleave(t *testing.T) {
+	type testcase struct {
+		name   string
+		input  []string
+		expect []string
+	}
+	cases := []testcase{{
+		name:   "with nil input",
+		input:  nil,
+		expect: nil,
+	}, {
+		name:   "with only IPv4 addresses",
+		input:  []string{"8.8.8.8", "8.8.4.4"},
+		expect: []string{"8.8.8.8", "8.8.4.4"},
+	}, {
+		name:   "with only IPv6 addresses",
+		input:  []string{"2001:4860:4860::8888", "2001:4860:4860::8844"},
+		expect: []string{"2001:4860:4860::8888", "2001:4860:4860::8844"},
+	}, {
+		name: "with mixed addresses",
+		input: []string{
+			"8.8.8.8", "8.8.4.4", "1.1.1.1",
+			"2001:4860:4860::8888", "2001:4860:4860::8844",
+		},
+		expect: []string{
+			"8.8.8.8", "2001:4860:4860::8888", "8.8.4.4",
+			"2001:4860:4860::8844", "1.1.1.1",
+		},
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := happyEyeballsInterleave(tc.input)
+			if diff := cmp.Diff(tc.expect, out); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
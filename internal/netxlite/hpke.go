@@ -0,0 +1,174 @@
+package netxlite
+
+//
+// Hybrid Public Key Encryption (HPKE)
+//
+// We implement the subset of RFC 9180 needed by ECH, i.e., the base mode
+// using the DHKEM(X25519, HKDF-SHA256) KEM to seal a single message.
+//
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/bassosimone/oonidsl/internal/runtimex"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE algorithm identifiers (see RFC 9180 Sect. 7).
+const (
+	hpkeKEMX25519HKDFSHA256  = 0x0020
+	hpkeKDFHKDFSHA256        = 0x0001
+	hpkeKDFHKDFSHA384        = 0x0002
+	hpkeKDFHKDFSHA512        = 0x0003
+	hpkeAEADAES128GCM        = 0x0001
+	hpkeAEADAES256GCM        = 0x0002
+	hpkeAEADChaCha20Poly1305 = 0x0003
+)
+
+// hpkeNonceLength is the nonce length of all the AEADs we support.
+const hpkeNonceLength = 12
+
+// errHPKEUnsupportedSuite indicates that we do not support an HPKE cipher suite.
+var errHPKEUnsupportedSuite = errors.New("hpke: unsupported cipher suite")
+
+// hpkeSupportedSuite returns whether we support the given cipher suite.
+func hpkeSupportedSuite(suite ECHCipherSuite) bool {
+	return hpkeKDFHash(suite.KDFID) != nil && hpkeAEADKeyLength(suite.AEADID) > 0
+}
+
+// hpkeKDFHash returns the hash used by the given KDF or nil.
+func hpkeKDFHash(id uint16) func() hash.Hash {
+	switch id {
+	case hpkeKDFHKDFSHA256:
+		return sha256.New
+	case hpkeKDFHKDFSHA384:
+		return sha512.New384
+	case hpkeKDFHKDFSHA512:
+		return sha512.New
+	default:
+		return nil
+	}
+}
+
+// hpkeAEADKeyLength returns the key length of the given AEAD or zero.
+func hpkeAEADKeyLength(id uint16) int {
+	switch id {
+	case hpkeAEADAES128GCM:
+		return 16
+	case hpkeAEADAES256GCM:
+		return 32
+	case hpkeAEADChaCha20Poly1305:
+		return chacha20poly1305.KeySize
+	default:
+		return 0
+	}
+}
+
+// hpkeNewAEAD creates the given AEAD using the given key.
+func hpkeNewAEAD(id uint16, key []byte) (cipher.AEAD, error) {
+	if id == hpkeAEADChaCha20Poly1305 {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hpkeContext is the encryption context resulting from the HPKE setup. Because ECH
+// only seals a single message per context, we only support the first sequence number.
+type hpkeContext struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+// seal encrypts and authenticates the plaintext using the given additional data.
+func (c *hpkeContext) seal(aad, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.nonce, plaintext, aad)
+}
+
+// hpkeSetupBaseSender implements SetupBaseS using DHKEM(X25519, HKDF-SHA256) and
+// returns the encapsulated key along with the context. We read the ephemeral
+// private key from the given reader, which should be crypto/rand.Reader.
+func hpkeSetupBaseSender(reader io.Reader, publicKey []byte,
+	suite ECHCipherSuite, info []byte) ([]byte, *hpkeContext, error) {
+	if !hpkeSupportedSuite(suite) {
+		return nil, nil, errHPKEUnsupportedSuite
+	}
+	privateKey := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(reader, privateKey); err != nil {
+		return nil, nil, err
+	}
+	enc, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := curve25519.X25519(privateKey, publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, err := hpkeKeySchedule(hpkeSharedSecret(dh, enc, publicKey), suite, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+// hpkeSharedSecret implements the ExtractAndExpand step of DHKEM(X25519, HKDF-SHA256).
+func hpkeSharedSecret(dh, enc, publicKey []byte) []byte {
+	suiteID := echAppendUint16([]byte("KEM"), hpkeKEMX25519HKDFSHA256)
+	kemContext := append(append([]byte{}, enc...), publicKey...)
+	prk := hpkeLabeledExtract(sha256.New, suiteID, nil, "eae_prk", dh)
+	return hpkeLabeledExpand(sha256.New, suiteID, prk, "shared_secret", kemContext, sha256.Size)
+}
+
+// hpkeKeySchedule implements the KeySchedule function for the base mode.
+func hpkeKeySchedule(sharedSecret []byte, suite ECHCipherSuite, info []byte) (*hpkeContext, error) {
+	suiteID := []byte("HPKE")
+	suiteID = echAppendUint16(suiteID, hpkeKEMX25519HKDFSHA256)
+	suiteID = echAppendUint16(suiteID, suite.KDFID)
+	suiteID = echAppendUint16(suiteID, suite.AEADID)
+	h := hpkeKDFHash(suite.KDFID)
+	context := []byte{0} // mode_base
+	context = append(context, hpkeLabeledExtract(h, suiteID, nil, "psk_id_hash", nil)...)
+	context = append(context, hpkeLabeledExtract(h, suiteID, nil, "info_hash", info)...)
+	secret := hpkeLabeledExtract(h, suiteID, sharedSecret, "secret", nil)
+	key := hpkeLabeledExpand(h, suiteID, secret, "key", context, hpkeAEADKeyLength(suite.AEADID))
+	aead, err := hpkeNewAEAD(suite.AEADID, key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := hpkeLabeledExpand(h, suiteID, secret, "base_nonce", context, hpkeNonceLength)
+	return &hpkeContext{aead: aead, nonce: nonce}, nil
+}
+
+// hpkeLabeledExtract implements the LabeledExtract function.
+func hpkeLabeledExtract(h func() hash.Hash, suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte("HPKE-v1"), suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(h, labeledIKM, salt)
+}
+
+// hpkeLabeledExpand implements the LabeledExpand function.
+func hpkeLabeledExpand(h func() hash.Hash,
+	suiteID, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := echAppendUint16(nil, uint16(length))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	out := make([]byte, length)
+	_, err := io.ReadFull(hkdf.Expand(h, prk, labeledInfo), out)
+	runtimex.PanicOnError(err, "hkdf.Expand failed") // only fails with very large lengths
+	return out
+}
@@ -0,0 +1,154 @@
+package netxlite
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// hpkeSetupBaseRecipient implements SetupBaseR using DHKEM(X25519, HKDF-SHA256).
+func hpkeSetupBaseRecipient(privateKey, enc []byte,
+	suite ECHCipherSuite, info []byte) (*hpkeContext, error) {
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := curve25519.X25519(privateKey, enc)
+	if err != nil {
+		return nil, err
+	}
+	return hpkeKeySchedule(hpkeSharedSecret(dh, enc, publicKey), suite, info)
+}
+
+// open decrypts and authenticates the ciphertext using the given additional data.
+func (c *hpkeContext) open(aad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nonce, ciphertext, aad)
+}
+
+// hpkeDeriveKeyPair implements DeriveKeyPair for DHKEM(X25519, HKDF-SHA256).
+func hpkeDeriveKeyPair(ikm []byte) []byte {
+	suiteID := echAppendUint16([]byte("KEM"), hpkeKEMX25519HKDFSHA256)
+	prk := hpkeLabeledExtract(sha256.New, suiteID, nil, "dkp_prk", ikm)
+	return hpkeLabeledExpand(sha256.New, suiteID, prk, "sk", nil, curve25519.ScalarSize)
+}
+
+// hpkeMustDecodeHex decodes an hex string or panics.
+func hpkeMustDecodeHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestHPKE(t *testing.T) {
+	// See RFC 9180 Appendix A.1.1.
+	t.Run("with the DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM test vector", func(t *testing.T) {
+		suite := ECHCipherSuite{KDFID: hpkeKDFHKDFSHA256, AEADID: hpkeAEADAES128GCM}
+		info := hpkeMustDecodeHex("4f6465206f6e2061204772656369616e2055726e")
+		skE := hpkeDeriveKeyPair(hpkeMustDecodeHex(
+			"7268600d403fce431561aef583ee1613527cff655c1343f29812e66706df3234"))
+		skR := hpkeDeriveKeyPair(hpkeMustDecodeHex(
+			"6db9df30aa07dd42ee5e8181afdb977e538f5e1fec8a06223f33f7013e525037"))
+		pkR, err := curve25519.X25519(skR, curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectPKR := hpkeMustDecodeHex("3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+		if !bytes.Equal(pkR, expectPKR) {
+			t.Fatal("unexpected pkR", hex.EncodeToString(pkR))
+		}
+		enc, sender, err := hpkeSetupBaseSender(bytes.NewReader(skE), pkR, suite, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectEnc := hpkeMustDecodeHex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+		if !bytes.Equal(enc, expectEnc) {
+			t.Fatal("unexpected enc", hex.EncodeToString(enc))
+		}
+		expectNonce := hpkeMustDecodeHex("56d890e5accaaf011cff4b7d")
+		if !bytes.Equal(sender.nonce, expectNonce) {
+			t.Fatal("unexpected nonce", hex.EncodeToString(sender.nonce))
+		}
+		aad := hpkeMustDecodeHex("436f756e742d30")
+		plaintext := hpkeMustDecodeHex("4265617574792069732074727574682c20747275746820626561757479")
+		ciphertext := sender.seal(aad, plaintext)
+		expectCiphertext := hpkeMustDecodeHex(
+			"f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a")
+		if !bytes.Equal(ciphertext, expectCiphertext) {
+			t.Fatal("unexpected ciphertext", hex.EncodeToString(ciphertext))
+		}
+		recipient, err := hpkeSetupBaseRecipient(skR, enc, suite, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := recipient.open(aad, ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatal("unexpected plaintext")
+		}
+	})
+
+	t.Run("with the other cipher suites", func(t *testing.T) {
+		skR := bytes.Repeat([]byte{0x22}, curve25519.ScalarSize)
+		pkR, err := curve25519.X25519(skR, curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		suites := []ECHCipherSuite{
+			{KDFID: hpkeKDFHKDFSHA384, AEADID: hpkeAEADAES256GCM},
+			{KDFID: hpkeKDFHKDFSHA512, AEADID: hpkeAEADChaCha20Poly1305},
+		}
+		for _, suite := range suites {
+			enc, sender, err := hpkeSetupBaseSender(bytes.NewReader(bytes.Repeat(
+				[]byte{0x33}, curve25519.ScalarSize)), pkR, suite, []byte("info"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ciphertext := sender.seal([]byte("aad"), []byte("plaintext"))
+			recipient, err := hpkeSetupBaseRecipient(skR, enc, suite, []byte("info"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := recipient.open([]byte("aad"), ciphertext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != "plaintext" {
+				t.Fatal("unexpected plaintext")
+			}
+		}
+	})
+
+	t.Run("with an unsupported cipher suite", func(t *testing.T) {
+		suite := ECHCipherSuite{KDFID: hpkeKDFHKDFSHA256, AEADID: 0xffff}
+		_, _, err := hpkeSetupBaseSender(bytes.NewReader(nil), nil, suite, nil)
+		if !errors.Is(err, errHPKEUnsupportedSuite) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("on failure to read the ephemeral key", func(t *testing.T) {
+		suite := ECHCipherSuite{KDFID: hpkeKDFHKDFSHA256, AEADID: hpkeAEADAES128GCM}
+		_, _, err := hpkeSetupBaseSender(bytes.NewReader(nil), nil, suite, nil)
+		if !errors.Is(err, io.EOF) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("with an invalid public key", func(t *testing.T) {
+		suite := ECHCipherSuite{KDFID: hpkeKDFHKDFSHA256, AEADID: hpkeAEADAES128GCM}
+		reader := bytes.NewReader(bytes.Repeat([]byte{0x33}, curve25519.ScalarSize))
+		_, _, err := hpkeSetupBaseSender(reader, make([]byte, curve25519.PointSize), suite, nil)
+		if err == nil {
+			t.Fatal("expected an error") // the all-zero point is a low-order point
+		}
+	})
+}
@@ -7,6 +7,7 @@ package netxlite
 import (
 	"context"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -26,7 +27,14 @@ var _ model.HTTPTransport = &httpTransportErrWrapper{}
 func (txp *httpTransportErrWrapper) RoundTrip(req *http.Request) (*http.Response, error) {
 	resp, err := txp.HTTPTransport.RoundTrip(req)
 	if err != nil {
-		return nil, NewTopLevelGenericErrWrapper(err)
+		return nil, NewErrWrapper(ClassifyHTTPStreamError, TopLevelOperation, err)
+	}
+	// Errors occurring mid-stream (e.g., HTTP/2 RST_STREAM) usually
+	// surface when reading the body, so we also wrap its errors. We do
+	// not wrap the body when it is also a writer (i.e., after 101
+	// Switching Protocols) because we would hide the Write method.
+	if _, writable := resp.Body.(io.Writer); resp.Body != nil && resp.Body != http.NoBody && !writable {
+		resp.Body = &httpBodyErrWrapper{resp.Body}
 	}
 	return resp, nil
 }
@@ -39,6 +47,20 @@ func (txp *httpTransportErrWrapper) Network() string {
 	return txp.HTTPTransport.Network()
 }
 
+// httpBodyErrWrapper is a response body with error wrapping.
+type httpBodyErrWrapper struct {
+	io.ReadCloser
+}
+
+// Read implements io.Reader.
+func (r *httpBodyErrWrapper) Read(b []byte) (int, error) {
+	count, err := r.ReadCloser.Read(b)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return count, NewErrWrapper(ClassifyHTTPStreamError, ReadOperation, err)
+	}
+	return count, err
+}
+
 // httpTransportLogger is an HTTPTransport with logging.
 type httpTransportLogger struct {
 	// HTTPTransport is the underlying HTTP transport.
@@ -169,6 +191,13 @@ func NewHTTPTransport(logger model.DebugLogger, dialer model.Dialer, tlsDialer m
 //
 // This factory uses github.com/ooni/oohttp, hence its name.
 func newOOHTTPBaseTransport(dialer model.Dialer, tlsDialer model.TLSDialer) model.HTTPTransport {
+	return newOOHTTPBaseTransportWithHTTP2(dialer, tlsDialer, true)
+}
+
+// newOOHTTPBaseTransportWithHTTP2 is like newOOHTTPBaseTransport but
+// allows to disable HTTP/2 by setting enableHTTP2 to false.
+func newOOHTTPBaseTransportWithHTTP2(
+	dialer model.Dialer, tlsDialer model.TLSDialer, enableHTTP2 bool) model.HTTPTransport {
 	// Using oohttp to support any TLS library.
 	txp := oohttp.DefaultTransport.(*oohttp.Transport).Clone()
 
@@ -195,7 +224,12 @@ func newOOHTTPBaseTransport(dialer model.Dialer, tlsDialer model.TLSDialer) mode
 
 	// Required to enable using HTTP/2 (which will be anyway forced
 	// upon us when we are using TLS parroting).
-	txp.ForceAttemptHTTP2 = true
+	txp.ForceAttemptHTTP2 = enableHTTP2
+
+	// A non-nil, empty TLSNextProto map disables HTTP/2.
+	if !enableHTTP2 {
+		txp.TLSNextProto = map[string]func(string, oohttp.TLSConn) oohttp.RoundTripper{}
+	}
 
 	// Ensure we correctly forward CloseIdleConnections.
 	return &httpTransportConnectionsCloser{
@@ -32,9 +32,15 @@ func (txp *http3Transport) Network() string {
 	return "udp"
 }
 
-// RoundTrip implements HTTPTransport.RoundTrip.
+// RoundTrip implements HTTPTransport.RoundTrip. We classify the errors
+// using ClassifyHTTPStreamError, so that QUIC errors occurring after the
+// handshake (e.g., stream resets) do not become unknown failures.
 func (txp *http3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	return txp.child.RoundTrip(req)
+	resp, err := txp.child.RoundTrip(req)
+	if err != nil {
+		return nil, NewErrWrapper(ClassifyHTTPStreamError, TopLevelOperation, err)
+	}
+	return resp, nil
 }
 
 // CloseIdleConnections implements HTTPTransport.CloseIdleConnections.
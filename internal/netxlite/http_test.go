@@ -2,10 +2,12 @@ package netxlite
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
@@ -120,6 +122,114 @@ func TestHTTPTransportErrWrapper(t *testing.T) {
 				t.Fatal("not the expected response")
 			}
 		})
+
+		t.Run("we wrap errors reading the body", func(t *testing.T) {
+			expected := errors.New("stream error: stream ID 1; INTERNAL_ERROR; received from peer")
+			txp := &httpTransportErrWrapper{
+				HTTPTransport: &mocks.HTTPTransport{
+					MockRoundTrip: func(req *http.Request) (*http.Response, error) {
+						body := io.NopCloser(io.MultiReader(
+							strings.NewReader("abc"),
+							&mocks.Conn{
+								MockRead: func(b []byte) (int, error) {
+									return 0, expected
+								},
+							},
+						))
+						return &http.Response{Body: body}, nil
+					},
+				},
+			}
+			resp, err := txp.RoundTrip(&http.Request{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(resp.Body)
+			if string(data) != "abc" {
+				t.Fatal("unexpected data", string(data))
+			}
+			var errWrapper *ErrWrapper
+			if !errors.As(err, &errWrapper) {
+				t.Fatal("the returned error is not an ErrWrapper")
+			}
+			if errWrapper.Failure != FailureHTTP2StreamReset || errWrapper.Operation != ReadOperation {
+				t.Fatal("unexpected error", errWrapper.Failure, errWrapper.Operation)
+			}
+		})
+
+		t.Run("we do not wrap io.EOF when reading the body", func(t *testing.T) {
+			txp := &httpTransportErrWrapper{
+				HTTPTransport: &mocks.HTTPTransport{
+					MockRoundTrip: func(req *http.Request) (*http.Response, error) {
+						return &http.Response{Body: io.NopCloser(strings.NewReader(""))}, nil
+					},
+				},
+			}
+			resp, err := txp.RoundTrip(&http.Request{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := resp.Body.Read(make([]byte, 4)); err != io.EOF {
+				t.Fatal("unexpected err", err)
+			}
+		})
+
+		t.Run("we do not wrap writable bodies", func(t *testing.T) {
+			body := &mocks.Conn{}
+			txp := &httpTransportErrWrapper{
+				HTTPTransport: &mocks.HTTPTransport{
+					MockRoundTrip: func(req *http.Request) (*http.Response, error) {
+						return &http.Response{Body: body}, nil
+					},
+				},
+			}
+			resp, err := txp.RoundTrip(&http.Request{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Body != body {
+				t.Fatal("we should not have wrapped the body")
+			}
+		})
+	})
+
+	t.Run("with an HTTP/2 server resetting the stream", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+			w.Write([]byte("abc"))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler) // causes RST_STREAM
+		}))
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+		defer srv.Close()
+		dialer := NewDialerWithoutResolver(model.DiscardLogger)
+		tlsConfig := &tls.Config{
+			RootCAs:    srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+			NextProtos: []string{"h2", "http/1.1"},
+		}
+		tlsDialer := NewTLSDialerWithConfig(dialer, NewTLSHandshakerStdlib(model.DiscardLogger), tlsConfig)
+		txp := NewHTTPTransport(model.DiscardLogger, dialer, tlsDialer)
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := txp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatal("expected HTTP/2", resp.Proto)
+		}
+		_, err = io.ReadAll(resp.Body)
+		var errWrapper *ErrWrapper
+		if !errors.As(err, &errWrapper) {
+			t.Fatal("the returned error is not an ErrWrapper", err)
+		}
+		if errWrapper.Failure != FailureHTTP2StreamReset {
+			t.Fatal("unexpected failure", errWrapper.Failure)
+		}
 	})
 }
 
@@ -0,0 +1,97 @@
+package netxlite
+
+//
+// HTTP/1.1-only and HTTP/2 cleartext (h2c) transports
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"golang.org/x/net/http2"
+)
+
+// NewHTTPTransportHTTP1Only is like NewHTTPTransport except that the returned
+// transport only speaks HTTP/1.1, even when the TLS dialer negotiates "h2" using
+// ALPN. Because of that, you SHOULD configure the TLS dialer to only offer the
+// "http/1.1" ALPN, otherwise the server may expect us to speak HTTP/2.
+func NewHTTPTransportHTTP1Only(
+	logger model.DebugLogger, dialer model.Dialer, tlsDialer model.TLSDialer) model.HTTPTransport {
+	return WrapHTTPTransport(logger, newOOHTTPBaseTransportWithHTTP2(dialer, tlsDialer, false))
+}
+
+// NewHTTPTransportH2C returns a wrapped HTTP transport that speaks HTTP/2 with
+// prior knowledge over the cleartext connections created using the given dialer
+// (i.e., h2c as defined by RFC7540 Sect. 3.4). You MUST use URLs with the
+// "http" scheme with this transport.
+//
+// Like the transport returned by NewHTTPTransport, the returned transport
+// disables transparent decompression and enforces a read timeout.
+func NewHTTPTransportH2C(logger model.DebugLogger, dialer model.Dialer) model.HTTPTransport {
+	// This wrapping ensures that we always have a timeout when we
+	// are using HTTP; see https://github.com/ooni/probe/issues/1609.
+	dialer = &httpDialerWithReadTimeout{dialer}
+	return WrapHTTPTransport(logger, &httpTransportH2C{
+		Transport: &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			DisableCompression: true,
+			AllowHTTP:          true,
+		},
+		Dialer: dialer,
+	})
+}
+
+// httpTransportH2C is the transport returned by NewHTTPTransportH2C.
+type httpTransportH2C struct {
+	Transport *http2.Transport
+	Dialer    model.Dialer
+}
+
+var _ model.HTTPTransport = &httpTransportH2C{}
+
+// RoundTrip implements HTTPTransport.RoundTrip.
+func (txp *httpTransportH2C) RoundTrip(req *http.Request) (*http.Response, error) {
+	return txp.Transport.RoundTrip(req)
+}
+
+// CloseIdleConnections implements HTTPTransport.CloseIdleConnections.
+func (txp *httpTransportH2C) CloseIdleConnections() {
+	txp.Transport.CloseIdleConnections()
+	txp.Dialer.CloseIdleConnections()
+}
+
+// Network implements HTTPTransport.Network.
+func (txp *httpTransportH2C) Network() string {
+	return "tcp"
+}
+
+// HTTPResponseProtocol returns the protocol we actually used to obtain
+// the given response, using the ALPN identifiers defined by IANA: "http/1.0",
+// "http/1.1", "h2", "h2c" (i.e., HTTP/2 over cleartext), and "h3". This function
+// returns an empty string when resp is nil or the protocol is unknown.
+func HTTPResponseProtocol(resp *http.Response) string {
+	if resp == nil {
+		return ""
+	}
+	switch resp.ProtoMajor {
+	case 1:
+		if resp.ProtoMinor == 0 {
+			return "http/1.0"
+		}
+		return "http/1.1"
+	case 2:
+		if resp.Request != nil && resp.Request.URL != nil && resp.Request.URL.Scheme == "http" {
+			return "h2c"
+		}
+		return "h2"
+	case 3:
+		return "h3"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,143 @@
+package netxlite
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestNewHTTPTransportHTTP1Only(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	dialer := NewDialerWithoutResolver(model.DiscardLogger)
+	tlsConfig := &tls.Config{
+		RootCAs:    srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+		NextProtos: []string{"http/1.1"},
+	}
+	tlsDialer := NewTLSDialerWithConfig(dialer, NewTLSHandshakerStdlib(model.DiscardLogger), tlsConfig)
+	txp := NewHTTPTransportHTTP1Only(model.DiscardLogger, dialer, tlsDialer)
+	defer txp.CloseIdleConnections()
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := txp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if proto := HTTPResponseProtocol(resp); proto != "http/1.1" {
+		t.Fatal("unexpected protocol", proto)
+	}
+}
+
+func TestNewHTTPTransportH2C(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+	srv := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer srv.Close()
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		txp := NewHTTPTransportH2C(model.DiscardLogger, NewDialerWithoutResolver(model.DiscardLogger))
+		defer txp.CloseIdleConnections()
+		if txp.Network() != "tcp" {
+			t.Fatal("unexpected network", txp.Network())
+		}
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := txp.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if proto := HTTPResponseProtocol(resp); proto != "h2c" {
+			t.Fatal("unexpected protocol", proto)
+		}
+	})
+
+	t.Run("with a server not speaking h2c", func(t *testing.T) {
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+		txp := NewHTTPTransportH2C(model.DiscardLogger, NewDialerWithoutResolver(model.DiscardLogger))
+		defer txp.CloseIdleConnections()
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := txp.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+			t.Fatal("expected an error")
+		}
+		if _, good := err.(*ErrWrapper); !good {
+			t.Fatal("expected an ErrWrapper", err)
+		}
+	})
+}
+
+func TestHTTPResponseProtocol(t *testing.T) {
+	newResponse := func(major, minor int, scheme string) *http.Response {
+		return &http.Response{
+			ProtoMajor: major,
+			ProtoMinor: minor,
+			Request:    &http.Request{URL: &url.URL{Scheme: scheme}},
+		}
+	}
+	var testcases = []struct {
+		name   string
+		resp   *http.Response
+		expect string
+	}{{
+		name:   "with a nil response",
+		resp:   nil,
+		expect: "",
+	}, {
+		name:   "with HTTP/1.0",
+		resp:   newResponse(1, 0, "http"),
+		expect: "http/1.0",
+	}, {
+		name:   "with HTTP/1.1",
+		resp:   newResponse(1, 1, "https"),
+		expect: "http/1.1",
+	}, {
+		name:   "with HTTP/2 over TLS",
+		resp:   newResponse(2, 0, "https"),
+		expect: "h2",
+	}, {
+		name:   "with HTTP/2 over cleartext",
+		resp:   newResponse(2, 0, "http"),
+		expect: "h2c",
+	}, {
+		name:   "with HTTP/2 and without a request",
+		resp:   &http.Response{ProtoMajor: 2},
+		expect: "h2",
+	}, {
+		name:   "with HTTP/3",
+		resp:   newResponse(3, 0, "https"),
+		expect: "h3",
+	}, {
+		name:   "with an unknown protocol",
+		resp:   newResponse(0, 9, "http"),
+		expect: "",
+	}}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := HTTPResponseProtocol(tc.resp); got != tc.expect {
+				t.Fatal("unexpected protocol", got)
+			}
+		})
+	}
+}
@@ -16,7 +16,6 @@ import (
 	"github.com/bassosimone/oonidsl/internal/model"
 	"github.com/bassosimone/oonidsl/internal/netxlite"
 	"github.com/bassosimone/oonidsl/internal/netxlite/filtering"
-	"github.com/bassosimone/oonidsl/internal/netxlite/quictesting"
 	"github.com/bassosimone/oonidsl/internal/randx"
 	"github.com/bassosimone/oonidsl/internal/runtimex"
 	utls "gitlab.com/yawning/utls.git"
@@ -118,7 +117,7 @@ func TestMeasureWithUDPResolver(t *testing.T) {
 
 	t.Run("for nxdomain", func(t *testing.T) {
 		proxy := &filtering.DNSServer{
-			OnQuery: func(domain string) filtering.DNSAction {
+			OnQuery: func(query *filtering.DNSQuery) filtering.DNSAction {
 				return filtering.DNSActionNXDOMAIN
 			},
 		}
@@ -142,7 +141,7 @@ func TestMeasureWithUDPResolver(t *testing.T) {
 
 	t.Run("for refused", func(t *testing.T) {
 		proxy := &filtering.DNSServer{
-			OnQuery: func(domain string) filtering.DNSAction {
+			OnQuery: func(query *filtering.DNSQuery) filtering.DNSAction {
 				return filtering.DNSActionRefused
 			},
 		}
@@ -166,7 +165,7 @@ func TestMeasureWithUDPResolver(t *testing.T) {
 
 	t.Run("for timeout", func(t *testing.T) {
 		proxy := &filtering.DNSServer{
-			OnQuery: func(domain string) filtering.DNSAction {
+			OnQuery: func(query *filtering.DNSQuery) filtering.DNSAction {
 				return filtering.DNSActionTimeout
 			},
 		}
@@ -410,10 +409,6 @@ func TestMeasureWithTLSHandshaker(t *testing.T) {
 }
 
 func TestMeasureWithQUICDialer(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skip test in short mode")
-	}
-
 	// TODO(bassosimone): here we're not testing the case in which
 	// the certificate is invalid for the required SNI.
 
@@ -426,16 +421,15 @@ func TestMeasureWithQUICDialer(t *testing.T) {
 	//
 
 	t.Run("on success", func(t *testing.T) {
+		srv := filtering.NewQUICServer(filtering.QUICActionPass)
+		defer srv.Close()
 		ql := netxlite.NewQUICListener()
 		d := netxlite.NewQUICDialerWithoutResolver(ql, log.Log)
 		defer d.CloseIdleConnections()
 		ctx := context.Background()
-		config := &tls.Config{
-			ServerName: quictesting.Domain,
-			NextProtos: []string{"h3"},
-			RootCAs:    netxlite.NewDefaultCertPool(),
-		}
-		sess, err := d.DialContext(ctx, quictesting.Endpoint("443"), config, &quic.Config{})
+		config := srv.TLSConfig()
+		config.ServerName = "dns.google"
+		sess, err := d.DialContext(ctx, srv.Endpoint(), config, &quic.Config{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -446,17 +440,16 @@ func TestMeasureWithQUICDialer(t *testing.T) {
 	})
 
 	t.Run("on timeout", func(t *testing.T) {
+		srv := filtering.NewQUICServer(filtering.QUICActionDrop)
+		defer srv.Close()
 		ql := netxlite.NewQUICListener()
 		d := netxlite.NewQUICDialerWithoutResolver(ql, log.Log)
 		defer d.CloseIdleConnections()
 		ctx := context.Background()
-		config := &tls.Config{
-			ServerName: quictesting.Domain,
-			NextProtos: []string{"h3"},
-			RootCAs:    netxlite.NewDefaultCertPool(),
-		}
-		// Here we assume <target-address>:1 is filtered
-		sess, err := d.DialContext(ctx, quictesting.Endpoint("1"), config, &quic.Config{})
+		config := srv.TLSConfig()
+		config.ServerName = "dns.google"
+		quicConfig := &quic.Config{HandshakeIdleTimeout: time.Second}
+		sess, err := d.DialContext(ctx, srv.Endpoint(), config, quicConfig)
 		if err == nil || err.Error() != netxlite.FailureGenericTimeoutError {
 			t.Fatal("not the error we expected", err)
 		}
@@ -515,19 +508,15 @@ func TestHTTPTransport(t *testing.T) {
 }
 
 func TestHTTP3Transport(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skip test in short mode")
-	}
-
 	t.Run("works as intended", func(t *testing.T) {
-		d := netxlite.NewQUICDialerWithResolver(
-			netxlite.NewQUICListener(),
-			log.Log,
-			netxlite.NewStdlibResolver(log.Log),
-		)
-		txp := netxlite.NewHTTP3Transport(log.Log, d, &tls.Config{})
+		srv := filtering.NewQUICServer(filtering.QUICActionPass)
+		defer srv.Close()
+		d := netxlite.NewQUICDialerWithoutResolver(netxlite.NewQUICListener(), log.Log)
+		config := srv.TLSConfig()
+		config.ServerName = "dns.google"
+		txp := netxlite.NewHTTP3Transport(log.Log, d, config)
 		client := &http.Client{Transport: txp}
-		URL := (&url.URL{Scheme: "https", Host: quictesting.Domain, Path: "/"}).String()
+		URL := (&url.URL{Scheme: "https", Host: srv.Endpoint(), Path: "/"}).String()
 		resp, err := client.Get(URL)
 		if err != nil {
 			t.Fatal(err)
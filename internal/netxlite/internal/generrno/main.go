@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/iancoleman/strcase"
@@ -73,8 +74,12 @@ func (es *ErrorSpec) AsFailureVar() string {
 }
 
 // AsFailureString returns the OONI failure string.
+//
+// Because failure names are already snake case, we just need to
+// lowercase them. We don't use strcase.ToSnake because it would
+// also split digits (e.g., "HTTP2" would become "http_2").
 func (es *ErrorSpec) AsFailureString() string {
-	return strcase.ToSnake(es.failure)
+	return strings.ToLower(es.failure)
 }
 
 // NewSystemError constructs a new ErrorSpec representing a system
@@ -170,6 +175,15 @@ var Specs = []*ErrorSpec{
 	NewLibraryError("SSL_invalid_certificate"),
 	NewLibraryError("JSON_parse_error"),
 	NewLibraryError("connection_already_closed"),
+	NewLibraryError("HTTP2_stream_reset"),
+	NewLibraryError("HTTP2_goaway"),
+	NewLibraryError("HTTP2_connection_error"),
+	NewLibraryError("HTTP3_stream_reset"),
+	NewLibraryError("QUIC_application_error"),
+	NewLibraryError("QUIC_transport_error"),
+	NewLibraryError("QUIC_stateless_reset"),
+	NewLibraryError("WebSocket_bad_handshake"),
+	NewLibraryError("WebSocket_closed"),
 
 	// QUIRKS: the following errors exist to clearly flag strange
 	// underlying behavior implemented by platforms.
@@ -6,6 +6,7 @@ package netxlite
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"net"
 	"net/url"
@@ -16,12 +17,31 @@ import (
 
 // proxyDialer is a dialer using a proxy.
 type proxyDialer struct {
-	Dialer   model.Dialer
+	// Dialer is the MANDATORY dialer used to connect to the proxy.
+	Dialer model.Dialer
+
+	// ProxyURL is the MANDATORY proxy URL.
 	ProxyURL *url.URL
+
+	// TLSConfig is the OPTIONAL TLS config used to connect to an
+	// "https" proxy. When nil, we use the proxy URL hostname as the
+	// SNI and our bundled certificate pool to verify the proxy.
+	TLSConfig *tls.Config
 }
 
 // MaybeWrapWithProxyDialer returns the original dialer if the proxyURL is nil
 // and otherwise returns a wrapped dialer that implements proxying.
+//
+// We support the following proxy URL schemes:
+//
+// - "socks5" for SOCKS5 proxies, where we use CONNECT for "tcp" and
+// UDP ASSOCIATE (RFC 1928) for "udp";
+//
+// - "http" and "https" for HTTP proxies supporting the CONNECT method,
+// which we can only use for "tcp".
+//
+// When the proxy URL contains a username and password, we use them
+// to authenticate with the proxy.
 func MaybeWrapWithProxyDialer(dialer model.Dialer, proxyURL *url.URL) model.Dialer {
 	if proxyURL == nil {
 		return dialer
@@ -42,15 +62,60 @@ func (d *proxyDialer) CloseIdleConnections() {
 // ErrProxyUnsupportedScheme indicates we don't support the proxy scheme.
 var ErrProxyUnsupportedScheme = errors.New("proxy: unsupported scheme")
 
+// ErrProxyUnsupportedNetwork indicates the proxy scheme does not support the network.
+var ErrProxyUnsupportedNetwork = errors.New("proxy: unsupported network")
+
 // DialContext implements Dialer.DialContext.
 func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	url := d.ProxyURL
-	if url.Scheme != "socks5" {
+	switch url.Scheme {
+	case "socks5":
+		if isUDPNetwork(network) {
+			return d.dialSOCKS5UDP(ctx, address)
+		}
+		// the code at proxy/socks5.go never fails; see https://git.io/JfJ4g
+		child, _ := proxy.SOCKS5(network, url.Host, proxyAuth(url), &proxyDialerWrapper{d.Dialer})
+		return d.dial(ctx, child, network, address)
+	case "http", "https":
+		if !isTCPNetwork(network) {
+			return nil, ErrProxyUnsupportedNetwork
+		}
+		return d.dialHTTPConnect(ctx, address)
+	default:
 		return nil, ErrProxyUnsupportedScheme
 	}
-	// the code at proxy/socks5.go never fails; see https://git.io/JfJ4g
-	child, _ := proxy.SOCKS5(network, url.Host, nil, &proxyDialerWrapper{d.Dialer})
-	return d.dial(ctx, child, network, address)
+}
+
+// proxyAuth returns the SOCKS5 credentials inside the URL, if any.
+func proxyAuth(url *url.URL) *proxy.Auth {
+	if url.User == nil {
+		return nil
+	}
+	password, _ := url.User.Password()
+	return &proxy.Auth{
+		User:     url.User.Username(),
+		Password: password,
+	}
+}
+
+// isTCPNetwork returns whether the network is a TCP network.
+func isTCPNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	default:
+		return false
+	}
+}
+
+// isUDPNetwork returns whether the network is an UDP network.
+func isUDPNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return true
+	default:
+		return false
+	}
 }
 
 func (d *proxyDialer) dial(
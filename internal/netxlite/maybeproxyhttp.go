@@ -0,0 +1,127 @@
+package netxlite
+
+//
+// HTTP CONNECT proxy support
+//
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrProxyConnectFailed indicates that the HTTP proxy refused CONNECT.
+var ErrProxyConnectFailed = errors.New("proxy: CONNECT failed")
+
+// dialHTTPConnect connects to the given address using HTTP CONNECT.
+func (d *proxyDialer) dialHTTPConnect(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, "tcp", d.ProxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if d.ProxyURL.Scheme == "https" {
+		tconn := tls.Client(conn, d.tlsConfig())
+		if err := tconn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, NewErrWrapper(ClassifyTLSHandshakeError, TLSHandshakeOperation, err)
+		}
+		conn = tconn
+	}
+	var reader *bufio.Reader
+	err = proxyRunWithContext(ctx, conn, func() (err error) {
+		reader, err = proxyHTTPConnect(conn, d.ProxyURL, address)
+		return
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &proxyHTTPConnectConn{Conn: conn, reader: reader}, nil
+}
+
+// tlsConfig returns the TLS config to use with an "https" proxy.
+func (d *proxyDialer) tlsConfig() *tls.Config {
+	if d.TLSConfig != nil {
+		return d.TLSConfig.Clone()
+	}
+	return &tls.Config{
+		ServerName: d.ProxyURL.Hostname(),
+		RootCAs:    defaultCertPool,
+	}
+}
+
+// proxyRunWithContext runs the given proxy handshake function making sure that
+// the I/O on conn is interrupted when the context is done.
+func proxyRunWithContext(ctx context.Context, conn net.Conn, fx func() error) error {
+	done := make(chan any)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now()) // interrupt pending I/O
+		case <-done:
+		}
+	}()
+	err := fx()
+	close(done)
+	wg.Wait() // make sure the goroutine won't touch the deadline anymore
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// proxyHTTPConnect sends the CONNECT request and reads the response.
+func proxyHTTPConnect(conn net.Conn, proxyURL *url.URL, address string) (*bufio.Reader, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		creds := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	// Note: we don't need to close the body because a 2xx response to CONNECT has
+	// no body and the caller closes the conn in case of failure.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%w: %s", ErrProxyConnectFailed, resp.Status)
+	}
+	return reader, nil
+}
+
+// proxyHTTPConnectConn is the net.Conn returned by dialHTTPConnect.
+type proxyHTTPConnectConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read implements net.Conn.Read.
+func (c *proxyHTTPConnectConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,210 @@
+package netxlite
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+)
+
+// proxyTestingNewEchoServer starts a TCP echo server and returns its endpoint.
+func proxyTestingNewEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// proxyTestingHTTPConnectHandler is a minimal HTTP CONNECT proxy.
+type proxyTestingHTTPConnectHandler struct {
+	// authorization is the OPTIONAL expected Proxy-Authorization value.
+	authorization string
+}
+
+func (h *proxyTestingHTTPConnectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Proxy-Authorization") != h.authorization {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	w.WriteHeader(http.StatusOK)
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// proxyTestingCheckEcho checks whether conn echoes back what we write.
+func proxyTestingCheckEcho(t *testing.T, conn net.Conn) {
+	message := []byte("Hello, world!")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer) != string(message) {
+		t.Fatal("unexpected echo", string(buffer))
+	}
+}
+
+func TestProxyDialerHTTPConnect(t *testing.T) {
+	t.Run("with an http proxy", func(t *testing.T) {
+		echo := proxyTestingNewEchoServer(t)
+		srv := httptest.NewServer(&proxyTestingHTTPConnectHandler{})
+		defer srv.Close()
+		URL, _ := url.Parse(srv.URL)
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		proxyTestingCheckEcho(t, conn)
+	})
+
+	t.Run("with an https proxy", func(t *testing.T) {
+		echo := proxyTestingNewEchoServer(t)
+		srv := httptest.NewTLSServer(&proxyTestingHTTPConnectHandler{})
+		defer srv.Close()
+		URL, _ := url.Parse(srv.URL)
+		pool := x509.NewCertPool()
+		pool.AddCert(srv.Certificate())
+		d := &proxyDialer{
+			Dialer:   NewDialerWithoutResolver(model.DiscardLogger),
+			ProxyURL: URL,
+			TLSConfig: &tls.Config{
+				ServerName: "example.com", // the httptest certificate is valid for this name
+				RootCAs:    pool,
+			},
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		proxyTestingCheckEcho(t, conn)
+	})
+
+	t.Run("with an https proxy we cannot verify", func(t *testing.T) {
+		srv := httptest.NewTLSServer(&proxyTestingHTTPConnectHandler{})
+		defer srv.Close()
+		URL, _ := url.Parse(srv.URL)
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:443")
+		var ew *ErrWrapper
+		if !errors.As(err, &ew) || ew.Operation != TLSHandshakeOperation {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("with proxy authentication", func(t *testing.T) {
+		echo := proxyTestingNewEchoServer(t)
+		srv := httptest.NewServer(&proxyTestingHTTPConnectHandler{
+			authorization: "Basic dXNlcjpwYXNz", // user:pass
+		})
+		defer srv.Close()
+		URL, _ := url.Parse(srv.URL)
+		URL.User = url.UserPassword("user", "pass")
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		proxyTestingCheckEcho(t, conn)
+	})
+
+	t.Run("when the proxy refuses CONNECT", func(t *testing.T) {
+		srv := httptest.NewServer(&proxyTestingHTTPConnectHandler{
+			authorization: "Basic dXNlcjpwYXNz", // and we don't send credentials
+		})
+		defer srv.Close()
+		URL, _ := url.Parse(srv.URL)
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:443")
+		if !errors.Is(err, ErrProxyConnectFailed) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("when the context is canceled during CONNECT", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			cancel() // cancel while the client is waiting for the response
+			io.Copy(io.Discard, conn)
+		}()
+		URL := &url.URL{Scheme: "http", Host: listener.Addr().String()}
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(ctx, "tcp", "127.0.0.1:443")
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("with the udp network", func(t *testing.T) {
+		URL := &url.URL{Scheme: "http", Host: "127.0.0.1:8080"}
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(context.Background(), "udp", "127.0.0.1:53")
+		if !errors.Is(err, ErrProxyUnsupportedNetwork) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+}
@@ -0,0 +1,445 @@
+package netxlite
+
+//
+// SOCKS5 UDP ASSOCIATE proxy support (RFC 1928)
+//
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+)
+
+// ErrProxyHandshakeFailed indicates that the SOCKS5 handshake failed.
+var ErrProxyHandshakeFailed = errors.New("proxy: handshake failed")
+
+// proxySOCKS5HandshakeTimeout is the timeout for the SOCKS5 handshake when we
+// don't have a context available (i.e., inside of QUICListener.Listen).
+const proxySOCKS5HandshakeTimeout = 10 * time.Second
+
+// MaybeWrapWithProxyQUICListener returns the original listener if the proxyURL
+// is nil and otherwise returns a wrapped listener where each listening conn
+// sends and receives datagrams through the proxy.
+//
+// The proxy URL scheme MUST be "socks5", since we use SOCKS5 UDP ASSOCIATE
+// (RFC 1928) for proxying, otherwise Listen fails with ErrProxyUnsupportedScheme.
+// We use the dialer to establish the SOCKS5 control connection, which stays
+// open until you close the returned listening conn.
+func MaybeWrapWithProxyQUICListener(
+	listener model.QUICListener, dialer model.Dialer, proxyURL *url.URL) model.QUICListener {
+	if proxyURL == nil {
+		return listener
+	}
+	return &proxyQUICListener{
+		Dialer:       dialer,
+		ProxyURL:     proxyURL,
+		QUICListener: listener,
+	}
+}
+
+// proxyQUICListener is a QUICListener using a proxy.
+type proxyQUICListener struct {
+	// Dialer is the MANDATORY dialer used to connect to the proxy.
+	Dialer model.Dialer
+
+	// ProxyURL is the MANDATORY proxy URL.
+	ProxyURL *url.URL
+
+	// QUICListener is the MANDATORY underlying QUICListener.
+	QUICListener model.QUICListener
+}
+
+var _ model.QUICListener = &proxyQUICListener{}
+
+// Listen implements QUICListener.Listen.
+func (ql *proxyQUICListener) Listen(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	return ql.listenContext(context.Background(), addr)
+}
+
+// listenContext implements quicListenerContext. We only use the context
+// to select the UnderlyingNetwork, because the SOCKS5 association outlives
+// the context, so we bound the handshake using a distinct timeout.
+func (ql *proxyQUICListener) listenContext(
+	ctx context.Context, addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	if ql.ProxyURL.Scheme != "socks5" {
+		return nil, ErrProxyUnsupportedScheme
+	}
+	tp := ContextUnderlyingNetworkOrDefault(ctx)
+	hctx, cancel := context.WithTimeout(context.Background(), proxySOCKS5HandshakeTimeout)
+	defer cancel()
+	hctx = ContextWithUnderlyingNetwork(hctx, tp)
+	assoc, err := socks5UDPAssociate(hctx, ql.Dialer, ql.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	pconn, err := quicListenerListenContext(ctx, ql.QUICListener, addr)
+	if err != nil {
+		assoc.Close()
+		return nil, err
+	}
+	return &socks5UDPLikeConn{UDPLikeConn: pconn, assoc: assoc}, nil
+}
+
+// dialSOCKS5UDP creates a connected UDP conn through the SOCKS5 proxy.
+func (d *proxyDialer) dialSOCKS5UDP(ctx context.Context, address string) (net.Conn, error) {
+	remote, err := newSOCKS5UDPAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	assoc, err := socks5UDPAssociate(ctx, d.Dialer, d.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	pconn, err := ContextUnderlyingNetworkOrDefault(ctx).ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		assoc.Close()
+		return nil, err
+	}
+	uconn := &socks5UDPLikeConn{UDPLikeConn: pconn, assoc: assoc}
+	return &socks5UDPConn{socks5UDPLikeConn: uconn, remote: remote}, nil
+}
+
+// socks5Association is an established SOCKS5 UDP association.
+type socks5Association struct {
+	// ctrl is the TCP control connection, which we must keep open.
+	ctrl net.Conn
+
+	// relay is the address of the proxy UDP relay.
+	relay *net.UDPAddr
+}
+
+// Close closes the association.
+func (a *socks5Association) Close() error {
+	return a.ctrl.Close()
+}
+
+// socks5UDPAssociate establishes a new SOCKS5 UDP association.
+func socks5UDPAssociate(ctx context.Context,
+	dialer model.Dialer, proxyURL *url.URL) (*socks5Association, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	var relay *net.UDPAddr
+	err = proxyRunWithContext(ctx, conn, func() (err error) {
+		relay, err = socks5UDPAssociateHandshake(conn, proxyURL)
+		return
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &socks5Association{ctrl: conn, relay: relay}, nil
+}
+
+// SOCKS5 protocol constants.
+const (
+	socks5Version             = 5
+	socks5MethodNoAuth        = 0
+	socks5MethodUserPass      = 2
+	socks5MethodNoAcceptable  = 0xff
+	socks5UserPassVersion     = 1
+	socks5CommandUDPAssociate = 3
+	socks5AddrIPv4            = 1
+	socks5AddrDomain          = 3
+	socks5AddrIPv6            = 4
+	socks5ReplySucceeded      = 0
+)
+
+// socks5MaxUDPHeaderLen is the maximum length of the SOCKS5 UDP header, which we
+// obtain with a 255 bytes domain name: RSV(2) + FRAG(1) + ATYP(1) + LEN(1) + 255 + PORT(2).
+const socks5MaxUDPHeaderLen = 262
+
+// socks5UDPAssociateHandshake performs the SOCKS5 handshake and returns
+// the address of the UDP relay we should be using.
+func socks5UDPAssociateHandshake(conn net.Conn, proxyURL *url.URL) (*net.UDPAddr, error) {
+	// 1. methods negotiation
+	method := byte(socks5MethodNoAuth)
+	if proxyURL.User != nil {
+		method = socks5MethodUserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != socks5Version {
+		return nil, fmt.Errorf("%w: unexpected version %d", ErrProxyHandshakeFailed, reply[0])
+	}
+	if reply[1] != method {
+		return nil, fmt.Errorf("%w: no acceptable method", ErrProxyHandshakeFailed)
+	}
+
+	// 2. optional username and password authentication (RFC 1929)
+	if method == socks5MethodUserPass {
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("%w: credentials too long", ErrProxyHandshakeFailed)
+		}
+		req := []byte{socks5UserPassVersion, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0 {
+			return nil, fmt.Errorf("%w: authentication failed", ErrProxyHandshakeFailed)
+		}
+	}
+
+	// 3. UDP ASSOCIATE request where we leave the client address unspecified
+	req := []byte{socks5Version, socks5CommandUDPAssociate, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("%w: unexpected version %d", ErrProxyHandshakeFailed, header[0])
+	}
+	if header[1] != socks5ReplySucceeded {
+		return nil, fmt.Errorf("%w: reply code %d", ErrProxyHandshakeFailed, header[1])
+	}
+	host, port, err := socks5ReadAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%w: relay address is not an IP address", ErrProxyHandshakeFailed)
+	}
+	if ip.IsUnspecified() {
+		// RFC 1928 does not say what this means, but proxies commonly
+		// use this value to indicate the proxy's own address.
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = tcpAddr.IP
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// socks5ReadAddr reads ATYP, ADDR and PORT from the given reader.
+func socks5ReadAddr(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if atyp[0] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+	default:
+		return "", 0, fmt.Errorf("%w: unknown address type %d", ErrProxyHandshakeFailed, atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	return host, int(port[0])<<8 | int(port[1]), nil
+}
+
+// socks5EncodeUDPHeader returns the header to prepend to a datagram for addr.
+func socks5EncodeUDPHeader(addr net.Addr) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("%w: invalid port", ErrProxyHandshakeFailed)
+	}
+	header := []byte{0, 0, 0} // RSV and FRAG
+	if ip := net.ParseIP(host); ip != nil {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			header = append(header, socks5AddrIPv4)
+			header = append(header, ipv4...)
+		} else {
+			header = append(header, socks5AddrIPv6)
+			header = append(header, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("%w: domain too long", ErrProxyHandshakeFailed)
+		}
+		header = append(header, socks5AddrDomain, byte(len(host)))
+		header = append(header, host...)
+	}
+	header = append(header, byte(port>>8), byte(port))
+	return header, nil
+}
+
+// socks5DecodeUDPDatagram returns the payload and the source address of a datagram.
+func socks5DecodeUDPDatagram(data []byte) ([]byte, net.Addr, error) {
+	reader := bytes.NewReader(data)
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	if header[2] != 0 {
+		// See RFC 1928 Sect. 7: an implementation that does not
+		// support fragmentation MUST drop fragmented datagrams.
+		return nil, nil, fmt.Errorf("%w: fragmented datagram", ErrProxyHandshakeFailed)
+	}
+	host, port, err := socks5ReadAddr(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload := data[len(data)-reader.Len():]
+	if ip := net.ParseIP(host); ip != nil {
+		return payload, &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return payload, &socks5DomainAddr{net.JoinHostPort(host, strconv.Itoa(port))}, nil
+}
+
+// newSOCKS5UDPAddr creates the net.Addr for the given UDP endpoint.
+func newSOCKS5UDPAddr(address string) (net.Addr, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return ParseUDPAddr(address)
+	}
+	return &socks5DomainAddr{address}, nil
+}
+
+// socks5DomainAddr is the net.Addr of an UDP endpoint containing a domain
+// name, which the SOCKS5 proxy is going to resolve for us.
+type socks5DomainAddr struct {
+	endpoint string
+}
+
+var _ net.Addr = &socks5DomainAddr{}
+
+// Network implements net.Addr.Network.
+func (a *socks5DomainAddr) Network() string {
+	return "udp"
+}
+
+// String implements net.Addr.String.
+func (a *socks5DomainAddr) String() string {
+	return a.endpoint
+}
+
+// socks5UDPLikeConn is an UDPLikeConn that sends and receives
+// datagrams through a SOCKS5 UDP association.
+type socks5UDPLikeConn struct {
+	// UDPLikeConn is the underlying conn.
+	model.UDPLikeConn
+
+	// assoc is the association we own.
+	assoc *socks5Association
+}
+
+var _ model.UDPLikeConn = &socks5UDPLikeConn{}
+
+// WriteTo implements UDPLikeConn.WriteTo.
+func (c *socks5UDPLikeConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	header, err := socks5EncodeUDPHeader(addr)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.UDPLikeConn.WriteTo(append(header, p...), c.assoc.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom implements UDPLikeConn.ReadFrom. We silently drop the datagrams
+// that do not come from the relay and the ones we cannot parse.
+func (c *socks5UDPLikeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buffer := make([]byte, len(b)+socks5MaxUDPHeaderLen)
+	for {
+		count, from, err := c.UDPLikeConn.ReadFrom(buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		if from.String() != c.assoc.relay.String() {
+			continue
+		}
+		payload, addr, err := socks5DecodeUDPDatagram(buffer[:count])
+		if err != nil {
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+// Close implements UDPLikeConn.Close.
+func (c *socks5UDPLikeConn) Close() error {
+	err := c.UDPLikeConn.Close()
+	c.assoc.Close()
+	return err
+}
+
+// socks5UDPConn is a connected UDP net.Conn using a SOCKS5 UDP association.
+type socks5UDPConn struct {
+	*socks5UDPLikeConn
+
+	// remote is the remote address.
+	remote net.Addr
+}
+
+var _ net.Conn = &socks5UDPConn{}
+
+// Read implements net.Conn.Read. Like connected UDP sockets, we ignore
+// datagrams that do not come from the remote address, unless the remote
+// address is a domain name, which only the proxy knows how to resolve.
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	_, isDomain := c.remote.(*socks5DomainAddr)
+	for {
+		count, from, err := c.socks5UDPLikeConn.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if !isDomain && from.String() != c.remote.String() {
+			continue
+		}
+		return count, nil
+	}
+}
+
+// Write implements net.Conn.Write.
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	return c.socks5UDPLikeConn.WriteTo(b, c.remote)
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr.
+func (c *socks5UDPConn) RemoteAddr() net.Addr {
+	return c.remote
+}
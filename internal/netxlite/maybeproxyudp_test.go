@@ -0,0 +1,357 @@
+package netxlite
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/model/mocks"
+)
+
+// proxyTestingNewUDPEchoServer starts an UDP echo server and returns its endpoint.
+func proxyTestingNewUDPEchoServer(t *testing.T) string {
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pconn.Close() })
+	go func() {
+		buffer := make([]byte, 1<<16)
+		for {
+			count, addr, err := pconn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			pconn.WriteTo(buffer[:count], addr)
+		}
+	}()
+	return pconn.LocalAddr().String()
+}
+
+// proxyTestingSOCKS5Server is a minimal SOCKS5 server supporting UDP ASSOCIATE.
+type proxyTestingSOCKS5Server struct {
+	// listener is the TCP listener.
+	listener net.Listener
+
+	// password is the OPTIONAL password we require for user "user".
+	password string
+
+	// reply is the reply code we send to UDP ASSOCIATE.
+	reply byte
+}
+
+// proxyTestingNewSOCKS5Server creates and starts a new proxyTestingSOCKS5Server.
+func proxyTestingNewSOCKS5Server(t *testing.T, password string, reply byte) *url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	srv := &proxyTestingSOCKS5Server{listener: listener, password: password, reply: reply}
+	go srv.mainloop()
+	URL := &url.URL{Scheme: "socks5", Host: listener.Addr().String()}
+	if password != "" {
+		URL.User = url.UserPassword("user", password)
+	}
+	return URL
+}
+
+func (s *proxyTestingSOCKS5Server) mainloop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *proxyTestingSOCKS5Server) serve(conn net.Conn) {
+	defer conn.Close()
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	if s.password != "" {
+		conn.Write([]byte{socks5Version, socks5MethodUserPass})
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		username := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, username); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return
+		}
+		password := make([]byte, header[0])
+		if _, err := io.ReadFull(conn, password); err != nil {
+			return
+		}
+		if string(username) != "user" || string(password) != s.password {
+			conn.Write([]byte{socks5UserPassVersion, 1})
+			return
+		}
+		conn.Write([]byte{socks5UserPassVersion, 0})
+	} else {
+		conn.Write([]byte{socks5Version, socks5MethodNoAuth})
+	}
+	request := make([]byte, 10)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	reply := []byte{socks5Version, s.reply, 0}
+	header, _ := socks5EncodeUDPHeader(relay.LocalAddr())
+	conn.Write(append(reply, header[3:]...))
+	go s.relay(relay)
+	io.Copy(io.Discard, conn) // the association lasts as long as the control conn
+}
+
+func (s *proxyTestingSOCKS5Server) relay(relay net.PacketConn) {
+	var client net.Addr
+	buffer := make([]byte, 1<<16)
+	for {
+		count, from, err := relay.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if client == nil {
+			client = from
+		}
+		if from.String() == client.String() {
+			payload, addr, err := socks5DecodeUDPDatagram(buffer[:count])
+			if err != nil {
+				continue
+			}
+			udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+			if err != nil {
+				continue
+			}
+			relay.WriteTo(payload, udpAddr)
+			continue
+		}
+		header, _ := socks5EncodeUDPHeader(from)
+		relay.WriteTo(append(header, buffer[:count]...), client)
+	}
+}
+
+// proxyTestingCheckUDPEcho checks whether pconn echoes back what we write.
+func proxyTestingCheckUDPEcho(t *testing.T, pconn net.PacketConn, echo net.Addr) {
+	message := []byte("Hello, world!")
+	if _, err := pconn.WriteTo(message, echo); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 1024)
+	count, from, err := pconn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.String() != echo.String() {
+		t.Fatal("unexpected source address", from)
+	}
+	if string(buffer[:count]) != string(message) {
+		t.Fatal("unexpected echo", string(buffer[:count]))
+	}
+}
+
+func TestProxyDialerSOCKS5UDP(t *testing.T) {
+	t.Run("with a working proxy", func(t *testing.T) {
+		echo := proxyTestingNewUDPEchoServer(t)
+		URL := proxyTestingNewSOCKS5Server(t, "", socks5ReplySucceeded)
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(context.Background(), "udp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if conn.RemoteAddr().String() != echo {
+			t.Fatal("unexpected remote address")
+		}
+		proxyTestingCheckEcho(t, conn)
+	})
+
+	t.Run("with a domain name", func(t *testing.T) {
+		echo := proxyTestingNewUDPEchoServer(t)
+		_, port, _ := net.SplitHostPort(echo)
+		URL := proxyTestingNewSOCKS5Server(t, "", socks5ReplySucceeded)
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(context.Background(), "udp", net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		proxyTestingCheckEcho(t, conn)
+	})
+
+	t.Run("with authentication", func(t *testing.T) {
+		echo := proxyTestingNewUDPEchoServer(t)
+		URL := proxyTestingNewSOCKS5Server(t, "pass", socks5ReplySucceeded)
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(context.Background(), "udp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		proxyTestingCheckEcho(t, conn)
+	})
+
+	t.Run("with wrong credentials", func(t *testing.T) {
+		URL := proxyTestingNewSOCKS5Server(t, "pass", socks5ReplySucceeded)
+		URL.User = url.UserPassword("user", "wrong")
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(context.Background(), "udp", "127.0.0.1:53")
+		if !errors.Is(err, ErrProxyHandshakeFailed) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("when the proxy refuses UDP ASSOCIATE", func(t *testing.T) {
+		const commandNotSupported = 7
+		URL := proxyTestingNewSOCKS5Server(t, "", commandNotSupported)
+		d := MaybeWrapWithProxyDialer(NewDialerWithoutResolver(model.DiscardLogger), URL)
+		conn, err := d.DialContext(context.Background(), "udp", "127.0.0.1:53")
+		if !errors.Is(err, ErrProxyHandshakeFailed) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("when we cannot connect to the proxy", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		d := &proxyDialer{
+			Dialer: &mocks.Dialer{
+				MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					return nil, expected
+				},
+			},
+			ProxyURL: &url.URL{Scheme: "socks5", Host: "127.0.0.1:1080"},
+		}
+		conn, err := d.DialContext(context.Background(), "udp", "127.0.0.1:53")
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+}
+
+func TestMaybeWrapWithProxyQUICListener(t *testing.T) {
+	t.Run("without a proxy URL", func(t *testing.T) {
+		underlying := &mocks.QUICListener{}
+		listener := MaybeWrapWithProxyQUICListener(underlying, &mocks.Dialer{}, nil)
+		if listener != underlying {
+			t.Fatal("should not have wrapped")
+		}
+	})
+
+	t.Run("with an unsupported scheme", func(t *testing.T) {
+		URL := &url.URL{Scheme: "http", Host: "127.0.0.1:8080"}
+		listener := MaybeWrapWithProxyQUICListener(NewQUICListener(), &mocks.Dialer{}, URL)
+		pconn, err := listener.Listen(&net.UDPAddr{})
+		if !errors.Is(err, ErrProxyUnsupportedScheme) {
+			t.Fatal("unexpected err", err)
+		}
+		if pconn != nil {
+			t.Fatal("expected nil pconn")
+		}
+	})
+
+	t.Run("with a working proxy", func(t *testing.T) {
+		echo := proxyTestingNewUDPEchoServer(t)
+		echoAddr, err := ParseUDPAddr(echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		URL := proxyTestingNewSOCKS5Server(t, "", socks5ReplySucceeded)
+		dialer := NewDialerWithoutResolver(model.DiscardLogger)
+		listener := MaybeWrapWithProxyQUICListener(NewQUICListener(), dialer, URL)
+		pconn, err := listener.Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pconn.Close()
+		proxyTestingCheckUDPEcho(t, pconn, echoAddr)
+	})
+
+	t.Run("when the underlying listener fails", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		URL := proxyTestingNewSOCKS5Server(t, "", socks5ReplySucceeded)
+		dialer := NewDialerWithoutResolver(model.DiscardLogger)
+		underlying := &mocks.QUICListener{
+			MockListen: func(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+				return nil, expected
+			},
+		}
+		listener := MaybeWrapWithProxyQUICListener(underlying, dialer, URL)
+		pconn, err := listener.Listen(&net.UDPAddr{})
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if pconn != nil {
+			t.Fatal("expected nil pconn")
+		}
+	})
+}
+
+func TestSOCKS5UDPHeader(t *testing.T) {
+	type testcase struct {
+		name string
+		addr net.Addr
+	}
+	cases := []testcase{{
+		name: "with IPv4",
+		addr: &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53},
+	}, {
+		name: "with IPv6",
+		addr: &net.UDPAddr{IP: net.ParseIP("2001:4860:4860::8888"), Port: 443},
+	}, {
+		name: "with a domain",
+		addr: &socks5DomainAddr{"dns.google:853"},
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			header, err := socks5EncodeUDPHeader(tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, addr, err := socks5DecodeUDPDatagram(append(header, "abc"...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != "abc" {
+				t.Fatal("unexpected payload")
+			}
+			if addr.String() != tc.addr.String() {
+				t.Fatal("unexpected addr", addr)
+			}
+		})
+	}
+
+	t.Run("we drop fragmented datagrams", func(t *testing.T) {
+		header, err := socks5EncodeUDPHeader(&net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53})
+		if err != nil {
+			t.Fatal(err)
+		}
+		header[2] = 1 // FRAG
+		_, _, err = socks5DecodeUDPDatagram(header)
+		if !errors.Is(err, ErrProxyHandshakeFailed) {
+			t.Fatal("unexpected err", err)
+		}
+	})
+}
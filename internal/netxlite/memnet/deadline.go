@@ -0,0 +1,76 @@
+package memnet
+
+//
+// Deadlines for in-memory conns
+//
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is a read or write deadline. The channel returned by wait
+// is closed when the deadline expires. This implementation is loosely
+// based on the pipeDeadline type in the Go standard library.
+type deadline struct {
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// timer is the timer that closes cancel.
+	timer *time.Timer
+
+	// cancel is closed when the deadline expires.
+	cancel chan any
+}
+
+// newDeadline creates a new deadline.
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan any)}
+}
+
+// set sets the deadline. A zero value means no deadline.
+func (d *deadline) set(t time.Time) {
+	defer d.mu.Unlock()
+	d.mu.Lock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan any)
+		}
+		return
+	}
+	if delay := time.Until(t); delay > 0 {
+		if closed {
+			d.cancel = make(chan any)
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(delay, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed when the deadline expires.
+func (d *deadline) wait() chan any {
+	defer d.mu.Unlock()
+	d.mu.Lock()
+	return d.cancel
+}
+
+// isClosedChan returns whether the given channel is closed.
+func isClosedChan(c <-chan any) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+package memnet
+
+//
+// DNS-over-UDP server using the DNS zone
+//
+
+import (
+	"io"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ServeDNS starts a DNS-over-UDP server listening on the given endpoint
+// (e.g., 10.0.0.53:53) that answers A, AAAA, and CNAME queries using the
+// DNS zone. The returned io.Closer allows to stop the server. Because the
+// server's traffic traverses the network, the Filter also applies to the
+// DNS queries and responses, so you can, e.g., inject DNS responses.
+func (n *Network) ServeDNS(endpoint string) (io.Closer, error) {
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	pconn, err := n.listenUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	go n.dnsServerLoop(pconn)
+	return pconn, nil
+}
+
+// dnsServerLoop is the main loop of the DNS server.
+func (n *Network) dnsServerLoop(pconn *udpLikeConn) {
+	buffer := make([]byte, 1<<17)
+	for {
+		count, addr, err := pconn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		rawResponse, err := n.dnsAnswer(buffer[:count])
+		if err != nil {
+			continue // just ignore malformed queries
+		}
+		pconn.WriteTo(rawResponse, addr)
+	}
+}
+
+// dnsAnswer computes the response to a raw DNS query.
+func (n *Network) dnsAnswer(rawQuery []byte) ([]byte, error) {
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil {
+		return nil, err
+	}
+	response := &dns.Msg{}
+	if len(query.Question) != 1 {
+		response.SetRcode(query, dns.RcodeRefused)
+		return response.Pack()
+	}
+	question := query.Question[0]
+	entry, found := n.lookup(question.Name)
+	if !found {
+		response.SetRcode(query, dns.RcodeNameError)
+		return response.Pack()
+	}
+	response.SetReply(query)
+	header := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    0,
+	}
+	if entry.cname != "" && question.Qtype == dns.TypeCNAME {
+		response.Answer = append(response.Answer, &dns.CNAME{
+			Hdr:    header,
+			Target: dns.Fqdn(entry.cname),
+		})
+	}
+	for _, addr := range entry.addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		switch {
+		case question.Qtype == dns.TypeA && ip.To4() != nil:
+			response.Answer = append(response.Answer, &dns.A{Hdr: header, A: ip})
+		case question.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	return response.Pack()
+}
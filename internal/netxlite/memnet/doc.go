@@ -0,0 +1,19 @@
+// Package memnet contains an in-memory model.UnderlyingNetwork implementation.
+//
+// A Network simulates, entirely in memory, a network where netxlite runs on
+// a client host having a given IP address and where servers listen on other
+// IP addresses. The Network contains a DNS zone used to implement getaddrinfo
+// as well as to serve DNS-over-UDP queries. You can script censorship on a
+// per-flow basis by installing a Filter, which decides whether to pass, drop,
+// reset, or inject traffic for each TCP connection attempt, TCP segment, and
+// UDP datagram that traverses the network.
+//
+// By binding a Network to a context using netxlite.ContextWithUnderlyingNetwork,
+// or by overriding netxlite.TProxy with a Network, you can run full measurement
+// pipelines (DNS, TCP, TLS, QUIC, HTTP) deterministically in unit tests
+// without touching the host network.
+//
+// Because quic-go multiplexes UDP conns having the same local address within
+// a process, you should close QUIC servers and clients before reusing their
+// endpoints in another Network, or use distinct endpoints.
+package memnet
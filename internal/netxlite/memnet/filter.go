@@ -0,0 +1,61 @@
+package memnet
+
+//
+// Per-flow censorship
+//
+
+// Packet is what a Filter inspects to decide which Verdict to apply.
+type Packet struct {
+	// Network is either "tcp" or "udp".
+	Network string
+
+	// Source is the source endpoint (e.g., 10.0.0.1:54321).
+	Source string
+
+	// Destination is the destination endpoint (e.g., 10.0.0.2:443).
+	Destination string
+
+	// Payload is the packet payload. For TCP, a nil Payload indicates a
+	// connection attempt (i.e., the SYN segment), while a non-nil Payload
+	// indicates that an endpoint is writing data.
+	Payload []byte
+}
+
+// Action is an action that a Filter can apply to a Packet.
+type Action int
+
+const (
+	// ActionPass passes the packet.
+	ActionPass = Action(iota)
+
+	// ActionDrop drops the packet. When applied to a TCP connection attempt, the
+	// connection attempt times out. When applied to TCP data, the peer never sees
+	// the data, even though the write succeeds. When applied to UDP, the datagram
+	// is lost, even though the write succeeds.
+	ActionDrop
+
+	// ActionReset resets the flow. When applied to a TCP connection attempt, the
+	// connection is refused. When applied to TCP data, the data is lost and both
+	// endpoints see the connection as reset by peer. When applied to UDP, this
+	// action is equivalent to ActionDrop.
+	ActionReset
+
+	// ActionInject drops the packet and sends Verdict.Inject to the packet
+	// source as if it came from the packet destination. When applied to a TCP
+	// connection attempt, this action is equivalent to ActionPass.
+	ActionInject
+)
+
+// Verdict is the verdict of a Filter.
+type Verdict struct {
+	// Action is the action to apply.
+	Action Action
+
+	// Inject is the payload to inject when Action is ActionInject.
+	Inject []byte
+}
+
+// Filter decides the fate of the given packet. Returning nil is
+// equivalent to returning a Verdict with ActionPass. A Filter MUST NOT
+// modify the packet and MAY be called concurrently.
+type Filter func(packet *Packet) *Verdict
@@ -0,0 +1,588 @@
+package memnet_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/dslx"
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+	"github.com/bassosimone/oonidsl/internal/netxlite/memnet"
+	"github.com/google/martian/v3/mitm"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/miekg/dns"
+)
+
+// useNetwork overrides netxlite.TProxy for the duration of the test.
+func useNetwork(t *testing.T, network *memnet.Network) {
+	saved := netxlite.TProxy
+	netxlite.TProxy = network
+	t.Cleanup(func() {
+		netxlite.TProxy = saved
+	})
+}
+
+// newCA creates a CA and a TLS config using such a CA.
+func newCA(t *testing.T) (*x509.CertPool, *tls.Config) {
+	cert, privkey, err := mitm.NewAuthority("jafar", "OONI", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mitm.NewConfig(cert, privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool, config.TLS()
+}
+
+// echoServer serves conns accepted by listener by echoing what they read.
+func echoServer(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Run("we panic with an invalid IP address", func(t *testing.T) {
+		var panicked bool
+		func() {
+			defer func() {
+				panicked = recover() != nil
+			}()
+			memnet.New("10.0.0")
+		}()
+		if !panicked {
+			t.Fatal("expected a panic")
+		}
+	})
+
+	t.Run("ClientIP returns the client IP", func(t *testing.T) {
+		network := memnet.New("10.0.0.1")
+		if network.ClientIP() != "10.0.0.1" {
+			t.Fatal("unexpected client IP")
+		}
+	})
+}
+
+func TestTCP(t *testing.T) {
+	newNetwork := func(t *testing.T) *memnet.Network {
+		network := memnet.New("10.0.0.1")
+		listener, err := network.ListenTCP("10.0.0.2:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go echoServer(listener)
+		return network
+	}
+
+	t.Run("we can exchange data with a server", func(t *testing.T) {
+		network := newNetwork(t)
+		conn, err := network.DialContext(context.Background(), time.Second, "tcp", "10.0.0.2:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ciao")); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer) != "ciao" {
+			t.Fatal("unexpected data", string(buffer))
+		}
+		if conn.LocalAddr().(*net.TCPAddr).IP.String() != "10.0.0.1" {
+			t.Fatal("unexpected local address", conn.LocalAddr())
+		}
+	})
+
+	t.Run("we cannot listen twice on the same endpoint", func(t *testing.T) {
+		network := newNetwork(t)
+		_, err := network.ListenTCP("10.0.0.2:7")
+		if !errors.Is(err, netxlite.EADDRINUSE) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("the connection is refused without a listener", func(t *testing.T) {
+		network := newNetwork(t)
+		conn, err := network.DialContext(context.Background(), time.Second, "tcp", "10.0.0.3:7")
+		if netxlite.NewTopLevelGenericErrWrapper(err).Error() != netxlite.FailureConnectionRefused {
+			t.Fatal("unexpected error", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("the connection attempt times out with ActionDrop", func(t *testing.T) {
+		network := newNetwork(t)
+		network.SetFilter(func(packet *memnet.Packet) *memnet.Verdict {
+			return &memnet.Verdict{Action: memnet.ActionDrop}
+		})
+		conn, err := network.DialContext(context.Background(), 10*time.Millisecond, "tcp", "10.0.0.2:7")
+		if netxlite.NewTopLevelGenericErrWrapper(err).Error() != netxlite.FailureGenericTimeoutError {
+			t.Fatal("unexpected error", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("the connection is refused with ActionReset", func(t *testing.T) {
+		network := newNetwork(t)
+		network.SetFilter(func(packet *memnet.Packet) *memnet.Verdict {
+			return &memnet.Verdict{Action: memnet.ActionReset}
+		})
+		_, err := network.DialContext(context.Background(), time.Second, "tcp", "10.0.0.2:7")
+		if netxlite.NewTopLevelGenericErrWrapper(err).Error() != netxlite.FailureConnectionRefused {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("writing data may cause a connection reset", func(t *testing.T) {
+		network := newNetwork(t)
+		network.SetFilter(func(packet *memnet.Packet) *memnet.Verdict {
+			if bytes.Contains(packet.Payload, []byte("censored")) {
+				return &memnet.Verdict{Action: memnet.ActionReset}
+			}
+			return nil
+		})
+		conn, err := network.DialContext(context.Background(), time.Second, "tcp", "10.0.0.2:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("censored")); err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Read(make([]byte, 8))
+		if netxlite.NewTopLevelGenericErrWrapper(err).Error() != netxlite.FailureConnectionReset {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("we can inject data", func(t *testing.T) {
+		network := newNetwork(t)
+		network.SetFilter(func(packet *memnet.Packet) *memnet.Verdict {
+			if packet.Payload != nil {
+				return &memnet.Verdict{Action: memnet.ActionInject, Inject: []byte("blocked!")}
+			}
+			return nil
+		})
+		conn, err := network.DialContext(context.Background(), time.Second, "tcp", "10.0.0.2:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ciao")); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 8)
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer) != "blocked!" {
+			t.Fatal("unexpected data", string(buffer))
+		}
+	})
+
+	t.Run("the read deadline works", func(t *testing.T) {
+		network := newNetwork(t)
+		network.SetFilter(func(packet *memnet.Packet) *memnet.Verdict {
+			if packet.Payload != nil {
+				return &memnet.Verdict{Action: memnet.ActionDrop}
+			}
+			return nil
+		})
+		conn, err := network.DialContext(context.Background(), time.Second, "tcp", "10.0.0.2:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ciao")); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 4))
+		if netxlite.NewTopLevelGenericErrWrapper(err).Error() != netxlite.FailureGenericTimeoutError {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("the peer sees EOF when we close", func(t *testing.T) {
+		network := memnet.New("10.0.0.1")
+		listener, err := network.ListenTCP("10.0.0.2:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		conn, err := network.DialContext(context.Background(), time.Second, "tcp", "10.0.0.2:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sconn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sconn.Close()
+		conn.Close()
+		if _, err := sconn.Read(make([]byte, 4)); !errors.Is(err, io.EOF) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestUDP(t *testing.T) {
+	newNetwork := func(t *testing.T) *memnet.Network {
+		network := memnet.New("10.0.0.1")
+		pconn, err := network.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pconn.Close() })
+		go func() {
+			buffer := make([]byte, 1024)
+			for {
+				count, addr, err := pconn.ReadFrom(buffer)
+				if err != nil {
+					return
+				}
+				pconn.WriteTo(buffer[:count], addr)
+			}
+		}()
+		return network
+	}
+
+	t.Run("we can exchange datagrams with a server", func(t *testing.T) {
+		network := newNetwork(t)
+		conn, err := network.DialContext(context.Background(), time.Second, "udp", "10.0.0.2:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ciao")); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 1024)
+		count, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer[:count]) != "ciao" {
+			t.Fatal("unexpected data", string(buffer[:count]))
+		}
+	})
+
+	t.Run("we cannot bind twice the same endpoint", func(t *testing.T) {
+		network := newNetwork(t)
+		_, err := network.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7})
+		if !errors.Is(err, netxlite.EADDRINUSE) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("ActionDrop causes a timeout", func(t *testing.T) {
+		network := newNetwork(t)
+		network.SetFilter(func(packet *memnet.Packet) *memnet.Verdict {
+			return &memnet.Verdict{Action: memnet.ActionDrop}
+		})
+		conn, err := network.DialContext(context.Background(), time.Second, "udp", "10.0.0.2:7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("ciao")); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1024))
+		if netxlite.NewTopLevelGenericErrWrapper(err).Error() != netxlite.FailureGenericTimeoutError {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
+
+func TestDNS(t *testing.T) {
+	newNetwork := func(t *testing.T) *memnet.Network {
+		network := memnet.New("10.0.0.1")
+		network.AddDNSRecord("www.example.com", "example.com", "10.0.0.2", "2001:db8::2")
+		network.AddDNSRecord("noanswer.example.com", "")
+		server, err := network.ServeDNS("10.0.0.53:53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { server.Close() })
+		useNetwork(t, network)
+		return network
+	}
+
+	t.Run("getaddrinfo", func(t *testing.T) {
+		newNetwork(t)
+		reso := netxlite.NewStdlibResolver(model.DiscardLogger)
+
+		addrs, err := reso.LookupHost(context.Background(), "WWW.example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 2 || addrs[0] != "10.0.0.2" || addrs[1] != "2001:db8::2" {
+			t.Fatal("unexpected addrs", addrs)
+		}
+
+		_, err = reso.LookupHost(context.Background(), "nonexistent.example.com")
+		if err == nil || err.Error() != netxlite.FailureDNSNXDOMAINError {
+			t.Fatal("unexpected error", err)
+		}
+
+		_, err = reso.LookupHost(context.Background(), "noanswer.example.com")
+		if err == nil || err.Error() != netxlite.FailureDNSNoAnswer {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("DNS over UDP", func(t *testing.T) {
+		newNetwork(t)
+		dialer := netxlite.NewDialerWithoutResolver(model.DiscardLogger)
+		reso := netxlite.NewParallelUDPResolver(model.DiscardLogger, dialer, "10.0.0.53:53")
+
+		addrs, err := reso.LookupHost(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 2 {
+			t.Fatal("unexpected addrs", addrs)
+		}
+
+		_, err = reso.LookupHost(context.Background(), "nonexistent.example.com")
+		if err == nil || err.Error() != netxlite.FailureDNSNXDOMAINError {
+			t.Fatal("unexpected error", err)
+		}
+	})
+
+	t.Run("DNS over UDP with injected responses", func(t *testing.T) {
+		network := newNetwork(t)
+		network.SetFilter(func(packet *memnet.Packet) *memnet.Verdict {
+			if packet.Destination != "10.0.0.53:53" {
+				return nil
+			}
+			query := &dns.Msg{}
+			if err := query.Unpack(packet.Payload); err != nil {
+				return nil
+			}
+			response := &dns.Msg{}
+			response.SetReply(query)
+			if query.Question[0].Qtype == dns.TypeA {
+				response.Answer = append(response.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   query.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+					},
+					A: net.IPv4(10, 10, 34, 35),
+				})
+			}
+			rawResponse, err := response.Pack()
+			if err != nil {
+				return nil
+			}
+			return &memnet.Verdict{Action: memnet.ActionInject, Inject: rawResponse}
+		})
+		dialer := netxlite.NewDialerWithoutResolver(model.DiscardLogger)
+		reso := netxlite.NewParallelUDPResolver(model.DiscardLogger, dialer, "10.0.0.53:53")
+		addrs, err := reso.LookupHost(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0] != "10.10.34.35" {
+			t.Fatal("unexpected addrs", addrs)
+		}
+	})
+}
+
+func TestDSLX(t *testing.T) {
+	// newNetwork creates a network where www.example.com serves HTTP
+	// and HTTPS at 10.0.0.2. We don't start an HTTP/3 server here, because
+	// quic-go multiplexes UDP conns having the same local address in a
+	// process, so we should only start it in the test that needs it.
+	newNetwork := func(t *testing.T) (*memnet.Network, *x509.CertPool, *tls.Config, http.Handler) {
+		network := memnet.New("10.0.0.1")
+		network.AddDNSRecord("www.example.com", "", "10.0.0.2")
+		useNetwork(t, network)
+		pool, config := newCA(t)
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Bonsoir, Elliot!"))
+		})
+
+		listener, err := network.ListenTCP("10.0.0.2:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go http.Serve(listener, handler)
+
+		tlsListener, err := network.ListenTCP("10.0.0.2:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { tlsListener.Close() })
+		go http.Serve(tls.NewListener(tlsListener, config), handler)
+
+		return network, pool, config, handler
+	}
+
+	// lookup resolves www.example.com using getaddrinfo.
+	lookup := func(t *testing.T) []string {
+		input := dslx.NewDomainToResolve(dslx.DomainName("www.example.com"))
+		result := dslx.DNSLookupGetaddrinfo().Apply(context.Background(), input)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		return result.State.Addresses
+	}
+
+	t.Run("HTTP over TCP", func(t *testing.T) {
+		newNetwork(t)
+		addrs := lookup(t)
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("tcp", dslx.EndpointAddress(net.JoinHostPort(addrs[0], "80")),
+			dslx.EndpointOptionDomain("www.example.com"))
+		fx := dslx.Compose2(dslx.TCPConnect(pool), dslx.HTTPRequestOverTCP())
+		result := fx.Apply(context.Background(), endpoint)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if string(result.State.HTTPResponseBodySnapshot) != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected body")
+		}
+	})
+
+	t.Run("HTTP over TLS", func(t *testing.T) {
+		_, certPool, _, _ := newNetwork(t)
+		addrs := lookup(t)
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("tcp", dslx.EndpointAddress(net.JoinHostPort(addrs[0], "443")),
+			dslx.EndpointOptionDomain("www.example.com"))
+		fx := dslx.Compose3(
+			dslx.TCPConnect(pool),
+			dslx.TLSHandshake(pool, dslx.TLSHandshakeOptionRootCAs(certPool)),
+			dslx.HTTPRequestOverTLS(),
+		)
+		result := fx.Apply(context.Background(), endpoint)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if string(result.State.HTTPResponseBodySnapshot) != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected body")
+		}
+	})
+
+	t.Run("HTTP over QUIC", func(t *testing.T) {
+		network, certPool, config, handler := newNetwork(t)
+		pconn, err := network.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h3srv := &http3.Server{Handler: handler, TLSConfig: config}
+		done := make(chan any)
+		go func() {
+			defer close(done)
+			h3srv.Serve(pconn)
+		}()
+		defer func() {
+			h3srv.Close()
+			pconn.Close()
+			<-done
+		}()
+		addrs := lookup(t)
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("udp", dslx.EndpointAddress(net.JoinHostPort(addrs[0], "443")),
+			dslx.EndpointOptionDomain("www.example.com"))
+		fx := dslx.Compose3(
+			dslx.QUICHandshake(pool, dslx.QUICHandshakeOptionRootCAs(certPool)),
+			dslx.HTTPTransportQUIC(),
+			dslx.HTTPRequest(),
+		)
+		result := fx.Apply(context.Background(), endpoint)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if string(result.State.HTTPResponseBodySnapshot) != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected body")
+		}
+	})
+
+	t.Run("TLS handshake reset by a censor", func(t *testing.T) {
+		network, certPool, _, _ := newNetwork(t)
+		network.SetFilter(func(packet *memnet.Packet) *memnet.Verdict {
+			// the ClientHello starts with a TLS handshake record
+			if len(packet.Payload) > 0 && packet.Payload[0] == 0x16 &&
+				bytes.Contains(packet.Payload, []byte("www.example.com")) {
+				return &memnet.Verdict{Action: memnet.ActionReset}
+			}
+			return nil
+		})
+		pool := &dslx.ConnPool{}
+		defer pool.Close()
+		endpoint := dslx.NewEndpoint("tcp", "10.0.0.2:443", dslx.EndpointOptionDomain("www.example.com"))
+		fx := dslx.Compose2(
+			dslx.TCPConnect(pool),
+			dslx.TLSHandshake(pool, dslx.TLSHandshakeOptionRootCAs(certPool)),
+		)
+		result := fx.Apply(context.Background(), endpoint)
+		if result.Error == nil || result.Error.Error() != netxlite.FailureConnectionReset {
+			t.Fatal("unexpected error", result.Error)
+		}
+	})
+}
+
+func TestContextWithUnderlyingNetwork(t *testing.T) {
+	// Each subtest runs in parallel using its own network bound to the
+	// context, so the same domain resolves to distinct addresses.
+	for _, addr := range []string{"10.0.0.2", "10.0.0.3"} {
+		addr := addr
+		t.Run(addr, func(t *testing.T) {
+			t.Parallel()
+			network := memnet.New("10.0.0.1")
+			network.AddDNSRecord("www.example.com", "", addr)
+			listener, err := network.ListenTCP(net.JoinHostPort(addr, "7"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			go echoServer(listener)
+			ctx := netxlite.ContextWithUnderlyingNetwork(context.Background(), network)
+			reso := netxlite.NewStdlibResolver(model.DiscardLogger)
+			dialer := netxlite.NewDialerWithResolver(model.DiscardLogger, reso)
+			conn, err := dialer.DialContext(ctx, "tcp", "www.example.com:7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if conn.RemoteAddr().String() != net.JoinHostPort(addr, "7") {
+				t.Fatal("unexpected remote address", conn.RemoteAddr())
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package memnet
+
+//
+// The simulated network
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/netxlite"
+	"github.com/bassosimone/oonidsl/internal/runtimex"
+)
+
+// dnsEntry is an entry inside the DNS zone.
+type dnsEntry struct {
+	// cname is the OPTIONAL CNAME.
+	cname string
+
+	// addrs contains the IP addresses.
+	addrs []string
+}
+
+// Network is an in-memory network implementing model.UnderlyingNetwork. The
+// zero value is invalid; please, use New to construct.
+type Network struct {
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// clientIP is the IP address of the client host.
+	clientIP net.IP
+
+	// filterFunc is the OPTIONAL filter.
+	filterFunc Filter
+
+	// nextPort is the next ephemeral port to use.
+	nextPort int
+
+	// tcpListeners maps an endpoint to the listener.
+	tcpListeners map[string]*streamListener
+
+	// udpConns maps an endpoint to the UDP conn.
+	udpConns map[string]*udpLikeConn
+
+	// zone is the DNS zone.
+	zone map[string]*dnsEntry
+}
+
+var _ model.UnderlyingNetwork = &Network{}
+
+// firstEphemeralPort is the first ephemeral port we use.
+const firstEphemeralPort = 49152
+
+// New creates a new Network where the client host has the given IP
+// address. This function panics if clientIP is not a valid IP address.
+func New(clientIP string) *Network {
+	ip := net.ParseIP(clientIP)
+	runtimex.PanicIfTrue(ip == nil, "memnet: invalid client IP address")
+	return &Network{
+		mu:           sync.Mutex{},
+		clientIP:     ip,
+		filterFunc:   nil,
+		nextPort:     firstEphemeralPort,
+		tcpListeners: map[string]*streamListener{},
+		udpConns:     map[string]*udpLikeConn{},
+		zone:         map[string]*dnsEntry{},
+	}
+}
+
+// ClientIP returns the IP address of the client host.
+func (n *Network) ClientIP() string {
+	return n.clientIP.String()
+}
+
+// AddDNSRecord adds to the DNS zone a record mapping domain to the given
+// OPTIONAL cname and IP addresses. An entry without addresses causes lookups
+// to fail with a no answer error. Lookups for domains that are not in the
+// zone fail with a no such host error.
+func (n *Network) AddDNSRecord(domain, cname string, addrs ...string) {
+	defer n.mu.Unlock()
+	n.mu.Lock()
+	n.zone[dnsCanonicalName(domain)] = &dnsEntry{
+		cname: cname,
+		addrs: append([]string{}, addrs...),
+	}
+}
+
+// dnsCanonicalName returns the canonical name of a domain.
+func dnsCanonicalName(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// lookup searches for domain inside the zone.
+func (n *Network) lookup(domain string) (*dnsEntry, bool) {
+	defer n.mu.Unlock()
+	n.mu.Lock()
+	entry, found := n.zone[dnsCanonicalName(domain)]
+	return entry, found
+}
+
+// SetFilter sets the filter deciding the fate of each packet. A nil
+// filter, which is the default, passes all packets.
+func (n *Network) SetFilter(f Filter) {
+	defer n.mu.Unlock()
+	n.mu.Lock()
+	n.filterFunc = f
+}
+
+// filter applies the filter to the given packet.
+func (n *Network) filter(packet *Packet) *Verdict {
+	n.mu.Lock()
+	f := n.filterFunc
+	n.mu.Unlock()
+	if f == nil {
+		return &Verdict{Action: ActionPass}
+	}
+	verdict := f(packet)
+	if verdict == nil {
+		return &Verdict{Action: ActionPass}
+	}
+	return verdict
+}
+
+// ephemeralPortLocked returns a free ephemeral port for the given IP address. This
+// function assumes the caller is holding the mutex.
+func (n *Network) ephemeralPortLocked(ip net.IP, inuse func(endpoint string) bool) (int, error) {
+	for attempts := 0; attempts < 65536-firstEphemeralPort; attempts++ {
+		port := n.nextPort
+		n.nextPort++
+		if n.nextPort > 65535 {
+			n.nextPort = firstEphemeralPort
+		}
+		endpoint := net.JoinHostPort(ip.String(), fmt.Sprint(port))
+		if !inuse(endpoint) {
+			return port, nil
+		}
+	}
+	return 0, syscall.EADDRNOTAVAIL
+}
+
+// ListenTCP creates a TCP listener for the given endpoint (e.g., 10.0.0.1:443),
+// which must contain an IP address and a nonzero port.
+func (n *Network) ListenTCP(endpoint string) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() || addr.Port == 0 {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: addr, Err: syscall.EINVAL}
+	}
+	defer n.mu.Unlock()
+	n.mu.Lock()
+	key := addr.String()
+	if _, found := n.tcpListeners[key]; found {
+		return nil, &net.OpError{
+			Op:   "listen",
+			Net:  "tcp",
+			Addr: addr,
+			Err:  os.NewSyscallError("bind", syscall.EADDRINUSE),
+		}
+	}
+	listener := &streamListener{
+		network:   n,
+		addr:      addr,
+		backlog:   make(chan *streamConn, 128),
+		closed:    make(chan any),
+		closeOnce: sync.Once{},
+	}
+	n.tcpListeners[key] = listener
+	return listener, nil
+}
+
+// removeStreamListener removes the given listener.
+func (n *Network) removeStreamListener(l *streamListener) {
+	defer n.mu.Unlock()
+	n.mu.Lock()
+	delete(n.tcpListeners, l.addr.String())
+}
+
+// removeUDPLikeConn removes the given UDP conn.
+func (n *Network) removeUDPLikeConn(c *udpLikeConn) {
+	defer n.mu.Unlock()
+	n.mu.Lock()
+	delete(n.udpConns, c.local.String())
+}
+
+// deliverUDP delivers a datagram to the conn bound to dest, if any.
+func (n *Network) deliverUDP(source, dest *net.UDPAddr, payload []byte) {
+	n.mu.Lock()
+	conn := n.udpConns[dest.String()]
+	n.mu.Unlock()
+	if conn != nil {
+		conn.deliver(source, payload)
+	}
+}
+
+// DialContext implements model.UnderlyingNetwork.
+func (n *Network) DialContext(
+	ctx context.Context, timeout time.Duration, network, address string) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return n.dialTCP(ctx, address)
+	case "udp", "udp4", "udp6":
+		return n.dialUDP(address)
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+}
+
+// dialTCP implements DialContext for TCP.
+func (n *Network) dialTCP(ctx context.Context, address string) (net.Conn, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	n.mu.Lock()
+	port, err := n.ephemeralPortLocked(n.clientIP, func(endpoint string) bool {
+		return false // we can reuse a port with a distinct remote endpoint
+	})
+	n.mu.Unlock()
+	laddr := &net.TCPAddr{IP: n.clientIP, Port: port}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Source: laddr, Addr: raddr, Err: err}
+	}
+	verdict := n.filter(&Packet{
+		Network:     "tcp",
+		Source:      laddr.String(),
+		Destination: raddr.String(),
+		Payload:     nil,
+	})
+	switch verdict.Action {
+	case ActionDrop:
+		<-ctx.Done()
+		err := ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = os.ErrDeadlineExceeded
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Source: laddr, Addr: raddr, Err: err}
+	case ActionReset:
+		return nil, n.connectionRefused(laddr, raddr)
+	}
+	n.mu.Lock()
+	listener := n.tcpListeners[raddr.String()]
+	n.mu.Unlock()
+	if listener == nil {
+		return nil, n.connectionRefused(laddr, raddr)
+	}
+	cconn, sconn := newStreamConnPair(n, laddr, raddr)
+	select {
+	case listener.backlog <- sconn:
+		return cconn, nil
+	case <-listener.closed:
+		return nil, n.connectionRefused(laddr, raddr)
+	case <-ctx.Done():
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Source: laddr, Addr: raddr, Err: ctx.Err()}
+	}
+}
+
+// connectionRefused returns a connection refused error.
+func (n *Network) connectionRefused(laddr, raddr *net.TCPAddr) error {
+	return &net.OpError{
+		Op:     "dial",
+		Net:    "tcp",
+		Source: laddr,
+		Addr:   raddr,
+		Err:    os.NewSyscallError("connect", syscall.ECONNREFUSED),
+	}
+}
+
+// dialUDP implements DialContext for UDP.
+func (n *Network) dialUDP(address string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "udp", Err: err}
+	}
+	pconn, err := n.listenUDP(&net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{udpLikeConn: pconn, remote: raddr}, nil
+}
+
+// ListenUDP implements model.UnderlyingNetwork. When addr has no IP address
+// or an unspecified IP address, we bind to the client IP address. When the
+// port is zero, we use an ephemeral port.
+func (n *Network) ListenUDP(network string, addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	if addr == nil {
+		addr = &net.UDPAddr{}
+	}
+	return n.listenUDP(addr)
+}
+
+// listenUDP implements ListenUDP.
+func (n *Network) listenUDP(addr *net.UDPAddr) (*udpLikeConn, error) {
+	ip := addr.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = n.clientIP
+	}
+	defer n.mu.Unlock()
+	n.mu.Lock()
+	port := addr.Port
+	if port == 0 {
+		var err error
+		port, err = n.ephemeralPortLocked(ip, func(endpoint string) bool {
+			_, found := n.udpConns[endpoint]
+			return found
+		})
+		if err != nil {
+			return nil, &net.OpError{Op: "listen", Net: "udp", Addr: addr, Err: err}
+		}
+	}
+	local := &net.UDPAddr{IP: ip, Port: port}
+	key := local.String()
+	if _, found := n.udpConns[key]; found {
+		return nil, &net.OpError{
+			Op:   "listen",
+			Net:  "udp",
+			Addr: local,
+			Err:  os.NewSyscallError("bind", syscall.EADDRINUSE),
+		}
+	}
+	conn := newUDPLikeConn(n, local)
+	n.udpConns[key] = conn
+	return conn, nil
+}
+
+// GetaddrinfoLookupANY implements model.UnderlyingNetwork.
+func (n *Network) GetaddrinfoLookupANY(ctx context.Context, domain string) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	if net.ParseIP(domain) != nil {
+		return []string{domain}, "", nil
+	}
+	entry, found := n.lookup(domain)
+	if !found {
+		return nil, "", &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+	if len(entry.addrs) <= 0 {
+		return nil, "", netxlite.ErrOODNSNoAnswer
+	}
+	return append([]string{}, entry.addrs...), entry.cname, nil
+}
+
+// GetaddrinfoResolverNetwork implements model.UnderlyingNetwork.
+func (n *Network) GetaddrinfoResolverNetwork() string {
+	return netxlite.StdlibResolverGetaddrinfo
+}
@@ -0,0 +1,309 @@
+package memnet
+
+//
+// In-memory TCP connections
+//
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// streamBuffer contains the data flowing in a direction of a streamConn.
+type streamBuffer struct {
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// data is the data the reader has not read yet.
+	data []byte
+
+	// eof indicates that the writer closed the conn.
+	eof bool
+
+	// reset indicates that the flow has been reset.
+	reset bool
+
+	// notify is posted in nonblocking mode when the state changes.
+	notify chan any
+}
+
+// newStreamBuffer creates a new streamBuffer.
+func newStreamBuffer() *streamBuffer {
+	return &streamBuffer{notify: make(chan any, 1)}
+}
+
+// update runs fx with the mutex locked and notifies the reader.
+func (sb *streamBuffer) update(fx func()) {
+	sb.mu.Lock()
+	fx()
+	sb.mu.Unlock()
+	select {
+	case sb.notify <- true:
+	default:
+	}
+}
+
+// write appends data to the buffer.
+func (sb *streamBuffer) write(data []byte) {
+	sb.update(func() {
+		sb.data = append(sb.data, data...)
+	})
+}
+
+// closeWrite indicates that the writer won't write anymore.
+func (sb *streamBuffer) closeWrite() {
+	sb.update(func() {
+		sb.eof = true
+	})
+}
+
+// setReset marks the flow as reset.
+func (sb *streamBuffer) setReset() {
+	sb.update(func() {
+		sb.reset = true
+		sb.data = nil
+	})
+}
+
+// isReset returns whether the flow has been reset.
+func (sb *streamBuffer) isReset() bool {
+	defer sb.mu.Unlock()
+	sb.mu.Lock()
+	return sb.reset
+}
+
+// tryRead attempts to read from the buffer. The boolean return
+// value is false when the caller should wait for more data.
+func (sb *streamBuffer) tryRead(b []byte) (int, bool, error) {
+	defer sb.mu.Unlock()
+	sb.mu.Lock()
+	if sb.reset {
+		return 0, true, syscall.ECONNRESET
+	}
+	if len(sb.data) > 0 {
+		count := copy(b, sb.data)
+		sb.data = sb.data[count:]
+		return count, true, nil
+	}
+	if sb.eof {
+		return 0, true, io.EOF
+	}
+	return 0, false, nil
+}
+
+// streamConn is an in-memory TCP net.Conn.
+type streamConn struct {
+	// network is the network that created us.
+	network *Network
+
+	// local is the local address.
+	local *net.TCPAddr
+
+	// remote is the remote address.
+	remote *net.TCPAddr
+
+	// rx is the buffer from which we read.
+	rx *streamBuffer
+
+	// tx is the buffer to which we write.
+	tx *streamBuffer
+
+	// closed is closed by Close.
+	closed chan any
+
+	// closeOnce allows to close just once.
+	closeOnce sync.Once
+
+	// readDeadline is the read deadline.
+	readDeadline *deadline
+
+	// writeDeadline is the write deadline.
+	writeDeadline *deadline
+}
+
+var _ net.Conn = &streamConn{}
+
+// newStreamConnPair creates a pair of connected streamConns.
+func newStreamConnPair(network *Network, client, server *net.TCPAddr) (*streamConn, *streamConn) {
+	c2s, s2c := newStreamBuffer(), newStreamBuffer()
+	cconn := &streamConn{
+		network:       network,
+		local:         client,
+		remote:        server,
+		rx:            s2c,
+		tx:            c2s,
+		closed:        make(chan any),
+		closeOnce:     sync.Once{},
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	sconn := &streamConn{
+		network:       network,
+		local:         server,
+		remote:        client,
+		rx:            c2s,
+		tx:            s2c,
+		closed:        make(chan any),
+		closeOnce:     sync.Once{},
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	return cconn, sconn
+}
+
+// opError creates a new *net.OpError.
+func (c *streamConn) opError(op string, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    "tcp",
+		Source: c.local,
+		Addr:   c.remote,
+		Err:    err,
+	}
+}
+
+// Read implements net.Conn.Read.
+func (c *streamConn) Read(b []byte) (int, error) {
+	for {
+		if isClosedChan(c.closed) {
+			return 0, c.opError("read", net.ErrClosed)
+		}
+		count, done, err := c.rx.tryRead(b)
+		if done {
+			if err != nil && err != io.EOF {
+				err = c.opError("read", os.NewSyscallError("read", err))
+			}
+			return count, err
+		}
+		select {
+		case <-c.rx.notify:
+		case <-c.closed:
+		case <-c.readDeadline.wait():
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// Write implements net.Conn.Write.
+func (c *streamConn) Write(b []byte) (int, error) {
+	if isClosedChan(c.closed) {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	}
+	if c.rx.isReset() {
+		return 0, c.opError("write", os.NewSyscallError("write", syscall.ECONNRESET))
+	}
+	if len(b) <= 0 {
+		return 0, nil
+	}
+	verdict := c.network.filter(&Packet{
+		Network:     "tcp",
+		Source:      c.local.String(),
+		Destination: c.remote.String(),
+		Payload:     b,
+	})
+	switch verdict.Action {
+	case ActionDrop:
+		// nothing
+	case ActionReset:
+		c.rx.setReset()
+		c.tx.setReset()
+	case ActionInject:
+		c.rx.write(verdict.Inject)
+	default:
+		c.tx.write(b)
+	}
+	return len(b), nil
+}
+
+// Close implements net.Conn.Close.
+func (c *streamConn) Close() (err error) {
+	err = c.opError("close", net.ErrClosed)
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.tx.closeWrite()
+		err = nil
+	})
+	return
+}
+
+// LocalAddr implements net.Conn.LocalAddr.
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr.
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline implements net.Conn.SetDeadline.
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.SetReadDeadline.
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.SetWriteDeadline.
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// streamListener is an in-memory TCP net.Listener.
+type streamListener struct {
+	// network is the network that created us.
+	network *Network
+
+	// addr is the address where we're listening.
+	addr *net.TCPAddr
+
+	// backlog contains the conns to accept.
+	backlog chan *streamConn
+
+	// closed is closed by Close.
+	closed chan any
+
+	// closeOnce allows to close just once.
+	closeOnce sync.Once
+}
+
+var _ net.Listener = &streamListener{}
+
+// Accept implements net.Listener.Accept.
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.backlog:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close implements net.Listener.Close.
+func (l *streamListener) Close() (err error) {
+	err = &net.OpError{Op: "close", Net: "tcp", Addr: l.addr, Err: net.ErrClosed}
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.network.removeStreamListener(l)
+		err = nil
+	})
+	return
+}
+
+// Addr implements net.Listener.Addr.
+func (l *streamListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,237 @@
+package memnet
+
+//
+// In-memory UDP sockets
+//
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+)
+
+// udpDatagram is a datagram in flight.
+type udpDatagram struct {
+	// payload is the datagram payload.
+	payload []byte
+
+	// source is the source address.
+	source *net.UDPAddr
+}
+
+// udpQueueSize is the maximum number of datagrams we queue for a
+// socket. When the queue is full, we drop incoming datagrams.
+const udpQueueSize = 1024
+
+// udpLikeConn is an in-memory model.UDPLikeConn.
+type udpLikeConn struct {
+	// network is the network that created us.
+	network *Network
+
+	// local is the local address.
+	local *net.UDPAddr
+
+	// queue contains the incoming datagrams.
+	queue chan *udpDatagram
+
+	// closed is closed by Close.
+	closed chan any
+
+	// closeOnce allows to close just once.
+	closeOnce sync.Once
+
+	// readDeadline is the read deadline.
+	readDeadline *deadline
+
+	// writeDeadline is the write deadline.
+	writeDeadline *deadline
+}
+
+var _ model.UDPLikeConn = &udpLikeConn{}
+
+// newUDPLikeConn creates a new udpLikeConn.
+func newUDPLikeConn(network *Network, local *net.UDPAddr) *udpLikeConn {
+	return &udpLikeConn{
+		network:       network,
+		local:         local,
+		queue:         make(chan *udpDatagram, udpQueueSize),
+		closed:        make(chan any),
+		closeOnce:     sync.Once{},
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+}
+
+// opError creates a new *net.OpError.
+func (c *udpLikeConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    "udp",
+		Source: c.local,
+		Addr:   addr,
+		Err:    err,
+	}
+}
+
+// deliver delivers a datagram to this conn.
+func (c *udpLikeConn) deliver(source *net.UDPAddr, payload []byte) {
+	datagram := &udpDatagram{
+		payload: append([]byte{}, payload...),
+		source:  source,
+	}
+	select {
+	case c.queue <- datagram:
+	default: // the queue is full
+	}
+}
+
+// WriteTo implements model.UDPLikeConn.WriteTo.
+func (c *udpLikeConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if isClosedChan(c.closed) {
+		return 0, c.opError("write", addr, net.ErrClosed)
+	}
+	if isClosedChan(c.writeDeadline.wait()) {
+		return 0, c.opError("write", addr, os.ErrDeadlineExceeded)
+	}
+	dest, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, c.opError("write", addr, err)
+	}
+	verdict := c.network.filter(&Packet{
+		Network:     "udp",
+		Source:      c.local.String(),
+		Destination: dest.String(),
+		Payload:     p,
+	})
+	switch verdict.Action {
+	case ActionDrop, ActionReset:
+		// nothing
+	case ActionInject:
+		c.deliver(dest, verdict.Inject)
+	default:
+		c.network.deliverUDP(c.local, dest, p)
+	}
+	return len(p), nil
+}
+
+// ReadFrom implements model.UDPLikeConn.ReadFrom.
+func (c *udpLikeConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case datagram := <-c.queue:
+		return copy(p, datagram.payload), datagram.source, nil
+	case <-c.closed:
+		return 0, nil, c.opError("read", nil, net.ErrClosed)
+	case <-c.readDeadline.wait():
+		return 0, nil, c.opError("read", nil, os.ErrDeadlineExceeded)
+	}
+}
+
+// Close implements model.UDPLikeConn.Close.
+func (c *udpLikeConn) Close() (err error) {
+	err = c.opError("close", nil, net.ErrClosed)
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.removeUDPLikeConn(c)
+		err = nil
+	})
+	return
+}
+
+// LocalAddr implements model.UDPLikeConn.LocalAddr.
+func (c *udpLikeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// SetDeadline implements model.UDPLikeConn.SetDeadline.
+func (c *udpLikeConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements model.UDPLikeConn.SetReadDeadline.
+func (c *udpLikeConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements model.UDPLikeConn.SetWriteDeadline.
+func (c *udpLikeConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadBuffer implements model.UDPLikeConn.SetReadBuffer.
+func (c *udpLikeConn) SetReadBuffer(bytes int) error {
+	return nil
+}
+
+// SyscallConn implements model.UDPLikeConn.SyscallConn.
+func (c *udpLikeConn) SyscallConn() (syscall.RawConn, error) {
+	return &udpRawConn{}, nil
+}
+
+// udpRawConn is the syscall.RawConn returned by udpLikeConn.SyscallConn. Because
+// there is no socket, its methods never invoke the callback function.
+type udpRawConn struct{}
+
+var _ syscall.RawConn = &udpRawConn{}
+
+// errNoSocket indicates that there is no socket.
+var errNoSocket = errors.New("memnet: no socket")
+
+// Control implements syscall.RawConn.Control. We return nil rather than an error,
+// such that quic-go does not fail when it tries to configure the socket.
+func (*udpRawConn) Control(f func(fd uintptr)) error {
+	return nil
+}
+
+// Read implements syscall.RawConn.Read.
+func (*udpRawConn) Read(f func(fd uintptr) (done bool)) error {
+	return errNoSocket
+}
+
+// Write implements syscall.RawConn.Write.
+func (*udpRawConn) Write(f func(fd uintptr) (done bool)) error {
+	return errNoSocket
+}
+
+// udpConn is a connected in-memory UDP net.Conn.
+type udpConn struct {
+	*udpLikeConn
+
+	// remote is the remote address.
+	remote *net.UDPAddr
+}
+
+var _ net.Conn = &udpConn{}
+
+// Read implements net.Conn.Read. Like connected UDP sockets, we
+// ignore datagrams that do not come from the remote address.
+func (c *udpConn) Read(b []byte) (int, error) {
+	for {
+		count, addr, err := c.udpLikeConn.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if addr.String() != c.remote.String() {
+			continue
+		}
+		return count, nil
+	}
+}
+
+// Write implements net.Conn.Write.
+func (c *udpConn) Write(b []byte) (int, error) {
+	return c.udpLikeConn.WriteTo(b, c.remote)
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr.
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -28,6 +28,9 @@ const (
 	// HTTPRoundTripOperation is the HTTP round trip.
 	HTTPRoundTripOperation = "http_round_trip"
 
+	// WebSocketHandshakeOperation is the WebSocket opening handshake.
+	WebSocketHandshakeOperation = "websocket_handshake"
+
 	// CloseOperation is when we close a socket.
 	CloseOperation = "close"
 
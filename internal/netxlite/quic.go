@@ -29,7 +29,33 @@ var _ model.QUICListener = &quicListenerStdlib{}
 
 // Listen implements QUICListener.Listen.
 func (qls *quicListenerStdlib) Listen(addr *net.UDPAddr) (model.UDPLikeConn, error) {
-	return TProxy.ListenUDP("udp", addr)
+	return qls.listenContext(context.Background(), addr)
+}
+
+// listenContext implements quicListenerContext.
+func (qls *quicListenerStdlib) listenContext(
+	ctx context.Context, addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	return ContextUnderlyingNetworkOrDefault(ctx).ListenUDP("udp", addr)
+}
+
+// quicListenerContext is a QUICListener that can use the UnderlyingNetwork
+// bound to a context. Because QUICListener.Listen does not take a context,
+// the QUIC dialer uses quicListenerListenContext, which calls listenContext
+// when the listener implements this interface and Listen otherwise. The
+// listeners and the wrappers we define in this package implement this
+// interface, while third-party wrappers fall back to using TProxy.
+type quicListenerContext interface {
+	listenContext(ctx context.Context, addr *net.UDPAddr) (model.UDPLikeConn, error)
+}
+
+// quicListenerListenContext calls listener's listenContext when possible and
+// otherwise falls back to calling listener's Listen.
+func quicListenerListenContext(
+	ctx context.Context, listener model.QUICListener, addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	if lc, good := listener.(quicListenerContext); good {
+		return lc.listenContext(ctx, addr)
+	}
+	return listener.Listen(addr)
 }
 
 // NewQUICDialerWithResolver is the WrapDialer equivalent for QUIC where
@@ -129,7 +155,8 @@ func (d *quicDialerQUICGo) DialContext(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
-	pconn, err := d.QUICListener.Listen(&net.UDPAddr{IP: net.IPv4zero, Port: 0, Zone: ""})
+	pconn, err := quicListenerListenContext(
+		ctx, d.QUICListener, &net.UDPAddr{IP: net.IPv4zero, Port: 0, Zone: ""})
 	if err != nil {
 		return nil, err
 	}
@@ -141,8 +168,11 @@ func (d *quicDialerQUICGo) DialContext(ctx context.Context,
 	qconn, err := d.dialEarlyContext(
 		ctx, pconn, udpAddr, address, tlsConfig, quicConfig)
 	finished := trace.TimeNow()
-	err = MaybeNewErrWrapper(ClassifyQUICHandshakeError, QUICHandshakeOperation, err)
-	trace.OnQUICHandshakeDone(started, address, qconn, tlsConfig, err, finished)
+	if err != nil {
+		err = NewErrWrapper(ClassifyQUICHandshakeError, QUICHandshakeOperation, err).withDetails(
+			finished.Sub(started), "", address)
+	}
+	trace.OnQUICHandshakeDone(started, address, qconn, tlsConfig, quicConfig, err, finished)
 	if err != nil {
 		pconn.Close() // we own it on failure
 		return nil, err
@@ -385,7 +415,13 @@ var _ model.QUICListener = &quicListenerErrWrapper{}
 
 // Listen implements QUICListener.Listen.
 func (qls *quicListenerErrWrapper) Listen(addr *net.UDPAddr) (model.UDPLikeConn, error) {
-	pconn, err := qls.QUICListener.Listen(addr)
+	return qls.listenContext(context.Background(), addr)
+}
+
+// listenContext implements quicListenerContext.
+func (qls *quicListenerErrWrapper) listenContext(
+	ctx context.Context, addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	pconn, err := quicListenerListenContext(ctx, qls.QUICListener, addr)
 	if err != nil {
 		return nil, NewErrWrapper(ClassifyGenericError, QUICListenOperation, err)
 	}
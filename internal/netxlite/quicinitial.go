@@ -0,0 +1,120 @@
+package netxlite
+
+//
+// Shaping the QUIC Initial packets
+//
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/lucas-clemente/quic-go"
+)
+
+// QUICVersionString returns a string representation of the given QUIC version.
+func QUICVersionString(version quic.VersionNumber) string {
+	switch version {
+	case quic.Version1:
+		return "v1"
+	case quic.Version2:
+		return "v2"
+	case quic.VersionDraft29:
+		return "draft-29"
+	default:
+		return fmt.Sprintf("0x%08x", uint32(version))
+	}
+}
+
+// QUICVersionStrings is like QUICVersionString but for a list of versions.
+func QUICVersionStrings(versions []quic.VersionNumber) (out []string) {
+	for _, version := range versions {
+		out = append(out, QUICVersionString(version))
+	}
+	return
+}
+
+// QUICMinInitialPacketSize is the minimum size of UDP datagrams
+// containing QUIC Initial packets sent by clients (RFC 9000 Sec. 14.1).
+const QUICMinInitialPacketSize = 1200
+
+// NewQUICListenerWithInitialPacketSize wraps the given listener such that
+// the UDP datagrams containing QUIC Initial packets are padded with zero bytes
+// until they're size bytes long. The peer ignores the zero bytes because they
+// do not parse as a valid QUIC packet (RFC 9000 Sec. 12.2).
+//
+// The QUIC library already pads such datagrams to QUICMinInitialPacketSize
+// bytes, so a size smaller than that does not have any effect. Be careful with
+// sizes larger than the path MTU, because the datagrams would be dropped.
+func NewQUICListenerWithInitialPacketSize(listener model.QUICListener, size int) model.QUICListener {
+	return &quicListenerInitialPacketSize{QUICListener: listener, size: size}
+}
+
+// QUICListenerInitialPacketSize returns the size of the datagrams containing QUIC Initial
+// packets configured using NewQUICListenerWithInitialPacketSize, or zero when the given
+// listener has not been created by NewQUICListenerWithInitialPacketSize.
+func QUICListenerInitialPacketSize(listener model.QUICListener) int {
+	if ql, good := listener.(*quicListenerInitialPacketSize); good {
+		return ql.size
+	}
+	return 0
+}
+
+// quicListenerInitialPacketSize is the listener returned by NewQUICListenerWithInitialPacketSize.
+type quicListenerInitialPacketSize struct {
+	model.QUICListener
+	size int
+}
+
+// Listen implements model.QUICListener.Listen.
+func (ql *quicListenerInitialPacketSize) Listen(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	return ql.listenContext(context.Background(), addr)
+}
+
+// listenContext implements quicListenerContext.
+func (ql *quicListenerInitialPacketSize) listenContext(
+	ctx context.Context, addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	pconn, err := quicListenerListenContext(ctx, ql.QUICListener, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &quicInitialPacketSizeConn{UDPLikeConn: pconn, size: ql.size}, nil
+}
+
+// quicInitialPacketSizeConn is the conn returned by quicListenerInitialPacketSize.
+type quicInitialPacketSizeConn struct {
+	model.UDPLikeConn
+	size int
+}
+
+// WriteTo implements model.UDPLikeConn.WriteTo.
+func (c *quicInitialPacketSizeConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) >= c.size || !quicIsInitialPacket(p) {
+		return c.UDPLikeConn.WriteTo(p, addr)
+	}
+	padded := make([]byte, c.size)
+	copy(padded, p)
+	if _, err := c.UDPLikeConn.WriteTo(padded, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil // pretend we only wrote what the caller passed us
+}
+
+// quicIsInitialPacket returns whether the first packet in the given
+// datagram is a QUIC Initial packet for a version we know.
+func quicIsInitialPacket(p []byte) bool {
+	if len(p) < 5 || p[0]&0x80 == 0 { // not a long header packet
+		return false
+	}
+	packetType := (p[0] & 0x30) >> 4
+	switch quic.VersionNumber(binary.BigEndian.Uint32(p[1:5])) {
+	case quic.Version1, quic.VersionDraft29:
+		return packetType == 0
+	case quic.Version2:
+		return packetType == 1 // see RFC 9369 Sec. 3.2
+	default:
+		return false
+	}
+}
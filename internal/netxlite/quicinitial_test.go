@@ -0,0 +1,160 @@
+package netxlite
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/model/mocks"
+	"github.com/google/go-cmp/cmp"
+	"github.com/lucas-clemente/quic-go"
+)
+
+func TestQUICVersionString(t *testing.T) {
+	versions := []quic.VersionNumber{quic.Version1, quic.Version2, quic.VersionDraft29, 0x1a2a3a4a}
+	expect := []string{"v1", "v2", "draft-29", "0x1a2a3a4a"}
+	if diff := cmp.Diff(expect, QUICVersionStrings(versions)); diff != "" {
+		t.Fatal(diff)
+	}
+	if QUICVersionStrings(nil) != nil {
+		t.Fatal("expected nil")
+	}
+}
+
+func Test_quicIsInitialPacket(t *testing.T) {
+	inputs := map[string]struct {
+		packet []byte
+		expect bool
+	}{
+		"too short":              {[]byte{0xc0, 0, 0}, false},
+		"short header":           {[]byte{0x40, 0, 0, 0, 1}, false},
+		"v1 Initial":             {[]byte{0xc0, 0, 0, 0, 1}, true},
+		"v1 Handshake":           {[]byte{0xe0, 0, 0, 0, 1}, false},
+		"draft-29 Initial":       {[]byte{0xc3, 0xff, 0, 0, 0x1d}, true},
+		"v2 Initial":             {[]byte{0xd0, 0x70, 0x9a, 0x50, 0xc4}, true},
+		"v2 0-RTT":               {[]byte{0xe0, 0x70, 0x9a, 0x50, 0xc4}, false},
+		"version negotiation":    {[]byte{0xc0, 0, 0, 0, 0}, false},
+		"unknown version":        {[]byte{0xc0, 0x1a, 0x2a, 0x3a, 0x4a}, false},
+		"v1 Initial with a body": {append([]byte{0xc1, 0, 0, 0, 1}, make([]byte, 64)...), true},
+	}
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			if got := quicIsInitialPacket(input.packet); got != input.expect {
+				t.Fatal("expected", input.expect, "got", got)
+			}
+		})
+	}
+}
+
+func TestNewQUICListenerWithInitialPacketSize(t *testing.T) {
+	newListener := func(written *[]byte, err error) model.QUICListener {
+		return NewQUICListenerWithInitialPacketSize(&mocks.QUICListener{
+			MockListen: func(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+				return &mocks.UDPLikeConn{
+					MockWriteTo: func(p []byte, addr net.Addr) (int, error) {
+						*written = append([]byte{}, p...)
+						if err != nil {
+							return 0, err
+						}
+						return len(p), nil
+					},
+				}, nil
+			},
+		}, 1350)
+	}
+
+	t.Run("we pad Initial packets", func(t *testing.T) {
+		var written []byte
+		pconn, err := newListener(&written, nil).Listen(&net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := append([]byte{0xc0, 0, 0, 0, 1}, make([]byte, 1195)...)
+		count, err := pconn.WriteTo(packet, &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(packet) {
+			t.Fatal("unexpected count", count)
+		}
+		if len(written) != 1350 {
+			t.Fatal("unexpected written length", len(written))
+		}
+	})
+
+	t.Run("we do not pad other packets", func(t *testing.T) {
+		var written []byte
+		pconn, err := newListener(&written, nil).Listen(&net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := []byte{0x40, 0, 0, 0, 1, 2, 3}
+		count, err := pconn.WriteTo(packet, &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(packet) || len(written) != len(packet) {
+			t.Fatal("unexpected length", count, len(written))
+		}
+	})
+
+	t.Run("we do not shrink large Initial packets", func(t *testing.T) {
+		var written []byte
+		pconn, err := newListener(&written, nil).Listen(&net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := append([]byte{0xc0, 0, 0, 0, 1}, make([]byte, 1395)...)
+		count, err := pconn.WriteTo(packet, &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1400 || len(written) != 1400 {
+			t.Fatal("unexpected length", count, len(written))
+		}
+	})
+
+	t.Run("we handle write errors", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		var written []byte
+		pconn, err := newListener(&written, expected).Listen(&net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := pconn.WriteTo([]byte{0xc0, 0, 0, 0, 1}, &net.UDPAddr{})
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected error", err)
+		}
+		if count != 0 {
+			t.Fatal("unexpected count", count)
+		}
+	})
+
+	t.Run("we handle listen errors", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		ql := NewQUICListenerWithInitialPacketSize(&mocks.QUICListener{
+			MockListen: func(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+				return nil, expected
+			},
+		}, 1350)
+		pconn, err := ql.Listen(&net.UDPAddr{})
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected error", err)
+		}
+		if pconn != nil {
+			t.Fatal("expected nil pconn")
+		}
+	})
+}
+
+func TestQUICListenerInitialPacketSize(t *testing.T) {
+	listener := NewQUICListener()
+	if size := QUICListenerInitialPacketSize(listener); size != 0 {
+		t.Fatal("unexpected size", size)
+	}
+	listener = NewQUICListenerWithInitialPacketSize(listener, 1350)
+	if size := QUICListenerInitialPacketSize(listener); size != 1350 {
+		t.Fatal("unexpected size", size)
+	}
+}
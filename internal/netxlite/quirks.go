@@ -40,15 +40,39 @@ func quirkReduceErrors(errorslist []error) error {
 		// See https://github.com/ooni/probe/issues/1985
 		return errReduceErrorsEmptyList
 	}
-	for _, err := range errorslist {
+	for idx, err := range errorslist {
 		var wrapper *ErrWrapper
 		if errors.As(err, &wrapper) && !strings.HasPrefix(
 			err.Error(), "unknown_failure",
 		) {
-			return err
+			return quirkAttachPreviousErrors(errorslist, idx)
 		}
 	}
-	return errorslist[0]
+	return quirkAttachPreviousErrors(errorslist, 0)
+}
+
+// quirkAttachPreviousErrors returns errorslist[idx] and, if it is an
+// *ErrWrapper, returns a copy of it whose Previous field contains the
+// other errors in the list (in order), so that we do not lose the
+// information about the errors discarded by quirkReduceErrors.
+func quirkAttachPreviousErrors(errorslist []error, idx int) error {
+	selected, good := errorslist[idx].(*ErrWrapper)
+	if !good || len(errorslist) <= 1 {
+		return errorslist[idx]
+	}
+	out := *selected
+	out.Previous = nil
+	for other, err := range errorslist {
+		if other == idx {
+			continue
+		}
+		previous, good := err.(*ErrWrapper)
+		if !good {
+			previous = NewTopLevelGenericErrWrapper(err)
+		}
+		out.Previous = append(out.Previous, previous)
+	}
+	return &out
 }
 
 // quirkSortIPAddrs sorts IP addresses so that IPv4 appears
@@ -49,6 +49,19 @@ func TestQuirkReduceErrors(t *testing.T) {
 		if result.Error() != FailureConnectionRefused {
 			t.Fatal("wrong result")
 		}
+		var ew *ErrWrapper
+		if !errors.As(result, &ew) {
+			t.Fatal("expected an ErrWrapper")
+		}
+		if len(ew.Previous) != 3 {
+			t.Fatal("unexpected number of previous errors", len(ew.Previous))
+		}
+		if ew.Previous[0].Failure != "unknown_failure: mocked error #1" || ew.Previous[1] != err2 {
+			t.Fatal("unexpected previous errors")
+		}
+		if len(err3.Previous) != 0 {
+			t.Fatal("we should not have modified the original error")
+		}
 	})
 }
 
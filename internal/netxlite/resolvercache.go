@@ -14,6 +14,10 @@ import (
 //
 // Bug: the returned resolver only applies caching to LookupHost and any other
 // lookup operation returns ErrNoDNSTransport to the caller.
+//
+// Deprecated: the returned resolver caches entries forever, without any bound
+// on the number of entries, and does not cache negative answers. Use a DNSCache,
+// which honours the records TTL, instead.
 func MaybeWrapWithCachingResolver(enabled bool, reso model.Resolver) model.Resolver {
 	if enabled {
 		reso = &cacheResolver{
@@ -1,15 +1,785 @@
 package netxlite
 
-import "github.com/bassosimone/oonidsl/internal/model"
+//
+// Traffic shaping
+//
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+)
+
+// ShapingPolicy describes how a Shaper should shape traffic. The zero
+// value of this structure is a valid policy that does not shape traffic.
+type ShapingPolicy struct {
+	// ReadBandwidth is the OPTIONAL maximum rate, in bytes per second, at which
+	// we receive data. When zero or negative, the rate is unlimited.
+	ReadBandwidth int64
 
-// NewMaybeShapingDialer takes in input a model.Dialer and returns in output another
-// model.Dialer that MAY dial connections with I/O shaping, depending on whether
-// the user builds with or without the `-tags shaping` CLI flag.
+	// WriteBandwidth is the OPTIONAL maximum rate, in bytes per second, at which
+	// we send data. When zero or negative, the rate is unlimited.
+	WriteBandwidth int64
+
+	// BurstSize is the OPTIONAL size, in bytes, of the token buckets we use to
+	// enforce the bandwidth. When zero or negative, we use the number of bytes
+	// we could transfer in ShapingDefaultBurstInterval.
+	BurstSize int64
+
+	// Latency is the OPTIONAL one-way delay we add when sending and when receiving,
+	// hence the round trip time increases by twice this value. We also add twice
+	// this value when establishing a new connection.
+	Latency time.Duration
+
+	// Jitter is the OPTIONAL maximum random delay we add to Latency.
+	Jitter time.Duration
+
+	// LossRate is the OPTIONAL probability, between zero and one, of losing a
+	// datagram, both when sending and when receiving. We only apply losses to
+	// UDPLikeConn, because we cannot lose segments of a TCP stream.
+	LossRate float64
+}
+
+// ShapingDefaultBurstInterval is the interval we use to compute the default
+// burst size from the bandwidth when ShapingPolicy.BurstSize is not set.
+const ShapingDefaultBurstInterval = 100 * time.Millisecond
+
+// Shaper shapes the traffic of the connections it wraps according to a
+// ShapingPolicy. All the wrapped connections share the same token buckets,
+// as if they were using the same access link. You can change the policy at
+// runtime using SetPolicy and the change applies to all the connections.
 //
-// We typically use `-tags shaping` when running integration tests for dash and ndt7 to
-// avoiod hammering m-lab servers from the very-fast GitHub CI servers.
+// A Shaper is a model.DialerWrapper, so you can pass it to the dialer
+// constructors (e.g., NewDialerWithResolver) to shape TCP connections. You
+// can use WrapQUICListener to shape QUIC traffic.
 //
-// See https://github.com/ooni/probe/issues/2112 for extra context.
-func NewMaybeShapingDialer(dialer model.Dialer) model.Dialer {
-	return newMaybeShapingDialer(dialer)
+// Use NewShaper to construct.
+type Shaper struct {
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// policy is the current policy.
+	policy ShapingPolicy
+
+	// rand is the random number generator for jitter and losses.
+	rand *rand.Rand
+
+	// readBucket is the token bucket for reading.
+	readBucket *shapingTokenBucket
+
+	// writeBucket is the token bucket for writing.
+	writeBucket *shapingTokenBucket
+}
+
+var _ model.DialerWrapper = &Shaper{}
+
+// NewShaper creates a new Shaper using the given policy. A nil policy
+// is equivalent to a zero-initialized policy.
+func NewShaper(policy *ShapingPolicy) *Shaper {
+	s := &Shaper{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.SetPolicy(policy)
+	return s
+}
+
+// SetPolicy changes the policy. A nil policy is equivalent to a
+// zero-initialized policy, which means that we stop shaping.
+func (s *Shaper) SetPolicy(policy *ShapingPolicy) {
+	if policy == nil {
+		policy = &ShapingPolicy{}
+	}
+	now := time.Now()
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	s.policy = *policy
+	s.readBucket = newShapingTokenBucket(policy.ReadBandwidth, policy.BurstSize, now)
+	s.writeBucket = newShapingTokenBucket(policy.WriteBandwidth, policy.BurstSize, now)
+}
+
+// WrapDialer implements model.DialerWrapper.
+func (s *Shaper) WrapDialer(dialer model.Dialer) model.Dialer {
+	return &shapingDialer{Dialer: dialer, shaper: s}
+}
+
+// WrapQUICListener returns a QUICListener whose listening conns are shaped.
+func (s *Shaper) WrapQUICListener(listener model.QUICListener) model.QUICListener {
+	return &shapingQUICListener{QUICListener: listener, shaper: s}
+}
+
+// WrapNetConn returns a shaped version of the given conn.
+func (s *Shaper) WrapNetConn(conn net.Conn) net.Conn {
+	read := func(b []byte) (int, net.Addr, error) {
+		count, err := conn.Read(b)
+		return count, nil, err
+	}
+	write := func(item *shapingItem) (int, error) {
+		return conn.Write(item.data)
+	}
+	return &shapingConn{Conn: conn, io: newShapingIO(s, false, read, write, conn.Close)}
+}
+
+// WrapUDPLikeConn returns a shaped version of the given conn.
+func (s *Shaper) WrapUDPLikeConn(conn model.UDPLikeConn) model.UDPLikeConn {
+	write := func(item *shapingItem) (int, error) {
+		if s.lost() {
+			return len(item.data), nil
+		}
+		return conn.WriteTo(item.data, item.addr)
+	}
+	return &shapingUDPLikeConn{
+		UDPLikeConn: conn,
+		io:          newShapingIO(s, true, conn.ReadFrom, write, conn.Close),
+	}
+}
+
+// delay returns the latency plus a random jitter.
+func (s *Shaper) delay() time.Duration {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	delay := s.policy.Latency
+	if s.policy.Jitter > 0 {
+		delay += time.Duration(s.rand.Int63n(int64(s.policy.Jitter)))
+	}
+	return delay
+}
+
+// lost returns whether we should lose the current datagram.
+func (s *Shaper) lost() bool {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	return s.policy.LossRate > 0 && s.rand.Float64() < s.policy.LossRate
+}
+
+// readChunk returns the maximum number of bytes we should read at once such
+// that the token bucket can smoothly shape the traffic (zero means no limit).
+func (s *Shaper) readChunk() int {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	return s.readBucket.maxChunk()
+}
+
+// writeChunk is like readChunk but for writing.
+func (s *Shaper) writeChunk() int {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	return s.writeBucket.maxChunk()
+}
+
+// reserveRead consumes count read tokens and returns how long we should wait.
+func (s *Shaper) reserveRead(count int) time.Duration {
+	now := time.Now()
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	return s.readBucket.reserve(count, now)
+}
+
+// reserveWrite consumes count write tokens and returns how long we should wait.
+func (s *Shaper) reserveWrite(count int) time.Duration {
+	now := time.Now()
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	return s.writeBucket.reserve(count, now)
+}
+
+// shapingTokenBucket is a token bucket where the number of tokens
+// may become negative, meaning we need to wait for the debt to be
+// repaid before sending or receiving more data.
+type shapingTokenBucket struct {
+	// rate is the rate in bytes per second (zero means unlimited).
+	rate float64
+
+	// burst is the bucket size in bytes.
+	burst float64
+
+	// tokens is the current number of tokens.
+	tokens float64
+
+	// last is the last time we updated the tokens.
+	last time.Time
+}
+
+// newShapingTokenBucket creates a new shapingTokenBucket.
+func newShapingTokenBucket(rate, burst int64, now time.Time) *shapingTokenBucket {
+	if rate <= 0 {
+		return &shapingTokenBucket{}
+	}
+	if burst <= 0 {
+		burst = int64(float64(rate) * ShapingDefaultBurstInterval.Seconds())
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &shapingTokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// maxChunk returns the maximum chunk we should transfer at once or zero
+// when the bandwidth is unlimited.
+func (tb *shapingTokenBucket) maxChunk() int {
+	return int(tb.burst)
+}
+
+// reserve consumes count tokens and returns how long we should wait.
+func (tb *shapingTokenBucket) reserve(count int, now time.Time) time.Duration {
+	if tb.rate <= 0 {
+		return 0
+	}
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	tb.tokens -= float64(count)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// shapingSleepContext sleeps for the given delay or until the context is done.
+func shapingSleepContext(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shapingLimit truncates buffer to the given limit, if the limit is positive.
+func shapingLimit(buffer []byte, limit int) []byte {
+	if limit > 0 && len(buffer) > limit {
+		return buffer[:limit]
+	}
+	return buffer
+}
+
+// shapingQueueSize is the maximum number of items we queue in each direction.
+const shapingQueueSize = 64
+
+// shapingDatagramSize is the buffer size we use to read datagrams.
+const shapingDatagramSize = 1 << 16
+
+// shapingStreamChunk is the chunk we read from streams when the read
+// bandwidth is unlimited and hence there is no maximum chunk.
+const shapingStreamChunk = 1 << 15
+
+// shapingItem is some data or an error that we deliver at a given time.
+type shapingItem struct {
+	// addr is the remote address for datagrams.
+	addr net.Addr
+
+	// at is when we should deliver this item.
+	at time.Time
+
+	// data contains the bytes to deliver.
+	data []byte
+
+	// err is the error to deliver after the bytes, if any.
+	err error
+}
+
+// shapingDeadline is a deadline that wakes up the waiters when it changes.
+type shapingDeadline struct {
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// t is the deadline (zero means no deadline).
+	t time.Time
+
+	// changed is closed (and replaced) when the deadline changes.
+	changed chan struct{}
+}
+
+// newShapingDeadline creates a new shapingDeadline.
+func newShapingDeadline() *shapingDeadline {
+	return &shapingDeadline{changed: make(chan struct{})}
+}
+
+// set changes the deadline.
+func (d *shapingDeadline) set(t time.Time) {
+	defer d.mu.Unlock()
+	d.mu.Lock()
+	d.t = t
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// get returns the deadline and a channel closed when it changes.
+func (d *shapingDeadline) get() (time.Time, <-chan struct{}) {
+	defer d.mu.Unlock()
+	d.mu.Lock()
+	return d.t, d.changed
+}
+
+// shapingWait waits until the given time (if not zero), for an item from recv (if
+// not nil), or for sending item to send (if not nil), whatever happens first. The
+// wait fails when the conn is closed or the deadline expires.
+func shapingWait(deadline *shapingDeadline, closed <-chan struct{}, at time.Time,
+	recv <-chan *shapingItem, send chan<- *shapingItem, item *shapingItem) (*shapingItem, error) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-closed:
+			return nil, net.ErrClosed
+		default:
+		}
+		now := time.Now()
+		t, changed := deadline.get()
+		if !t.IsZero() && !now.Before(t) {
+			return nil, os.ErrDeadlineExceeded
+		}
+		if !at.IsZero() && !now.Before(at) {
+			return nil, nil
+		}
+		wakeup := at
+		if wakeup.IsZero() || (!t.IsZero() && t.Before(wakeup)) {
+			wakeup = t
+		}
+		var timeout <-chan time.Time
+		if !wakeup.IsZero() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wakeup.Sub(now))
+			timeout = timer.C
+		}
+		select {
+		case <-closed:
+			return nil, net.ErrClosed
+		case <-changed:
+		case <-timeout:
+		case out := <-recv:
+			return out, nil
+		case send <- item:
+			return nil, nil
+		}
+	}
+}
+
+// shapingIO implements the latency without limiting the throughput. A background
+// goroutine reads from the underlying conn and schedules each chunk for delivery
+// after the latency. Likewise, another goroutine writes each chunk after the
+// latency, so that Write only waits for the bandwidth. All the waits honour the
+// deadlines and Close.
+type shapingIO struct {
+	// shaper is the shaper.
+	shaper *Shaper
+
+	// datagrams indicates whether we are shaping datagrams.
+	datagrams bool
+
+	// readFn reads from the underlying conn.
+	readFn func(b []byte) (int, net.Addr, error)
+
+	// writeFn writes to the underlying conn.
+	writeFn func(item *shapingItem) (int, error)
+
+	// closeFn closes the underlying conn.
+	closeFn func() error
+
+	// closeOnce allows to close just once.
+	closeOnce sync.Once
+
+	// closed is closed by Close.
+	closed chan struct{}
+
+	// readDeadline is the read deadline.
+	readDeadline *shapingDeadline
+
+	// writeDeadline is the write deadline.
+	writeDeadline *shapingDeadline
+
+	// readOnce starts the background reader on the first read.
+	readOnce sync.Once
+
+	// reads contains the items read in the background.
+	reads chan *shapingItem
+
+	// readMu serializes reads and protects head.
+	readMu sync.Mutex
+
+	// head is the item we are currently reading.
+	head *shapingItem
+
+	// writeMu serializes writes.
+	writeMu sync.Mutex
+
+	// writes contains the items to write in the background.
+	writes chan *shapingItem
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// lastWrite is the delivery time of the last write.
+	lastWrite time.Time
+
+	// pending is the number of queued writes.
+	pending int
+
+	// writerStarted indicates we've started the background writer.
+	writerStarted bool
+
+	// writeErr is the sticky error of a background stream write.
+	writeErr error
+}
+
+// newShapingIO creates a new shapingIO.
+func newShapingIO(shaper *Shaper, datagrams bool, readFn func(b []byte) (int, net.Addr, error),
+	writeFn func(item *shapingItem) (int, error), closeFn func() error) *shapingIO {
+	return &shapingIO{
+		shaper:        shaper,
+		datagrams:     datagrams,
+		readFn:        readFn,
+		writeFn:       writeFn,
+		closeFn:       closeFn,
+		closed:        make(chan struct{}),
+		readDeadline:  newShapingDeadline(),
+		writeDeadline: newShapingDeadline(),
+		reads:         make(chan *shapingItem, shapingQueueSize),
+		writes:        make(chan *shapingItem, shapingQueueSize),
+	}
+}
+
+// next returns the current item once it is time to deliver it. The caller
+// MUST hold readMu and MUST set head to nil after consuming the item.
+func (sio *shapingIO) next() (*shapingItem, error) {
+	sio.readOnce.Do(func() {
+		go sio.readLoop()
+	})
+	if sio.head == nil {
+		item, err := shapingWait(sio.readDeadline, sio.closed, time.Time{}, sio.reads, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		sio.head = item
+	}
+	if _, err := shapingWait(sio.readDeadline, sio.closed, sio.head.at, nil, nil, nil); err != nil {
+		return nil, err
+	}
+	return sio.head, nil
+}
+
+// readLoop reads from the underlying conn and schedules the delivery. We do not
+// delay errors, yet we deliver them after the data read before them.
+func (sio *shapingIO) readLoop() {
+	var last time.Time
+	var buffer []byte
+	for {
+		size := shapingDatagramSize
+		if !sio.datagrams {
+			if size = sio.shaper.readChunk(); size <= 0 {
+				size = shapingStreamChunk
+			}
+		}
+		if len(buffer) < size {
+			buffer = make([]byte, size)
+		}
+		count, addr, err := sio.readFn(buffer[:size])
+		at := time.Now()
+		if count > 0 {
+			at = at.Add(sio.shaper.delay() + sio.shaper.reserveRead(count))
+		}
+		if at.Before(last) {
+			at = last // deliver in order
+		}
+		last = at
+		if err == nil && sio.datagrams && sio.shaper.lost() {
+			continue
+		}
+		item := &shapingItem{
+			addr: addr,
+			at:   at,
+			data: append([]byte{}, buffer[:count]...),
+			err:  err,
+		}
+		select {
+		case sio.reads <- item:
+		case <-sio.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write waits for the bandwidth and writes data after the latency. When there is no
+// latency and nothing is queued, we write synchronously. Otherwise, we pretend we
+// wrote the whole data and a background goroutine writes it. For streams, errors
+// occurring in the background are returned by the next write.
+func (sio *shapingIO) write(data []byte, addr net.Addr) (int, error) {
+	defer sio.writeMu.Unlock()
+	sio.writeMu.Lock()
+	if err := sio.writeError(); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	wait := sio.shaper.reserveWrite(len(data))
+	if _, err := shapingWait(sio.writeDeadline, sio.closed, now.Add(wait), nil, nil, nil); err != nil {
+		return 0, err
+	}
+	at := now.Add(wait + sio.shaper.delay())
+	sio.mu.Lock()
+	if at.Before(sio.lastWrite) {
+		at = sio.lastWrite // deliver in order
+	}
+	sio.lastWrite = at
+	inline := sio.pending <= 0 && !time.Now().Before(at)
+	if !inline {
+		sio.pending++
+		if !sio.writerStarted {
+			sio.writerStarted = true
+			go sio.writeLoop()
+		}
+	}
+	sio.mu.Unlock()
+	item := &shapingItem{addr: addr, at: at, data: data}
+	if inline {
+		return sio.writeFn(item)
+	}
+	item.data = append([]byte{}, data...)
+	if _, err := shapingWait(sio.writeDeadline, sio.closed, time.Time{}, nil, sio.writes, item); err != nil {
+		sio.mu.Lock()
+		sio.pending--
+		sio.mu.Unlock()
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// writeError returns the error that should cause write to fail immediately.
+func (sio *shapingIO) writeError() error {
+	defer sio.mu.Unlock()
+	sio.mu.Lock()
+	select {
+	case <-sio.closed:
+		return net.ErrClosed
+	default:
+		return sio.writeErr
+	}
+}
+
+// writeLoop writes the queued items after their latency. When the conn
+// is closed, it flushes the queue and closes the underlying conn.
+func (sio *shapingIO) writeLoop() {
+	for {
+		select {
+		case item := <-sio.writes:
+			sio.deliver(item)
+		case <-sio.closed:
+			for {
+				select {
+				case item := <-sio.writes:
+					sio.deliver(item)
+				default:
+					sio.closeFn()
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver writes an item at the scheduled time.
+func (sio *shapingIO) deliver(item *shapingItem) {
+	time.Sleep(time.Until(item.at))
+	_, err := sio.writeFn(item)
+	defer sio.mu.Unlock()
+	sio.mu.Lock()
+	sio.pending--
+	if err != nil && !sio.datagrams && sio.writeErr == nil {
+		sio.writeErr = err
+	}
+}
+
+// close interrupts the pending reads and writes and closes the underlying
+// conn, possibly after the background writer has flushed the queue.
+func (sio *shapingIO) close() (err error) {
+	err = net.ErrClosed
+	sio.closeOnce.Do(func() {
+		sio.mu.Lock()
+		close(sio.closed)
+		started := sio.writerStarted
+		sio.mu.Unlock()
+		err = nil
+		if !started {
+			err = sio.closeFn()
+		}
+	})
+	return
+}
+
+// shapingDialer is the model.Dialer returned by Shaper.WrapDialer.
+type shapingDialer struct {
+	model.Dialer
+	shaper *Shaper
+}
+
+// DialContext implements model.Dialer.DialContext.
+func (d *shapingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// simulate the SYN, SYN+ACK round trip
+	if err := shapingSleepContext(ctx, d.shaper.delay()+d.shaper.delay()); err != nil {
+		return nil, err
+	}
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.shaper.WrapNetConn(conn), nil
+}
+
+// shapingConn is the net.Conn returned by Shaper.WrapNetConn.
+type shapingConn struct {
+	net.Conn
+	io *shapingIO
+}
+
+// Read implements net.Conn.Read.
+func (c *shapingConn) Read(b []byte) (int, error) {
+	defer c.io.readMu.Unlock()
+	c.io.readMu.Lock()
+	item, err := c.io.next()
+	if err != nil {
+		return 0, err
+	}
+	count := copy(b, item.data)
+	item.data = item.data[count:]
+	if len(item.data) <= 0 && item.err == nil {
+		c.io.head = nil
+	}
+	if count > 0 {
+		return count, nil
+	}
+	return 0, item.err // sticky
+}
+
+// Write implements net.Conn.Write.
+func (c *shapingConn) Write(b []byte) (int, error) {
+	var total int
+	for len(b) > 0 {
+		chunk := shapingLimit(b, c.io.shaper.writeChunk())
+		count, err := c.io.write(chunk, nil)
+		total += count
+		if err != nil {
+			return total, err
+		}
+		b = b[count:]
+	}
+	return total, nil
+}
+
+// SetDeadline implements net.Conn.SetDeadline.
+func (c *shapingConn) SetDeadline(t time.Time) error {
+	c.io.readDeadline.set(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.SetReadDeadline. We do not forward
+// the deadline to the underlying conn, which we read in the background.
+func (c *shapingConn) SetReadDeadline(t time.Time) error {
+	c.io.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.SetWriteDeadline.
+func (c *shapingConn) SetWriteDeadline(t time.Time) error {
+	c.io.writeDeadline.set(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Close implements net.Conn.Close.
+func (c *shapingConn) Close() error {
+	return c.io.close()
+}
+
+// shapingQUICListener is the model.QUICListener returned by Shaper.WrapQUICListener.
+type shapingQUICListener struct {
+	model.QUICListener
+	shaper *Shaper
+}
+
+// Listen implements model.QUICListener.Listen.
+func (ql *shapingQUICListener) Listen(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	return ql.listenContext(context.Background(), addr)
+}
+
+// listenContext implements quicListenerContext.
+func (ql *shapingQUICListener) listenContext(
+	ctx context.Context, addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	pconn, err := quicListenerListenContext(ctx, ql.QUICListener, addr)
+	if err != nil {
+		return nil, err
+	}
+	return ql.shaper.WrapUDPLikeConn(pconn), nil
+}
+
+// shapingUDPLikeConn is the model.UDPLikeConn returned by Shaper.WrapUDPLikeConn.
+type shapingUDPLikeConn struct {
+	model.UDPLikeConn
+	io *shapingIO
+}
+
+// WriteTo implements model.UDPLikeConn.WriteTo. A lost datagram
+// looks like a datagram we successfully sent to the caller.
+func (c *shapingUDPLikeConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.io.write(p, addr)
+}
+
+// ReadFrom implements model.UDPLikeConn.ReadFrom.
+func (c *shapingUDPLikeConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	defer c.io.readMu.Unlock()
+	c.io.readMu.Lock()
+	item, err := c.io.next()
+	if err != nil {
+		return 0, nil, err
+	}
+	if item.err == nil {
+		c.io.head = nil
+	}
+	count := copy(p, item.data)
+	return count, item.addr, item.err
+}
+
+// SetDeadline implements model.UDPLikeConn.SetDeadline.
+func (c *shapingUDPLikeConn) SetDeadline(t time.Time) error {
+	c.io.readDeadline.set(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements model.UDPLikeConn.SetReadDeadline. We do
+// not forward the deadline to the underlying conn, which we read in the background.
+func (c *shapingUDPLikeConn) SetReadDeadline(t time.Time) error {
+	c.io.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements model.UDPLikeConn.SetWriteDeadline.
+func (c *shapingUDPLikeConn) SetWriteDeadline(t time.Time) error {
+	c.io.writeDeadline.set(t)
+	return c.UDPLikeConn.SetWriteDeadline(t)
+}
+
+// Close implements model.UDPLikeConn.Close.
+func (c *shapingUDPLikeConn) Close() error {
+	return c.io.close()
 }
@@ -0,0 +1,536 @@
+package netxlite
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/model/mocks"
+)
+
+func TestShaper(t *testing.T) {
+	t.Run("NewShaper with a nil policy", func(t *testing.T) {
+		s := NewShaper(nil)
+		if s.delay() != 0 {
+			t.Fatal("expected zero delay")
+		}
+		if s.lost() {
+			t.Fatal("expected no losses")
+		}
+		if s.readChunk() != 0 || s.writeChunk() != 0 {
+			t.Fatal("expected unlimited chunks")
+		}
+		if s.reserveRead(1<<20) != 0 || s.reserveWrite(1<<20) != 0 {
+			t.Fatal("expected no waiting")
+		}
+	})
+
+	t.Run("SetPolicy changes the policy at runtime", func(t *testing.T) {
+		s := NewShaper(&ShapingPolicy{Latency: time.Second})
+		if s.delay() != time.Second {
+			t.Fatal("unexpected delay")
+		}
+		s.SetPolicy(&ShapingPolicy{Latency: time.Millisecond})
+		if s.delay() != time.Millisecond {
+			t.Fatal("unexpected delay")
+		}
+	})
+
+	t.Run("delay includes the jitter", func(t *testing.T) {
+		s := NewShaper(&ShapingPolicy{Latency: time.Second, Jitter: time.Second})
+		for i := 0; i < 100; i++ {
+			if delay := s.delay(); delay < time.Second || delay >= 2*time.Second {
+				t.Fatal("unexpected delay", delay)
+			}
+		}
+	})
+
+	t.Run("WrapDialer produces the expected chain", func(t *testing.T) {
+		s := NewShaper(nil)
+		d := NewDialerWithoutResolver(model.DiscardLogger, s)
+		logger := d.(*dialerLogger)
+		reso := logger.Dialer.(*dialerResolverWithTracing)
+		logger = reso.Dialer.(*dialerLogger)
+		shd := logger.Dialer.(*shapingDialer)
+		if shd.shaper != s {
+			t.Fatal("invalid shaper")
+		}
+		_ = shd.Dialer.(*dialerErrWrapper)
+	})
+}
+
+func TestShapingTokenBucket(t *testing.T) {
+	t.Run("with unlimited rate", func(t *testing.T) {
+		tb := newShapingTokenBucket(0, 0, time.Now())
+		if tb.maxChunk() != 0 {
+			t.Fatal("unexpected max chunk")
+		}
+		if tb.reserve(1<<30, time.Now()) != 0 {
+			t.Fatal("expected no waiting")
+		}
+	})
+
+	t.Run("with the default burst size", func(t *testing.T) {
+		tb := newShapingTokenBucket(1000, 0, time.Now())
+		if tb.maxChunk() != 100 {
+			t.Fatal("unexpected max chunk", tb.maxChunk())
+		}
+	})
+
+	t.Run("with a very low rate", func(t *testing.T) {
+		tb := newShapingTokenBucket(1, 0, time.Now())
+		if tb.maxChunk() != 1 {
+			t.Fatal("unexpected max chunk", tb.maxChunk())
+		}
+	})
+
+	t.Run("we wait when we exhaust the tokens", func(t *testing.T) {
+		zero := time.Now()
+		tb := newShapingTokenBucket(1000, 100, zero)
+		if delay := tb.reserve(100, zero); delay != 0 {
+			t.Fatal("unexpected delay", delay)
+		}
+		if delay := tb.reserve(100, zero); delay != 100*time.Millisecond {
+			t.Fatal("unexpected delay", delay)
+		}
+		// after 100 ms we've repaid the debt and we have zero tokens
+		if delay := tb.reserve(50, zero.Add(100*time.Millisecond)); delay != 50*time.Millisecond {
+			t.Fatal("unexpected delay", delay)
+		}
+		// after a long time, the tokens are capped to the burst size
+		if delay := tb.reserve(200, zero.Add(time.Hour)); delay != 100*time.Millisecond {
+			t.Fatal("unexpected delay", delay)
+		}
+	})
+}
+
+func TestShapingDialer(t *testing.T) {
+	t.Run("on success", func(t *testing.T) {
+		expected := &mocks.Conn{}
+		s := NewShaper(nil)
+		d := s.WrapDialer(&mocks.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return expected, nil
+			},
+		})
+		conn, err := d.DialContext(context.Background(), "tcp", "8.8.8.8:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		shc := conn.(*shapingConn)
+		if shc.Conn != expected {
+			t.Fatal("unexpected conn")
+		}
+	})
+
+	t.Run("on failure", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		s := NewShaper(nil)
+		d := s.WrapDialer(&mocks.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, expected
+			},
+		})
+		conn, err := d.DialContext(context.Background(), "tcp", "8.8.8.8:443")
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("we honour the context while simulating the latency", func(t *testing.T) {
+		s := NewShaper(&ShapingPolicy{Latency: time.Hour})
+		d := s.WrapDialer(&mocks.Dialer{})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel() // immediately
+		conn, err := d.DialContext(ctx, "tcp", "8.8.8.8:443")
+		if !errors.Is(err, context.Canceled) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+}
+
+func TestShapingConn(t *testing.T) {
+	t.Run("Read", func(t *testing.T) {
+		t.Run("reads at most the burst size", func(t *testing.T) {
+			s := NewShaper(&ShapingPolicy{ReadBandwidth: 1 << 20, BurstSize: 16})
+			conn := s.WrapNetConn(&mocks.Conn{
+				MockRead: func(b []byte) (int, error) {
+					return len(b), nil
+				},
+			})
+			count, err := conn.Read(make([]byte, 1024))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 16 {
+				t.Fatal("unexpected count", count)
+			}
+		})
+
+		t.Run("adds the latency", func(t *testing.T) {
+			const latency = 50 * time.Millisecond
+			s := NewShaper(&ShapingPolicy{Latency: latency})
+			conn := s.WrapNetConn(&mocks.Conn{
+				MockRead: func(b []byte) (int, error) {
+					return len(b), nil
+				},
+			})
+			started := time.Now()
+			if _, err := conn.Read(make([]byte, 16)); err != nil {
+				t.Fatal(err)
+			}
+			if time.Since(started) < latency {
+				t.Fatal("did not add the latency")
+			}
+		})
+
+		t.Run("the latency does not limit the throughput", func(t *testing.T) {
+			const latency = 50 * time.Millisecond
+			s := NewShaper(&ShapingPolicy{Latency: latency})
+			conn := s.WrapNetConn(&mocks.Conn{
+				MockRead: func(b []byte) (int, error) {
+					return len(b), nil
+				},
+			})
+			started := time.Now()
+			for i := 0; i < 10; i++ {
+				if _, err := conn.Read(make([]byte, 16)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if elapsed := time.Since(started); elapsed < latency || elapsed >= 5*latency {
+				t.Fatal("unexpected elapsed time", elapsed)
+			}
+		})
+
+		t.Run("honours the read deadline", func(t *testing.T) {
+			s := NewShaper(&ShapingPolicy{Latency: time.Hour})
+			conn := s.WrapNetConn(&mocks.Conn{
+				MockRead: func(b []byte) (int, error) {
+					return len(b), nil
+				},
+			})
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				conn.SetReadDeadline(time.Now())
+			}()
+			count, err := conn.Read(make([]byte, 16))
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("unexpected err", err)
+			}
+			if count != 0 {
+				t.Fatal("unexpected count", count)
+			}
+		})
+
+		t.Run("Close interrupts Read", func(t *testing.T) {
+			s := NewShaper(&ShapingPolicy{Latency: time.Hour})
+			conn := s.WrapNetConn(&mocks.Conn{
+				MockRead: func(b []byte) (int, error) {
+					return len(b), nil
+				},
+				MockClose: func() error {
+					return nil
+				},
+			})
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				conn.Close()
+			}()
+			count, err := conn.Read(make([]byte, 16))
+			if !errors.Is(err, net.ErrClosed) {
+				t.Fatal("unexpected err", err)
+			}
+			if count != 0 {
+				t.Fatal("unexpected count", count)
+			}
+			if err := conn.Close(); !errors.Is(err, net.ErrClosed) {
+				t.Fatal("unexpected err", err)
+			}
+		})
+
+		t.Run("returns the underlying error", func(t *testing.T) {
+			s := NewShaper(&ShapingPolicy{Latency: time.Hour})
+			conn := s.WrapNetConn(&mocks.Conn{
+				MockRead: func(b []byte) (int, error) {
+					return 0, io.EOF
+				},
+			})
+			count, err := conn.Read(make([]byte, 16))
+			if !errors.Is(err, io.EOF) {
+				t.Fatal("unexpected err", err)
+			}
+			if count != 0 {
+				t.Fatal("unexpected count", count)
+			}
+		})
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		t.Run("enforces the bandwidth", func(t *testing.T) {
+			var chunks []int
+			s := NewShaper(&ShapingPolicy{WriteBandwidth: 10000, BurstSize: 100})
+			conn := s.WrapNetConn(&mocks.Conn{
+				MockWrite: func(b []byte) (int, error) {
+					chunks = append(chunks, len(b))
+					return len(b), nil
+				},
+			})
+			started := time.Now()
+			count, err := conn.Write(make([]byte, 1000))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 1000 {
+				t.Fatal("unexpected count", count)
+			}
+			// the first 100 bytes are free, the other 900 take 90 ms
+			if elapsed := time.Since(started); elapsed < 80*time.Millisecond {
+				t.Fatal("did not enforce the bandwidth", elapsed)
+			}
+			if len(chunks) != 10 {
+				t.Fatal("unexpected number of chunks", len(chunks))
+			}
+		})
+
+		t.Run("the latency does not limit the throughput", func(t *testing.T) {
+			const latency = 50 * time.Millisecond
+			var (
+				mu      sync.Mutex
+				written []time.Time
+			)
+			closed := make(chan struct{})
+			s := NewShaper(&ShapingPolicy{Latency: latency})
+			conn := s.WrapNetConn(&mocks.Conn{
+				MockWrite: func(b []byte) (int, error) {
+					defer mu.Unlock()
+					mu.Lock()
+					written = append(written, time.Now())
+					return len(b), nil
+				},
+				MockClose: func() error {
+					close(closed)
+					return nil
+				},
+			})
+			started := time.Now()
+			for i := 0; i < 10; i++ {
+				if _, err := conn.Write(make([]byte, 16)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if elapsed := time.Since(started); elapsed >= latency {
+				t.Fatal("writing should not wait for the latency", elapsed)
+			}
+			conn.Close() // flushes the queue before closing
+			<-closed
+			defer mu.Unlock()
+			mu.Lock()
+			if len(written) != 10 {
+				t.Fatal("unexpected number of writes", len(written))
+			}
+			for _, t0 := range written {
+				if elapsed := t0.Sub(started); elapsed < latency || elapsed >= 5*latency {
+					t.Fatal("unexpected write time", elapsed)
+				}
+			}
+		})
+
+		t.Run("honours the write deadline", func(t *testing.T) {
+			s := NewShaper(&ShapingPolicy{WriteBandwidth: 1, BurstSize: 1})
+			conn := s.WrapNetConn(&mocks.Conn{
+				MockWrite: func(b []byte) (int, error) {
+					return len(b), nil
+				},
+				MockSetWriteDeadline: func(t time.Time) error {
+					return nil
+				},
+			})
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+			count, err := conn.Write(make([]byte, 16))
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("unexpected err", err)
+			}
+			if count != 1 { // the first byte is within the burst
+				t.Fatal("unexpected count", count)
+			}
+		})
+
+		t.Run("returns the underlying error", func(t *testing.T) {
+			expected := errors.New("mocked error")
+			s := NewShaper(&ShapingPolicy{WriteBandwidth: 1 << 20, BurstSize: 16})
+			conn := s.WrapNetConn(&mocks.Conn{
+				MockWrite: func(b []byte) (int, error) {
+					return 4, expected
+				},
+			})
+			count, err := conn.Write(make([]byte, 1024))
+			if !errors.Is(err, expected) {
+				t.Fatal("unexpected err", err)
+			}
+			if count != 4 {
+				t.Fatal("unexpected count", count)
+			}
+		})
+	})
+}
+
+func TestShapingQUICListener(t *testing.T) {
+	t.Run("on success", func(t *testing.T) {
+		expected := &mocks.UDPLikeConn{}
+		s := NewShaper(nil)
+		ql := s.WrapQUICListener(&mocks.QUICListener{
+			MockListen: func(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+				return expected, nil
+			},
+		})
+		pconn, err := ql.Listen(&net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		shc := pconn.(*shapingUDPLikeConn)
+		if shc.UDPLikeConn != expected {
+			t.Fatal("unexpected conn")
+		}
+	})
+
+	t.Run("on failure", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		s := NewShaper(nil)
+		ql := s.WrapQUICListener(&mocks.QUICListener{
+			MockListen: func(addr *net.UDPAddr) (model.UDPLikeConn, error) {
+				return nil, expected
+			},
+		})
+		pconn, err := ql.Listen(&net.UDPAddr{})
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if pconn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+}
+
+func TestShapingUDPLikeConn(t *testing.T) {
+	t.Run("WriteTo", func(t *testing.T) {
+		t.Run("without losses", func(t *testing.T) {
+			var called bool
+			s := NewShaper(nil)
+			pconn := s.WrapUDPLikeConn(&mocks.UDPLikeConn{
+				MockWriteTo: func(p []byte, addr net.Addr) (int, error) {
+					called = true
+					return len(p), nil
+				},
+			})
+			count, err := pconn.WriteTo(make([]byte, 16), &net.UDPAddr{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 16 || !called {
+				t.Fatal("unexpected result")
+			}
+		})
+
+		t.Run("with losses", func(t *testing.T) {
+			var called bool
+			s := NewShaper(&ShapingPolicy{LossRate: 1})
+			pconn := s.WrapUDPLikeConn(&mocks.UDPLikeConn{
+				MockWriteTo: func(p []byte, addr net.Addr) (int, error) {
+					called = true
+					return len(p), nil
+				},
+			})
+			count, err := pconn.WriteTo(make([]byte, 16), &net.UDPAddr{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 16 || called {
+				t.Fatal("unexpected result")
+			}
+		})
+	})
+
+	t.Run("ReadFrom", func(t *testing.T) {
+		t.Run("without losses", func(t *testing.T) {
+			s := NewShaper(nil)
+			pconn := s.WrapUDPLikeConn(&mocks.UDPLikeConn{
+				MockReadFrom: func(p []byte) (int, net.Addr, error) {
+					return len(p), &net.UDPAddr{}, nil
+				},
+			})
+			count, _, err := pconn.ReadFrom(make([]byte, 16))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 16 {
+				t.Fatal("unexpected count")
+			}
+		})
+
+		t.Run("with losses we skip datagrams", func(t *testing.T) {
+			s := NewShaper(&ShapingPolicy{LossRate: 1})
+			pconn := s.WrapUDPLikeConn(&mocks.UDPLikeConn{
+				MockReadFrom: func(p []byte) (int, net.Addr, error) {
+					return len(p), &net.UDPAddr{}, nil
+				},
+			})
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				s.SetPolicy(nil) // stop losing datagrams
+			}()
+			count, _, err := pconn.ReadFrom(make([]byte, 16))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 16 {
+				t.Fatal("unexpected count")
+			}
+		})
+
+		t.Run("honours the read deadline", func(t *testing.T) {
+			s := NewShaper(&ShapingPolicy{Latency: time.Hour})
+			pconn := s.WrapUDPLikeConn(&mocks.UDPLikeConn{
+				MockReadFrom: func(p []byte) (int, net.Addr, error) {
+					return len(p), &net.UDPAddr{}, nil
+				},
+			})
+			pconn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			count, _, err := pconn.ReadFrom(make([]byte, 16))
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("unexpected err", err)
+			}
+			if count != 0 {
+				t.Fatal("unexpected count")
+			}
+		})
+
+		t.Run("on failure", func(t *testing.T) {
+			s := NewShaper(nil)
+			pconn := s.WrapUDPLikeConn(&mocks.UDPLikeConn{
+				MockReadFrom: func(p []byte) (int, net.Addr, error) {
+					return 0, nil, io.EOF
+				},
+			})
+			count, _, err := pconn.ReadFrom(make([]byte, 16))
+			if !errors.Is(err, io.EOF) {
+				t.Fatal("unexpected err", err)
+			}
+			if count != 0 {
+				t.Fatal("unexpected count")
+			}
+		})
+	})
+}
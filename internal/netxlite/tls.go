@@ -224,8 +224,11 @@ func (h *tlsHandshakerConfigurable) Handshake(
 	started := trace.TimeNow()
 	trace.OnTLSHandshakeStart(started, remoteAddr, config)
 	err = tlsconn.HandshakeContext(ctx)
-	err = MaybeNewErrWrapper(ClassifyTLSHandshakeError, TLSHandshakeOperation, err)
 	finished := trace.TimeNow()
+	if err != nil {
+		err = NewErrWrapper(ClassifyTLSHandshakeError, TLSHandshakeOperation, err).withDetails(
+			finished.Sub(started), "", remoteAddr)
+	}
 	state := tlsMaybeConnectionState(tlsconn, err)
 	trace.OnTLSHandshakeDone(started, remoteAddr, config, state, err, finished)
 	if err != nil {
@@ -0,0 +1,219 @@
+package netxlite
+
+//
+// TLS interception (MITM) detection
+//
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// TLSCertFingerprint returns the hex-encoded SHA256 of the certificate's DER encoding.
+func TLSCertFingerprint(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(digest[:])
+}
+
+// TLSExpectedCertStore contains, for each domain, the fingerprints of the
+// known-good leaf certificates and the known-good SPKI pins (see CertSPKIPin).
+// We use this store to detect TLS interception by comparing the certificates
+// a server presents with the ones we expect for the domain.
+//
+// The zero value is invalid; please, use NewTLSExpectedCertStore.
+type TLSExpectedCertStore struct {
+	// entries maps a domain to its entry.
+	entries map[string]*tlsExpectedCertEntry
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+}
+
+// tlsExpectedCertEntry is an entry inside the TLSExpectedCertStore.
+type tlsExpectedCertEntry struct {
+	// fingerprints contains the leaf certificates fingerprints.
+	fingerprints map[string]bool
+
+	// pins contains the SPKI pins.
+	pins map[string]bool
+}
+
+// NewTLSExpectedCertStore creates a new, empty TLSExpectedCertStore.
+func NewTLSExpectedCertStore() *TLSExpectedCertStore {
+	return &TLSExpectedCertStore{
+		entries: map[string]*tlsExpectedCertEntry{},
+		mu:      sync.Mutex{},
+	}
+}
+
+// entryLocked returns the entry for domain, possibly creating it. This
+// function assumes the caller is holding the mutex.
+func (s *TLSExpectedCertStore) entryLocked(domain string) *tlsExpectedCertEntry {
+	domain = tlsExpectedCertDomain(domain)
+	entry := s.entries[domain]
+	if entry == nil {
+		entry = &tlsExpectedCertEntry{
+			fingerprints: map[string]bool{},
+			pins:         map[string]bool{},
+		}
+		s.entries[domain] = entry
+	}
+	return entry
+}
+
+// tlsExpectedCertDomain returns the canonical form of a domain.
+func tlsExpectedCertDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// AddLeafFingerprint adds the fingerprint of a known-good leaf certificate
+// for domain. See TLSCertFingerprint for the fingerprint format.
+func (s *TLSExpectedCertStore) AddLeafFingerprint(domain, fingerprint string) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	s.entryLocked(domain).fingerprints[strings.ToLower(fingerprint)] = true
+}
+
+// AddSPKIPin adds a known-good SPKI pin for domain. A pin matches the presented
+// leaf, any certificate in the verified chains, and any presented certificate
+// that signs the leaf directly or through the presented certificates preceding
+// it. Therefore, you can pin the leaf key as well as the key of an intermediate
+// or root CA, but a forged leaf followed by the genuine CA does not match.
+func (s *TLSExpectedCertStore) AddSPKIPin(domain, pin string) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	s.entryLocked(domain).pins[pin] = true
+}
+
+// AddCertificate adds both the fingerprint and the SPKI pin of the given
+// known-good leaf certificate for domain.
+func (s *TLSExpectedCertStore) AddCertificate(domain string, cert *x509.Certificate) {
+	s.AddLeafFingerprint(domain, TLSCertFingerprint(cert))
+	s.AddSPKIPin(domain, CertSPKIPin(cert))
+}
+
+// lookup returns a copy of the entry for domain or nil.
+func (s *TLSExpectedCertStore) lookup(domain string) *tlsExpectedCertEntry {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	entry := s.entries[tlsExpectedCertDomain(domain)]
+	if entry == nil {
+		return nil
+	}
+	out := &tlsExpectedCertEntry{
+		fingerprints: map[string]bool{},
+		pins:         map[string]bool{},
+	}
+	for key := range entry.fingerprints {
+		out.fingerprints[key] = true
+	}
+	for key := range entry.pins {
+		out.pins[key] = true
+	}
+	return out
+}
+
+// TLSInterceptionEvidence is the result of TLSExpectedCertStore.Check. This
+// structure is suitable for inclusion into the test keys.
+type TLSInterceptionEvidence struct {
+	// Domain is the domain we checked.
+	Domain string `json:"domain"`
+
+	// Known indicates whether the store contains expectations for Domain. When
+	// Known is false, we cannot say whether there was interception.
+	Known bool `json:"known"`
+
+	// Intercepted indicates that we think there was interception, because the
+	// store contains expectations for Domain and none of them matched.
+	Intercepted bool `json:"intercepted"`
+
+	// LeafFingerprint is the fingerprint of the presented leaf certificate.
+	LeafFingerprint string `json:"leaf_fingerprint"`
+
+	// LeafSPKIPin is the SPKI pin of the presented leaf certificate.
+	LeafSPKIPin string `json:"leaf_spki_pin"`
+
+	// MatchedFingerprint indicates whether the leaf fingerprint matched.
+	MatchedFingerprint bool `json:"matched_fingerprint"`
+
+	// MatchedSPKIPin indicates whether a pin matched the leaf, a certificate in
+	// the verified chains, or a presented certificate signing the leaf.
+	MatchedSPKIPin bool `json:"matched_spki_pin"`
+
+	// Issuer is the issuer of the presented leaf certificate.
+	Issuer string `json:"issuer"`
+
+	// IssuingCA describes the CA at the top of the chain, that is, the root
+	// of the verified chain, if any, or otherwise the topmost presented
+	// certificate other than the leaf. It is nil when the server only
+	// presented the leaf and we did not verify the chain.
+	IssuingCA *CertVerificationCert `json:"issuing_ca"`
+
+	// Chain contains the presented certificates.
+	Chain []*CertVerificationCert `json:"chain"`
+}
+
+// Check checks whether the certificates inside the given connection state
+// match the expectations for domain and returns the evidence. When the state
+// does not contain any certificate, we flag interception if the domain is
+// known, because we cannot prove that the server is the expected one.
+func (s *TLSExpectedCertStore) Check(domain string, state tls.ConnectionState) *TLSInterceptionEvidence {
+	evidence := &TLSInterceptionEvidence{Domain: domain}
+	certs := state.PeerCertificates
+	for _, cert := range certs {
+		evidence.Chain = append(evidence.Chain, newCertVerificationCert(cert))
+	}
+	if len(certs) > 0 {
+		leaf := certs[0]
+		evidence.LeafFingerprint = TLSCertFingerprint(leaf)
+		evidence.LeafSPKIPin = CertSPKIPin(leaf)
+		evidence.Issuer = leaf.Issuer.String()
+	}
+	switch {
+	case len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0:
+		chain := state.VerifiedChains[0]
+		evidence.IssuingCA = newCertVerificationCert(chain[len(chain)-1])
+	case len(certs) > 1:
+		evidence.IssuingCA = newCertVerificationCert(certs[len(certs)-1])
+	}
+	entry := s.lookup(domain)
+	if entry == nil {
+		return evidence
+	}
+	evidence.Known = true
+	evidence.MatchedFingerprint = entry.fingerprints[evidence.LeafFingerprint]
+	for _, cert := range tlsPinCandidates(state) {
+		if entry.pins[CertSPKIPin(cert)] {
+			evidence.MatchedSPKIPin = true
+			break
+		}
+	}
+	evidence.Intercepted = !evidence.MatchedFingerprint && !evidence.MatchedSPKIPin
+	return evidence
+}
+
+// tlsPinCandidates returns the certificates we should match against the SPKI
+// pins: the presented leaf, the presented certificates that form a chain of valid
+// signatures starting from the leaf, and the verified chains. We cannot use all
+// the presented certificates because, when we skip verification, a middlebox
+// could forge the leaf and append the genuine CA certificate.
+func tlsPinCandidates(state tls.ConnectionState) (out []*x509.Certificate) {
+	certs := state.PeerCertificates
+	if len(certs) > 0 {
+		out = append(out, certs[0])
+		for idx := 1; idx < len(certs); idx++ {
+			if certs[idx-1].CheckSignatureFrom(certs[idx]) != nil {
+				break
+			}
+			out = append(out, certs[idx])
+		}
+	}
+	for _, chain := range state.VerifiedChains {
+		out = append(out, chain...)
+	}
+	return
+}
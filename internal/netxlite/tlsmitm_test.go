@@ -0,0 +1,67 @@
+package netxlite
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestTLSExpectedCertStore(t *testing.T) {
+	notBefore, notAfter := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	ca := newCertVerifyTestCert(t, "Real CA", true, nil, notBefore, notAfter)
+	intermediate := newCertVerifyTestCert(t, "Real Intermediate", true, ca, notBefore, notAfter)
+	leaf := newCertVerifyTestCert(t, "dns.google", false, intermediate, notBefore, notAfter)
+	forgedCA := newCertVerifyTestCert(t, "Forged CA", true, nil, notBefore, notAfter)
+	forged := newCertVerifyTestCert(t, "dns.google", false, forgedCA, notBefore, notAfter)
+
+	t.Run("the leaf pin matches", func(t *testing.T) {
+		store := NewTLSExpectedCertStore()
+		store.AddSPKIPin("dns.google", CertSPKIPin(leaf.cert))
+		state := tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf.cert},
+		}
+		evidence := store.Check("dns.google", state)
+		if !evidence.MatchedSPKIPin || evidence.Intercepted {
+			t.Fatal("unexpected evidence", evidence)
+		}
+	})
+
+	t.Run("a CA pin matches a chain of valid signatures", func(t *testing.T) {
+		store := NewTLSExpectedCertStore()
+		store.AddSPKIPin("dns.google", CertSPKIPin(ca.cert))
+		state := tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf.cert, intermediate.cert, ca.cert},
+		}
+		evidence := store.Check("dns.google", state)
+		if !evidence.MatchedSPKIPin || evidence.Intercepted {
+			t.Fatal("unexpected evidence", evidence)
+		}
+	})
+
+	t.Run("a CA pin matches the verified chains", func(t *testing.T) {
+		store := NewTLSExpectedCertStore()
+		store.AddSPKIPin("dns.google", CertSPKIPin(ca.cert))
+		state := tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{leaf.cert},
+			VerifiedChains:   [][]*x509.Certificate{{leaf.cert, intermediate.cert, ca.cert}},
+		}
+		evidence := store.Check("dns.google", state)
+		if !evidence.MatchedSPKIPin || evidence.Intercepted {
+			t.Fatal("unexpected evidence", evidence)
+		}
+	})
+
+	t.Run("a forged leaf followed by the real CA does not match", func(t *testing.T) {
+		store := NewTLSExpectedCertStore()
+		store.AddSPKIPin("dns.google", CertSPKIPin(ca.cert))
+		store.AddSPKIPin("dns.google", CertSPKIPin(intermediate.cert))
+		state := tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{forged.cert, intermediate.cert, ca.cert},
+		}
+		evidence := store.Check("dns.google", state)
+		if evidence.MatchedSPKIPin || !evidence.Intercepted {
+			t.Fatal("unexpected evidence", evidence)
+		}
+	})
+}
@@ -6,12 +6,39 @@ import (
 	"time"
 
 	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/runtimex"
 )
 
 // TProxy refers to the UnderlyingNetwork implementation. By overriding this
 // variable you can force netxlite to use alternative network primitives.
+//
+// Because overriding TProxy affects all goroutines, you should prefer binding
+// an UnderlyingNetwork to a context using ContextWithUnderlyingNetwork. We
+// only use TProxy when the context does not carry any UnderlyingNetwork.
 var TProxy model.UnderlyingNetwork = &DefaultTProxy{}
 
+// underlyingNetworkKey is the private type used to set/retrieve the context's
+// UnderlyingNetwork.
+type underlyingNetworkKey struct{}
+
+// ContextUnderlyingNetworkOrDefault retrieves the UnderlyingNetwork bound to
+// the context or returns TProxy when the context does not carry any.
+func ContextUnderlyingNetworkOrDefault(ctx context.Context) model.UnderlyingNetwork {
+	if tp, _ := ctx.Value(underlyingNetworkKey{}).(model.UnderlyingNetwork); tp != nil {
+		return tp
+	}
+	return TProxy
+}
+
+// ContextWithUnderlyingNetwork returns a new context that binds to the given
+// UnderlyingNetwork, which the dialers, the QUIC listeners and the getaddrinfo
+// resolver use instead of TProxy. If the given network is nil, this function
+// will call panic.
+func ContextWithUnderlyingNetwork(ctx context.Context, tp model.UnderlyingNetwork) context.Context {
+	runtimex.PanicIfTrue(tp == nil, "netxlite.ContextWithUnderlyingNetwork passed a nil network")
+	return context.WithValue(ctx, underlyingNetworkKey{}, tp)
+}
+
 // defaultTProxy is the default UnderlyingNetwork implementation.
 type DefaultTProxy struct{}
 
@@ -2,10 +2,16 @@ package netxlite
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"net"
 	"runtime"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/lucas-clemente/quic-go"
 )
 
 func TestDefaultTProxy(t *testing.T) {
@@ -30,3 +36,92 @@ func TestDefaultTProxy(t *testing.T) {
 		}
 	})
 }
+
+// tproxyFailing is an UnderlyingNetwork where every operation fails.
+type tproxyFailing struct {
+	err error
+}
+
+var _ model.UnderlyingNetwork = &tproxyFailing{}
+
+func (tp *tproxyFailing) DialContext(ctx context.Context, timeout time.Duration, network, address string) (net.Conn, error) {
+	return nil, tp.err
+}
+
+func (tp *tproxyFailing) ListenUDP(network string, addr *net.UDPAddr) (model.UDPLikeConn, error) {
+	return nil, tp.err
+}
+
+func (tp *tproxyFailing) GetaddrinfoLookupANY(ctx context.Context, domain string) ([]string, string, error) {
+	return nil, "", tp.err
+}
+
+func (tp *tproxyFailing) GetaddrinfoResolverNetwork() string {
+	return "failing"
+}
+
+func TestContextWithUnderlyingNetwork(t *testing.T) {
+	t.Run("we panic with a nil network", func(t *testing.T) {
+		var panicked bool
+		func() {
+			defer func() {
+				panicked = recover() != nil
+			}()
+			ContextWithUnderlyingNetwork(context.Background(), nil)
+		}()
+		if !panicked {
+			t.Fatal("expected a panic")
+		}
+	})
+
+	t.Run("we fallback to TProxy", func(t *testing.T) {
+		if ContextUnderlyingNetworkOrDefault(context.Background()) != TProxy {
+			t.Fatal("expected TProxy")
+		}
+	})
+
+	t.Run("we return the bound network", func(t *testing.T) {
+		tp := &tproxyFailing{}
+		ctx := ContextWithUnderlyingNetwork(context.Background(), tp)
+		if ContextUnderlyingNetworkOrDefault(ctx) != tp {
+			t.Fatal("expected the bound network")
+		}
+	})
+
+	expected := errors.New("mocked error")
+	ctx := ContextWithUnderlyingNetwork(context.Background(), &tproxyFailing{expected})
+
+	t.Run("DialerSystem uses the bound network", func(t *testing.T) {
+		d := &DialerSystem{}
+		conn, err := d.DialContext(ctx, "tcp", "8.8.8.8:443")
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("the QUIC dialer uses the bound network", func(t *testing.T) {
+		listener := (&Shaper{}).WrapQUICListener(NewQUICListener())
+		d := NewQUICDialerWithoutResolver(listener, model.DiscardLogger)
+		qconn, err := d.DialContext(ctx, "8.8.8.8:443", &tls.Config{}, &quic.Config{})
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if qconn != nil {
+			t.Fatal("expected nil conn")
+		}
+	})
+
+	t.Run("the getaddrinfo transport uses the bound network", func(t *testing.T) {
+		reso := NewStdlibResolver(model.DiscardLogger)
+		addrs, err := reso.LookupHost(ctx, "dns.google")
+		if !errors.Is(err, expected) {
+			t.Fatal("unexpected err", err)
+		}
+		if len(addrs) != 0 {
+			t.Fatal("expected no addrs")
+		}
+	})
+}
@@ -95,6 +95,6 @@ func (*traceDefault) OnQUICHandshakeStart(now time.Time, remoteAddr string, conf
 }
 
 func (*traceDefault) OnQUICHandshakeDone(started time.Time, remoteAddr string, qconn quic.EarlyConnection,
-	config *tls.Config, err error, finished time.Time) {
+	config *tls.Config, quicConfig *quic.Config, err error, finished time.Time) {
 	// nothing
 }
@@ -0,0 +1,151 @@
+package netxlite
+
+//
+// WebSocket client
+//
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/gorilla/websocket"
+)
+
+// Message types that you can use with model.WebSocketConn.
+const (
+	// WebSocketTextMessage is a UTF-8 text message.
+	WebSocketTextMessage = websocket.TextMessage
+
+	// WebSocketBinaryMessage is a binary message.
+	WebSocketBinaryMessage = websocket.BinaryMessage
+)
+
+// WebSocketHandshakeTimeout is the timeout for the whole WebSocket handshake,
+// which includes dialing, the TLS handshake (for wss:// URLs), sending the upgrade
+// request and receiving the server response.
+const WebSocketHandshakeTimeout = 10 * time.Second
+
+// NewWebSocketDialer creates a new model.WebSocketDialer using the given dialer for
+// ws:// URLs and the given TLS dialer for wss:// URLs. The TLS dialer SHOULD only
+// offer the "http/1.1" ALPN, because WebSocket requires HTTP/1.1 (RFC6455). To use
+// an already established connection, pass a single-use dialer (NewSingleUseDialer
+// or NewSingleUseTLSDialer) along with a null dialer (NewNullDialer or NewNullTLSDialer).
+//
+// The returned dialer wraps errors using the WebSocketHandshakeOperation and the
+// returned conn wraps errors using the ReadOperation, WriteOperation and CloseOperation.
+func NewWebSocketDialer(logger model.DebugLogger,
+	dialer model.Dialer, tlsDialer model.TLSDialer) model.WebSocketDialer {
+	return &webSocketDialerLogger{
+		WebSocketDialer: &webSocketDialerGorilla{
+			Dialer:    dialer,
+			TLSDialer: tlsDialer,
+		},
+		DebugLogger: logger,
+	}
+}
+
+// webSocketDialerGorilla is a WebSocket dialer using gorilla/websocket.
+type webSocketDialerGorilla struct {
+	// Dialer is the MANDATORY dialer for ws:// URLs.
+	Dialer model.Dialer
+
+	// TLSDialer is the MANDATORY TLS dialer for wss:// URLs.
+	TLSDialer model.TLSDialer
+}
+
+var _ model.WebSocketDialer = &webSocketDialerGorilla{}
+
+// DialContext implements model.WebSocketDialer.
+func (d *webSocketDialerGorilla) DialContext(ctx context.Context,
+	URL string, header http.Header) (model.WebSocketConn, *http.Response, error) {
+	wd := &websocket.Dialer{
+		NetDialContext:    d.Dialer.DialContext,
+		NetDialTLSContext: d.TLSDialer.DialTLSContext,
+		HandshakeTimeout:  WebSocketHandshakeTimeout,
+	}
+	started := time.Now()
+	conn, resp, err := wd.DialContext(ctx, URL, header)
+	if err != nil {
+		ew := NewErrWrapper(ClassifyWebSocketError, WebSocketHandshakeOperation, err)
+		return nil, resp, ew.withDetails(time.Since(started), "", "")
+	}
+	return &webSocketConnErrWrapper{conn}, resp, nil
+}
+
+// CloseIdleConnections implements model.WebSocketDialer.
+func (d *webSocketDialerGorilla) CloseIdleConnections() {
+	d.Dialer.CloseIdleConnections()
+	d.TLSDialer.CloseIdleConnections()
+}
+
+// webSocketDialerLogger is a WebSocketDialer with logging.
+type webSocketDialerLogger struct {
+	// WebSocketDialer is the underlying dialer.
+	WebSocketDialer model.WebSocketDialer
+
+	// DebugLogger is the underlying logger.
+	DebugLogger model.DebugLogger
+}
+
+var _ model.WebSocketDialer = &webSocketDialerLogger{}
+
+// DialContext implements model.WebSocketDialer.
+func (d *webSocketDialerLogger) DialContext(ctx context.Context,
+	URL string, header http.Header) (model.WebSocketConn, *http.Response, error) {
+	d.DebugLogger.Debugf("websocket_handshake %s...", URL)
+	start := time.Now()
+	conn, resp, err := d.WebSocketDialer.DialContext(ctx, URL, header)
+	elapsed := time.Since(start)
+	if err != nil {
+		d.DebugLogger.Debugf("websocket_handshake %s... %s in %s", URL, err, elapsed)
+		return nil, resp, err
+	}
+	d.DebugLogger.Debugf("websocket_handshake %s... ok in %s", URL, elapsed)
+	return conn, resp, nil
+}
+
+// CloseIdleConnections implements model.WebSocketDialer.
+func (d *webSocketDialerLogger) CloseIdleConnections() {
+	d.WebSocketDialer.CloseIdleConnections()
+}
+
+// webSocketCloseTimeout is the maximum time we wait
+// for sending the close message to the peer.
+const webSocketCloseTimeout = time.Second
+
+// webSocketConnErrWrapper is a model.WebSocketConn wrapping errors.
+type webSocketConnErrWrapper struct {
+	*websocket.Conn
+}
+
+var _ model.WebSocketConn = &webSocketConnErrWrapper{}
+
+// ReadMessage implements model.WebSocketConn.
+func (c *webSocketConnErrWrapper) ReadMessage() (int, []byte, error) {
+	messageType, data, err := c.Conn.ReadMessage()
+	if err != nil {
+		return 0, nil, NewErrWrapper(ClassifyWebSocketError, ReadOperation, err)
+	}
+	return messageType, data, nil
+}
+
+// WriteMessage implements model.WebSocketConn.
+func (c *webSocketConnErrWrapper) WriteMessage(messageType int, data []byte) error {
+	if err := c.Conn.WriteMessage(messageType, data); err != nil {
+		return NewErrWrapper(ClassifyWebSocketError, WriteOperation, err)
+	}
+	return nil
+}
+
+// Close implements model.WebSocketConn.
+func (c *webSocketConnErrWrapper) Close() error {
+	// Note: ignore the error because the peer may have already closed
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = c.Conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(webSocketCloseTimeout))
+	if err := c.Conn.Close(); err != nil {
+		return NewErrWrapper(ClassifyWebSocketError, CloseOperation, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package netxlite
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/oonidsl/internal/model"
+	"github.com/bassosimone/oonidsl/internal/model/mocks"
+	"github.com/gorilla/websocket"
+)
+
+// webSocketEchoHandler is an http.Handler implementing a WebSocket echo
+// server that closes the conn after receiving the "close" message.
+func webSocketEchoHandler() http.Handler {
+	upgrader := &websocket.Upgrader{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return // the upgrader already wrote the response
+		}
+		defer conn.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(data) == "close" {
+				message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye")
+				conn.WriteMessage(websocket.CloseMessage, message)
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestNewWebSocketDialer(t *testing.T) {
+	t.Run("we can exchange messages over ws", func(t *testing.T) {
+		srv := httptest.NewServer(webSocketEchoHandler())
+		defer srv.Close()
+		dialer := NewDialerWithoutResolver(model.DiscardLogger)
+		wsd := NewWebSocketDialer(model.DiscardLogger, dialer, NewNullTLSDialer())
+		defer wsd.CloseIdleConnections()
+		URL := strings.Replace(srv.URL, "http://", "ws://", 1)
+		conn, resp, err := wsd.DialContext(context.Background(), URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatal("unexpected status code", resp.StatusCode)
+		}
+		if resp.Request == nil || len(resp.Request.Header["Sec-WebSocket-Key"]) != 1 {
+			t.Fatal("expected to see the upgrade request")
+		}
+		if err := conn.WriteMessage(WebSocketTextMessage, []byte("Bonsoir, Elliot!")); err != nil {
+			t.Fatal(err)
+		}
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != WebSocketTextMessage || string(data) != "Bonsoir, Elliot!" {
+			t.Fatal("unexpected message", messageType, string(data))
+		}
+	})
+
+	t.Run("we can exchange messages over wss", func(t *testing.T) {
+		srv := httptest.NewTLSServer(webSocketEchoHandler())
+		defer srv.Close()
+		dialer := NewDialerWithoutResolver(model.DiscardLogger)
+		tlsConfig := &tls.Config{
+			RootCAs:    srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+			NextProtos: []string{"http/1.1"},
+		}
+		tlsDialer := NewTLSDialerWithConfig(dialer, NewTLSHandshakerStdlib(model.DiscardLogger), tlsConfig)
+		wsd := NewWebSocketDialer(model.DiscardLogger, NewNullDialer(), tlsDialer)
+		URL := strings.Replace(srv.URL, "https://", "wss://", 1)
+		conn, _, err := wsd.DialContext(context.Background(), URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.WriteMessage(WebSocketBinaryMessage, []byte{0, 1, 2}); err != nil {
+			t.Fatal(err)
+		}
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != WebSocketBinaryMessage || len(data) != 3 {
+			t.Fatal("unexpected message", messageType, data)
+		}
+	})
+
+	t.Run("we wrap the error when the peer closes", func(t *testing.T) {
+		srv := httptest.NewServer(webSocketEchoHandler())
+		defer srv.Close()
+		dialer := NewDialerWithoutResolver(model.DiscardLogger)
+		wsd := NewWebSocketDialer(model.DiscardLogger, dialer, NewNullTLSDialer())
+		URL := strings.Replace(srv.URL, "http://", "ws://", 1)
+		conn, _, err := wsd.DialContext(context.Background(), URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.WriteMessage(WebSocketTextMessage, []byte("close")); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = conn.ReadMessage()
+		var ew *ErrWrapper
+		if !errors.As(err, &ew) {
+			t.Fatal("not an ErrWrapper", err)
+		}
+		if ew.Failure != FailureWebSocketClosed || ew.Operation != ReadOperation {
+			t.Fatal("unexpected error", ew.Failure, ew.Operation)
+		}
+	})
+
+	t.Run("we return the response when the server refuses the upgrade", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnavailableForLegalReasons)
+			w.Write([]byte("blocked"))
+		}))
+		defer srv.Close()
+		dialer := NewDialerWithoutResolver(model.DiscardLogger)
+		wsd := NewWebSocketDialer(model.DiscardLogger, dialer, NewNullTLSDialer())
+		URL := strings.Replace(srv.URL, "http://", "ws://", 1)
+		conn, resp, err := wsd.DialContext(context.Background(), URL, nil)
+		var ew *ErrWrapper
+		if !errors.As(err, &ew) {
+			t.Fatal("not an ErrWrapper", err)
+		}
+		if ew.Failure != FailureWebSocketBadHandshake || ew.Operation != WebSocketHandshakeOperation {
+			t.Fatal("unexpected error", ew.Failure, ew.Operation)
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn")
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnavailableForLegalReasons {
+			t.Fatal("expected the server response")
+		}
+	})
+
+	t.Run("we keep the operation of dial errors", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		dialer := &mocks.Dialer{
+			MockDialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, NewErrWrapper(ClassifyGenericError, ConnectOperation, expected)
+			},
+		}
+		wsd := NewWebSocketDialer(model.DiscardLogger, dialer, NewNullTLSDialer())
+		conn, resp, err := wsd.DialContext(context.Background(), "ws://10.0.0.1/", nil)
+		var ew *ErrWrapper
+		if !errors.As(err, &ew) {
+			t.Fatal("not an ErrWrapper", err)
+		}
+		if ew.Operation != ConnectOperation || !errors.Is(err, expected) {
+			t.Fatal("unexpected error", ew.Operation, err)
+		}
+		if conn != nil || resp != nil {
+			t.Fatal("expected nil conn and response")
+		}
+	})
+}